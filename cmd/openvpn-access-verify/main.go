@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/verify"
+)
+
+const usage = `Usage: openvpn-access-verify [flags]
+
+Asks openvpn-access whether a client may connect, as tls-verify or auth-user-pass-verify hook of openvpn:
+
+    script-security 2
+    tls-verify "/usr/local/bin/openvpn-access-verify -url https://vpn.example.com/vpn -server vpn1 -token-file /etc/openvpn/server-token"
+
+The exit code is 0 when the client may connect, 1 otherwise.
+
+`
+
+func main() {
+	fs := flag.NewFlagSet("openvpn-access-verify", flag.ExitOnError)
+	url := fs.String("url", os.Getenv("OPENVPN_ACCESS_URL"), "url of openvpn-access, including the url prefix")
+	server := fs.String("server", os.Getenv("OPENVPN_ACCESS_SERVER"), "name of this openvpn server")
+	tokenFile := fs.String("token-file", "", "file with the server token (default: OPENVPN_ACCESS_TOKEN)")
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout of the request to openvpn-access")
+	cacheDir := fs.String("cache-dir", filepath.Join(os.TempDir(), "openvpn-access-verify"), "directory for the cached decisions, empty to disable the cache")
+	cacheTTL := fs.Duration("cache-ttl", 15*time.Minute, "use a cached decision for this long when openvpn-access can't be reached")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	token := os.Getenv("OPENVPN_ACCESS_TOKEN")
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			fail("could not read token: %s", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if *url == "" || *server == "" || token == "" {
+		fail("-url, -server and the token are required")
+	}
+
+	request, skip, err := verify.RequestFromEnv(os.Getenv, fs.Args())
+	if err != nil {
+		fail("%s", err)
+	}
+	if skip {
+		os.Exit(0)
+	}
+	client := &verify.Client{
+		URL:        *url,
+		Server:     *server,
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: *timeout},
+		CacheDir:   *cacheDir,
+		CacheTTL:   *cacheTTL,
+	}
+	decision, err := client.Verify(context.Background(), request)
+	if err != nil {
+		fail("could not verify %s: %s", request.CommonName, err)
+	}
+	if decision.Cached {
+		fmt.Fprintf(os.Stderr, "openvpn-access-verify: openvpn-access can't be reached, using the cached decision for %s\n", request.CommonName)
+	}
+	if !decision.Allow {
+		fail("access denied for %s: %s", request.CommonName, decision.Reason)
+	}
+}
+
+// fail writes the message to stderr (the openvpn log) and refuses the connection
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "openvpn-access-verify: "+format+"\n", args...)
+	os.Exit(1)
+}
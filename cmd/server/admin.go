@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/api"
+	"github.com/in4it/openvpn-access/pkg/config"
+	"github.com/in4it/openvpn-access/pkg/logging"
+)
+
+const adminUsage = `Usage: openvpn-access [flags]                           start the server
+       openvpn-access init-pki [flags]                  create a new CA, server certificate, dh.pem, ta.key, crl.pem and openvpn-client.conf
+       openvpn-access import-ca [flags]                 use an existing CA, e.g. an intermediate CA signed by an offline root
+       openvpn-access rotate-ca [flags]                 replace the CA, the previous CA stays trusted during the overlap window
+       openvpn-access ca-status [flags]                 show the CA rotation and the certificates that are still signed by the previous CA
+       openvpn-access finish-rotation [flags]           stop trusting the previous CA and delete its key
+       openvpn-access issue [flags] <common name>       issue a client certificate
+       openvpn-access issue-server [flags] <name>       issue a certificate for an openvpn server
+       openvpn-access issue-ocsp-signer [flags]         issue a delegated certificate to sign the responses of the OCSP responder
+       openvpn-access revoke [flags] <common name>      revoke the certificates with the common name and regenerate crl.pem
+       openvpn-access list [flags]                      list the issued and revoked certificates
+       openvpn-access usage [flags]                     list the certificates with their last connection, or the unused certificates
+       openvpn-access gen-crl [flags]                   regenerate crl.pem
+       openvpn-access encrypt-keys [flags]              encrypt the private keys with the key encryption key (storage.encryption)
+       openvpn-access reset-mfa [flags] <login>         remove the two-factor authentication of a user, the user can set it up again
+       openvpn-access export [flags] <name>             write the openvpn profile of issued/<name>.crt
+
+Run openvpn-access <command> -h for the flags of a command. The storage backend is read from the configuration
+(-config or CONFIG_FILE, and the environment variables).
+`
+
+// adminCommand is a subcommand that operates directly on the storage backend
+type adminCommand struct {
+	args int
+	run  func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error
+}
+
+// runAdmin runs the subcommand and returns the exit code
+func runAdmin(ctx context.Context, command string, args []string, out io.Writer) int {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "yaml configuration file")
+	actor := fs.String("actor", defaultActor(), "actor in the audit log")
+
+	var cmd adminCommand
+	switch command {
+	case "init-pki":
+		opts := api.InitOptions{}
+		fs.StringVar(&opts.CACommonName, "ca-name", "OpenVPN Access CA", "common name of the CA")
+		fs.StringVar(&opts.ServerName, "server-name", "openvpn", "common name of the openvpn server certificate")
+		serverSANs := fs.String("server-sans", "", "comma separated list of dns names or ip addresses of the openvpn server")
+		fs.StringVar(&opts.Remote, "remote", "vpn.example.com 1194 udp", "remote (host port protocol) in the starter openvpn-client.conf")
+		fs.BoolVar(&opts.Intermediate, "intermediate", false, "sign the certificates with an intermediate CA, the root CA key is written to -root-key-out")
+		rootKeyOut := fs.String("root-key-out", "", "file to write the key of the root CA to, with -intermediate. Keep it offline")
+		fs.BoolVar(&opts.Force, "force", false, "overwrite an existing CA")
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			opts.ServerSANs = splitList(*serverSANs)
+			if opts.Intermediate && *rootKeyOut == "" {
+				return fmt.Errorf("-root-key-out is required with -intermediate")
+			}
+			rootKey, err := pki.InitPKI(ctx, opts)
+			if err != nil {
+				return err
+			}
+			if opts.Intermediate {
+				if err := os.WriteFile(*rootKeyOut, []byte(rootKey), 0600); err != nil {
+					return fmt.Errorf("could not write root CA key: %s", err)
+				}
+				fmt.Fprintf(out, "Wrote the root CA key to %s, it's not in the storage backend\n", *rootKeyOut)
+			}
+			fmt.Fprintf(out, "Created CA %q and server certificate %q\n", opts.CACommonName, opts.ServerName)
+			return nil
+		}}
+	case "import-ca":
+		certFile := fs.String("cert", "", "CA certificates (pem): the signing CA, followed by the intermediates and the root")
+		keyFile := fs.String("key", "", "key of the signing CA (pem)")
+		force := fs.Bool("force", false, "overwrite an existing CA")
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			chain, err := os.ReadFile(*certFile)
+			if err != nil {
+				return err
+			}
+			key, err := os.ReadFile(*keyFile)
+			if err != nil {
+				return err
+			}
+			return pki.ImportCA(string(chain), string(key), *force)
+		}}
+	case "rotate-ca":
+		opts := api.RotateOptions{}
+		fs.StringVar(&opts.CACommonName, "ca-name", "OpenVPN Access CA "+time.Now().Format("2006"), "common name of the new CA")
+		fs.DurationVar(&opts.Overlap, "overlap", 30*24*time.Hour, "how long the previous CA stays trusted")
+		certFile := fs.String("cert", "", "use an existing CA (pem) instead of creating a new root CA: the signing CA, followed by the intermediates and the root")
+		keyFile := fs.String("key", "", "key of the signing CA (pem), with -cert")
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			if (*certFile == "") != (*keyFile == "") {
+				return fmt.Errorf("-cert and -key should be used together")
+			}
+			if *certFile != "" {
+				chain, err := os.ReadFile(*certFile)
+				if err != nil {
+					return err
+				}
+				key, err := os.ReadFile(*keyFile)
+				if err != nil {
+					return err
+				}
+				opts.Chain, opts.Key = string(chain), string(key)
+			}
+			if err := pki.RotateCA(ctx, opts); err != nil {
+				return err
+			}
+			status, err := pki.CAStatus()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Rotated the CA from %q to %q, the previous CA is trusted until %s\n", status.PreviousCA, status.CA, status.OverlapUntil.Format(time.RFC3339))
+			return nil
+		}}
+	case "ca-status":
+		asJSON := fs.Bool("json", false, "output json")
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			status, err := pki.CAStatus()
+			if err != nil {
+				return err
+			}
+			if *asJSON {
+				return json.NewEncoder(out).Encode(status)
+			}
+			fmt.Fprintf(out, "CA: %s (expires %s)\n", status.CA, status.NotAfter.Format(time.RFC3339))
+			if status.PreviousCA != "" {
+				fmt.Fprintf(out, "Previous CA: %s (rotated at %s, trusted until %s)\n", status.PreviousCA, status.RotatedAt.Format(time.RFC3339), status.OverlapUntil.Format(time.RFC3339))
+			}
+			if len(status.Outdated) == 0 {
+				fmt.Fprintln(out, "All certificates are signed by the CA")
+				return nil
+			}
+			fmt.Fprintf(out, "%d certificates are not signed by the CA:\n", len(status.Outdated))
+			return writeCertificates(out, status.Outdated)
+		}}
+	case "finish-rotation":
+		force := fs.Bool("force", false, "finish the rotation even when certificates of the previous CA are still in use")
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			return pki.FinishRotation(*force)
+		}}
+	case "issue":
+		name := fs.String("name", "", "name of the certificate in issued/, default client-<common name>-<year>")
+		cmd = adminCommand{args: 1, run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			certificate, err := pki.Issue(ctx, args[0], *name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Issued %s (serial %s, expires %s)\n", certificate.Name, certificate.Serial, certificate.NotAfter.Format(time.RFC3339))
+			return nil
+		}}
+	case "issue-server":
+		sans := fs.String("sans", "", "comma separated list of dns names or ip addresses of the server")
+		cmd = adminCommand{args: 1, run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			certificate, err := pki.IssueServer(ctx, args[0], splitList(*sans))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Issued %s (serial %s, expires %s)\n", certificate.Name, certificate.Serial, certificate.NotAfter.Format(time.RFC3339))
+			return nil
+		}}
+	case "issue-ocsp-signer":
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			certificate, err := pki.IssueOCSPSigner(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Issued %s (serial %s, expires %s)\n", certificate.CommonName, certificate.Serial, certificate.NotAfter.Format(time.RFC3339))
+			return nil
+		}}
+	case "revoke":
+		reason := fs.String("reason", "revoked by admin", "reason in the revocation index")
+		cmd = adminCommand{args: 1, run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			revoked, err := pki.Revoke(ctx, args[0], *reason)
+			for _, certificate := range revoked {
+				fmt.Fprintf(out, "Revoked %s (serial %s)\n", certificate.Name, certificate.Serial)
+			}
+			if err != nil {
+				return err
+			}
+			if len(revoked) == 0 {
+				return fmt.Errorf("no certificates found for %s", args[0])
+			}
+			return nil
+		}}
+	case "list":
+		asJSON := fs.Bool("json", false, "output json")
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			certificates, err := pki.List()
+			if err != nil {
+				return err
+			}
+			if *asJSON {
+				return json.NewEncoder(out).Encode(certificates)
+			}
+			return writeCertificates(out, certificates)
+		}}
+	case "usage":
+		asJSON := fs.Bool("json", false, "output json")
+		idle := fs.Int("idle", 30, "days without a connection after which a certificate is idle")
+		unused := fs.Bool("unused", false, "only list the certificates that are idle or were never used")
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			certificates, err := pki.Usage(*idle, *unused)
+			if err != nil {
+				return err
+			}
+			if *asJSON {
+				return json.NewEncoder(out).Encode(certificates)
+			}
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "COMMON NAME\tNAME\tSERIAL\tUSAGE\tLAST SEEN\tADDRESS")
+			for _, certificate := range certificates {
+				lastSeen := "never"
+				if certificate.LastSeen != nil {
+					lastSeen = certificate.LastSeen.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", certificate.CommonName, certificate.Name, certificate.Serial, certificate.Usage, lastSeen, certificate.RealAddress)
+			}
+			return w.Flush()
+		}}
+	case "gen-crl":
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			return pki.GenerateCRL()
+		}}
+	case "encrypt-keys":
+		cmd = adminCommand{run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			count, err := pki.EncryptKeys()
+			fmt.Fprintf(out, "Encrypted %d keys\n", count)
+			return err
+		}}
+	case "reset-mfa":
+		cmd = adminCommand{args: 1, run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			if err := pki.ResetMFA(args[0]); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Removed the two-factor authentication of %s\n", args[0])
+			return nil
+		}}
+	case "export":
+		outFile := fs.String("out", "", "write the profile to a file instead of stdout")
+		cmd = adminCommand{args: 1, run: func(ctx context.Context, pki *api.PKI, args []string, out io.Writer) error {
+			ovpnConfig, err := pki.Export(args[0])
+			if err != nil {
+				return err
+			}
+			if *outFile != "" {
+				return os.WriteFile(*outFile, []byte(ovpnConfig), 0600)
+			}
+			_, err = fmt.Fprint(out, ovpnConfig)
+			return err
+		}}
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(out, adminUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", command, adminUsage)
+		return 2
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != cmd.args {
+		fmt.Fprintf(os.Stderr, "%s expects %d argument(s), got %d\n", command, cmd.args, fs.NArg())
+		return 2
+	}
+
+	var configArgs []string
+	if *configFile != "" {
+		configArgs = []string{"-config", *configFile}
+	}
+	conf, err := config.LoadStorage(configArgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	logging.Init(conf.Log.Format, conf.Log.Level)
+
+	pki, err := api.NewPKI(ctx, conf, *actor)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = cmd.run(ctx, pki, fs.Args(), out)
+	if closeErr := pki.Close(); closeErr != nil {
+		fmt.Fprintf(os.Stderr, "Could not write audit log: %s\n", closeErr)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func writeCertificates(out io.Writer, certificates []api.Certificate) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMON NAME\tNAME\tSERIAL\tSTATUS")
+	for _, certificate := range certificates {
+		status := "valid until " + certificate.NotAfter.Format("2006-01-02")
+		if certificate.Revoked {
+			status = "revoked at " + certificate.RevokedAt.Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", certificate.CommonName, certificate.Name, certificate.Serial, status)
+	}
+	return w.Flush()
+}
+
+// splitList splits a comma separated list
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// defaultActor returns the user running the command, for the audit log
+func defaultActor() string {
+	if user := os.Getenv("USER"); user != "" {
+		return "cli:" + user
+	}
+	return "cli"
+}
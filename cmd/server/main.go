@@ -1,10 +1,35 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
 	"github.com/in4it/openvpn-access/pkg/api"
+	"github.com/in4it/openvpn-access/pkg/config"
+	"github.com/in4it/openvpn-access/pkg/logging"
 )
 
 func main() {
-	config := api.Config{Port: "8080"}
-	api.NewServer(config).Start()
+	// admin commands, e.g. openvpn-access init-pki
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runAdmin(context.Background(), os.Args[1], os.Args[2:], os.Stdout))
+	}
+
+	conf, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logging.Init(conf.Log.Format, conf.Log.Level)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := api.NewServer(conf).Start(ctx); err != nil {
+		slog.Error("Server stopped", "error", err)
+		os.Exit(1)
+	}
 }
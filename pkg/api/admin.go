@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/metrics"
+)
+
+type auditResponse struct {
+	Events []audit.Event `json:"events"`
+}
+
+// isAdmin returns true when the login is in the list of admin users
+func (s *server) isAdmin(login string) bool {
+	for _, admin := range s.config.AdminUsers {
+		if admin != "" && admin == login {
+			return true
+		}
+	}
+	return false
+}
+
+// getAdminLogin returns the login of the user in the session, when the user is an admin
+func (s *server) getAdminLogin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", err.Error())
+		return "", false
+	}
+	if !s.isAdmin(login) {
+		s.writeError(w, r, http.StatusForbidden, login, "You need to be an admin to access this page")
+		return "", false
+	}
+	return login, true
+}
+
+// adminAuditHandler returns the audit events, filtered by the query parameters type, actor, subject, since, until and limit
+func (s *server) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	login, ok := s.getAdminLogin(w, r)
+	if !ok {
+		return
+	}
+	query, err := parseAuditQuery(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, login, err.Error())
+		return
+	}
+	events, err := s.auditLogger.Query(query)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not query audit log: "+err.Error())
+		return
+	}
+	s.auditLog(r, audit.Event{Type: audit.AdminAction, Actor: login, Details: map[string]string{"action": "audit.query", "query": r.URL.RawQuery}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(auditResponse{Events: events})
+}
+
+// adminCAHandler returns the CA, the state of the CA rotation and the certificates that are still signed by the previous CA
+func (s *server) adminCAHandler(w http.ResponseWriter, r *http.Request) {
+	login, ok := s.getAdminLogin(w, r)
+	if !ok {
+		return
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not create session: "+err.Error())
+		return
+	}
+	status, err := s.newPKI(blobStorage, storageBucket, storagePrefix).caStatus(time.Now())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not get CA status: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func parseAuditQuery(r *http.Request) (audit.Query, error) {
+	var err error
+	query := audit.Query{
+		Type:    r.URL.Query().Get("type"),
+		Actor:   r.URL.Query().Get("actor"),
+		Subject: r.URL.Query().Get("subject"),
+		Limit:   1000,
+	}
+	if since := r.URL.Query().Get("since"); since != "" {
+		if query.Since, err = parseAuditTime(since); err != nil {
+			return query, fmt.Errorf("invalid since: %s", err)
+		}
+	}
+	if until := r.URL.Query().Get("until"); until != "" {
+		if query.Until, err = parseAuditTime(until); err != nil {
+			return query, fmt.Errorf("invalid until: %s", err)
+		}
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return query, fmt.Errorf("invalid limit: %s", err)
+		}
+	}
+	return query, nil
+}
+
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// auditLog adds the client ip and user agent to the event and writes it to the audit log
+func (s *server) auditLog(r *http.Request, event audit.Event) {
+	if s.auditLogger == nil {
+		return
+	}
+	event.IP = clientIP(r, s.config.TrustedProxies)
+	event.UserAgent = r.UserAgent()
+	s.auditLogger.Log(event)
+}
+
+// auditCerts writes an event for every certificate. The events are counted in the metrics as well.
+func (s *server) auditCerts(r *http.Request, eventType, actor string, certs ...issuedCert) {
+	for _, issuedCert := range certs {
+		switch eventType {
+		case audit.CertIssued:
+			metrics.Certificates.WithLabelValues("issued").Inc()
+		case audit.CertRevoked:
+			metrics.Certificates.WithLabelValues("revoked").Inc()
+		case audit.ProfileDownloaded:
+			metrics.ProfileDownloads.Inc()
+		}
+		s.auditLog(r, audit.Event{
+			Type:    eventType,
+			Actor:   actor,
+			Subject: issuedCert.Cert.Subject.CommonName,
+			Serial:  fmt.Sprintf("%X", issuedCert.Cert.SerialNumber),
+			Details: map[string]string{"name": issuedCert.Name},
+		})
+	}
+}
+
+/*
+ * clientIP returns the ip of the client. Every proxy appends the address it received the request from to
+ * X-Forwarded-For, so with trustedProxies proxies in front of the server the client is the trustedProxies-th hop from the
+ * end. The hops before it are set by the client and can't be trusted. Without trusted proxies the header is ignored.
+ */
+func clientIP(r *http.Request, trustedProxies int) string {
+	if trustedProxies > 0 {
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if forwarded := strings.TrimSpace(hops[max(len(hops)-trustedProxies, 0)]); forwarded != "" {
+			return forwarded
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
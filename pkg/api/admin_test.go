@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		forwarded      []string
+		trustedProxies int
+		expected       string
+	}{
+		{nil, 0, "10.0.0.2"},
+		{[]string{"1.2.3.4"}, 0, "10.0.0.2"},
+		{nil, 1, "10.0.0.2"},
+		{[]string{"1.2.3.4"}, 1, "1.2.3.4"},
+		// the first hops are set by the client
+		{[]string{"9.9.9.9, 1.2.3.4"}, 1, "1.2.3.4"},
+		{[]string{"9.9.9.9", "1.2.3.4"}, 1, "1.2.3.4"},
+		{[]string{"1.2.3.4, 10.0.1.1"}, 2, "1.2.3.4"},
+		{[]string{"1.2.3.4"}, 2, "1.2.3.4"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.2:1234"
+		for _, forwarded := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", forwarded)
+		}
+		if ip := clientIP(r, test.trustedProxies); ip != test.expected {
+			t.Errorf("clientIP of %q with %d trusted proxies: expected %s, got %s", test.forwarded, test.trustedProxies, test.expected, ip)
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"strings"
+	"sync"
 
 	oidc "github.com/coreos/go-oidc"
+	"github.com/in4it/openvpn-access/pkg/config"
+	"github.com/in4it/openvpn-access/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/oauth2"
 )
 
@@ -16,13 +18,14 @@ import (
 type Auth struct {
 	oauth2Config   oauth2.Config
 	oauth2Verifier *oidc.IDTokenVerifier
-	idToken        *oidc.IDToken
 	authType       string
-	login          string
+	config         config.Auth
+	// mu protects the oauth2 config, the client secret is replaced when it's refreshed
+	mu sync.RWMutex
 }
 
-func NewAuth() *Auth {
-	return &Auth{}
+func NewAuth(conf config.Auth) *Auth {
+	return &Auth{config: conf}
 }
 
 func (a *Auth) init() error {
@@ -35,12 +38,12 @@ func (a *Auth) oauthInit() error {
 
 	// Configure an OpenID Connect aware OAuth2 client.
 	a.oauth2Config = oauth2.Config{
-		ClientID:     os.Getenv("OAUTH2_CLIENT_ID"),
-		ClientSecret: os.Getenv("OAUTH2_CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("OAUTH2_REDIRECT_URL"),
+		ClientID:     a.config.ClientID,
+		ClientSecret: a.config.ClientSecret,
+		RedirectURL:  a.config.RedirectURL,
 	}
 
-	if os.Getenv("AUTH_TYPE") == "github" {
+	if a.config.Type == "github" {
 		a.oauth2Config.Scopes = []string{"all"}
 		a.oauth2Config.Endpoint = oauth2.Endpoint{
 			AuthURL:  "https://github.com/login/oauth/authorize",
@@ -48,7 +51,7 @@ func (a *Auth) oauthInit() error {
 		}
 		a.authType = "github"
 	} else {
-		provider, err := oidc.NewProvider(ctx, os.Getenv("OAUTH2_URL"))
+		provider, err := oidc.NewProvider(ctx, a.config.URL)
 		if err != nil {
 			return err
 		}
@@ -57,11 +60,10 @@ func (a *Auth) oauthInit() error {
 		a.oauth2Config.Endpoint = provider.Endpoint()
 
 		// verifier
-		a.oauth2Verifier = provider.Verifier(&oidc.Config{ClientID: os.Getenv("OAUTH2_CLIENT_ID")})
+		a.oauth2Verifier = provider.Verifier(&oidc.Config{ClientID: a.config.ClientID})
 		// scope
-		scopes := os.Getenv("OAUTH2_SCOPES")
-		if len(scopes) > 0 {
-			a.oauth2Config.Scopes = strings.Split(scopes, " ")
+		if len(a.config.Scopes) > 0 {
+			a.oauth2Config.Scopes = a.config.Scopes
 		} else {
 			a.oauth2Config.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
 		}
@@ -73,12 +75,16 @@ func (a *Auth) oauthInit() error {
 }
 
 func (a *Auth) getAuthURL(token string) string {
-	return a.oauth2Config.AuthCodeURL(token)
+	oauth2Config := a.getOauth2Config()
+	return oauth2Config.AuthCodeURL(token)
 }
 
-func (a *Auth) getToken(code string) (string, error) {
-	ctx := context.Background()
-	oauth2Token, err := a.oauth2Config.Exchange(ctx, code)
+func (a *Auth) getToken(ctx context.Context, code string) (token string, err error) {
+	ctx, span := tracing.Start(ctx, "auth.getToken", attribute.String("auth.type", a.authType))
+	defer func() { tracing.End(span, err) }()
+
+	oauth2Config := a.getOauth2Config()
+	oauth2Token, err := oauth2Config.Exchange(ctx, code)
 	if err != nil {
 		return "", fmt.Errorf("Oauth2 exchange error: %s", err)
 	}
@@ -99,58 +105,82 @@ func (a *Auth) getToken(code string) (string, error) {
 
 	}
 }
-func (a *Auth) verifyToken(token string) error {
-	var err error
-	ctx := context.Background()
+// verifyToken verifies the token and returns the login of the user. The Auth is shared by all requests, so nothing of the token is kept in it
+func (a *Auth) verifyToken(ctx context.Context, token string) (login string, err error) {
+	ctx, span := tracing.Start(ctx, "auth.verifyToken", attribute.String("auth.type", a.authType))
+	defer func() { tracing.End(span, err) }()
+
 	switch a.authType {
 	case "oidc":
 		var claims Claims
 
-		a.idToken, err = a.oauth2Verifier.Verify(ctx, token)
+		idToken, err := a.oauth2Verifier.Verify(ctx, token)
 		if err != nil {
-			return fmt.Errorf("token verification failed: %s", err)
+			return "", fmt.Errorf("token verification failed: %s", err)
 		}
 
-		if err := a.idToken.Claims(&claims); err != nil {
-			return err
+		if err := idToken.Claims(&claims); err != nil {
+			return "", err
 		}
 
 		if claims.Email != "" {
-			a.login = claims.Email
+			return claims.Email, nil
 		} else if claims.Name != "" {
-			a.login = claims.Name
-		} else {
-			return fmt.Errorf("No login found in token claims (email / name is empty)")
+			return claims.Name, nil
 		}
-
-		return nil
+		return "", fmt.Errorf("No login found in token claims (email / name is empty)")
 	case "github":
 		var githubUser GitHubUser
 		client := &http.Client{}
-		req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", "https://api.github.com/user", nil)
 		if err != nil {
-			return err
+			return "", err
 		}
 		req.Header.Add("Authorization", "token "+token)
 		resp, err := client.Do(req)
 		if err != nil {
-			return err
+			return "", err
 		}
 		defer resp.Body.Close()
 		json.NewDecoder(resp.Body).Decode(&githubUser)
 
 		if githubUser.Message != "" {
-			return fmt.Errorf("Github response: " + githubUser.Message)
+			return "", fmt.Errorf("Github response: " + githubUser.Message)
+		}
+		if githubUser.Login == "" {
+			return "", fmt.Errorf("No login found in github user")
 		}
 
-		a.login = githubUser.Login
+		return githubUser.Login, nil
+	default:
+		return "", fmt.Errorf("Misconfiguration: Auth type not recognized")
+	}
+}
 
+// ready returns an error when the oauth2 endpoints are not configured, e.g. when the oidc discovery didn't succeed
+func (a *Auth) ready() error {
+	switch a.authType {
+	case "oidc":
+		if a.oauth2Verifier == nil || a.getOauth2Config().Endpoint.TokenURL == "" {
+			return fmt.Errorf("oidc discovery didn't succeed")
+		}
+		return nil
+	case "github":
 		return nil
 	default:
-		return fmt.Errorf("Misconfiguration: Auth type not recognized")
+		return fmt.Errorf("auth is not initialized")
 	}
 }
 
-func (a *Auth) getLogin() string {
-	return a.login
+func (a *Auth) getOauth2Config() oauth2.Config {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.oauth2Config
+}
+
+// setClientSecret replaces the oauth2 client secret, e.g. after the secret is rotated
+func (a *Auth) setClientSecret(clientSecret string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.oauth2Config.ClientSecret = clientSecret
 }
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/gorilla/sessions"
+)
+
+// testKeySet accepts every signature, the tokens of the tests aren't signed with a real key
+type testKeySet struct{}
+
+func (testKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt")
+	}
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+// testIDToken returns an id token of the issuer for the email
+func testIDToken(t testing.TB, email string) string {
+	payload, err := json.Marshal(map[string]interface{}{"iss": "https://issuer", "aud": "client-id", "exp": time.Now().Add(time.Hour).Unix(), "email": email})
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"RS256"}`)) + "." + encode(payload) + "." + encode([]byte("signature"))
+}
+
+// loginTestSession configures the server with the test issuer and returns the session cookies of the email, as set by
+// the callback
+func loginTestSession(tb testing.TB, s *server, email string) []*http.Cookie {
+	s.auth = &Auth{
+		authType:       "oidc",
+		oauth2Verifier: oidc.NewVerifier("https://issuer", testKeySet{}, &oidc.Config{ClientID: "client-id"}),
+	}
+	s.sessionStore = sessions.NewCookieStore([]byte("session-key"))
+	r := httptest.NewRequest("GET", "/callback", nil)
+	rec := httptest.NewRecorder()
+	session, _ := s.sessionStore.Get(r, "token-session")
+	session.Values["token"] = testIDToken(tb, email)
+	if err := session.Save(r, rec); err != nil {
+		tb.Fatalf("session save error: %s", err)
+	}
+	return rec.Result().Cookies()
+}
+
+func TestVerifyTokenConcurrently(t *testing.T) {
+	a := &Auth{
+		authType:       "oidc",
+		oauth2Verifier: oidc.NewVerifier("https://issuer", testKeySet{}, &oidc.Config{ClientID: "client-id"}),
+	}
+	logins := []string{"alice@example.com", "bob@example.com"}
+	tokens := []string{testIDToken(t, logins[0]), testIDToken(t, logins[1])}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for j := range tokens {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				login, err := a.verifyToken(context.Background(), tokens[j])
+				if err != nil {
+					t.Errorf("verifyToken error: %s", err)
+					return
+				}
+				if login != logins[j] {
+					t.Errorf("verifyToken returned login %q for the token of %q", login, logins[j])
+				}
+			}(j)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"crypto/sha256"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+// cachedObjects are read for every profile or OCSP response, they're cached for storage.cache_ttl
+var cachedObjects = []string{"ca.crt", "private/ca.key", "ta.key", "openvpn-client.conf", "ca-rotation.json", "ocsp.crt", "private/ocsp.key"}
+
+// cacheStorage caches the cachedObjects of the storage backend, unless the cache is disabled
+func (s *server) cacheStorage(blobStorage storage.StorageIf, prefix string) storage.StorageIf {
+	if s.config.Storage.CacheTTL == 0 {
+		return blobStorage
+	}
+	return storage.NewCache(blobStorage, s.config.Storage.CacheTTL, func(item string) bool {
+		return strings.HasPrefix(item, prefix) && slices.Contains(cachedObjects, strings.TrimPrefix(item, prefix))
+	})
+}
+
+/*
+ * caCache keeps the parsed CA chain and key. They're parsed again when the content of ca.crt or private/ca.key
+ * changes, the content itself is revalidated by the storage cache. A nil caCache parses every time.
+ */
+type caCache struct {
+	mu       sync.Mutex
+	chainSum [sha256.Size]byte
+	chain    caChain
+	keySum   [sha256.Size]byte
+	key      interface{}
+}
+
+func newCACache() *caCache {
+	return &caCache{}
+}
+
+// parseChain returns the parsed ca.crt
+func (c *caCache) parseChain(input string) (caChain, error) {
+	if c == nil {
+		return parseCAChain(input)
+	}
+	sum := sha256.Sum256([]byte(input))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.chain.certs != nil && sum == c.chainSum {
+		return c.chain, nil
+	}
+	chain, err := parseCAChain(input)
+	if err != nil {
+		return chain, err
+	}
+	c.chain, c.chainSum = chain, sum
+	return chain, nil
+}
+
+// parseKey returns the parsed private/ca.key
+func (c *caCache) parseKey(input string) (interface{}, error) {
+	if c == nil {
+		return NewCert().readPrivateKey(input)
+	}
+	sum := sha256.Sum256([]byte(input))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.key != nil && sum == c.keySum {
+		return c.key, nil
+	}
+	key, err := NewCert().readPrivateKey(input)
+	if err != nil {
+		return key, err
+	}
+	c.key, c.keySum = key, sum
+	return key, nil
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/config"
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+// slowStorage adds the latency of a remote storage backend to every operation
+type slowStorage struct {
+	storage.StorageIf
+	latency time.Duration
+}
+
+func (s *slowStorage) HeadObject(bucket, item string) error {
+	time.Sleep(s.latency)
+	return s.StorageIf.HeadObject(bucket, item)
+}
+func (s *slowStorage) GetObject(bucket, item string) (bytes.Buffer, error) {
+	time.Sleep(s.latency)
+	return s.StorageIf.GetObject(bucket, item)
+}
+func (s *slowStorage) PutObject(bucket, item, data, kmsArn string) error {
+	time.Sleep(s.latency)
+	return s.StorageIf.PutObject(bucket, item, data, kmsArn)
+}
+func (s *slowStorage) ListObjects(bucket, prefix string) ([]string, error) {
+	time.Sleep(s.latency)
+	return s.StorageIf.ListObjects(bucket, prefix)
+}
+
+func TestCACache(t *testing.T) {
+	c := newCACache()
+	chain, err := c.parseChain(caCert)
+	if err != nil {
+		t.Fatalf("parseChain error: %s", err)
+	}
+	if cached, _ := c.parseChain(caCert); cached.signer() != chain.signer() {
+		t.Errorf("Expected the parsed chain to be reused")
+	}
+	key, err := c.parseKey(caKey)
+	if err != nil {
+		t.Fatalf("parseKey error: %s", err)
+	}
+	if err := chain.matchesKey(key); err != nil {
+		t.Errorf("Unexpected key: %s", err)
+	}
+	if _, err := c.parseChain("invalid"); err == nil {
+		t.Errorf("Expected error for an invalid chain")
+	}
+	if cached, _ := c.parseChain(caCert); cached.signer() != chain.signer() {
+		t.Errorf("Expected an invalid chain not to replace the cached chain")
+	}
+}
+
+// BenchmarkProfile measures a profile download (/ovpnconfig) of an existing certificate, with a backend that takes 2ms
+// per operation, without and with the cache
+func BenchmarkProfile(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		name := "uncached"
+		if cached {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := NewServer(config.Default())
+			backend := storage.NewMemory()
+			for key, value := range map[string]string{"ca.crt": caCert, "private/ca.key": caKey, "ta.key": "ta", "openvpn-client.conf": "[CA]\n[CERT]\n[KEY]\n[TLS-AUTH]\n"} {
+				backend.PutObject("bucket", "pki/"+key, value, "")
+			}
+			s.storage = &slowStorage{StorageIf: backend, latency: 2 * time.Millisecond}
+			if !cached {
+				s.caCache = nil
+			} else {
+				s.storage = s.cacheStorage(s.storage, "pki/")
+			}
+			s.storageBucket, s.storagePrefix = "bucket", "pki/"
+
+			cookies := loginTestSession(b, s, "alice@example.com")
+			download := func() {
+				req := httptest.NewRequest("GET", "/ovpnconfig", nil)
+				for _, cookie := range cookies {
+					req.AddCookie(cookie)
+				}
+				rec := httptest.NewRecorder()
+				s.ovpnConfigHandler(rec, req)
+				if rec.Code != http.StatusOK {
+					b.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+				}
+			}
+			download()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				download()
+			}
+		})
+	}
+}
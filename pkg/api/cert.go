@@ -2,19 +2,39 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
-	"log"
 	"math/big"
-	"os"
+	"net"
 	"time"
+
+	"github.com/in4it/openvpn-access/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// validity of the certificates created by createCA, createIntermediateCA and createServerCert (same defaults as easy-rsa)
+const (
+	caValidityDays             = 3650
+	intermediateCAValidityDays = 1825
+	serverCertValidityDays     = 825
+	ocspSignerValidityDays     = 365
 )
 
+// oidNsCertType is the netscape certificate type extension, nsCertTypeServer is the server bit (bit 1) in its bit string
+var oidNsCertType = asn1.ObjectIdentifier{2, 16, 840, 1, 113730, 1, 1}
+
+const nsCertTypeServer = 0x40
+
+// oidOCSPNoCheck tells OCSP clients not to check the revocation status of the OCSP signing certificate (RFC 6960 4.2.2.2.1)
+var oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
 type cert struct {
 }
 
@@ -42,6 +62,9 @@ func (c *cert) readPrivateKey(keyInput string) (interface{}, error) {
 	var err error
 
 	privPem, _ := pem.Decode([]byte(keyInput))
+	if privPem == nil {
+		return nil, fmt.Errorf("failed to parse private key PEM")
+	}
 
 	if privPem.Type != "RSA PRIVATE KEY" {
 		return nil, fmt.Errorf("RSA private key is of the wrong type: %s", privPem.Type)
@@ -56,52 +79,148 @@ func (c *cert) readPrivateKey(keyInput string) (interface{}, error) {
 	return parsedKey, nil
 }
 
-func (c *cert) createClientCert(caCert *x509.Certificate, caKey interface{}, subject string) (bytes.Buffer, bytes.Buffer, error) {
-	var (
-		certOut bytes.Buffer
-		keyOut  bytes.Buffer
-		priv    interface{}
-		err     error
-	)
+func (c *cert) createClientCert(ctx context.Context, caCert *x509.Certificate, caKey interface{}, subject, organization string) (bytes.Buffer, bytes.Buffer, error) {
+	template := x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{organization},
+			CommonName:   subject,
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().AddDate(1, 1, 0),
 
-	priv, err = rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return certOut, keyOut, err
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
 	}
+	return c.createCert(ctx, &template, caCert, caKey)
+}
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+// createServerCert creates a certificate for an openvpn server, to be used with remote-cert-tls server (or the deprecated
+// ns-cert-type server) in the client config. The sans are added as dns names or ip addresses.
+func (c *cert) createServerCert(ctx context.Context, caCert *x509.Certificate, caKey interface{}, subject, organization string, sans []string) (bytes.Buffer, bytes.Buffer, error) {
+	nsCertType, err := asn1.Marshal(asn1.BitString{Bytes: []byte{nsCertTypeServer}, BitLength: 2})
 	if err != nil {
-		log.Fatalf("failed to generate serial number: %s", err)
+		return bytes.Buffer{}, bytes.Buffer{}, err
 	}
-
 	template := x509.Certificate{
-		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			Organization: []string{os.Getenv("CLIENT_CERT_ORG")},
+			Organization: []string{organization},
 			CommonName:   subject,
 		},
 		NotBefore: time.Now(),
-		NotAfter:  time.Now().AddDate(1, 1, 0),
+		NotAfter:  time.Now().AddDate(0, 0, serverCertValidityDays),
 
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: oidNsCertType, Value: nsCertType}},
 	}
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+	return c.createCert(ctx, &template, caCert, caKey)
+}
+
+// createOCSPSignerCert creates a certificate that signs OCSP responses on behalf of the CA
+func (c *cert) createOCSPSignerCert(ctx context.Context, caCert *x509.Certificate, caKey interface{}, subject string) (bytes.Buffer, bytes.Buffer, error) {
+	template := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: subject,
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().AddDate(0, 0, ocspSignerValidityDays),
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, caCert, c.publicKey(priv), caKey)
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		BasicConstraintsValid: true,
+		// asn1 NULL
+		ExtraExtensions: []pkix.Extension{{Id: oidOCSPNoCheck, Value: []byte{0x05, 0x00}}},
+	}
+	return c.createCert(ctx, &template, caCert, caKey)
+}
+
+// createCA creates a self-signed CA certificate and key
+func (c *cert) createCA(ctx context.Context, subject string) (bytes.Buffer, bytes.Buffer, error) {
+	template := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: subject,
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().AddDate(0, 0, caValidityDays),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	// a nil parent makes the certificate self-signed
+	return c.createCert(ctx, &template, nil, nil)
+}
+
+// createIntermediateCA creates an intermediate CA signed by the root CA. It can only sign client and server
+// certificates, not other CAs.
+func (c *cert) createIntermediateCA(ctx context.Context, rootCert *x509.Certificate, rootKey interface{}, subject string) (bytes.Buffer, bytes.Buffer, error) {
+	template := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: subject,
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().AddDate(0, 0, intermediateCAValidityDays),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	return c.createCert(ctx, &template, rootCert, rootKey)
+}
+
+// createCert generates a key and signs the template with the CA. The template is self-signed when caCert is nil.
+func (c *cert) createCert(ctx context.Context, template *x509.Certificate, caCert *x509.Certificate, caKey interface{}) (bytes.Buffer, bytes.Buffer, error) {
+	var (
+		certOut bytes.Buffer
+		keyOut  bytes.Buffer
+		priv    interface{}
+		err     error
+	)
+	subject := template.Subject.CommonName
+
+	_, span := tracing.Start(ctx, "cert.generateKey", attribute.String("cert.subject", subject))
+	priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	tracing.End(span, err)
 	if err != nil {
 		return certOut, keyOut, err
 	}
 
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	template.SerialNumber, err = rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return certOut, keyOut, fmt.Errorf("failed to generate serial number: %s", err)
+	}
+
+	if caCert == nil {
+		caCert, caKey = template, priv
+	}
+
+	_, span = tracing.Start(ctx, "cert.sign", attribute.String("cert.subject", subject), attribute.String("cert.serial", fmt.Sprintf("%X", template.SerialNumber)))
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, caCert, c.publicKey(priv), caKey)
+	tracing.End(span, err)
 	if err != nil {
 		return certOut, keyOut, err
 	}
+
 	if err := pem.Encode(&certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
 		return certOut, keyOut, err
 	}
 
-	if err := pem.Encode(&keyOut, c.pemBlockForKey(priv)); err != nil {
+	keyBlock, err := c.pemBlockForKey(priv)
+	if err != nil {
+		return certOut, keyOut, err
+	}
+	if err := pem.Encode(&keyOut, keyBlock); err != nil {
 		return certOut, keyOut, err
 	}
 
@@ -117,18 +236,17 @@ func (c *cert) publicKey(priv interface{}) interface{} {
 		return nil
 	}
 }
-func (c *cert) pemBlockForKey(priv interface{}) *pem.Block {
+func (c *cert) pemBlockForKey(priv interface{}) (*pem.Block, error) {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
-		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
 	case *ecdsa.PrivateKey:
 		b, err := x509.MarshalECPrivateKey(k)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
-			os.Exit(2)
+			return nil, fmt.Errorf("Unable to marshal ECDSA private key: %v", err)
 		}
-		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
 	default:
-		return nil
+		return nil, fmt.Errorf("Unsupported private key type %T", priv)
 	}
 }
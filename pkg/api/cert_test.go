@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"testing"
 )
@@ -68,7 +69,7 @@ func TestCreateCert(t *testing.T) {
 		t.Errorf("Parsed CA Key Error: %s", err)
 		return
 	}
-	clientCert, clientKey, err := c.createClientCert(parsedCaCert, parsedCaKey, "test-subject")
+	clientCert, clientKey, err := c.createClientCert(context.Background(), parsedCaCert, parsedCaKey, "test-subject", "")
 	if err != nil {
 		t.Errorf("Create Cert error: %s", err)
 		return
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/metrics"
+)
+
+// certificateMetricsInterval is the interval at which the certificate gauges are populated from storage
+const certificateMetricsInterval = 5 * time.Minute
+
+// refreshCertificateMetrics updates the certificate gauges now and at every interval, until ctx is done
+func (s *server) refreshCertificateMetrics(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.updateCertificateMetrics(ctx, time.Now()); err != nil {
+			slog.Error("Could not update certificate metrics", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) updateCertificateMetrics(ctx context.Context, now time.Time) error {
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		return err
+	}
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	issued, err := p.listIssued()
+	if err != nil {
+		return err
+	}
+	// the OCSP responder looks up the certificates by serial
+	if count, err := p.indexSerials(issued); err != nil {
+		return err
+	} else if count > 0 {
+		slog.Info("Indexed the serials of the issued certificates", "certificates", count)
+	}
+	// the certificates of a login are looked up by login
+	if count, err := p.indexLogins(issued); err != nil {
+		return err
+	} else if count > 0 {
+		slog.Info("Indexed the logins of the issued certificates", "certificates", count)
+	}
+	valid, expiring := 0, 0
+	for _, issuedCert := range issued {
+		if now.After(issuedCert.Cert.NotAfter) {
+			continue
+		}
+		valid++
+		if issuedCert.Cert.NotAfter.Before(now.AddDate(0, 0, 30)) {
+			expiring++
+		}
+	}
+	metrics.CertificatesIssued.Set(float64(valid))
+	metrics.CertificatesExpiring.Set(float64(expiring))
+
+	chain, err := p.loadCAChain()
+	if err != nil {
+		return err
+	}
+	expiry := chain.certs[0].NotAfter
+	for _, cert := range chain.certs[1:] {
+		if cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	metrics.CAExpiry.Set(float64(expiry.Unix()))
+	return nil
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpdateCertificateMetrics(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	issued := issueTestCert(t, blobStorage, "alice@example.com", "client-alice@example.com-2024")
+	issueTestCert(t, blobStorage, "bob@example.com", "client-bob@example.com-2024")
+
+	if err := s.updateCertificateMetrics(context.Background(), time.Now()); err != nil {
+		t.Fatalf("updateCertificateMetrics error: %s", err)
+	}
+	if value := testutil.ToFloat64(metrics.CertificatesIssued); value != 2 {
+		t.Errorf("Expected 2 issued certificates, got %f", value)
+	}
+	if value := testutil.ToFloat64(metrics.CertificatesExpiring); value != 0 {
+		t.Errorf("Expected 0 expiring certificates, got %f", value)
+	}
+	ca, _ := NewCert().readCert(caCert)
+	if value := testutil.ToFloat64(metrics.CAExpiry); value != float64(ca.NotAfter.Unix()) {
+		t.Errorf("Expected the CA expiry %d, got %f", ca.NotAfter.Unix(), value)
+	}
+
+	// 10 days before expiry both certificates are expiring
+	if err := s.updateCertificateMetrics(context.Background(), issued.NotAfter.AddDate(0, 0, -10)); err != nil {
+		t.Fatalf("updateCertificateMetrics error: %s", err)
+	}
+	if value := testutil.ToFloat64(metrics.CertificatesExpiring); value != 2 {
+		t.Errorf("Expected 2 expiring certificates, got %f", value)
+	}
+}
+
+func TestRefreshCertificateMetricsStops(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.refreshCertificateMetrics(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("refreshCertificateMetrics didn't stop when the context was done")
+	}
+}
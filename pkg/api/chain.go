@@ -0,0 +1,97 @@
+package api
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// caChain is the CA in ca.crt: the certificate that signs the client and server certificates, followed by the
+// intermediates up to the root. When ca.crt contains a single certificate, the root signs the certificates.
+type caChain struct {
+	certs []*x509.Certificate
+	pems  []string
+}
+
+// parseCAChain parses the certificates in ca.crt and checks that every certificate is signed by the next one
+func parseCAChain(input string) (caChain, error) {
+	var chain caChain
+	rest := []byte(input)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return chain, err
+		}
+		chain.certs = append(chain.certs, cert)
+		chain.pems = append(chain.pems, string(pem.EncodeToMemory(block)))
+	}
+	if len(chain.certs) == 0 {
+		return chain, fmt.Errorf("failed to parse certificate PEM")
+	}
+	for k := 0; k < len(chain.certs)-1; k++ {
+		if err := chain.certs[k].CheckSignatureFrom(chain.certs[k+1]); err != nil {
+			return chain, fmt.Errorf("%s is not signed by %s, the chain should start with the signing CA and end with the root: %s",
+				chain.certs[k].Subject.CommonName, chain.certs[k+1].Subject.CommonName, err)
+		}
+	}
+	return chain, nil
+}
+
+// signer returns the certificate that signs the client and server certificates
+func (c caChain) signer() *x509.Certificate {
+	return c.certs[0]
+}
+
+// root returns the root certificate (pem), the trust anchor in the <ca> section of the openvpn config
+func (c caChain) root() string {
+	return c.pems[len(c.pems)-1]
+}
+
+// intermediates returns the intermediate certificates (pem) that are sent with a client or server certificate, in
+// the <cert> section of the openvpn config. Empty when the root signs the certificates.
+func (c caChain) intermediates() string {
+	return strings.Join(c.pems[:len(c.pems)-1], "")
+}
+
+// checkExpiry returns an error when one of the certificates in the chain expires within threshold
+func (c caChain) checkExpiry(now time.Time, threshold time.Duration) error {
+	for _, cert := range c.certs {
+		if cert.NotAfter.Sub(now) < threshold {
+			return fmt.Errorf("CA certificate %s expires at %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// matchesKey returns an error when the key is not the private key of the signing certificate
+func (c caChain) matchesKey(key interface{}) error {
+	publicKey, ok := c.signer().PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(NewCert().publicKey(key)) {
+		return fmt.Errorf("ca.key is not the key of %s, the first certificate in ca.crt", c.signer().Subject.CommonName)
+	}
+	return nil
+}
+
+// loadCAChain returns the certificates in ca.crt
+func (p *pki) loadCAChain() (caChain, error) {
+	caCert, err := p.storage.GetObject(p.bucket, p.prefix+"ca.crt")
+	if err != nil {
+		return caChain{}, fmt.Errorf("ca.crt download error: %s", err)
+	}
+	chain, err := p.caCache.parseChain(caCert.String())
+	if err != nil {
+		return chain, fmt.Errorf("Parsed CA cert Error: %s", err)
+	}
+	return chain, nil
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+// profileSection returns the content of <tag>...</tag> in an openvpn config
+func profileSection(t *testing.T, ovpnConfig, tag string) string {
+	start := strings.Index(ovpnConfig, "<"+tag+">")
+	end := strings.Index(ovpnConfig, "</"+tag+">")
+	if start == -1 || end == -1 {
+		t.Fatalf("section %s not found in: %s", tag, ovpnConfig)
+	}
+	return ovpnConfig[start+len(tag)+2 : end]
+}
+
+// verifyChain verifies the first certificate in certPem with the other certificates as intermediates and caPem as roots
+func verifyChain(certPem, caPem string, usage x509.ExtKeyUsage) error {
+	chain, err := parseCAChain(certPem)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(caPem))
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain.certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = chain.certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{usage}})
+	return err
+}
+
+func TestIntermediateCA(t *testing.T) {
+	blobStorage := storage.NewMemory()
+	a := newAdminPKI(newPKI(blobStorage, "bucket", "pki/"), "admin")
+	rootKey, err := a.InitPKI(context.Background(), InitOptions{CACommonName: "Test CA", ServerName: "openvpn", Remote: "vpn.example.com 1194 udp", Intermediate: true})
+	if err != nil {
+		t.Fatalf("InitPKI error: %s", err)
+	}
+	caKey, _ := blobStorage.GetObject("bucket", "pki/private/ca.key")
+	if rootKey == "" || caKey.String() == rootKey {
+		t.Fatalf("The root key should be returned and not be stored")
+	}
+	chain, err := a.pki.loadCAChain()
+	if err != nil || len(chain.certs) != 2 || chain.signer().Subject.CommonName != "Test CA Intermediate" {
+		t.Fatalf("Unexpected CA chain: %+v (err: %v)", chain.certs, err)
+	}
+
+	issued, err := a.Issue(context.Background(), "alice@example.com", "")
+	if err != nil {
+		t.Fatalf("Issue error: %s", err)
+	}
+	ovpnConfig, err := a.Export(issued.Name)
+	if err != nil {
+		t.Fatalf("Export error: %s", err)
+	}
+	ca := profileSection(t, ovpnConfig, "ca")
+	clientCert := profileSection(t, ovpnConfig, "cert")
+	if strings.Count(ca, "BEGIN CERTIFICATE") != 1 || strings.Count(clientCert, "BEGIN CERTIFICATE") != 2 {
+		t.Errorf("Expected the root in <ca> and the client certificate with the intermediate in <cert>")
+	}
+	if err := verifyChain(clientCert, ca, x509.ExtKeyUsageClientAuth); err != nil {
+		t.Errorf("Client certificate not valid: %s", err)
+	}
+	leafOnly, _ := blobStorage.GetObject("bucket", "pki/issued/"+issued.Name+".crt")
+	if err := verifyChain(leafOnly.String(), ca, x509.ExtKeyUsageClientAuth); err == nil {
+		t.Errorf("Client certificate should not be valid without the intermediate")
+	}
+
+	serverCert, serverKey, err := a.pki.getCertAndKey(serverCertName("openvpn"))
+	if err != nil {
+		t.Fatalf("getCertAndKey error: %s", err)
+	}
+	for _, key := range []string{"ta.key", "dh.pem", "crl.pem"} {
+		blobStorage.PutObject("bucket", "pki/"+key, key, "")
+	}
+	bundle, err := a.pki.serverBundle("openvpn", serverCert, serverKey)
+	if err != nil {
+		t.Fatalf("serverBundle error: %s", err)
+	}
+	if err := verifyChain(bundle.Certificate, bundle.CA, x509.ExtKeyUsageServerAuth); err != nil {
+		t.Errorf("Server certificate not valid: %s", err)
+	}
+}
+
+func TestImportCA(t *testing.T) {
+	c := NewCert()
+	rootPem, rootKeyPem, err := c.createCA(context.Background(), "Offline Root")
+	if err != nil {
+		t.Fatalf("createCA error: %s", err)
+	}
+	rootCert, _ := c.readCert(rootPem.String())
+	rootKey, _ := c.readPrivateKey(rootKeyPem.String())
+	intermediatePem, intermediateKeyPem, err := c.createIntermediateCA(context.Background(), rootCert, rootKey, "Online Intermediate")
+	if err != nil {
+		t.Fatalf("createIntermediateCA error: %s", err)
+	}
+
+	blobStorage := storage.NewMemory()
+	a := newAdminPKI(newPKI(blobStorage, "bucket", "pki/"), "admin")
+	if err := a.ImportCA(rootPem.String()+intermediatePem.String(), intermediateKeyPem.String(), false); err == nil || !strings.Contains(err.Error(), "not signed by") {
+		t.Errorf("Expected error for a chain in the wrong order, got: %v", err)
+	}
+	if err := a.ImportCA(intermediatePem.String()+rootPem.String(), rootKeyPem.String(), false); err == nil || !strings.Contains(err.Error(), "is not the key of") {
+		t.Errorf("Expected error for the key of the wrong certificate, got: %v", err)
+	}
+	if err := a.ImportCA(intermediatePem.String()+rootPem.String(), "not a key", false); err == nil {
+		t.Errorf("Expected error for an invalid key")
+	}
+	if err := a.ImportCA(intermediatePem.String()+rootPem.String(), intermediateKeyPem.String(), false); err != nil {
+		t.Fatalf("ImportCA error: %s", err)
+	}
+	if err := a.ImportCA(intermediatePem.String()+rootPem.String(), intermediateKeyPem.String(), false); err == nil {
+		t.Errorf("Expected error when the CA already exists")
+	}
+
+	signer, _, err := a.pki.loadCA()
+	if err != nil || signer.Subject.CommonName != "Online Intermediate" {
+		t.Fatalf("Expected the intermediate to sign, got %v (err: %v)", signer, err)
+	}
+	crlPem, _ := blobStorage.GetObject("bucket", "pki/crl.pem")
+	crl, err := x509.ParseRevocationList(pemBytes(t, crlPem.String()))
+	if err != nil || crl.CheckSignatureFrom(signer) != nil {
+		t.Errorf("Expected the CRL to be signed by the intermediate (err: %v)", err)
+	}
+}
+
+func TestCheckCACertChain(t *testing.T) {
+	c := NewCert()
+	rootPem, rootKeyPem, _ := c.createCA(context.Background(), "Root")
+	rootCert, _ := c.readCert(rootPem.String())
+	rootKey, _ := c.readPrivateKey(rootKeyPem.String())
+	intermediatePem, _, err := c.createCert(context.Background(), &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Short-lived Intermediate"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(10 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, rootCert, rootKey)
+	if err != nil {
+		t.Fatalf("createCert error: %s", err)
+	}
+	if err := checkCACert(rootPem.String(), time.Now()); err != nil {
+		t.Errorf("Root CA should be valid: %s", err)
+	}
+	err = checkCACert(intermediatePem.String()+rootPem.String(), time.Now())
+	if err == nil || !strings.Contains(err.Error(), "Short-lived Intermediate") {
+		t.Errorf("Expected error for the expiring intermediate, got: %v", err)
+	}
+}
+
+func pemBytes(t *testing.T, input string) []byte {
+	block, _ := pem.Decode([]byte(input))
+	if block == nil {
+		t.Fatalf("failed to parse PEM: %s", input)
+	}
+	return block.Bytes
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/config"
+	"github.com/in4it/openvpn-access/pkg/logging"
+	"github.com/in4it/openvpn-access/pkg/management"
+	"github.com/in4it/openvpn-access/pkg/metrics"
+)
+
+// checkManagementAddresses returns an error when one of the management addresses of the configuration is invalid
+func checkManagementAddresses(conf config.Management) error {
+	for _, address := range conf.Addresses {
+		if _, _, err := management.ParseAddress(address); err != nil {
+			return fmt.Errorf("management.addresses (MANAGEMENT_ADDRESSES): %s", err)
+		}
+	}
+	return nil
+}
+
+// killedSessions are the sessions of a common name that were disconnected on an openvpn server
+type killedSessions struct {
+	Server     string
+	CommonName string
+	Sessions   int
+}
+
+type connectionsResponse struct {
+	Connections []connection `json:"connections"`
+	// Errors are the servers that couldn't be reached
+	Errors []string `json:"errors,omitempty"`
+}
+
+// connection is a client that's connected to an openvpn server, with the issued certificates of its common name
+type connection struct {
+	Server string `json:"server"`
+	management.ClientInfo
+	Login        string            `json:"login"`
+	Device       string            `json:"device,omitempty"`
+	Certificates []certificateInfo `json:"certificates"`
+}
+
+/*
+ * killSessions disconnects the sessions of the common names on all the openvpn servers. Openvpn only checks the CRL when
+ * a client connects, so a revoked client stays connected until its session is killed. The servers that can't be
+ * reached are skipped, their errors are returned together with the sessions that were killed.
+ */
+func killSessions(ctx context.Context, conf config.Management, commonNames []string) ([]killedSessions, error) {
+	killed := []killedSessions{}
+	var errs []error
+	for _, address := range conf.Addresses {
+		client, err := management.Dial(ctx, address, conf.Password, conf.Timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", address, err))
+			continue
+		}
+		for _, commonName := range commonNames {
+			sessions, err := client.Kill(commonName)
+			if sessions > 0 {
+				name, _ := management.SplitAddress(address)
+				killed = append(killed, killedSessions{Server: name, CommonName: commonName, Sessions: sessions})
+				metrics.SessionsKilled.Add(float64(sessions))
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", address, err))
+			}
+		}
+		client.Close()
+	}
+	return killed, errors.Join(errs...)
+}
+
+// commonNamesOf returns the distinct common names of the certificates
+func commonNamesOf(certs []issuedCert) []string {
+	commonNames := []string{}
+	seen := map[string]bool{}
+	for _, issued := range certs {
+		commonName := issued.Cert.Subject.CommonName
+		if !seen[commonName] {
+			seen[commonName] = true
+			commonNames = append(commonNames, commonName)
+		}
+	}
+	return commonNames
+}
+
+// disconnect kills the sessions of the revoked certificates on the openvpn servers and audits the killed sessions
+func (s *server) disconnect(r *http.Request, actor string, revoked ...issuedCert) {
+	conf := s.getManagementConfig()
+	if len(conf.Addresses) == 0 || len(revoked) == 0 {
+		return
+	}
+	killed, err := killSessions(r.Context(), conf, commonNamesOf(revoked))
+	for _, sessions := range killed {
+		s.auditLog(r, audit.Event{
+			Type:    audit.SessionKilled,
+			Actor:   actor,
+			Subject: sessions.CommonName,
+			Details: map[string]string{"server": sessions.Server, "sessions": strconv.Itoa(sessions.Sessions)},
+		})
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Could not disconnect revoked clients", "error", err)
+	}
+}
+
+// listConnections returns the clients that are connected to the openvpn servers, and the errors of the servers that
+// couldn't be reached
+func listConnections(ctx context.Context, conf config.Management) ([]connection, []string) {
+	connections := []connection{}
+	var errs []string
+	for _, address := range conf.Addresses {
+		status, err := serverStatus(ctx, conf, address)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", address, err))
+			continue
+		}
+		name, _ := management.SplitAddress(address)
+		for _, client := range status.Clients {
+			connections = append(connections, connection{Server: name, ClientInfo: client, Certificates: []certificateInfo{}})
+		}
+	}
+	return connections, errs
+}
+
+// serverStatus returns the status of one openvpn server
+func serverStatus(ctx context.Context, conf config.Management, address string) (*management.Status, error) {
+	client, err := management.Dial(ctx, address, conf.Password, conf.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.Status()
+}
+
+// adminConnectionsHandler shows the clients that are connected right now, with the issued certificates of their common name
+func (s *server) adminConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	login, ok := s.getAdminLogin(w, r)
+	if !ok {
+		return
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not create session: "+err.Error())
+		return
+	}
+	issued, err := s.newPKI(blobStorage, storageBucket, storagePrefix).listIssued()
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not list certificates: "+err.Error())
+		return
+	}
+	byCommonName := map[string][]certificateInfo{}
+	for _, issuedCert := range issued {
+		commonName := issuedCert.Cert.Subject.CommonName
+		byCommonName[commonName] = append(byCommonName[commonName], newCertificateInfo(issuedCert))
+	}
+
+	connections, errs := listConnections(r.Context(), s.getManagementConfig())
+	for k, conn := range connections {
+		connections[k].Login, connections[k].Device = splitCommonName(conn.CommonName)
+		if certificates, ok := byCommonName[conn.CommonName]; ok {
+			connections[k].Certificates = certificates
+		}
+	}
+	sort.SliceStable(connections, func(i, j int) bool {
+		return connections[i].CommonName < connections[j].CommonName
+	})
+	response := connectionsResponse{Connections: connections, Errors: errs}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	s.render(w, r, http.StatusOK, "connections.html", "Connected clients", login, response)
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/config"
+)
+
+// fakeManagement is the management interface of an openvpn server with connected clients (common name, client id)
+type fakeManagement struct {
+	listener net.Listener
+	mu       sync.Mutex
+	clients  map[string]string
+}
+
+func newFakeManagement(t *testing.T, clients map[string]string) *fakeManagement {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	f := &fakeManagement{listener: listener, clients: clients}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.handle(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeManagement) handle(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprint(conn, ">INFO:OpenVPN Management Interface Version 3\n")
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command := scanner.Text()
+		f.mu.Lock()
+		switch {
+		case command == "status 3":
+			fmt.Fprint(conn, "TITLE\tOpenVPN 2.6.8\nTIME\t2024-06-18 10:00:00\t1718704800\n")
+			fmt.Fprint(conn, "HEADER\tCLIENT_LIST\tCommon Name\tReal Address\tVirtual Address\tVirtual IPv6 Address\tBytes Received\tBytes Sent\tConnected Since\tConnected Since (time_t)\tUsername\tClient ID\n")
+			for commonName, id := range f.clients {
+				fmt.Fprintf(conn, "CLIENT_LIST\t%s\t203.0.113.10:51234\t10.8.0.2\t\t100\t200\t2024-06-18 09:00:00\t1718701200\tUNDEF\t%s\n", commonName, id)
+			}
+			fmt.Fprint(conn, "END\n")
+		case strings.HasPrefix(command, "client-kill "):
+			for commonName, id := range f.clients {
+				if id == strings.TrimPrefix(command, "client-kill ") {
+					delete(f.clients, commonName)
+				}
+			}
+			fmt.Fprint(conn, "SUCCESS: client-kill command succeeded\n")
+		case command == "quit":
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeManagement) connected(commonName string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.clients[commonName]
+	return ok
+}
+
+func TestDeprovisionKillsSessions(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	f := newFakeManagement(t, map[string]string{"alice@example.com": "1", "alice@example.com:laptop": "2", "bob@example.com": "3"})
+	s.config.SCIMToken = "secret-token"
+	s.config.Management.Addresses = []string{f.listener.Addr().String(), "127.0.0.1:1"}
+	r := mux.NewRouter()
+	s.scimRoutes(r, "")
+
+	issueTestCert(t, blobStorage, "alice@example.com", "client-alice@example.com-2024")
+	issueTestCert(t, blobStorage, "alice@example.com:laptop", "client-alice@example.com-laptop-2024")
+	issueTestCert(t, blobStorage, "bob@example.com", "client-bob@example.com-2024")
+
+	rec := scimRequest(t, r, "POST", "/scim/v2/Users", "secret-token", ScimUser{UserName: "alice@example.com", Active: true})
+	var user ScimUser
+	if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+	// the second server can't be reached, the sessions on the first server are killed anyway
+	rec = scimRequest(t, r, "DELETE", "/scim/v2/Users/"+user.ID, "secret-token", nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if f.connected("alice@example.com") || f.connected("alice@example.com:laptop") || !f.connected("bob@example.com") {
+		t.Errorf("Expected the sessions of alice to be killed and bob to stay connected")
+	}
+
+	s.auditLogger.Flush()
+	events, err := s.auditLogger.Query(audit.Query{Type: audit.SessionKilled})
+	if err != nil || len(events) != 2 || events[0].Actor != "scim" || events[0].Details["sessions"] != "1" {
+		t.Errorf("Expected the killed sessions in the audit log, got %+v (err: %v)", events, err)
+	}
+}
+
+func TestCLIRevokeKillsSessions(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	f := newFakeManagement(t, map[string]string{"alice@example.com": "7"})
+	issueTestCert(t, blobStorage, "alice@example.com", "client-alice@example.com-2024")
+
+	a := newAdminPKI(s.newPKI(blobStorage, "bucket", "pki/"), "admin")
+	a.management = config.Management{Addresses: []string{f.listener.Addr().String()}, Timeout: time.Second}
+	if _, err := a.Revoke(context.Background(), "alice@example.com", "test"); err != nil {
+		t.Fatalf("Revoke error: %s", err)
+	}
+	if f.connected("alice@example.com") {
+		t.Errorf("Session of alice was not killed")
+	}
+}
+
+func TestListConnections(t *testing.T) {
+	f := newFakeManagement(t, map[string]string{"alice@example.com:laptop": "1"})
+	conf := config.Management{Addresses: []string{f.listener.Addr().String(), "127.0.0.1:1"}, Timeout: time.Second}
+	connections, errs := listConnections(context.Background(), conf)
+	if len(connections) != 1 || connections[0].CommonName != "alice@example.com:laptop" || connections[0].Server != conf.Addresses[0] ||
+		connections[0].BytesSent != 200 {
+		t.Errorf("Unexpected connections: %+v", connections)
+	}
+	if len(errs) != 1 || !strings.HasPrefix(errs[0], "127.0.0.1:1") {
+		t.Errorf("Expected an error for the unreachable server, got %v", errs)
+	}
+}
+
+func TestCheckManagementAddresses(t *testing.T) {
+	if err := checkManagementAddresses(config.Management{Addresses: []string{"unix:///run/openvpn/management.sock", "vpn-1=localhost:7505"}}); err != nil {
+		t.Errorf("Expected valid addresses, got: %s", err)
+	}
+	if err := checkManagementAddresses(config.Management{Addresses: []string{"localhost:7505", "http://localhost:7505"}}); err == nil || !strings.Contains(err.Error(), "MANAGEMENT_ADDRESSES") {
+		t.Errorf("Expected an error for the http address, got: %v", err)
+	}
+}
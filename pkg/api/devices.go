@@ -0,0 +1,277 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/audit"
+)
+
+var deviceNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+var (
+	errInvalidDeviceName = errors.New("device name should be lowercase letters, digits and dashes (max 32 characters)")
+	errDeviceExists      = errors.New("device already exists")
+	errDeviceNotFound    = errors.New("device not found")
+	errDeviceLimit       = errors.New("maximum number of devices reached")
+)
+
+type devicesResponse struct {
+	Devices    []certificateInfo `json:"devices"`
+	MaxDevices int               `json:"maxDevices"`
+}
+
+// deviceCommonName returns the common name of a device certificate. The colon is kept as-is by openvpn in
+// the common name, and can't be part of a device name.
+func deviceCommonName(login, device string) string {
+	return login + ":" + device
+}
+
+// splitCommonName returns the login and device (empty for the default certificate) of a common name
+func splitCommonName(commonName string) (string, string) {
+	if i := strings.LastIndex(commonName, ":"); i != -1 {
+		return commonName[:i], commonName[i+1:]
+	}
+	return commonName, ""
+}
+
+func deviceCertName(login, device string) string {
+	return "client-" + deviceCommonName(login, device)
+}
+
+// devicesHandler lists the devices of the user (GET) or creates a new device (POST)
+func (s *server) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", err.Error())
+		return
+	}
+	if r.Method != http.MethodPost {
+		if !wantsJSON(r) {
+			http.Redirect(w, r, s.config.URLPrefix+"/access", http.StatusFound)
+			return
+		}
+		devices, err := s.listDevices(r.Context(), login)
+		if err != nil {
+			s.writeError(w, r, http.StatusInternalServerError, login, "Could not retrieve devices: "+err.Error())
+			return
+		}
+		response := devicesResponse{
+			Devices:    make([]certificateInfo, len(devices)),
+			MaxDevices: s.config.MaxDevicesPerUser,
+		}
+		for k, device := range devices {
+			response.Devices[k] = newCertificateInfo(device)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	device := r.FormValue("name")
+	issued, err := s.createDevice(r.Context(), login, device)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidDeviceName):
+			s.writeError(w, r, http.StatusBadRequest, login, err.Error())
+		case errors.Is(err, errAccessRevoked):
+			s.writeError(w, r, http.StatusForbidden, login, err.Error())
+		case errors.Is(err, errDeviceExists), errors.Is(err, errDeviceLimit), errors.Is(err, errConcurrentIssue):
+			s.writeError(w, r, http.StatusConflict, login, err.Error())
+		default:
+			s.writeError(w, r, http.StatusInternalServerError, login, "Could not create device: "+err.Error())
+		}
+		return
+	}
+	s.auditCerts(r, audit.CertIssued, login, issued)
+	response := issuedResponse{
+		Message:     "Device " + device + " has been created",
+		Note:        "Download the configuration and import it on " + device + " only. Create another device for your other devices.",
+		Download:    s.config.URLPrefix + "/devices/" + device + "/ovpnconfig",
+		Certificate: newCertificateInfo(issued),
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	s.render(w, r, http.StatusCreated, "issued.html", "Device created", login, response)
+}
+
+// deviceConfigHandler downloads the openvpn config of a device
+func (s *server) deviceConfigHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", err.Error())
+		return
+	}
+	device := mux.Vars(r)["device"]
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not create session: "+err.Error())
+		return
+	}
+	if err := s.newScimDirectory(blobStorage, storageBucket, storagePrefix).checkAccess(login); errors.Is(err, errAccessRevoked) {
+		s.writeError(w, r, http.StatusForbidden, login, err.Error())
+		return
+	} else if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, err.Error())
+		return
+	}
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	if s.mfaMissing(p, login) {
+		s.writeError(w, r, http.StatusForbidden, login, "Set up two-factor authentication before downloading a configuration")
+		return
+	}
+	etag, err := p.clientCertETag(r.Context(), deviceCertName(login, device))
+	if err != nil {
+		s.writeError(w, r, http.StatusNotFound, login, "Device "+device+" not found")
+		return
+	}
+	clientCert, clientKey, err := p.readClientCert(r.Context(), deviceCertName(login, device))
+	incomplete := errors.Is(err, errIncompleteCert)
+	if errors.Is(err, errConcurrentIssue) {
+		s.writeError(w, r, http.StatusConflict, login, err.Error())
+		return
+	}
+	if err != nil && !incomplete {
+		s.writeError(w, r, http.StatusNotFound, login, "Device "+device+" not found")
+		return
+	}
+	// an expired device certificate, a certificate without its key, or a certificate of the previous CA after a CA
+	// rotation, is renewed on download
+	issued := issuedCert{Name: deviceCertName(login, device)}
+	issued.Cert, err = NewCert().readCert(clientCert.String())
+	renew := err == nil && (incomplete || time.Now().After(issued.Cert.NotAfter))
+	if err == nil && !renew {
+		var superseded *issuedCert
+		superseded, err = p.supersedeOutdated(issued.Name, clientCert)
+		if superseded != nil {
+			s.auditCerts(r, audit.CertRevoked, login, *superseded)
+			// the superseded certificate is revoked, so it's issued again
+			etag, renew = "", true
+		}
+	}
+	if err == nil && renew {
+		clientCert, clientKey, err = p.issueLocked(r.Context(), login, deviceCommonName(login, device), issued.Name, etag)
+		if err == nil {
+			issued.Cert, err = NewCert().readCert(clientCert.String())
+			s.auditCerts(r, audit.CertIssued, login, issued)
+		}
+	}
+	if errors.Is(err, errConcurrentIssue) {
+		s.writeError(w, r, http.StatusConflict, login, err.Error())
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, err.Error())
+		return
+	}
+	ovpnConfig, err := p.clientConfig(clientCert, clientKey)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, err.Error())
+		return
+	}
+	s.auditCerts(r, audit.ProfileDownloaded, login, issued)
+	writeOvpnConfig(w, login+"-"+device, ovpnConfig)
+}
+
+// deviceRevokeHandler revokes the certificate of a device
+func (s *server) deviceRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", err.Error())
+		return
+	}
+	device := mux.Vars(r)["device"]
+	revoked, err := s.revokeDevice(r.Context(), login, device)
+	s.auditCerts(r, audit.CertRevoked, login, revoked...)
+	s.disconnect(r, login, revoked...)
+	if errors.Is(err, errDeviceNotFound) {
+		s.writeError(w, r, http.StatusNotFound, login, "Device "+device+" not found")
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not revoke device: "+err.Error())
+		return
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response{Message: "Device " + device + " revoked"})
+		return
+	}
+	http.Redirect(w, r, s.config.URLPrefix+"/access", http.StatusSeeOther)
+}
+
+// listDevices returns the device certificates of the user
+func (s *server) listDevices(ctx context.Context, login string) ([]issuedCert, error) {
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.newPKI(blobStorage, storageBucket, storagePrefix).listDevices(login)
+}
+
+// createDevice issues a certificate for a new device of the user, while holding the lock of the login
+func (s *server) createDevice(ctx context.Context, login, device string) (issuedCert, error) {
+	var issued issuedCert
+	if !deviceNameRegexp.MatchString(device) {
+		return issued, errInvalidDeviceName
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		return issued, err
+	}
+	if err := s.newScimDirectory(blobStorage, storageBucket, storagePrefix).checkAccess(login); err != nil {
+		return issued, err
+	}
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	// the devices are counted while holding the lock of the login, so concurrent requests can't exceed the limit
+	lock, err := p.lockLogin(ctx, login)
+	if err != nil {
+		return issued, err
+	}
+	defer lock.Release(context.WithoutCancel(ctx))
+	devices, err := p.listDevices(login)
+	if err != nil {
+		return issued, err
+	}
+	for _, existing := range devices {
+		if existing.Cert.Subject.CommonName == deviceCommonName(login, device) {
+			return issued, errDeviceExists
+		}
+	}
+	if len(devices) >= s.config.MaxDevicesPerUser {
+		return issued, errDeviceLimit
+	}
+	issued.Name = deviceCertName(login, device)
+	clientCert, _, err := p.issueClientCert(ctx, deviceCommonName(login, device), issued.Name, "")
+	if err != nil {
+		return issued, err
+	}
+	issued.Cert, err = NewCert().readCert(clientCert.String())
+	return issued, err
+}
+
+// revokeDevice revokes the certificate of a device of the user
+func (s *server) revokeDevice(ctx context.Context, login, device string) ([]issuedCert, error) {
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := s.newPKI(blobStorage, storageBucket, storagePrefix).revokeCommonName(deviceCommonName(login, device), "device revoked by user")
+	if err != nil {
+		return revoked, err
+	}
+	if len(revoked) == 0 {
+		return revoked, errDeviceNotFound
+	}
+	return revoked, nil
+}
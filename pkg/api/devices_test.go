@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestDevices(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	s.config.MaxDevicesPerUser = 2
+	issueTestCert(t, blobStorage, "alice@example.com", "client-alice@example.com-2024")
+
+	if _, err := s.createDevice(context.Background(), "alice@example.com", "My Laptop"); !errors.Is(err, errInvalidDeviceName) {
+		t.Errorf("Expected invalid device name error, got: %v", err)
+	}
+	laptop, err := s.createDevice(context.Background(), "alice@example.com", "laptop")
+	if err != nil {
+		t.Fatalf("createDevice error: %s", err)
+	}
+	if laptop.Cert.Subject.CommonName != "alice@example.com:laptop" {
+		t.Errorf("Unexpected common name: %s", laptop.Cert.Subject.CommonName)
+	}
+	if _, err := s.createDevice(context.Background(), "alice@example.com", "laptop"); !errors.Is(err, errDeviceExists) {
+		t.Errorf("Expected device exists error, got: %v", err)
+	}
+	if _, err := s.createDevice(context.Background(), "alice@example.com", "phone"); err != nil {
+		t.Fatalf("createDevice error: %s", err)
+	}
+	if _, err := s.createDevice(context.Background(), "alice@example.com", "tablet"); !errors.Is(err, errDeviceLimit) {
+		t.Errorf("Expected device limit error, got: %v", err)
+	}
+
+	devices, err := s.listDevices(context.Background(), "alice@example.com")
+	if err != nil || len(devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %d (err: %v)", len(devices), err)
+	}
+
+	if _, err := s.revokeDevice(context.Background(), "alice@example.com", "laptop"); err != nil {
+		t.Fatalf("revokeDevice error: %s", err)
+	}
+	if _, err := s.revokeDevice(context.Background(), "alice@example.com", "laptop"); !errors.Is(err, errDeviceNotFound) {
+		t.Errorf("Expected device not found error, got: %v", err)
+	}
+	devices, _ = s.listDevices(context.Background(), "alice@example.com")
+	if len(devices) != 1 || devices[0].Cert.Subject.CommonName != "alice@example.com:phone" {
+		t.Errorf("Expected only the phone to be left, got %+v", devices)
+	}
+	// the default certificate is not affected by device revocation
+	if _, _, err := newPKI(blobStorage, "bucket", "pki/").getClientCert("client-alice@example.com-2024"); err != nil {
+		t.Errorf("Default certificate was revoked: %s", err)
+	}
+}
+
+func TestCreateDevicesConcurrently(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.config.MaxDevicesPerUser = 2
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.createDevice(context.Background(), "alice@example.com", fmt.Sprintf("device-%d", i))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+		} else if !errors.Is(err, errDeviceLimit) {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+	if devices, _ := s.listDevices(context.Background(), "alice@example.com"); created != 2 || len(devices) != 2 {
+		t.Errorf("Expected 2 devices, created %d and listed %d", created, len(devices))
+	}
+}
+
+func TestDeprovisionRemovesDeviceCCD(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	for _, entry := range []string{"alice@example.com", "alice@example.com:laptop", "alice@example.com:phone", "alice@example.community:laptop"} {
+		blobStorage.PutObject("bucket", "pki/ccd/"+entry, "ifconfig-push 10.8.0.10 255.255.255.0", "")
+	}
+	if err := s.deprovision(httptest.NewRequest("DELETE", "/scim/v2/Users/1", nil), "alice@example.com"); err != nil {
+		t.Fatalf("deprovision error: %s", err)
+	}
+	entries, _ := blobStorage.ListObjects("bucket", "pki/ccd/")
+	if len(entries) != 1 || entries[0] != "pki/ccd/alice@example.community:laptop" {
+		t.Errorf("Expected only the ccd entry of another user to be left, got %v", entries)
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/config"
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+// newKeyEncryptionKey returns the key encryption key of the configuration
+func newKeyEncryptionKey(conf config.Storage) (storage.KeyEncryptionKey, error) {
+	switch conf.Encryption.KEK {
+	case "aws-kms":
+		return storage.NewKMSKEK(conf.S3.Region, conf.Encryption.KMSKeyID)
+	case "azure-keyvault":
+		return storage.NewKeyVaultKEK(conf.Encryption.KeyVaultKey)
+	case "file":
+		return storage.NewKeyFileKEK(conf.Encryption.KeyFile)
+	}
+	return nil, fmt.Errorf("unknown key encryption key %q", conf.Encryption.KEK)
+}
+
+// encryptStorage adds the envelope encryption of the private keys to the storage backend, when a key encryption key is configured
+func (s *server) encryptStorage(blobStorage storage.StorageIf) (storage.StorageIf, error) {
+	if s.config.Storage.Encryption.KEK == "" {
+		return blobStorage, nil
+	}
+	kek, err := newKeyEncryptionKey(s.config.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("Could not initialize the key encryption key: %s", err)
+	}
+	return storage.NewEnvelope(blobStorage, kek), nil
+}
+
+/*
+ * EncryptKeys rewrites the private keys with the envelope encryption: keys that were stored before the encryption was
+ * enabled are encrypted, and encrypted keys get a new data key wrapped by the configured key encryption key. The keys
+ * are read with the configured key encryption key as well, so it only moves keys to another KMS key, or another version
+ * of the Key Vault key, while the previous one can still unwrap them. A key file only unwraps its own data keys and a
+ * Key Vault key only the data keys of its versions: keys wrapped by another key or another type of key encryption key
+ * can't be read, EncryptKeys stops at the first one. The number of rewritten keys is returned.
+ */
+func (a *PKI) EncryptKeys() (int, error) {
+	p := a.pki
+	if !a.encryption {
+		return 0, fmt.Errorf("storage.encryption.kek (STORAGE_ENCRYPTION_KEK) is not configured")
+	}
+	count := 0
+	for _, dir := range storage.EncryptedDirs {
+		items, err := p.storage.ListObjects(p.bucket, p.prefix+dir)
+		if err != nil {
+			return count, err
+		}
+		for _, item := range items {
+			data, err := p.storage.GetObject(p.bucket, item)
+			if err != nil {
+				return count, fmt.Errorf("could not read %s: %s", item, err)
+			}
+			if err := p.storage.PutObject(p.bucket, item, data.String(), p.kmsArn); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	a.auditLogger.Log(audit.Event{Type: audit.AdminAction, Actor: a.actor, Details: map[string]string{"action": "storage.encrypt-keys", "keys": strconv.Itoa(count)}})
+	return count, nil
+}
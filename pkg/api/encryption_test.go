@@ -0,0 +1,77 @@
+package api
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/in4it/openvpn-access/pkg/config"
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+func TestEncryptStorage(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "kek")
+	os.WriteFile(keyFile, bytes.Repeat([]byte{3}, 32), 0600)
+	conf := config.Default()
+	conf.Storage.Encryption.KEK = "file"
+	conf.Storage.Encryption.KeyFile = keyFile
+	s := NewServer(conf)
+
+	backend := storage.NewMemory()
+	encrypted, err := s.encryptStorage(backend)
+	if err != nil {
+		t.Fatalf("encryptStorage error: %s", err)
+	}
+	encrypted.PutObject("bucket", "pki/private/ca.key", caKey, "")
+	if raw, _ := backend.GetObject("bucket", "pki/private/ca.key"); strings.Contains(raw.String(), "PRIVATE KEY") {
+		t.Errorf("Expected an encrypted key in the backend")
+	}
+	if out, err := encrypted.GetObject("bucket", "pki/private/ca.key"); err != nil || out.String() != caKey {
+		t.Errorf("Unexpected key: %q (err: %v)", out.String(), err)
+	}
+
+	conf.Storage.Encryption.KeyFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := NewServer(conf).encryptStorage(backend); err == nil {
+		t.Errorf("Expected error for a missing key file")
+	}
+}
+
+func TestEncryptKeys(t *testing.T) {
+	backend := storage.NewMemory()
+	backend.PutObject("bucket", "pki/private/ca.key", caKey, "")
+	backend.PutObject("bucket", "pki/revoked/private_by_serial/01.key", caKey, "")
+	backend.PutObject("bucket", "pki/issued/client.crt", caCert, "")
+	kek, _ := storage.NewLocalKEK(bytes.Repeat([]byte{3}, 32))
+	a := newAdminPKI(newPKI(storage.NewEnvelope(backend, kek), "bucket", "pki/"), "admin")
+
+	if _, err := a.EncryptKeys(); err == nil {
+		t.Errorf("Expected error when the encryption isn't configured")
+	}
+	a.encryption = true
+	count, err := a.EncryptKeys()
+	if err != nil || count != 2 {
+		t.Fatalf("Unexpected EncryptKeys result: %d (err: %v)", count, err)
+	}
+	for _, item := range []string{"pki/private/ca.key", "pki/revoked/private_by_serial/01.key"} {
+		if raw, _ := backend.GetObject("bucket", item); strings.Contains(raw.String(), "PRIVATE KEY") {
+			t.Errorf("Expected %s to be encrypted", item)
+		}
+	}
+	if raw, _ := backend.GetObject("bucket", "pki/issued/client.crt"); raw.String() != caCert {
+		t.Errorf("Expected the certificate to be unchanged")
+	}
+	key, err := a.pki.storage.GetObject("bucket", "pki/private/ca.key")
+	if err != nil || key.String() != caKey {
+		t.Errorf("Unexpected key: %q (err: %v)", key.String(), err)
+	}
+
+	// another key file can't unwrap the data keys
+	otherKEK, _ := storage.NewLocalKEK(bytes.Repeat([]byte{4}, 32))
+	other := newAdminPKI(newPKI(storage.NewEnvelope(backend, otherKEK), "bucket", "pki/"), "admin")
+	other.encryption = true
+	if count, err := other.EncryptKeys(); err == nil || count != 0 || !strings.Contains(err.Error(), "pki/private/ca.key") {
+		t.Errorf("Expected an error for the keys of another key file, got %d (err: %v)", count, err)
+	}
+}
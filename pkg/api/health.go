@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/*
+ * caExpiryThreshold is the remaining validity of the CA certificate below which the ca check warns. An expiring CA doesn't
+ * fail the readiness: every replica would be taken out of the load balancer at the same time, while they can still serve
+ * (and rotate) the CA. The expiry is exported in the metrics to alert on.
+ */
+const caExpiryThreshold = 30 * 24 * time.Hour
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// errCAExpiring is returned by checkCACert when a CA certificate expires within caExpiryThreshold
+var errCAExpiring = errors.New("expires within 30 days")
+
+func newHealthCheck(err error) healthCheck {
+	if errors.Is(err, errCAExpiring) {
+		return healthCheck{Status: "warn", Message: err.Error()}
+	}
+	if err != nil {
+		return healthCheck{Status: "fail", Message: err.Error()}
+	}
+	return healthCheck{Status: "ok"}
+}
+
+// healthzHandler returns 200 when the process is running (liveness)
+func (s *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(healthResponse{Status: "ok"})
+}
+
+// readyzHandler returns 200 when the identity provider and storage are usable, 503 otherwise (readiness)
+func (s *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	response := s.readiness(r.Context(), time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// readiness runs all dependency checks and returns their status
+func (s *server) readiness(ctx context.Context, now time.Time) healthResponse {
+	response := healthResponse{
+		Status: "ok",
+		Checks: map[string]healthCheck{
+			"auth": newHealthCheck(s.auth.ready()),
+		},
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		response.Checks["storage"] = newHealthCheck(err)
+	} else {
+		response.Checks["storage"] = newHealthCheck(blobStorage.HeadObject(storageBucket, storagePrefix+"ca.crt"))
+		response.Checks["template"] = newHealthCheck(blobStorage.HeadObject(storageBucket, storagePrefix+"openvpn-client.conf"))
+		caCert, err := blobStorage.GetObject(storageBucket, storagePrefix+"ca.crt")
+		if err != nil {
+			response.Checks["ca"] = newHealthCheck(fmt.Errorf("ca.crt download error: %s", err))
+		} else {
+			response.Checks["ca"] = newHealthCheck(checkCACert(caCert.String(), now))
+		}
+	}
+	for _, check := range response.Checks {
+		if check.Status == "fail" {
+			response.Status = "fail"
+		}
+	}
+	return response
+}
+
+// checkCACert returns an error when the CA certificates can't be parsed, or errCAExpiring when one of them expires within caExpiryThreshold
+func checkCACert(caCert string, now time.Time) error {
+	chain, err := parseCAChain(caCert)
+	if err != nil {
+		return fmt.Errorf("Parsed CA cert Error: %s", err)
+	}
+	if err := chain.checkExpiry(now, caExpiryThreshold); err != nil {
+		return fmt.Errorf("%s: %w", err, errCAExpiring)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	s.readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", rec.Code)
+	}
+	var response healthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+	for name, status := range map[string]string{"auth": "fail", "storage": "ok", "template": "fail", "ca": "ok"} {
+		if response.Checks[name].Status != status {
+			t.Errorf("Expected check %s to be %s, got %+v", name, status, response.Checks[name])
+		}
+	}
+
+	s.auth.authType = "github"
+	blobStorage.PutObject("bucket", "pki/openvpn-client.conf", "[CERT]", "")
+	rec = httptest.NewRecorder()
+	s.readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	cert, _ := NewCert().readCert(caCert)
+	response = s.readiness(context.Background(), cert.NotAfter.Add(-10*24*time.Hour))
+	if response.Status != "ok" || response.Checks["ca"].Status != "warn" {
+		t.Errorf("Expected CA check to warn without failing the readiness when the CA expires within 30 days, got %+v", response)
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 60 * time.Second
+	idleTimeout       = 120 * time.Second
+	// shutdownTimeout is the time in-flight requests get to finish after SIGTERM. ECS kills the container after 30s.
+	shutdownTimeout = 25 * time.Second
+)
+
+// newHTTPServer returns a http server with timeouts
+func newHTTPServer(handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// listener is a http server with the listener it serves on
+type listener struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// listen opens the listener of a http server
+func listen(addr string, server *http.Server) (listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return listener{}, fmt.Errorf("Could not listen on %s: %s", addr, err)
+	}
+	return listener{server: server, listener: l}, nil
+}
+
+/*
+ * serve serves the listeners until ctx is done or one of the servers stops. The servers are shut down gracefully:
+ * they stop accepting connections and wait (max shutdownTimeout) for in-flight requests to finish.
+ */
+func serve(ctx context.Context, listeners ...listener) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			var err error
+			if l.server.TLSConfig != nil {
+				err = l.server.ServeTLS(l.listener, "", "")
+			} else {
+				err = l.server.Serve(l.listener)
+			}
+			errs <- err
+		}(l)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down, waiting for in-flight requests to finish")
+	case err = <-errs:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, l := range listeners {
+		if shutdownErr := l.server.Shutdown(shutdownCtx); shutdownErr != nil {
+			slog.Error("Could not shut down gracefully", "addr", l.listener.Addr().String(), "error", shutdownErr)
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+/*
+ * newTLSConfig returns the tls config of the server. The certificate is read from the tls cert and key file (reloaded
+ * when the files change), or requested with ACME for the acme domains. The autocert manager is returned
+ * for the http-01 challenge. The tls config is nil when TLS is not enabled.
+ */
+func newTLSConfig(conf config.Config) (*tls.Config, *autocert.Manager, error) {
+	if conf.TLS.CertFile != "" || conf.TLS.KeyFile != "" {
+		reloader, err := newCertReloader(conf.TLS.CertFile, conf.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}, nil, nil
+	}
+	if len(conf.ACME.Domains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(conf.ACME.Domains...),
+			Cache:      autocert.DirCache(conf.ACME.CacheDir),
+			Email:      conf.ACME.Email,
+		}
+		if conf.ACME.DirectoryURL != "" {
+			manager.Client = &acme.Client{DirectoryURL: conf.ACME.DirectoryURL}
+		}
+		tlsConfig := manager.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		return tlsConfig, manager, nil
+	}
+	return nil, nil, nil
+}
+
+// certReloader serves a certificate from disk, and reloads it when the certificate or key file is modified
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both the tls cert and key file need to be set")
+	}
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the certificate when it was modified since the last load
+func (c *certReloader) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return nil
+	}
+	// the modification time is stored when the load fails too, to only retry when the files change again
+	c.modTime = modTime
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Could not load tls certificate: %s", err)
+	}
+	c.cert = &cert
+	return nil
+}
+
+func (c *certReloader) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// GetCertificate returns the current certificate. When the reload fails, the previous certificate is kept.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		slog.Error("Could not reload tls certificate", "cert_file", c.certFile, "error", err)
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		w.Write([]byte("issued"))
+	})
+	l, err := listen("127.0.0.1:0", newHTTPServer(handler, nil))
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- serve(ctx, l)
+	}()
+
+	responses := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + l.listener.Addr().String() + "/")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-stopped:
+		t.Fatalf("server stopped before the in-flight request finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(finish)
+	if body := <-responses; body != "issued" {
+		t.Errorf("in-flight request didn't finish: %s", body)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("serve error: %s", err)
+	}
+	if _, err := http.Get("http://" + l.listener.Addr().String() + "/"); err == nil {
+		t.Errorf("server still accepts connections after shutdown")
+	}
+}
+
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate error: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey error: %s", err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Errorf("Expected error when the certificate doesn't exist")
+	}
+	writeTestCertificate(t, certFile, keyFile, "first")
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader error: %s", err)
+	}
+	commonName := func() string {
+		cert, err := reloader.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("GetCertificate error: %s", err)
+		}
+		parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+		return parsed.Subject.CommonName
+	}
+	if cn := commonName(); cn != "first" {
+		t.Errorf("Expected first certificate, got %s", cn)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, "second")
+	modTime := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, modTime, modTime)
+	if cn := commonName(); cn != "second" {
+		t.Errorf("Expected reloaded certificate, got %s", cn)
+	}
+
+	// an invalid certificate keeps the previous one
+	os.WriteFile(certFile, []byte("invalid"), 0600)
+	modTime = modTime.Add(time.Minute)
+	os.Chtimes(certFile, modTime, modTime)
+	if cn := commonName(); cn != "second" {
+		t.Errorf("Expected previous certificate after invalid reload, got %s", cn)
+	}
+}
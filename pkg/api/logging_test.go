@@ -0,0 +1,43 @@
+package api
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/logging"
+)
+
+func TestCallbackDoesNotLogSecrets(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(logging.New(&out, "json", "debug"))
+	defer slog.SetDefault(defaultLogger)
+
+	s, blobStorage := newTestServer(t)
+	s.auditLogger = audit.NewLogger(blobStorage, "bucket", "pki/", "", &out)
+	s.sessionStore = sessions.NewCookieStore([]byte("session-key"))
+
+	rec := httptest.NewRecorder()
+	logging.Middleware(http.HandlerFunc(s.callbackHandler)).ServeHTTP(rec, httptest.NewRequest("GET", "/callback?code=secret-oauth2-code", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d", rec.Code)
+	}
+	if !strings.Contains(out.String(), rec.Header().Get(logging.RequestIDHeader)) {
+		t.Errorf("request id not logged: %s", out.String())
+	}
+	if strings.Contains(out.String(), "secret-oauth2-code") {
+		t.Errorf("oauth2 code is logged: %s", out.String())
+	}
+}
+
+func TestPemBlockForKey(t *testing.T) {
+	if _, err := NewCert().pemBlockForKey("not a key"); err == nil {
+		t.Errorf("Expected error for unsupported key type")
+	}
+}
@@ -0,0 +1,479 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/qrcode"
+	"github.com/in4it/openvpn-access/pkg/storage"
+	"github.com/in4it/openvpn-access/pkg/totp"
+	"github.com/in4it/openvpn-access/pkg/verify"
+)
+
+const (
+	// recoveryCodes is the number of recovery codes that is generated at enrollment
+	recoveryCodes = 10
+	// mfaSkew is the number of time steps before and after the current time step that is accepted
+	mfaSkew = 1
+	// mfaSessionKey is the session value with the secret of an enrollment that isn't confirmed yet
+	mfaSessionKey = "mfa-secret"
+	// mfaMaxFailures is the number of invalid codes after which the second factor of the user is locked for mfaLockout
+	mfaMaxFailures = 5
+	mfaLockout     = 15 * time.Minute
+	// mfaSaveRetries is the number of times a check is retried when the enrollment is changed by another request
+	mfaSaveRetries = 3
+)
+
+// errMFALocked is returned by a check after mfaMaxFailures invalid codes, until the lockout is over
+var errMFALocked = errors.New("too many invalid two-factor codes, try again later")
+
+// mfaEnrollment is the second factor of a user, stored in mfa/<login>.json
+type mfaEnrollment struct {
+	// Secret is the totp secret, encrypted with the mfa key
+	Secret string `json:"secret"`
+	// RecoveryCodes are the hashes of the recovery codes that weren't used yet
+	RecoveryCodes []string  `json:"recoveryCodes"`
+	Enrolled      time.Time `json:"enrolled"`
+	// LastStep is the time step of the last accepted code, a code can't be used twice
+	LastStep int64 `json:"lastStep"`
+	// Failures is the number of invalid codes since the last valid code or lockout
+	Failures    int       `json:"failures,omitempty"`
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+	// etag is the ETag of the stored enrollment, it's only saved again when it wasn't changed in the meantime
+	etag string
+}
+
+// mfaStore stores the enrolled second factors in the storage backend
+type mfaStore struct {
+	storage storage.StorageIf
+	bucket  string
+	prefix  string
+	kmsArn  string
+	key     []byte
+}
+
+func newMFAStore(blobStorage storage.StorageIf, bucket, prefix, key string) *mfaStore {
+	return &mfaStore{
+		storage: blobStorage,
+		bucket:  bucket,
+		prefix:  prefix,
+		key:     []byte(key),
+	}
+}
+
+// newMFAStore returns the mfa store in the storage backend, with the mfa and kms key of the configuration
+func (s *server) newMFAStore(blobStorage storage.StorageIf, bucket, prefix string) *mfaStore {
+	m := newMFAStore(blobStorage, bucket, prefix, s.config.MFA.Key)
+	m.kmsArn = s.config.Storage.S3.KMSArn
+	return m
+}
+
+// mfaEnabled returns true when the users can enroll a second factor
+func (s *server) mfaEnabled() bool {
+	return s.config.MFA.Key != ""
+}
+
+// get returns the enrollment of the user, or nil when the user didn't enroll
+func (m *mfaStore) get(login string) (*mfaEnrollment, error) {
+	body, info, err := storage.Objects(m.storage).Get(context.Background(), m.bucket, m.prefix+"mfa/"+login+".json")
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	enrollment := mfaEnrollment{etag: info.ETag}
+	if err := json.NewDecoder(body).Decode(&enrollment); err != nil {
+		return nil, fmt.Errorf("invalid mfa enrollment of %s: %s", login, err)
+	}
+	return &enrollment, nil
+}
+
+/*
+ * save writes the enrollment. An enrollment that was read with get is only written when it wasn't changed by another
+ * request, e.g. on another replica, otherwise storage.ErrPreconditionFailed is returned. A new enrollment is only
+ * written when the user didn't enroll yet.
+ */
+func (m *mfaStore) save(login string, enrollment *mfaEnrollment) error {
+	out, err := json.Marshal(enrollment)
+	if err != nil {
+		return err
+	}
+	info, err := storage.Objects(m.storage).Put(context.Background(), m.bucket, m.prefix+"mfa/"+login+".json", bytes.NewReader(out), storage.PutOptions{
+		ContentType: "application/json",
+		KMSArn:      m.kmsArn,
+		IfNoneMatch: enrollment.etag == "",
+		IfMatch:     enrollment.etag,
+	})
+	if err != nil {
+		return err
+	}
+	enrollment.etag = info.ETag
+	return nil
+}
+
+func (m *mfaStore) remove(login string) error {
+	return m.storage.DeleteObject(m.bucket, m.prefix+"mfa/"+login+".json")
+}
+
+/*
+ * enroll stores the secret of the user, encrypted, and returns new recovery codes. step is the time step of the code
+ * that confirmed the enrollment, it can't be used again to connect.
+ */
+func (m *mfaStore) enroll(login, secret string, step int64, now time.Time) ([]string, error) {
+	encrypted, err := m.encrypt(login, secret)
+	if err != nil {
+		return nil, err
+	}
+	enrollment := &mfaEnrollment{Secret: encrypted, Enrolled: now, LastStep: step}
+	codes := make([]string, recoveryCodes)
+	for k := range codes {
+		random := make([]byte, 5)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(random))
+		codes[k] = code[:4] + "-" + code[4:]
+		enrollment.RecoveryCodes = append(enrollment.RecoveryCodes, m.hashRecoveryCode(codes[k]))
+	}
+	return codes, m.save(login, enrollment)
+}
+
+/*
+ * check validates the code of the authenticator app or a recovery code of the user. A valid code can't be used again:
+ * the time step of the code is stored, and a recovery code is removed. recovery is true when a recovery code was used.
+ * After mfaMaxFailures invalid codes, errMFALocked is returned for mfaLockout. The enrollment is saved with a
+ * conditional write: when it's changed by another request, e.g. a request with the same code, it's read again and the
+ * code is checked again.
+ */
+func (m *mfaStore) check(login string, enrollment *mfaEnrollment, code string, now time.Time) (valid bool, recovery bool, err error) {
+	for attempt := 1; ; attempt++ {
+		valid, recovery, err = m.checkOnce(login, enrollment, code, now)
+		if !errors.Is(err, storage.ErrPreconditionFailed) || attempt == mfaSaveRetries {
+			return valid, recovery, err
+		}
+		current, err := m.get(login)
+		if err != nil {
+			return false, false, err
+		}
+		if current == nil {
+			return false, false, fmt.Errorf("the two-factor authentication of %s was removed", login)
+		}
+		*enrollment = *current
+	}
+}
+
+func (m *mfaStore) checkOnce(login string, enrollment *mfaEnrollment, code string, now time.Time) (valid bool, recovery bool, err error) {
+	if now.Before(enrollment.LockedUntil) {
+		return false, false, errMFALocked
+	}
+	secret, err := m.decrypt(login, enrollment.Secret)
+	if err != nil {
+		return false, false, err
+	}
+	code = strings.TrimSpace(code)
+	if step, ok := totp.Validate(secret, code, now, mfaSkew); ok && step > enrollment.LastStep {
+		enrollment.LastStep = step
+		enrollment.Failures = 0
+		return true, false, m.save(login, enrollment)
+	}
+	hash := m.hashRecoveryCode(code)
+	for k, recoveryCode := range enrollment.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(recoveryCode), []byte(hash)) == 1 {
+			enrollment.RecoveryCodes = append(enrollment.RecoveryCodes[:k:k], enrollment.RecoveryCodes[k+1:]...)
+			enrollment.Failures = 0
+			return true, true, m.save(login, enrollment)
+		}
+	}
+	enrollment.Failures++
+	if enrollment.Failures >= mfaMaxFailures {
+		enrollment.Failures = 0
+		enrollment.LockedUntil = now.Add(mfaLockout)
+	}
+	return false, false, m.save(login, enrollment)
+}
+
+// hashRecoveryCode returns the hmac of the recovery code, ignoring case, dashes and spaces
+func (m *mfaStore) hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte("recovery-code:" + normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encrypt encrypts the secret with aes-gcm. The login is authenticated as well: a secret can't be copied to another user.
+func (m *mfaStore) encrypt(login, secret string) (string, error) {
+	gcm, err := m.cipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), []byte(login))), nil
+}
+
+func (m *mfaStore) decrypt(login, encrypted string) (string, error) {
+	gcm, err := m.cipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid mfa secret of %s", login)
+	}
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(login))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt the mfa secret of %s: %s", login, err)
+	}
+	return string(secret), nil
+}
+
+func (m *mfaStore) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(m.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mfa key: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// mfaEnrolled returns true when the user has enrolled a second factor, the storage isn't read when mfa is disabled
+func (p *pki) mfaEnrolled(login string) bool {
+	return p.mfa && p.storage.HeadObject(p.bucket, p.prefix+"mfa/"+login+".json") == nil
+}
+
+// mfaMissing returns true when a second factor is required and the user didn't enroll one
+func (s *server) mfaMissing(p *pki, login string) bool {
+	return s.config.MFA.Required && !p.mfaEnrolled(login)
+}
+
+// withAuthUserPass adds auth-user-pass to the openvpn config, so the client asks for the username and code
+func withAuthUserPass(ovpnConfig string) string {
+	for _, line := range strings.Split(ovpnConfig, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "auth-user-pass") {
+			return ovpnConfig
+		}
+	}
+	// a one-time code can't be reused on renegotiation, the server hands out a token (auth-gen-token) instead
+	return strings.TrimRight(ovpnConfig, "\n") + "\nauth-user-pass\nauth-nocache\n"
+}
+
+/*
+ * verifyMFA checks the code of users with a second factor, when the request comes from auth-user-pass-verify. Users
+ * without a second factor can only connect when mfa isn't required. The use of a recovery code is audited.
+ */
+func (s *server) verifyMFA(r *http.Request, request verify.Request, now time.Time) (verify.Decision, error) {
+	if !s.mfaEnabled() || request.Hook == verify.HookTLSVerify {
+		return verify.Decision{Allow: true}, nil
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		return verify.Decision{}, err
+	}
+	store := s.newMFAStore(blobStorage, storageBucket, storagePrefix)
+	login, _ := splitCommonName(request.CommonName)
+	enrollment, err := store.get(login)
+	if err != nil {
+		return verify.Decision{}, err
+	}
+	switch {
+	case enrollment == nil && s.config.MFA.Required:
+		return deny("user didn't set up two-factor authentication"), nil
+	case enrollment == nil:
+		return verify.Decision{Allow: true}, nil
+	case request.Password == "":
+		return deny("two-factor code is required"), nil
+	}
+	valid, recovery, err := store.check(login, enrollment, request.Password, now)
+	if errors.Is(err, errMFALocked) {
+		return deny(err.Error()), nil
+	}
+	if err != nil {
+		return verify.Decision{}, err
+	}
+	if !valid {
+		return deny("invalid two-factor code"), nil
+	}
+	if recovery {
+		s.auditLog(r, audit.Event{Type: audit.MFARecoveryUsed, Actor: login, Subject: request.CommonName, Details: map[string]string{"left": fmt.Sprint(len(enrollment.RecoveryCodes))}})
+	}
+	return verify.Decision{Allow: true}, nil
+}
+
+type mfaResponse struct {
+	Message  string `json:"message,omitempty"`
+	Enrolled bool   `json:"enrolled"`
+	Required bool   `json:"required"`
+	// RecoveryCodesLeft is the number of unused recovery codes of an enrolled user
+	RecoveryCodesLeft int `json:"recoveryCodesLeft,omitempty"`
+	// Secret, URI and QRCode are shown to enroll
+	Secret string        `json:"secret,omitempty"`
+	URI    string        `json:"uri,omitempty"`
+	QRCode template.HTML `json:"-"`
+	// RecoveryCodes are only shown once, right after the enrollment
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+/*
+ * mfaHandler shows the second factor of the user. Users without second factor get a new secret with a qr code for
+ * their authenticator app (GET), and enroll by confirming a code of the app (POST). The recovery codes are shown once.
+ */
+func (s *server) mfaHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", err.Error())
+		return
+	}
+	if !s.mfaEnabled() {
+		s.writeError(w, r, http.StatusNotFound, login, "Two-factor authentication is not enabled")
+		return
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not create session: "+err.Error())
+		return
+	}
+	store := s.newMFAStore(blobStorage, storageBucket, storagePrefix)
+	enrollment, err := store.get(login)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not get two-factor authentication: "+err.Error())
+		return
+	}
+	response := mfaResponse{Required: s.config.MFA.Required}
+	if enrollment != nil {
+		if r.Method == http.MethodPost {
+			s.writeError(w, r, http.StatusConflict, login, "Two-factor authentication is already set up")
+			return
+		}
+		response.Enrolled = true
+		response.RecoveryCodesLeft = len(enrollment.RecoveryCodes)
+		s.writeMFA(w, r, http.StatusOK, login, response)
+		return
+	}
+
+	session, _ := s.sessionStore.Get(r, "token-session")
+	secret, _ := session.Values[mfaSessionKey].(string)
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		step, ok := totp.Validate(secret, r.FormValue("code"), time.Now(), mfaSkew)
+		if ok {
+			codes, err := store.enroll(login, secret, step, time.Now())
+			if err != nil {
+				s.writeError(w, r, http.StatusInternalServerError, login, "Could not set up two-factor authentication: "+err.Error())
+				return
+			}
+			delete(session.Values, mfaSessionKey)
+			session.Save(r, w)
+			s.auditLog(r, audit.Event{Type: audit.MFAEnrolled, Actor: login, Subject: login})
+			response.Enrolled = true
+			response.RecoveryCodesLeft = len(codes)
+			response.RecoveryCodes = codes
+			response.Message = "Two-factor authentication is set up. Download your OpenVPN configuration again: the new configuration asks for your username and the code of your authenticator app."
+			s.writeMFA(w, r, http.StatusOK, login, response)
+			return
+		}
+		status = http.StatusBadRequest
+		response.Message = "The code is not valid, try again with the next code of your authenticator app."
+	}
+	if secret == "" {
+		if secret, err = totp.GenerateSecret(); err != nil {
+			s.writeError(w, r, http.StatusInternalServerError, login, "Could not generate secret: "+err.Error())
+			return
+		}
+		session.Values[mfaSessionKey] = secret
+		if err := session.Save(r, w); err != nil {
+			s.writeError(w, r, http.StatusInternalServerError, login, "Could not save session: "+err.Error())
+			return
+		}
+	}
+	response.Secret = secret
+	response.URI = totp.URI(s.config.MFA.Issuer, login, secret)
+	qr, err := qrcode.Encode([]byte(response.URI))
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not create qr code: "+err.Error())
+		return
+	}
+	response.QRCode = template.HTML(qr.SVG(4))
+	s.writeMFA(w, r, status, login, response)
+}
+
+// mfaRemoveHandler removes the second factor of the user, after confirming a code of the authenticator app or a recovery code
+func (s *server) mfaRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", err.Error())
+		return
+	}
+	if !s.mfaEnabled() {
+		s.writeError(w, r, http.StatusNotFound, login, "Two-factor authentication is not enabled")
+		return
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not create session: "+err.Error())
+		return
+	}
+	store := s.newMFAStore(blobStorage, storageBucket, storagePrefix)
+	enrollment, err := store.get(login)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not get two-factor authentication: "+err.Error())
+		return
+	}
+	if enrollment == nil {
+		s.writeError(w, r, http.StatusNotFound, login, "Two-factor authentication is not set up")
+		return
+	}
+	valid, _, err := store.check(login, enrollment, r.FormValue("code"), time.Now())
+	if errors.Is(err, errMFALocked) {
+		s.writeError(w, r, http.StatusTooManyRequests, login, err.Error())
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not check the code: "+err.Error())
+		return
+	}
+	if !valid {
+		s.writeError(w, r, http.StatusForbidden, login, "The code is not valid")
+		return
+	}
+	if err := store.remove(login); err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not remove two-factor authentication: "+err.Error())
+		return
+	}
+	s.auditLog(r, audit.Event{Type: audit.MFARemoved, Actor: login, Subject: login})
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response{Message: "Two-factor authentication removed"})
+		return
+	}
+	http.Redirect(w, r, s.config.URLPrefix+"/mfa", http.StatusSeeOther)
+}
+
+func (s *server) writeMFA(w http.ResponseWriter, r *http.Request, status int, login string, response mfaResponse) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	s.render(w, r, status, "mfa.html", "Two-factor authentication", login, response)
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/totp"
+	"github.com/in4it/openvpn-access/pkg/verify"
+)
+
+const testMFAKey = "0123456789abcdef0123456789abcdef"
+
+func TestMFAStore(t *testing.T) {
+	_, blobStorage := newTestServer(t)
+	store := newMFAStore(blobStorage, "bucket", "pki/", testMFAKey)
+	secret, _ := totp.GenerateSecret()
+	now := time.Now()
+	codes, err := store.enroll("alice", secret, totp.Step(now)-1, now)
+	if err != nil || len(codes) != recoveryCodes {
+		t.Fatalf("Unexpected recovery codes %v (err: %v)", codes, err)
+	}
+	if data, _ := blobStorage.GetObject("bucket", "pki/mfa/alice.json"); strings.Contains(data.String(), secret) || strings.Contains(data.String(), codes[0]) {
+		t.Errorf("The secret and recovery codes should not be stored in plain text: %s", data.String())
+	}
+
+	// a code and a recovery code can only be used once
+	code, _ := totp.Code(secret, now)
+	for _, test := range []struct {
+		code     string
+		valid    bool
+		recovery bool
+	}{
+		{code: code, valid: true},
+		{code: code},
+		{code: strings.ToUpper(codes[3]), valid: true, recovery: true},
+		{code: codes[3]},
+		{code: "000000"},
+	} {
+		enrollment, err := store.get("alice")
+		if err != nil || enrollment == nil {
+			t.Fatalf("Expected the enrollment of alice (err: %v)", err)
+		}
+		valid, recovery, err := store.check("alice", enrollment, test.code, now)
+		if err != nil || valid != test.valid || recovery != test.recovery {
+			t.Errorf("Unexpected check of %q: valid %v, recovery %v (err: %v)", test.code, valid, recovery, err)
+		}
+	}
+	if enrollment, _ := store.get("alice"); len(enrollment.RecoveryCodes) != recoveryCodes-1 {
+		t.Errorf("Expected %d recovery codes, got %d", recoveryCodes-1, len(enrollment.RecoveryCodes))
+	}
+
+	// the secret of alice can't be used for bob
+	enrollment, _ := store.get("alice")
+	if _, _, err := store.check("bob", enrollment, code, now); err == nil {
+		t.Errorf("Expected error decrypting the secret of another user")
+	}
+	if enrollment, err := store.get("bob"); enrollment != nil || err != nil {
+		t.Errorf("Expected no enrollment of bob, got %+v (err: %v)", enrollment, err)
+	}
+	// a user whose enrollment can't be read isn't treated as a user without second factor
+	failing := newMFAStore(&failingStorage{StorageIf: blobStorage, prefix: "pki/mfa/"}, "bucket", "pki/", testMFAKey)
+	if enrollment, err := failing.get("alice"); enrollment != nil || err == nil {
+		t.Errorf("Expected an error reading the enrollment, got %+v (err: %v)", enrollment, err)
+	}
+}
+
+func TestMFALockout(t *testing.T) {
+	_, blobStorage := newTestServer(t)
+	store := newMFAStore(blobStorage, "bucket", "pki/", testMFAKey)
+	secret, _ := totp.GenerateSecret()
+	now := time.Now()
+	if _, err := store.enroll("alice", secret, totp.Step(now)-1, now); err != nil {
+		t.Fatalf("enroll error: %s", err)
+	}
+	for i := 0; i < mfaMaxFailures; i++ {
+		enrollment, _ := store.get("alice")
+		if valid, _, err := store.check("alice", enrollment, "000000", now); valid || err != nil {
+			t.Fatalf("Unexpected check of an invalid code: valid %v (err: %v)", valid, err)
+		}
+	}
+	code, _ := totp.Code(secret, now)
+	enrollment, _ := store.get("alice")
+	if _, _, err := store.check("alice", enrollment, code, now); !errors.Is(err, errMFALocked) {
+		t.Errorf("Expected errMFALocked after %d invalid codes, got %v", mfaMaxFailures, err)
+	}
+	later := now.Add(mfaLockout + time.Second)
+	code, _ = totp.Code(secret, later)
+	enrollment, _ = store.get("alice")
+	if valid, _, err := store.check("alice", enrollment, code, later); !valid || err != nil {
+		t.Errorf("Expected a valid code after the lockout: valid %v (err: %v)", valid, err)
+	}
+}
+
+func TestMFACheckConcurrently(t *testing.T) {
+	_, blobStorage := newTestServer(t)
+	store := newMFAStore(blobStorage, "bucket", "pki/", testMFAKey)
+	secret, _ := totp.GenerateSecret()
+	now := time.Now()
+	if _, err := store.enroll("alice", secret, totp.Step(now)-1, now); err != nil {
+		t.Fatalf("enroll error: %s", err)
+	}
+	code, _ := totp.Code(secret, now)
+
+	// the same code is checked by several requests, e.g. on several replicas: it's only accepted once
+	var wg sync.WaitGroup
+	var accepted atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enrollment, err := store.get("alice")
+			if err != nil {
+				t.Errorf("get error: %s", err)
+				return
+			}
+			if valid, _, _ := store.check("alice", enrollment, code, now); valid {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted.Load() != 1 {
+		t.Errorf("Expected the code to be accepted once, got %d", accepted.Load())
+	}
+}
+
+func TestVerifyMFA(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	s.config.MFA.Key = testMFAKey
+	secret, _ := totp.GenerateSecret()
+	now := time.Now()
+	codes, err := s.newMFAStore(blobStorage, "bucket", "pki/").enroll("alice", secret, 0, now)
+	if err != nil {
+		t.Fatalf("enroll error: %s", err)
+	}
+	code, _ := totp.Code(secret, now)
+
+	tests := []struct {
+		request  verify.Request
+		required bool
+		reason   string
+	}{
+		{request: verify.Request{Hook: "user-pass-verify", CommonName: "alice:laptop", Username: "alice"}, reason: "two-factor code is required"},
+		{request: verify.Request{Hook: "user-pass-verify", CommonName: "alice", Username: "alice", Password: code}},
+		{request: verify.Request{Hook: "user-pass-verify", CommonName: "alice", Username: "alice", Password: code}, reason: "invalid two-factor code"},
+		{request: verify.Request{Hook: "user-pass-verify", CommonName: "alice", Username: "alice", Password: codes[0]}},
+		{request: verify.Request{Hook: verify.HookTLSVerify, CommonName: "alice"}},
+		{request: verify.Request{Hook: "user-pass-verify", CommonName: "bob", Username: "bob"}},
+		{request: verify.Request{Hook: "user-pass-verify", CommonName: "bob", Username: "bob"}, required: true, reason: "user didn't set up two-factor authentication"},
+	}
+	for _, test := range tests {
+		s.config.MFA.Required = test.required
+		decision, err := s.verifyMFA(httptest.NewRequest("POST", "/api/servers/vpn1/verify", nil), test.request, now)
+		if err != nil || decision.Allow != (test.reason == "") || decision.Reason != test.reason {
+			t.Errorf("Unexpected decision for %+v: %+v (err: %v)", test.request, decision, err)
+		}
+	}
+
+	s.auditLogger.Flush()
+	events, err := s.auditLogger.Query(audit.Query{Type: audit.MFARecoveryUsed})
+	if err != nil || len(events) != 1 || events[0].Actor != "alice" || events[0].Details["left"] != "9" {
+		t.Errorf("Expected the recovery code in the audit log, got %+v (err: %v)", events, err)
+	}
+}
+
+func TestMFAProfile(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	blobStorage.PutObject("bucket", "pki/ta.key", "ta", "")
+	blobStorage.PutObject("bucket", "pki/openvpn-client.conf", "client\n<tls-auth>\n[TLS-AUTH]\n</tls-auth>\n", "")
+	issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+	blobStorage.PutObject("bucket", "pki/mfa/alice.json", "{}", "")
+
+	for _, enabled := range []bool{false, true} {
+		s.config.MFA.Key = ""
+		if enabled {
+			s.config.MFA.Key = testMFAKey
+		}
+		p := s.newPKI(blobStorage, "bucket", "pki/")
+		clientCert, clientKey, err := p.getClientCert("client-alice-2024")
+		if err != nil {
+			t.Fatalf("getClientCert error: %s", err)
+		}
+		ovpnConfig, err := p.clientConfig(clientCert, clientKey)
+		if err != nil {
+			t.Fatalf("clientConfig error: %s", err)
+		}
+		if strings.Contains(ovpnConfig, "auth-user-pass\n") != enabled {
+			t.Errorf("Unexpected config with mfa enabled %v: %s", enabled, ovpnConfig)
+		}
+		if withAuthUserPass(ovpnConfig) != withAuthUserPass(withAuthUserPass(ovpnConfig)) {
+			t.Errorf("auth-user-pass should only be added once")
+		}
+	}
+
+	s.config.MFA.Required = true
+	if p := s.newPKI(blobStorage, "bucket", "pki/"); s.mfaMissing(p, "alice") || !s.mfaMissing(p, "bob") {
+		t.Errorf("Expected only bob to miss two-factor authentication")
+	}
+}
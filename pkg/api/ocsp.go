@@ -0,0 +1,429 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/logging"
+	"github.com/in4it/openvpn-access/pkg/metrics"
+	"github.com/in4it/openvpn-access/pkg/storage"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspCacheTTL is how long an OCSP response is cached, it's also the next update of the response
+	ocspCacheTTL = 5 * time.Minute
+	// ocspCacheMaxEntries is the number of cached responses after which expired responses are removed
+	ocspCacheMaxEntries = 10000
+	// ocspMaxRequestSize is the maximum size of an OCSP request
+	ocspMaxRequestSize = 10 * 1024
+)
+
+// errUnknownIssuer is returned for OCSP requests for certificates that are not issued by the CA
+var errUnknownIssuer = errors.New("unknown issuer")
+
+// ocspCache caches the signed OCSP responses by certificate id (issuer hashes and serial)
+type ocspCache struct {
+	mu        sync.Mutex
+	responses map[string]ocspCacheEntry
+}
+
+type ocspCacheEntry struct {
+	response []byte
+	status   int
+	expires  time.Time
+}
+
+func newOCSPCache() *ocspCache {
+	return &ocspCache{responses: make(map[string]ocspCacheEntry)}
+}
+
+func (c *ocspCache) get(key string, now time.Time) (ocspCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.responses[key]
+	if !ok || now.After(entry.expires) {
+		return entry, false
+	}
+	return entry, true
+}
+
+func (c *ocspCache) put(key string, entry ocspCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.responses) >= ocspCacheMaxEntries {
+		for k, entry := range c.responses {
+			if time.Now().After(entry.expires) {
+				delete(c.responses, k)
+			}
+		}
+	}
+	c.responses[key] = entry
+}
+
+// invalidate removes the cached responses for the certificate with the serial, e.g. after it's revoked
+func (c *ocspCache) invalidate(serial *big.Int) {
+	if c == nil {
+		return
+	}
+	suffix := fmt.Sprintf(":%X", serial)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.responses {
+		if strings.HasSuffix(key, suffix) {
+			delete(c.responses, key)
+		}
+	}
+}
+
+// ocspCacheKey returns the certificate id of the request
+func ocspCacheKey(req *ocsp.Request) string {
+	return fmt.Sprintf("%d:%s:%s:%X", req.HashAlgorithm, hex.EncodeToString(req.IssuerNameHash), hex.EncodeToString(req.IssuerKeyHash), req.SerialNumber)
+}
+
+// serialIndex is the record in issued_by_serial/<serial>.json, the name of the certificate in issued/ with the serial
+type serialIndex struct {
+	Serial string `json:"serial"`
+	Name   string `json:"name"`
+}
+
+// indexSerial records the name of the certificate in issued_by_serial/, so the OCSP responder finds it without listing issued/
+func (p *pki) indexSerial(name string, cert *x509.Certificate) error {
+	serial := fmt.Sprintf("%X", cert.SerialNumber)
+	record, err := json.Marshal(serialIndex{Serial: serial, Name: name})
+	if err != nil {
+		return err
+	}
+	return p.storage.PutObject(p.bucket, p.prefix+"issued_by_serial/"+serial+".json", string(record), p.kmsArn)
+}
+
+// indexSerials adds the certificates in issued/ that are missing in issued_by_serial/, e.g. the certificates issued before
+// the index existed. The number of added certificates is returned.
+func (p *pki) indexSerials(issued []issuedCert) (int, error) {
+	items, err := p.storage.ListObjects(p.bucket, p.prefix+"issued_by_serial/")
+	if err != nil {
+		return 0, err
+	}
+	indexed := make(map[string]bool, len(items))
+	for _, item := range items {
+		indexed[item] = true
+	}
+	count := 0
+	for _, issuedCert := range issued {
+		if indexed[p.prefix+"issued_by_serial/"+fmt.Sprintf("%X", issuedCert.Cert.SerialNumber)+".json"] {
+			continue
+		}
+		if err := p.indexSerial(issuedCert.Name, issuedCert.Cert); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// lookupSerial returns the certificate in issued/ with the serial, or ErrNotExist when there's none
+func (p *pki) lookupSerial(serial *big.Int) (*x509.Certificate, error) {
+	serialHex := fmt.Sprintf("%X", serial)
+	data, err := p.storage.GetObject(p.bucket, p.prefix+"issued_by_serial/"+serialHex+".json")
+	if err != nil {
+		return nil, err
+	}
+	var record serialIndex
+	if err := json.Unmarshal(data.Bytes(), &record); err != nil {
+		return nil, fmt.Errorf("could not parse serial index %s: %s", serialHex, err)
+	}
+	certPem, err := p.storage.GetObject(p.bucket, p.prefix+"issued/"+record.Name+".crt")
+	if err != nil {
+		return nil, err
+	}
+	cert, err := NewCert().readCert(certPem.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", record.Name, err)
+	}
+	// the certificate was renewed, the index of the previous serial is left behind
+	if cert.SerialNumber.Cmp(serial) != 0 {
+		return nil, fmt.Errorf("serial %s: %w", serialHex, storage.ErrNotExist)
+	}
+	return cert, nil
+}
+
+// ocspIssuer is a CA the responder answers for, with the certificate and key that sign the responses: the CA itself or
+// a delegated OCSP signer
+type ocspIssuer struct {
+	cert      *x509.Certificate
+	responder *x509.Certificate
+	key       interface{}
+}
+
+// matches returns true when the request is for a certificate issued by the CA
+func (i ocspIssuer) matches(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(i.cert.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return false
+	}
+	h := req.HashAlgorithm.New()
+	h.Write(publicKeyInfo.PublicKey.RightAlign())
+	if !bytes.Equal(h.Sum(nil), req.IssuerKeyHash) {
+		return false
+	}
+	h.Reset()
+	h.Write(i.cert.RawSubject)
+	return bytes.Equal(h.Sum(nil), req.IssuerNameHash)
+}
+
+// loadOCSPSigner returns the delegated OCSP signer (ocsp.crt and private/ocsp.key)
+func (p *pki) loadOCSPSigner() (*x509.Certificate, interface{}, error) {
+	certPem, err := p.storage.GetObject(p.bucket, p.prefix+"ocsp.crt")
+	if err != nil {
+		return nil, nil, fmt.Errorf("ocsp.crt download error: %s", err)
+	}
+	keyPem, err := p.storage.GetObject(p.bucket, p.prefix+"private/ocsp.key")
+	if err != nil {
+		return nil, nil, fmt.Errorf("ocsp.key download error: %s", err)
+	}
+	cert, err := NewCert().readCert(certPem.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Parsed OCSP signer cert Error: %s", err)
+	}
+	key, err := NewCert().readPrivateKey(keyPem.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Parsed OCSP signer key Error: %s", err)
+	}
+	return cert, key, nil
+}
+
+// issueOCSPSigner issues a delegated OCSP signer, stored as ocsp.crt and private/ocsp.key
+func (p *pki) issueOCSPSigner(ctx context.Context) (*x509.Certificate, error) {
+	caCert, caKey, err := p.loadCA()
+	if err != nil {
+		return nil, err
+	}
+	signerCert, signerKey, err := NewCert().createOCSPSignerCert(ctx, caCert, caKey, caCert.Subject.CommonName+" OCSP Signer")
+	if err != nil {
+		return nil, fmt.Errorf("Create Cert error: %s", err)
+	}
+	if err := p.storage.PutObject(p.bucket, p.prefix+"private/ocsp.key", signerKey.String(), p.kmsArn); err != nil {
+		return nil, fmt.Errorf("Blob Storage Put error: %s", err)
+	}
+	if err := p.storage.PutObject(p.bucket, p.prefix+"ocsp.crt", signerCert.String(), p.kmsArn); err != nil {
+		return nil, fmt.Errorf("Blob Storage Put error: %s", err)
+	}
+	return NewCert().readCert(signerCert.String())
+}
+
+// ocspIssuers returns the CA, and the previous CA during the overlap window of a CA rotation. The responses for the CA
+// are signed by the delegated OCSP signer when it's issued by the CA and valid, otherwise by the CA.
+func (p *pki) ocspIssuers(now time.Time) ([]ocspIssuer, error) {
+	caCert, caKey, err := p.loadCA()
+	if err != nil {
+		return nil, err
+	}
+	issuer := ocspIssuer{cert: caCert, responder: caCert, key: caKey}
+	if p.storage.HeadObject(p.bucket, p.prefix+"ocsp.crt") == nil {
+		signerCert, signerKey, err := p.loadOCSPSigner()
+		if err != nil {
+			return nil, err
+		}
+		if signerCert.CheckSignatureFrom(caCert) == nil && now.After(signerCert.NotBefore) && now.Before(signerCert.NotAfter) {
+			issuer.responder, issuer.key = signerCert, signerKey
+		}
+	}
+	issuers := []ocspIssuer{issuer}
+	rotation, err := p.loadRotation()
+	if err != nil {
+		return nil, err
+	}
+	if rotation.active(now) {
+		previousCert, previousKey, err := p.loadPreviousCA(rotation)
+		if err != nil {
+			return nil, err
+		}
+		issuers = append(issuers, ocspIssuer{cert: previousCert, responder: previousCert, key: previousKey})
+	}
+	return issuers, nil
+}
+
+// ocspStatus returns the status of the certificate with the serial, when it's issued by the issuer: revoked when it's
+// in the revocation index, good when it's in issued/ (found with issued_by_serial/), unknown otherwise
+func (p *pki) ocspStatus(issuer *x509.Certificate, serial *big.Int) (ocsp.Response, error) {
+	status := ocsp.Response{Status: ocsp.Unknown, SerialNumber: serial}
+	serialHex := fmt.Sprintf("%X", serial)
+	if p.storage.HeadObject(p.bucket, p.prefix+"revoked/index/"+serialHex+".json") == nil {
+		data, err := p.storage.GetObject(p.bucket, p.prefix+"revoked/index/"+serialHex+".json")
+		if err != nil {
+			return status, err
+		}
+		var record revocation
+		if err := json.Unmarshal(data.Bytes(), &record); err != nil {
+			return status, fmt.Errorf("could not parse revocation %s: %s", serialHex, err)
+		}
+		certPem, err := p.storage.GetObject(p.bucket, p.prefix+"revoked/certs_by_serial/"+serialHex+".crt")
+		if err != nil {
+			return status, err
+		}
+		revokedCert, err := NewCert().readCert(certPem.String())
+		if err != nil || revokedCert.CheckSignatureFrom(issuer) != nil {
+			return status, nil
+		}
+		status.Status = ocsp.Revoked
+		status.RevokedAt = record.RevokedAt
+		status.RevocationReason = ocspRevocationReason(record.Reason)
+		return status, nil
+	}
+	issuedCert, err := p.lookupSerial(serial)
+	if errors.Is(err, storage.ErrNotExist) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	if issuedCert.CheckSignatureFrom(issuer) == nil {
+		status.Status = ocsp.Good
+	}
+	return status, nil
+}
+
+// ocspRevocationReason maps the reason in the revocation index to the CRL reason code
+func ocspRevocationReason(reason string) int {
+	switch {
+	case reason == "superseded":
+		return ocsp.Superseded
+	case reason == "deprovisioned":
+		return ocsp.CessationOfOperation
+	case strings.Contains(strings.ToLower(reason), "compromise"):
+		return ocsp.KeyCompromise
+	}
+	return ocsp.Unspecified
+}
+
+// ocspResponse returns the signed response to the request
+func (p *pki) ocspResponse(req *ocsp.Request, now time.Time) ([]byte, int, error) {
+	issuers, err := p.ocspIssuers(now)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, issuer := range issuers {
+		if !issuer.matches(req) {
+			continue
+		}
+		template, err := p.ocspStatus(issuer.cert, req.SerialNumber)
+		if err != nil {
+			return nil, 0, err
+		}
+		signer, ok := issuer.key.(crypto.Signer)
+		if !ok {
+			return nil, 0, errors.New("OCSP signer key can't be used to sign")
+		}
+		template.IssuerHash = req.HashAlgorithm
+		template.ThisUpdate = now
+		template.NextUpdate = now.Add(ocspCacheTTL)
+		if issuer.responder != issuer.cert {
+			template.Certificate = issuer.responder
+		}
+		response, err := ocsp.CreateResponse(issuer.cert, issuer.responder, template, signer)
+		return response, template.Status, err
+	}
+	return nil, 0, errUnknownIssuer
+}
+
+func (s *server) ocspRoutes(r *mux.Router, prefix string) {
+	r.HandleFunc(prefix+"/ocsp", s.ocspHandler).Methods("POST")
+	r.PathPrefix(prefix + "/ocsp/").HandlerFunc(s.ocspHandler).Methods("GET")
+}
+
+// ocspHandler answers OCSP requests (RFC 6960), posted as application/ocsp-request or base64 encoded in the url (GET)
+func (s *server) ocspHandler(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	var err error
+	if r.Method == http.MethodGet {
+		var encoded string
+		encoded, err = url.PathUnescape(r.URL.EscapedPath()[strings.LastIndex(r.URL.EscapedPath(), "/ocsp/")+len("/ocsp/"):])
+		if err == nil {
+			body, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	} else {
+		body, err = io.ReadAll(io.LimitReader(r.Body, ocspMaxRequestSize))
+	}
+	var req *ocsp.Request
+	if err == nil {
+		req, err = ocsp.ParseRequest(body)
+	}
+	if err != nil {
+		metrics.OCSPResponses.WithLabelValues("malformed", "miss").Inc()
+		writeOCSPResponse(w, ocsp.MalformedRequestErrorResponse, 0)
+		return
+	}
+
+	now := time.Now()
+	key := ocspCacheKey(req)
+	if entry, ok := s.ocspCache.get(key, now); ok {
+		metrics.OCSPResponses.WithLabelValues(ocspStatusLabel(entry.status), "hit").Inc()
+		writeOCSPResponse(w, entry.response, ocspCacheTTL)
+		return
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Could not create session", "error", err)
+		writeOCSPResponse(w, ocsp.InternalErrorErrorResponse, 0)
+		return
+	}
+	response, status, err := s.newPKI(blobStorage, storageBucket, storagePrefix).ocspResponse(req, now)
+	if errors.Is(err, errUnknownIssuer) {
+		metrics.OCSPResponses.WithLabelValues("unauthorized", "miss").Inc()
+		writeOCSPResponse(w, ocsp.UnauthorizedErrorResponse, 0)
+		return
+	}
+	if err != nil {
+		metrics.OCSPResponses.WithLabelValues("error", "miss").Inc()
+		logging.FromContext(r.Context()).Error("Could not create OCSP response", "serial", fmt.Sprintf("%X", req.SerialNumber), "error", err)
+		writeOCSPResponse(w, ocsp.InternalErrorErrorResponse, 0)
+		return
+	}
+	s.ocspCache.put(key, ocspCacheEntry{response: response, status: status, expires: now.Add(ocspCacheTTL)})
+	metrics.OCSPResponses.WithLabelValues(ocspStatusLabel(status), "miss").Inc()
+	writeOCSPResponse(w, response, ocspCacheTTL)
+}
+
+func ocspStatusLabel(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// writeOCSPResponse writes the response, cacheable for maxAge
+func writeOCSPResponse(w http.ResponseWriter, response []byte, maxAge time.Duration) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", int(maxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	w.Write(response)
+}
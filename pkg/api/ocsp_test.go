@@ -0,0 +1,161 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ocsp"
+)
+
+func ocspRequestRecorder(t *testing.T, router *mux.Router, cert, issuer *x509.Certificate, get bool) *httptest.ResponseRecorder {
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		t.Fatalf("CreateRequest error: %s", err)
+	}
+	req := httptest.NewRequest("POST", "/ocsp", bytes.NewReader(request))
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	if get {
+		req = httptest.NewRequest("GET", "/ocsp/"+url.PathEscape(base64.StdEncoding.EncodeToString(request)), nil)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/ocsp-response" {
+		t.Fatalf("Unexpected response %d: %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	return rr
+}
+
+func TestOCSPHandler(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	router := mux.NewRouter()
+	s.ocspRoutes(router, "")
+	parsedCaCert, _ := NewCert().readCert(caCert)
+	alice := issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+
+	for _, get := range []bool{false, true} {
+		rr := ocspRequestRecorder(t, router, alice, parsedCaCert, get)
+		response, err := ocsp.ParseResponseForCert(rr.Body.Bytes(), alice, parsedCaCert)
+		if err != nil {
+			t.Fatalf("ParseResponse error: %s", err)
+		}
+		if response.Status != ocsp.Good || response.Certificate != nil || response.NextUpdate.Sub(response.ThisUpdate) != ocspCacheTTL {
+			t.Errorf("Unexpected response (get: %v): %+v", get, response)
+		}
+	}
+
+	// the cached response is removed when the certificate is revoked
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+	if _, err := p.revokeLogin("alice", "deprovisioned"); err != nil {
+		t.Fatalf("revokeLogin error: %s", err)
+	}
+	rr := ocspRequestRecorder(t, router, alice, parsedCaCert, false)
+	response, err := ocsp.ParseResponse(rr.Body.Bytes(), parsedCaCert)
+	if err != nil || response.Status != ocsp.Revoked || response.RevocationReason != ocsp.CessationOfOperation {
+		t.Errorf("Expected revoked, got %+v (err: %v)", response, err)
+	}
+
+	// a certificate signed by the CA that's not in the storage backend
+	parsedCaKey, _ := NewCert().readPrivateKey(caKey)
+	unknownPem, _, _ := NewCert().createClientCert(context.Background(), parsedCaCert, parsedCaKey, "mallory", "")
+	unknown, _ := NewCert().readCert(unknownPem.String())
+	rr = ocspRequestRecorder(t, router, unknown, parsedCaCert, false)
+	if response, err := ocsp.ParseResponse(rr.Body.Bytes(), parsedCaCert); err != nil || response.Status != ocsp.Unknown {
+		t.Errorf("Expected unknown, got %+v (err: %v)", response, err)
+	}
+
+	// a certificate of another CA
+	otherCA, otherKey := shortLivedCA(t, "Other CA", time.Hour)
+	otherCaCert, _ := NewCert().readCert(otherCA)
+	otherCaKey, _ := NewCert().readPrivateKey(otherKey)
+	otherPem, _, _ := NewCert().createClientCert(context.Background(), otherCaCert, otherCaKey, "alice", "")
+	other, _ := NewCert().readCert(otherPem.String())
+	rr = ocspRequestRecorder(t, router, other, otherCaCert, false)
+	if !bytes.Equal(rr.Body.Bytes(), ocsp.UnauthorizedErrorResponse) {
+		t.Errorf("Expected unauthorized, got %x", rr.Body.Bytes())
+	}
+
+	req := httptest.NewRequest("POST", "/ocsp", bytes.NewReader([]byte("not a request")))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if !bytes.Equal(rr.Body.Bytes(), ocsp.MalformedRequestErrorResponse) {
+		t.Errorf("Expected malformed, got %x", rr.Body.Bytes())
+	}
+}
+
+func TestOCSPDelegatedSigner(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	router := mux.NewRouter()
+	s.ocspRoutes(router, "")
+	parsedCaCert, _ := NewCert().readCert(caCert)
+	bob := issueTestCert(t, blobStorage, "bob", "client-bob-2024")
+
+	signer, err := s.newPKI(blobStorage, "bucket", "pki/").issueOCSPSigner(context.Background())
+	if err != nil {
+		t.Fatalf("issueOCSPSigner error: %s", err)
+	}
+	rr := ocspRequestRecorder(t, router, bob, parsedCaCert, false)
+	response, err := ocsp.ParseResponseForCert(rr.Body.Bytes(), bob, parsedCaCert)
+	if err != nil {
+		t.Fatalf("ParseResponse error: %s", err)
+	}
+	if response.Status != ocsp.Good || response.Certificate == nil || !response.Certificate.Equal(signer) {
+		t.Errorf("Expected a response signed by the delegated signer, got %+v", response)
+	}
+	noCheck := false
+	for _, extension := range signer.Extensions {
+		noCheck = noCheck || extension.Id.Equal(oidOCSPNoCheck)
+	}
+	if len(signer.ExtKeyUsage) != 1 || signer.ExtKeyUsage[0] != x509.ExtKeyUsageOCSPSigning || !noCheck {
+		t.Errorf("Unexpected OCSP signer: %v", signer.ExtKeyUsage)
+	}
+}
+
+func TestOCSPLookupSerial(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	parsedCaCert, _ := NewCert().readCert(caCert)
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+	alice := issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+
+	// the certificates in issued/ are only found through the serial index
+	bob := issueTestCert(t, blobStorage, "bob", "client-bob-2024")
+	blobStorage.DeleteObject("bucket", "pki/issued_by_serial/"+fmt.Sprintf("%X", bob.SerialNumber)+".json")
+	if status, err := p.ocspStatus(parsedCaCert, bob.SerialNumber); err != nil || status.Status != ocsp.Unknown {
+		t.Errorf("Expected unknown without an index, got %+v (err: %v)", status, err)
+	}
+	issued, err := p.listIssued()
+	if err != nil {
+		t.Fatalf("listIssued error: %s", err)
+	}
+	if count, err := p.indexSerials(issued); err != nil || count != 1 {
+		t.Fatalf("Expected 1 indexed certificate, got %d (err: %v)", count, err)
+	}
+	if status, err := p.ocspStatus(parsedCaCert, bob.SerialNumber); err != nil || status.Status != ocsp.Good {
+		t.Errorf("Expected good after indexing, got %+v (err: %v)", status, err)
+	}
+
+	// the serial of a renewed certificate isn't good anymore
+	renewed := issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+	if status, err := p.ocspStatus(parsedCaCert, alice.SerialNumber); err != nil || status.Status != ocsp.Unknown {
+		t.Errorf("Expected unknown for the renewed serial, got %+v (err: %v)", status, err)
+	}
+	if status, err := p.ocspStatus(parsedCaCert, renewed.SerialNumber); err != nil || status.Status != ocsp.Good {
+		t.Errorf("Expected good for the new serial, got %+v (err: %v)", status, err)
+	}
+
+	// the index is removed on revocation
+	if _, err := p.revokeLogin("bob", "deprovisioned"); err != nil {
+		t.Fatalf("revokeLogin error: %s", err)
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/issued_by_serial/"+fmt.Sprintf("%X", bob.SerialNumber)+".json"); err == nil {
+		t.Errorf("Expected the serial index to be removed on revocation")
+	}
+}
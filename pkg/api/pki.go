@@ -0,0 +1,701 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+// crlValidity is how long a generated CRL stays valid (same default as easy-rsa)
+const crlValidity = 180 * 24 * time.Hour
+
+// pki manages the easy-rsa compatible layout of certificates in the storage backend
+type pki struct {
+	storage storage.StorageIf
+	bucket  string
+	prefix  string
+	kmsArn  string
+	// clientOrganization is the organization in the subject of issued client certificates
+	clientOrganization string
+	// mfa adds auth-user-pass to the profiles of the users that enrolled a second factor
+	mfa bool
+	// caCache keeps the parsed CA between requests, nil to parse it every time
+	caCache *caCache
+	// ocspCache is invalidated for the revoked certificates, nil when there's no OCSP responder
+	ocspCache *ocspCache
+}
+
+type issuedCert struct {
+	Name string
+	Cert *x509.Certificate
+}
+
+type revocation struct {
+	Serial     string    `json:"serial"`
+	CommonName string    `json:"commonName"`
+	RevokedAt  time.Time `json:"revokedAt"`
+	Reason     string    `json:"reason"`
+}
+
+func newPKI(blobStorage storage.StorageIf, bucket, prefix string) *pki {
+	return &pki{
+		storage: blobStorage,
+		bucket:  bucket,
+		prefix:  prefix,
+	}
+}
+
+// newPKI returns the pki in the storage backend, with the kms key and certificate settings of the configuration
+func (s *server) newPKI(blobStorage storage.StorageIf, bucket, prefix string) *pki {
+	p := newPKI(blobStorage, bucket, prefix)
+	p.kmsArn = s.config.Storage.S3.KMSArn
+	p.clientOrganization = s.config.Cert.ClientOrganization
+	p.mfa = s.mfaEnabled()
+	p.caCache = s.caCache
+	p.ocspCache = s.ocspCache
+	return p
+}
+
+// errServerCert is returned when a client certificate is requested or issued with the name or login of an openvpn server
+var errServerCert = errors.New("the names and logins starting with server- are reserved for the certificates of openvpn servers")
+
+// getClientCert returns the certificate and key stored as issued/<name>.crt and private/<name>.key, or errIncompleteCert
+// (see getCertAndKey). The certificates of the openvpn servers are stored next to them, these are refused with errServerCert.
+func (p *pki) getClientCert(name string) (bytes.Buffer, bytes.Buffer, error) {
+	clientCert, clientKey, err := p.getCertAndKey(name)
+	if err != nil && !errors.Is(err, errIncompleteCert) {
+		return clientCert, clientKey, err
+	}
+	parsedCert, parseErr := NewCert().readCert(clientCert.String())
+	if parseErr != nil {
+		return clientCert, clientKey, parseErr
+	}
+	if isServerCert(parsedCert) {
+		return bytes.Buffer{}, bytes.Buffer{}, fmt.Errorf("%s: %w", name, errServerCert)
+	}
+	return clientCert, clientKey, err
+}
+
+// errIncompleteCert is returned when the key in private/ doesn't belong to the certificate in issued/: the certificate is
+// being renewed (the key is written first) or the key is missing
+var errIncompleteCert = errors.New("the key doesn't belong to the certificate")
+
+/*
+ * getCertAndKey returns the certificate and key stored as issued/<name>.crt and private/<name>.key. When the key is
+ * missing or doesn't belong to the certificate, errIncompleteCert is returned with the certificate.
+ */
+func (p *pki) getCertAndKey(name string) (bytes.Buffer, bytes.Buffer, error) {
+	var clientCert, clientKey bytes.Buffer
+	err := p.storage.HeadObject(p.bucket, p.prefix+"issued/"+name+".crt")
+	if err != nil {
+		return clientCert, clientKey, err
+	}
+	clientCert, err = p.storage.GetObject(p.bucket, p.prefix+"issued/"+name+".crt")
+	if err != nil {
+		return clientCert, clientKey, err
+	}
+	clientKey, err = p.storage.GetObject(p.bucket, p.prefix+"private/"+name+".key")
+	if errors.Is(err, storage.ErrNotExist) {
+		return clientCert, bytes.Buffer{}, fmt.Errorf("key of %s is missing: %w", name, errIncompleteCert)
+	}
+	if err != nil {
+		return clientCert, clientKey, err
+	}
+	if clientCert.Len() == 0 || clientKey.Len() == 0 {
+		return clientCert, clientKey, fmt.Errorf("certificate or key of %s is empty", name)
+	}
+	parsedCert, err := NewCert().readCert(clientCert.String())
+	if err != nil {
+		return clientCert, clientKey, fmt.Errorf("could not parse %s: %s", name, err)
+	}
+	parsedKey, err := NewCert().readPrivateKey(clientKey.String())
+	if err != nil {
+		return clientCert, clientKey, fmt.Errorf("could not parse the key of %s: %s", name, err)
+	}
+	if publicKey, ok := parsedCert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(NewCert().publicKey(parsedKey)) {
+		return clientCert, bytes.Buffer{}, fmt.Errorf("%s: %w", name, errIncompleteCert)
+	}
+	return clientCert, clientKey, nil
+}
+
+/*
+ * readClientCert returns the certificate and key with getClientCert. A reader that doesn't hold the lock can read the
+ * previous certificate with the key of a renewal that's in progress, the pair is read again while holding the lock of
+ * the login, when no renewal is in progress. errIncompleteCert is still returned when the pair was left behind
+ * incomplete, e.g. by a crash: renew the certificate.
+ */
+func (p *pki) readClientCert(ctx context.Context, name string) (bytes.Buffer, bytes.Buffer, error) {
+	clientCert, clientKey, err := p.getClientCert(name)
+	if !errors.Is(err, errIncompleteCert) {
+		return clientCert, clientKey, err
+	}
+	parsedCert, parseErr := NewCert().readCert(clientCert.String())
+	if parseErr != nil {
+		return clientCert, clientKey, err
+	}
+	login, _ := splitCommonName(parsedCert.Subject.CommonName)
+	lock, err := p.lockLogin(ctx, login)
+	if err != nil {
+		return bytes.Buffer{}, bytes.Buffer{}, err
+	}
+	defer lock.Release(context.WithoutCancel(ctx))
+	return p.getClientCert(name)
+}
+
+// errConcurrentIssue is returned when the certificate was issued or renewed by another request at the same time, e.g. on
+// another replica
+var errConcurrentIssue = errors.New("the certificate is being issued by another request, try again")
+
+// issueClientCert creates a new client certificate signed by the CA and writes it to issued/<name>.crt and private/<name>.key
+// with writeCertAndKey. Callers hold the lock of the login (lockLogin). Common names and names starting with server- are
+// refused with errServerCert.
+func (p *pki) issueClientCert(ctx context.Context, commonName, name, ifMatch string) (bytes.Buffer, bytes.Buffer, error) {
+	var clientCert, clientKey bytes.Buffer
+	if strings.HasPrefix(commonName, "server-") || strings.HasPrefix(name, "server-") {
+		return clientCert, clientKey, errServerCert
+	}
+	parsedCaCert, parsedCaKey, err := p.loadCA()
+	if err != nil {
+		return clientCert, clientKey, err
+	}
+	clientCert, clientKey, err = NewCert().createClientCert(ctx, parsedCaCert, parsedCaKey, commonName, p.clientOrganization)
+	if err != nil {
+		return clientCert, clientKey, fmt.Errorf("Create Cert error: %s", err)
+	}
+	if err := p.writeCertAndKey(ctx, name, clientCert, clientKey, ifMatch); err != nil {
+		return clientCert, clientKey, err
+	}
+	return clientCert, clientKey, nil
+}
+
+/*
+ * writeCertAndKey writes the certificate to issued/<name>.crt and its key to private/<name>.key, and indexes the serial.
+ * The key is written first: until the certificate is written, a renewal leaves the previous certificate with the new
+ * key, which getCertAndKey reports as errIncompleteCert (readers without the lock read it again with readClientCert).
+ * The certificate is only written when issued/<name>.crt doesn't exist, or still has the ETag ifMatch when a certificate
+ * is renewed, otherwise errConcurrentIssue is returned and the previous key is restored. Callers hold the lock of the
+ * certificate (lockLogin), so the key of another request isn't overwritten. The certificate is indexed by login before
+ * it's written, and by serial afterwards.
+ */
+func (p *pki) writeCertAndKey(ctx context.Context, name string, cert, key bytes.Buffer, ifMatch string) error {
+	parsedCert, err := NewCert().readCert(cert.String())
+	if err != nil {
+		return err
+	}
+	// the login is indexed first, the entry of a certificate that isn't written is skipped by listIssuedForLogin
+	if err := p.indexLogin(name, parsedCert); err != nil {
+		return fmt.Errorf("Blob Storage Put error: %s", err)
+	}
+	objects := storage.Objects(p.storage)
+	// a certificate that was issued or renewed in the meantime fails before the key is replaced
+	current, err := objects.Head(ctx, p.bucket, p.prefix+"issued/"+name+".crt")
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return fmt.Errorf("Blob Storage Head error: %s", err)
+	}
+	if exists := err == nil; (ifMatch == "" && exists) || (ifMatch != "" && (!exists || current.ETag != ifMatch)) {
+		return errConcurrentIssue
+	}
+	previousKey, err := p.storage.GetObject(p.bucket, p.prefix+"private/"+name+".key")
+	keyExists := err == nil
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return fmt.Errorf("Blob Storage Get error: %s", err)
+	}
+	_, err = objects.Put(ctx, p.bucket, p.prefix+"private/"+name+".key", bytes.NewReader(key.Bytes()), storage.PutOptions{
+		ContentType: "application/x-pem-file",
+		KMSArn:      p.kmsArn,
+	})
+	if err != nil {
+		return fmt.Errorf("Blob Storage Put error: %s", err)
+	}
+	_, err = objects.Put(ctx, p.bucket, p.prefix+"issued/"+name+".crt", bytes.NewReader(cert.Bytes()), storage.PutOptions{
+		ContentType: "application/x-pem-file",
+		KMSArn:      p.kmsArn,
+		IfNoneMatch: ifMatch == "",
+		IfMatch:     ifMatch,
+	})
+	if err != nil {
+		// the certificate in issued/ still belongs to the previous key
+		var rollbackErr error
+		if keyExists {
+			rollbackErr = p.storage.PutObject(p.bucket, p.prefix+"private/"+name+".key", previousKey.String(), p.kmsArn)
+		} else {
+			rollbackErr = p.storage.DeleteObject(p.bucket, p.prefix+"private/"+name+".key")
+		}
+		if rollbackErr != nil {
+			return fmt.Errorf("Blob Storage Put error: %s (restoring the key of %s failed: %s)", err, name, rollbackErr)
+		}
+	}
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		return errConcurrentIssue
+	}
+	if err != nil {
+		return fmt.Errorf("Blob Storage Put error: %s", err)
+	}
+	// the certificate is issued, a missing index is added by the next refresh of the certificate metrics
+	if err := p.indexSerial(name, parsedCert); err != nil {
+		slog.Error("Could not index the serial of the certificate", "name", name, "error", err)
+	}
+	return nil
+}
+
+// issueLockTTL is the lease of the lock of a login while its certificate is issued, and how long a request waits for it
+const issueLockTTL = 30 * time.Second
+
+// lockLogin acquires the lock of the login in locks/<login>.json, server certificates are locked with their name
+// (server-<name>). errConcurrentIssue is returned when the lock is held by another request for longer than issueLockTTL.
+func (p *pki) lockLogin(ctx context.Context, login string) (*storage.Lock, error) {
+	ctx, cancel := context.WithTimeout(ctx, issueLockTTL)
+	defer cancel()
+	lock, err := storage.AcquireLock(ctx, p.storage, p.bucket, p.prefix+"locks/"+login+".json", issueLockTTL)
+	if errors.Is(err, storage.ErrLocked) {
+		return nil, errConcurrentIssue
+	}
+	return lock, err
+}
+
+// issueLocked issues the certificate with issueClientCert while holding the lock of the login
+func (p *pki) issueLocked(ctx context.Context, login, commonName, name, ifMatch string) (bytes.Buffer, bytes.Buffer, error) {
+	lock, err := p.lockLogin(ctx, login)
+	if err != nil {
+		return bytes.Buffer{}, bytes.Buffer{}, err
+	}
+	defer lock.Release(context.WithoutCancel(ctx))
+	return p.issueClientCert(ctx, commonName, name, ifMatch)
+}
+
+// ensureClientCert returns the certificate issued/<name>.crt of the login, and issues it when it doesn't exist or is signed
+// by the previous CA (the superseded certificate is revoked and returned). The certificate is issued while holding the lock
+// of the login and read again once the lock is acquired, so concurrent requests, e.g. on several replicas, issue it once
+// and all return the same certificate and key.
+func (p *pki) ensureClientCert(ctx context.Context, login, name string) (clientCert, clientKey bytes.Buffer, superseded *issuedCert, issued bool, err error) {
+	clientCert, clientKey, err = p.getClientCert(name)
+	if errors.Is(err, errServerCert) {
+		return clientCert, clientKey, nil, false, err
+	}
+	if err == nil {
+		parsedCert, err := NewCert().readCert(clientCert.String())
+		if err != nil {
+			return clientCert, clientKey, nil, false, err
+		}
+		if current, err := p.signedByCurrentCA(parsedCert); err != nil || current {
+			return clientCert, clientKey, nil, false, err
+		}
+	}
+	lock, err := p.lockLogin(ctx, login)
+	if err != nil {
+		return clientCert, clientKey, nil, false, err
+	}
+	defer lock.Release(context.WithoutCancel(ctx))
+	clientCert, clientKey, err = p.getClientCert(name)
+	ifMatch := ""
+	switch {
+	case errors.Is(err, errIncompleteCert):
+		// the certificate was left without its key, e.g. by a crash during a renewal: issue it again
+		if ifMatch, err = p.clientCertETag(ctx, name); err != nil {
+			return clientCert, clientKey, nil, false, err
+		}
+	case errors.Is(err, errServerCert):
+		return clientCert, clientKey, nil, false, err
+	case err == nil:
+		superseded, err = p.supersedeOutdated(name, clientCert)
+		if err != nil || superseded == nil {
+			return clientCert, clientKey, nil, false, err
+		}
+	}
+	clientCert, clientKey, err = p.issueClientCert(ctx, login, name, ifMatch)
+	return clientCert, clientKey, superseded, err == nil, err
+}
+
+// clientCertETag returns the ETag of issued/<name>.crt, to renew the certificate with issueClientCert. Read it before the
+// certificate, so a renewal by another request in between makes the renewal fail instead of overwriting it.
+func (p *pki) clientCertETag(ctx context.Context, name string) (string, error) {
+	info, err := storage.Objects(p.storage).Head(ctx, p.bucket, p.prefix+"issued/"+name+".crt")
+	return info.ETag, err
+}
+
+// clientConfig fills in the openvpn-client.conf template with the client certificate, key, CA and tls-auth key. The
+// intermediate CAs are added to the client certificate, the root CA is the CA of the config. During a CA rotation, the
+// root of the previous CA is added to the CA of the config.
+func (p *pki) clientConfig(clientCert, clientKey bytes.Buffer) (string, error) {
+	chain, err := p.loadCAChain()
+	if err != nil {
+		return "", err
+	}
+	taKey, err := p.storage.GetObject(p.bucket, p.prefix+"ta.key")
+	if err != nil {
+		return "", fmt.Errorf("ta.key download error: %s", err)
+	}
+	ovpnConfig, err := p.storage.GetObject(p.bucket, p.prefix+"openvpn-client.conf")
+	if err != nil {
+		return "", fmt.Errorf("openvpn-client.conf download error: %s", err)
+	}
+	ca, err := p.trustBundle(chain, time.Now())
+	if err != nil {
+		return "", err
+	}
+	strOvpnConfig := ovpnConfig.String()
+	strOvpnConfig = strings.Replace(strOvpnConfig, "[CERT]", clientCert.String()+chain.intermediates(), -1)
+	strOvpnConfig = strings.Replace(strOvpnConfig, "[KEY]", clientKey.String(), -1)
+	strOvpnConfig = strings.Replace(strOvpnConfig, "[CA]", ca, -1)
+	strOvpnConfig = strings.Replace(strOvpnConfig, "[TLS-AUTH]", taKey.String(), -1)
+	parsedCert, err := NewCert().readCert(clientCert.String())
+	if err != nil {
+		return "", fmt.Errorf("Could not parse client certificate: %s", err)
+	}
+	if login, _ := splitCommonName(parsedCert.Subject.CommonName); p.mfaEnrolled(login) {
+		strOvpnConfig = withAuthUserPass(strOvpnConfig)
+	}
+	return strOvpnConfig, nil
+}
+
+// loadCA returns the signing certificate of the CA (the first certificate in ca.crt) and its key
+func (p *pki) loadCA() (*x509.Certificate, interface{}, error) {
+	caKey, err := p.storage.GetObject(p.bucket, p.prefix+"private/ca.key")
+	if err != nil {
+		return nil, nil, fmt.Errorf("ca.key download error: %s", err)
+	}
+	chain, err := p.loadCAChain()
+	if err != nil {
+		return nil, nil, err
+	}
+	parsedCaKey, err := p.caCache.parseKey(caKey.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Parsed CA key Error: %s", err)
+	}
+	if err := chain.matchesKey(parsedCaKey); err != nil {
+		return nil, nil, err
+	}
+	return chain.signer(), parsedCaKey, nil
+}
+
+// listIssued returns all client certificates in issued/
+func (p *pki) listIssued() ([]issuedCert, error) {
+	c := NewCert()
+	issued := []issuedCert{}
+	items, err := p.storage.ListObjects(p.bucket, p.prefix+"issued/")
+	if err != nil {
+		return issued, err
+	}
+	for _, item := range items {
+		if !strings.HasSuffix(item, ".crt") {
+			continue
+		}
+		certPem, err := p.storage.GetObject(p.bucket, item)
+		if err != nil {
+			return issued, err
+		}
+		parsedCert, err := c.readCert(certPem.String())
+		if err != nil {
+			return issued, fmt.Errorf("could not parse %s: %s", item, err)
+		}
+		issued = append(issued, issuedCert{
+			Name: strings.TrimSuffix(strings.TrimPrefix(item, p.prefix+"issued/"), ".crt"),
+			Cert: parsedCert,
+		})
+	}
+	return issued, nil
+}
+
+// loginIndexComplete is written when all certificates in issued/ are in issued_by_login/, until then the certificates of a
+// login are found by listing issued/
+const loginIndexComplete = "issued_by_login.json"
+
+// indexLogin records the name of the certificate in issued_by_login/<login>/<name>, so the certificates of a login are
+// found without listing issued/. Server certificates are indexed with their common name.
+func (p *pki) indexLogin(name string, cert *x509.Certificate) error {
+	login, _ := splitCommonName(cert.Subject.CommonName)
+	return p.storage.PutObject(p.bucket, p.prefix+"issued_by_login/"+login+"/"+name, name, p.kmsArn)
+}
+
+// indexLogins adds the certificates in issued/ that are missing in issued_by_login/, e.g. the certificates issued before
+// the index existed, and marks the index as complete. The number of added certificates is returned.
+func (p *pki) indexLogins(issued []issuedCert) (int, error) {
+	items, err := p.storage.ListObjects(p.bucket, p.prefix+"issued_by_login/")
+	if err != nil {
+		return 0, err
+	}
+	indexed := make(map[string]bool, len(items))
+	for _, item := range items {
+		indexed[item] = true
+	}
+	count := 0
+	for _, issuedCert := range issued {
+		login, _ := splitCommonName(issuedCert.Cert.Subject.CommonName)
+		if indexed[p.prefix+"issued_by_login/"+login+"/"+issuedCert.Name] {
+			continue
+		}
+		if err := p.indexLogin(issuedCert.Name, issuedCert.Cert); err != nil {
+			return count, err
+		}
+		count++
+	}
+	err = p.storage.HeadObject(p.bucket, p.prefix+loginIndexComplete)
+	if errors.Is(err, storage.ErrNotExist) {
+		err = p.storage.PutObject(p.bucket, p.prefix+loginIndexComplete, `{"complete":true}`, p.kmsArn)
+	}
+	return count, err
+}
+
+// listIndexed returns the certificates in issued/ that are indexed for the login, or all certificates in issued/ when
+// the index isn't complete yet
+func (p *pki) listIndexed(login string) ([]issuedCert, error) {
+	err := p.storage.HeadObject(p.bucket, p.prefix+loginIndexComplete)
+	if errors.Is(err, storage.ErrNotExist) {
+		return p.listIssued()
+	}
+	if err != nil {
+		return nil, err
+	}
+	issued := []issuedCert{}
+	items, err := p.storage.ListObjects(p.bucket, p.prefix+"issued_by_login/"+login+"/")
+	if err != nil {
+		return issued, err
+	}
+	for _, item := range items {
+		name := strings.TrimPrefix(item, p.prefix+"issued_by_login/"+login+"/")
+		certPem, err := p.storage.GetObject(p.bucket, p.prefix+"issued/"+name+".crt")
+		if errors.Is(err, storage.ErrNotExist) {
+			// the certificate wasn't written, or the index was left behind by a revocation
+			continue
+		}
+		if err != nil {
+			return issued, err
+		}
+		parsedCert, err := NewCert().readCert(certPem.String())
+		if err != nil {
+			return issued, fmt.Errorf("could not parse %s: %s", name, err)
+		}
+		issued = append(issued, issuedCert{Name: name, Cert: parsedCert})
+	}
+	return issued, nil
+}
+
+// listIssuedForLogin returns the certificates in issued/ of a user, including the device certificates. Server
+// certificates are never returned, even when the common name matches the login.
+func (p *pki) listIssuedForLogin(login string) ([]issuedCert, error) {
+	issued, err := p.listIndexed(login)
+	if err != nil {
+		return nil, err
+	}
+	filtered := []issuedCert{}
+	for _, issuedCert := range issued {
+		if certLogin, _ := splitCommonName(issuedCert.Cert.Subject.CommonName); certLogin == login && !isServerCert(issuedCert.Cert) {
+			filtered = append(filtered, issuedCert)
+		}
+	}
+	return filtered, nil
+}
+
+// listIssuedForCommonName returns the certificates in issued/ with the given common name
+func (p *pki) listIssuedForCommonName(commonName string) ([]issuedCert, error) {
+	login, _ := splitCommonName(commonName)
+	issued, err := p.listIndexed(login)
+	if err != nil {
+		return nil, err
+	}
+	filtered := []issuedCert{}
+	for _, issuedCert := range issued {
+		if issuedCert.Cert.Subject.CommonName == commonName {
+			filtered = append(filtered, issuedCert)
+		}
+	}
+	return filtered, nil
+}
+
+// listDevices returns the device certificates of the user
+func (p *pki) listDevices(login string) ([]issuedCert, error) {
+	issued, err := p.listIssuedForLogin(login)
+	if err != nil {
+		return nil, err
+	}
+	devices := []issuedCert{}
+	for _, issuedCert := range issued {
+		if _, device := splitCommonName(issuedCert.Cert.Subject.CommonName); device != "" {
+			devices = append(devices, issuedCert)
+		}
+	}
+	return devices, nil
+}
+
+// revoke moves the certificate and key to revoked/ (like easy-rsa does) and records the revocation.
+// The CRL needs to be regenerated afterwards.
+func (p *pki) revoke(issued issuedCert, reason string) error {
+	serial := fmt.Sprintf("%X", issued.Cert.SerialNumber)
+
+	record, err := json.Marshal(revocation{
+		Serial:     serial,
+		CommonName: issued.Cert.Subject.CommonName,
+		RevokedAt:  time.Now().UTC(),
+		Reason:     reason,
+	})
+	if err != nil {
+		return err
+	}
+	err = p.storage.PutObject(p.bucket, p.prefix+"revoked/index/"+serial+".json", string(record), p.kmsArn)
+	if err != nil {
+		return err
+	}
+
+	certPem, err := p.storage.GetObject(p.bucket, p.prefix+"issued/"+issued.Name+".crt")
+	if err != nil {
+		return err
+	}
+	err = p.storage.PutObject(p.bucket, p.prefix+"revoked/certs_by_serial/"+serial+".crt", certPem.String(), p.kmsArn)
+	if err != nil {
+		return err
+	}
+	keyPem, err := p.storage.GetObject(p.bucket, p.prefix+"private/"+issued.Name+".key")
+	keyExists := err == nil
+	if keyExists {
+		err = p.storage.PutObject(p.bucket, p.prefix+"revoked/private_by_serial/"+serial+".key", keyPem.String(), p.kmsArn)
+		if err != nil {
+			return err
+		}
+	}
+	// the certificate is deleted before its key, a key without a certificate is overwritten when it's issued again
+	if err := p.storage.DeleteObject(p.bucket, p.prefix+"issued/"+issued.Name+".crt"); err != nil {
+		return err
+	}
+	if keyExists {
+		if err := p.storage.DeleteObject(p.bucket, p.prefix+"private/"+issued.Name+".key"); err != nil {
+			return err
+		}
+	}
+	p.ocspCache.invalidate(issued.Cert.SerialNumber)
+	login, _ := splitCommonName(issued.Cert.Subject.CommonName)
+	for _, index := range []string{"issued_by_serial/" + serial + ".json", "issued_by_login/" + login + "/" + issued.Name} {
+		if err := p.storage.DeleteObject(p.bucket, p.prefix+index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeLogin revokes all certificates of a user (including devices) and regenerates the CRL
+func (p *pki) revokeLogin(login, reason string) ([]issuedCert, error) {
+	issued, err := p.listIssuedForLogin(login)
+	if err != nil {
+		return nil, err
+	}
+	return p.revokeAll(issued, reason)
+}
+
+// revokeCommonName revokes all certificates with the given common name and regenerates the CRL
+func (p *pki) revokeCommonName(commonName, reason string) ([]issuedCert, error) {
+	issued, err := p.listIssuedForCommonName(commonName)
+	if err != nil {
+		return nil, err
+	}
+	return p.revokeAll(issued, reason)
+}
+
+func (p *pki) revokeAll(issued []issuedCert, reason string) ([]issuedCert, error) {
+	for k, issuedCert := range issued {
+		if err := p.revoke(issuedCert, reason); err != nil {
+			return issued[:k], fmt.Errorf("could not revoke %s: %s", issuedCert.Name, err)
+		}
+	}
+	if len(issued) > 0 {
+		if err := p.generateCRL(); err != nil {
+			return issued, fmt.Errorf("could not generate CRL: %s", err)
+		}
+	}
+	return issued, nil
+}
+
+func (p *pki) listRevocations() ([]revocation, error) {
+	revocations := []revocation{}
+	items, err := p.storage.ListObjects(p.bucket, p.prefix+"revoked/index/")
+	if err != nil {
+		return revocations, err
+	}
+	for _, item := range items {
+		var record revocation
+		data, err := p.storage.GetObject(p.bucket, item)
+		if err != nil {
+			return revocations, err
+		}
+		if err := json.Unmarshal(data.Bytes(), &record); err != nil {
+			return revocations, fmt.Errorf("could not parse %s: %s", item, err)
+		}
+		revocations = append(revocations, record)
+	}
+	return revocations, nil
+}
+
+// generateCRL writes crl.pem, signed by the CA, containing all revoked certificates
+func (p *pki) generateCRL() error {
+	caCert, caKey, err := p.loadCA()
+	if err != nil {
+		return err
+	}
+	revocations, err := p.listRevocations()
+	if err != nil {
+		return err
+	}
+	revokedCerts := make([]pkix.RevokedCertificate, len(revocations))
+	for k, record := range revocations {
+		serial, ok := new(big.Int).SetString(record.Serial, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial in revocation index: %s", record.Serial)
+		}
+		revokedCerts[k] = pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: record.RevokedAt,
+		}
+	}
+	now := time.Now()
+	crlPem, err := signCRL(caCert, caKey, revokedCerts, now)
+	if err != nil {
+		return err
+	}
+	// during the overlap window of a CA rotation, the certificates of the previous CA are revoked in a second CRL,
+	// signed by the previous CA. OpenVPN reads all CRLs in crl.pem.
+	rotation, err := p.loadRotation()
+	if err != nil {
+		return err
+	}
+	if rotation.active(now) {
+		previousCert, previousKey, err := p.loadPreviousCA(rotation)
+		if err != nil {
+			return err
+		}
+		previousCRL, err := signCRL(previousCert, previousKey, revokedCerts, now)
+		if err != nil {
+			return err
+		}
+		crlPem = append(crlPem, previousCRL...)
+	}
+	return p.storage.PutObject(p.bucket, p.prefix+"crl.pem", string(crlPem), p.kmsArn)
+}
+
+// signCRL returns a CRL (pem) signed by caCert
+func signCRL(caCert *x509.Certificate, caKey interface{}, revokedCerts []pkix.RevokedCertificate, now time.Time) ([]byte, error) {
+	signer, ok := caKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key can't be used to sign")
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlValidity),
+		RevokedCertificates: revokedCerts,
+	}, caCert, signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), nil
+}
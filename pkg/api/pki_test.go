@@ -0,0 +1,267 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+func TestIssueClientCertConcurrently(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock, err := p.lockLogin(context.Background(), "alice@example.com")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer lock.Release(context.Background())
+			_, _, err = p.issueClientCert(context.Background(), "alice@example.com", "client-alice@example.com-2024", "")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	issued := 0
+	for err := range errs {
+		if err == nil {
+			issued++
+		} else if !errors.Is(err, errConcurrentIssue) {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+	if issued != 1 {
+		t.Errorf("Expected the certificate to be issued once, got %d", issued)
+	}
+
+	// a renewal only replaces the certificate that was read
+	etag, err := p.clientCertETag(context.Background(), "client-alice@example.com-2024")
+	if err != nil {
+		t.Fatalf("clientCertETag error: %s", err)
+	}
+	if _, _, err := p.issueClientCert(context.Background(), "alice@example.com", "client-alice@example.com-2024", etag); err != nil {
+		t.Fatalf("Renewal error: %s", err)
+	}
+	if _, _, err := p.issueClientCert(context.Background(), "alice@example.com", "client-alice@example.com-2024", etag); !errors.Is(err, errConcurrentIssue) {
+		t.Errorf("Expected errConcurrentIssue for an outdated ETag, got %v", err)
+	}
+	clientCert, clientKey, err := p.getClientCert("client-alice@example.com-2024")
+	if err != nil {
+		t.Fatalf("getClientCert error: %s", err)
+	}
+	parsedCert, _ := NewCert().readCert(clientCert.String())
+	parsedKey, _ := NewCert().readPrivateKey(clientKey.String())
+	signer, ok := parsedKey.(crypto.Signer)
+	if parsedCert == nil || !ok || !signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(parsedCert.PublicKey) {
+		t.Errorf("Expected the key of the certificate")
+	}
+}
+
+// failingWrites fails the writes of the objects with the prefix
+type failingWrites struct {
+	storage.StorageIf
+	prefix string
+}
+
+func (s *failingWrites) PutObject(bucket, item, data, kmsArn string) error {
+	if strings.HasPrefix(item, s.prefix) {
+		return fmt.Errorf("storage unavailable")
+	}
+	return s.StorageIf.PutObject(bucket, item, data, kmsArn)
+}
+
+func TestIssueClientCertRollback(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	failing := &failingWrites{StorageIf: blobStorage, prefix: "pki/issued/"}
+	p := s.newPKI(failing, "bucket", "pki/")
+
+	// the certificate isn't written without its key
+	keyFailing := s.newPKI(&failingWrites{StorageIf: blobStorage, prefix: "pki/private/"}, "bucket", "pki/")
+	if _, _, err := keyFailing.issueClientCert(context.Background(), "alice", "client-alice-2024", ""); err == nil {
+		t.Fatalf("Expected an error when the key can't be written")
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/issued/client-alice-2024.crt"); err == nil {
+		t.Errorf("Certificate was written without its key")
+	}
+
+	// the key isn't left behind without its certificate
+	if _, _, err := p.issueClientCert(context.Background(), "alice", "client-alice-2024", ""); err == nil {
+		t.Fatalf("Expected an error when the certificate can't be written")
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/private/client-alice-2024.key"); err == nil {
+		t.Errorf("Key was written without its certificate")
+	}
+
+	// a failed renewal keeps the key of the current certificate
+	issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+	previousKey, _ := blobStorage.GetObject("bucket", "pki/private/client-alice-2024.key")
+	etag, err := s.newPKI(blobStorage, "bucket", "pki/").clientCertETag(context.Background(), "client-alice-2024")
+	if err != nil {
+		t.Fatalf("clientCertETag error: %s", err)
+	}
+	if _, _, err := p.issueClientCert(context.Background(), "alice", "client-alice-2024", etag); err == nil {
+		t.Fatalf("Expected an error when the certificate can't be written")
+	}
+	if key, _ := blobStorage.GetObject("bucket", "pki/private/client-alice-2024.key"); key.String() != previousKey.String() {
+		t.Errorf("Key of the current certificate was replaced")
+	}
+}
+
+func TestEnsureClientCertConcurrently(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+
+	var wg sync.WaitGroup
+	serials := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clientCert, _, _, _, err := p.ensureClientCert(context.Background(), "alice@example.com", "client-alice@example.com-2024")
+			if err != nil {
+				t.Errorf("ensureClientCert error: %s", err)
+				return
+			}
+			parsedCert, _ := NewCert().readCert(clientCert.String())
+			serials <- parsedCert.SerialNumber.String()
+		}()
+	}
+	wg.Wait()
+	close(serials)
+	unique := map[string]bool{}
+	for serial := range serials {
+		unique[serial] = true
+	}
+	if len(unique) != 1 {
+		t.Errorf("Expected every request to return the same certificate, got %d certificates", len(unique))
+	}
+	if locks, _ := blobStorage.ListObjects("bucket", "pki/locks/"); len(locks) != 0 {
+		t.Errorf("Expected the lock to be released, got %v", locks)
+	}
+}
+
+func TestReadClientCertDuringRenewal(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+	issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+	aliceKey, _ := blobStorage.GetObject("bucket", "pki/private/client-alice-2024.key")
+	issueTestCert(t, blobStorage, "bob", "client-bob-2024")
+	bobKey, _ := blobStorage.GetObject("bucket", "pki/private/client-bob-2024.key")
+
+	// a renewal in progress wrote the new key, but not yet the certificate
+	lock, err := p.lockLogin(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("lockLogin error: %s", err)
+	}
+	blobStorage.PutObject("bucket", "pki/private/client-alice-2024.key", bobKey.String(), "")
+	if _, _, err := p.getClientCert("client-alice-2024"); !errors.Is(err, errIncompleteCert) {
+		t.Fatalf("Expected errIncompleteCert, got %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, clientKey, err := p.readClientCert(context.Background(), "client-alice-2024")
+		if err == nil && clientKey.String() != aliceKey.String() {
+			err = fmt.Errorf("returned the key of another certificate")
+		}
+		done <- err
+	}()
+	blobStorage.PutObject("bucket", "pki/private/client-alice-2024.key", aliceKey.String(), "")
+	lock.Release(context.Background())
+	if err := <-done; err != nil {
+		t.Errorf("readClientCert error: %s", err)
+	}
+
+	// a pair that's left incomplete is issued again
+	blobStorage.PutObject("bucket", "pki/private/client-alice-2024.key", bobKey.String(), "")
+	clientCert, clientKey, _, issued, err := p.ensureClientCert(context.Background(), "alice", "client-alice-2024")
+	if err != nil || !issued {
+		t.Fatalf("Expected the certificate to be issued again, got issued %v (err: %v)", issued, err)
+	}
+	if current, currentKey, err := p.getClientCert("client-alice-2024"); err != nil || current.String() != clientCert.String() || currentKey.String() != clientKey.String() {
+		t.Errorf("Expected the new pair to be stored (err: %v)", err)
+	}
+}
+
+// failingDeletes fails the deletes of the objects with the prefix
+type failingDeletes struct {
+	storage.StorageIf
+	prefix string
+}
+
+func (s *failingDeletes) DeleteObject(bucket, item string) error {
+	if strings.HasPrefix(item, s.prefix) {
+		return fmt.Errorf("storage unavailable")
+	}
+	return s.StorageIf.DeleteObject(bucket, item)
+}
+
+func TestRevokeDeletesCertificateFirst(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	alice := issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+	failing := s.newPKI(&failingDeletes{StorageIf: blobStorage, prefix: "pki/private/"}, "bucket", "pki/")
+	if err := failing.revoke(issuedCert{Name: "client-alice-2024", Cert: alice}, "superseded"); err == nil {
+		t.Fatalf("Expected an error when the key can't be deleted")
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/issued/client-alice-2024.crt"); err == nil {
+		t.Errorf("Expected the certificate to be deleted before its key")
+	}
+	// the key that's left behind is replaced by the next certificate
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+	if _, _, _, issued, err := p.ensureClientCert(context.Background(), "alice", "client-alice-2024"); err != nil || !issued {
+		t.Errorf("Expected a new certificate, got issued %v (err: %v)", issued, err)
+	}
+}
+
+func TestListIssuedForLoginIndex(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+	issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+	if _, _, err := p.issueLocked(context.Background(), "alice", deviceCommonName("alice", "laptop"), deviceCertName("alice", "laptop"), ""); err != nil {
+		t.Fatalf("issueLocked error: %s", err)
+	}
+	issueTestCert(t, blobStorage, "bob", "client-bob-2024")
+	// issued before the index existed
+	blobStorage.DeleteObject("bucket", "pki/issued_by_login/alice/client-alice-2024")
+
+	// issued/ is listed until the index is complete
+	if issued, err := p.listIssuedForLogin("alice"); err != nil || len(issued) != 2 {
+		t.Fatalf("Expected the certificates of alice, got %+v (err: %v)", issued, err)
+	}
+	all, err := p.listIssued()
+	if err != nil {
+		t.Fatalf("listIssued error: %s", err)
+	}
+	if count, err := p.indexLogins(all); err != nil || count != 1 {
+		t.Fatalf("Expected 1 added certificate, got %d (err: %v)", count, err)
+	}
+
+	indexed := s.newPKI(&failingLists{StorageIf: blobStorage, prefix: "pki/issued/"}, "bucket", "pki/")
+	if issued, err := indexed.listIssuedForLogin("alice"); err != nil || len(issued) != 2 {
+		t.Errorf("Expected the certificates of alice from the index, got %+v (err: %v)", issued, err)
+	}
+	if devices, err := indexed.listDevices("alice"); err != nil || len(devices) != 1 || devices[0].Name != deviceCertName("alice", "laptop") {
+		t.Errorf("Expected the device of alice, got %+v (err: %v)", devices, err)
+	}
+	revoked, err := indexed.revokeLogin("alice", "deprovisioned")
+	if err != nil || len(revoked) != 2 {
+		t.Fatalf("Expected 2 revoked certificates, got %+v (err: %v)", revoked, err)
+	}
+	if items, _ := blobStorage.ListObjects("bucket", "pki/issued_by_login/alice/"); len(items) != 0 {
+		t.Errorf("Expected the index of alice to be removed, got %v", items)
+	}
+	if issued, err := indexed.listIssuedForCommonName("bob"); err != nil || len(issued) != 1 {
+		t.Errorf("Expected the certificate of bob, got %+v (err: %v)", issued, err)
+	}
+}
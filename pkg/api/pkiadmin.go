@@ -0,0 +1,493 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/config"
+)
+
+// ffdhe2048 is the 2048-bit finite field Diffie-Hellman group of RFC 7919, with generator 2. Generating new DH parameters
+// takes minutes and has no security benefit over a well-known safe prime.
+const ffdhe2048 = "FFFFFFFFFFFFFFFFADF85458A2BB4A9AAFDC5620273D3CF1D8B9C583CE2D3695A9E13641146433FBCC939DCE249B3EF97D2FE363630C75D8" +
+	"F681B202AEC4617AD3DF1ED5D5FD65612433F51F5F066ED0856365553DED1AF3B557135E7F57C935984F0C70E0E68B77E2A689DAF3EFE8721DF158A1" +
+	"36ADE73530ACCA4F483A797ABC0AB182B324FB61D108A94BB2C8E3FBB96ADAB760D7F4681D4F42A3DE394DF4AE56EDE76372BB190B07A7C8EE0A6D70" +
+	"9E02FCE1CDF7E2ECC03404CD28342F619172FE9CE98583FF8E4F1232EEF28183C3FE3B1B4C6FAD733BB5FCBC2EC22005C58EF1837D1683B2C6F34A26" +
+	"C1B2EFFA886B423861285C97FFFFFFFFFFFFFFFF"
+
+// starterClientConfig is the openvpn-client.conf written by InitPKI. [CERT], [KEY], [CA] and [TLS-AUTH] are filled in when a
+// profile is downloaded.
+const starterClientConfig = `client
+nobind
+dev tun
+remote-cert-tls server
+
+remote %s
+
+<key>
+[KEY]
+</key>
+<cert>
+[CERT]
+</cert>
+<ca>
+[CA]
+</ca>
+key-direction 1
+<tls-auth>
+[TLS-AUTH]
+</tls-auth>
+
+redirect-gateway def1
+`
+
+// PKI manages the certificate authority in the storage backend, for the admin commands
+type PKI struct {
+	pki         *pki
+	auditLogger *audit.Logger
+	actor       string
+	// management are the management interfaces of the openvpn servers, to disconnect revoked clients
+	management config.Management
+	// encryption is true when the private keys are encrypted with a key encryption key
+	encryption bool
+}
+
+// InitOptions are the options of InitPKI
+type InitOptions struct {
+	// CACommonName is the common name of the new CA
+	CACommonName string
+	// ServerName is the common name of the openvpn server certificate, stored as issued/server-<ServerName>.crt
+	ServerName string
+	// ServerSANs are the dns names or ip addresses of the openvpn server
+	ServerSANs []string
+	// Remote is the remote line of the starter client config: host, port and protocol
+	Remote string
+	// Intermediate signs the certificates with an intermediate CA, the key of the root CA is not stored
+	Intermediate bool
+	// Force overwrites an existing CA
+	Force bool
+}
+
+// Certificate is an issued or revoked client certificate
+type Certificate struct {
+	Name       string    `json:"name,omitempty"`
+	CommonName string    `json:"commonName"`
+	Serial     string    `json:"serial"`
+	NotAfter   time.Time `json:"notAfter,omitempty"`
+	Revoked    bool      `json:"revoked"`
+	RevokedAt  time.Time `json:"revokedAt,omitempty"`
+}
+
+/*
+ * NewPKI returns the PKI in the configured storage backend. The actions are written to the audit log with actor as the
+ * actor, call Close to flush the audit log.
+ */
+func NewPKI(ctx context.Context, conf config.Config, actor string) (*PKI, error) {
+	s := NewServer(conf)
+	if err := s.initStorage(); err != nil {
+		return nil, fmt.Errorf("Could not initialize storage: %s", err)
+	}
+	blobStorage, bucket, prefix, err := s.getStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a := newAdminPKI(s.newPKI(blobStorage, bucket, prefix), actor)
+	a.management = conf.Management
+	a.encryption = conf.Storage.Encryption.KEK != ""
+	return a, nil
+}
+
+func newAdminPKI(p *pki, actor string) *PKI {
+	return &PKI{
+		pki:         p,
+		auditLogger: audit.NewLogger(p.storage, p.bucket, p.prefix, p.kmsArn, nil),
+		actor:       actor,
+	}
+}
+
+// Close flushes the audit log
+func (a *PKI) Close() error {
+	return a.auditLogger.Close()
+}
+
+/*
+ * InitPKI creates a new CA, a server certificate, the DH parameters, the tls-auth key, an empty CRL and a starter
+ * openvpn-client.conf. An existing CA is only overwritten with Force, an existing openvpn-client.conf is kept.
+ * With Intermediate, the certificates are signed by an intermediate CA and the key of the root CA is returned instead
+ * of written to the storage backend: keep it offline.
+ */
+func (a *PKI) InitPKI(ctx context.Context, opts InitOptions) (string, error) {
+	p := a.pki
+	if err := p.storage.HeadObject(p.bucket, p.prefix+"ca.crt"); err == nil && !opts.Force {
+		return "", fmt.Errorf("ca.crt already exists, use force to overwrite the CA")
+	}
+	c := NewCert()
+
+	caCert, caKey, err := c.createCA(ctx, opts.CACommonName)
+	if err != nil {
+		return "", fmt.Errorf("Create CA error: %s", err)
+	}
+	rootKey := ""
+	if opts.Intermediate {
+		parsedRootCert, err := c.readCert(caCert.String())
+		if err != nil {
+			return "", err
+		}
+		parsedRootKey, err := c.readPrivateKey(caKey.String())
+		if err != nil {
+			return "", err
+		}
+		intermediateCert, intermediateKey, err := c.createIntermediateCA(ctx, parsedRootCert, parsedRootKey, opts.CACommonName+" Intermediate")
+		if err != nil {
+			return "", fmt.Errorf("Create CA error: %s", err)
+		}
+		rootKey = caKey.String()
+		caKey = intermediateKey
+		caCert.Reset()
+		caCert.WriteString(intermediateCert.String() + string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: parsedRootCert.Raw})))
+	}
+	if err := a.pki.storeCA(caCert.String(), caKey.String()); err != nil {
+		return "", err
+	}
+	if _, _, err := p.issueServerLocked(ctx, opts.ServerName, opts.ServerSANs); err != nil {
+		return "", err
+	}
+	dhParams, err := dhParams()
+	if err != nil {
+		return "", err
+	}
+	taKey, err := newTLSAuthKey()
+	if err != nil {
+		return "", err
+	}
+	objects := []struct{ key, value string }{
+		{"dh.pem", dhParams},
+		{"ta.key", taKey},
+	}
+	for _, object := range objects {
+		if err := p.storage.PutObject(p.bucket, p.prefix+object.key, object.value, p.kmsArn); err != nil {
+			return "", fmt.Errorf("Blob Storage Put error: %s", err)
+		}
+	}
+	if err := p.storage.HeadObject(p.bucket, p.prefix+"openvpn-client.conf"); err != nil {
+		if err := p.storage.PutObject(p.bucket, p.prefix+"openvpn-client.conf", fmt.Sprintf(starterClientConfig, opts.Remote), p.kmsArn); err != nil {
+			return "", fmt.Errorf("Blob Storage Put error: %s", err)
+		}
+	}
+	if err := p.generateCRL(); err != nil {
+		return "", fmt.Errorf("could not generate CRL: %s", err)
+	}
+
+	a.auditLogger.Log(audit.Event{Type: audit.AdminAction, Actor: a.actor, Subject: opts.CACommonName, Details: map[string]string{"action": "pki.init", "server": opts.ServerName, "intermediate": fmt.Sprint(opts.Intermediate)}})
+	return rootKey, nil
+}
+
+// ImportCA replaces the CA with an existing CA, e.g. an intermediate CA signed by an offline root. chain contains the
+// signing certificate, followed by the intermediates and the root. key is the key of the signing certificate. An
+// existing CA is only overwritten with force.
+func (a *PKI) ImportCA(chain, key string, force bool) error {
+	p := a.pki
+	if err := p.storage.HeadObject(p.bucket, p.prefix+"ca.crt"); err == nil && !force {
+		return fmt.Errorf("ca.crt already exists, use force to overwrite the CA")
+	}
+	parsedChain, err := validateCA(chain, key)
+	if err != nil {
+		return err
+	}
+	if err := a.pki.storeCA(strings.Join(parsedChain.pems, ""), key); err != nil {
+		return err
+	}
+	if err := p.generateCRL(); err != nil {
+		return fmt.Errorf("could not generate CRL: %s", err)
+	}
+	a.auditLogger.Log(audit.Event{Type: audit.AdminAction, Actor: a.actor, Subject: parsedChain.signer().Subject.CommonName, Details: map[string]string{"action": "pki.import", "root": parsedChain.certs[len(parsedChain.certs)-1].Subject.CommonName}})
+	return nil
+}
+
+// storeCA writes ca.crt and private/ca.key, after checking that the key belongs to the signing certificate
+func (p *pki) storeCA(chain, key string) error {
+	if _, err := validateCA(chain, key); err != nil {
+		return err
+	}
+	if err := p.storage.PutObject(p.bucket, p.prefix+"private/ca.key", key, p.kmsArn); err != nil {
+		return fmt.Errorf("Blob Storage Put error: %s", err)
+	}
+	if err := p.storage.PutObject(p.bucket, p.prefix+"ca.crt", chain, p.kmsArn); err != nil {
+		return fmt.Errorf("Blob Storage Put error: %s", err)
+	}
+	return nil
+}
+
+// validateCA parses the chain and checks that the key belongs to the signing certificate
+func validateCA(chain, key string) (caChain, error) {
+	parsedChain, err := parseCAChain(chain)
+	if err != nil {
+		return parsedChain, err
+	}
+	for _, cert := range parsedChain.certs {
+		if !cert.IsCA {
+			return parsedChain, fmt.Errorf("%s is not a CA certificate", cert.Subject.CommonName)
+		}
+	}
+	parsedKey, err := NewCert().readPrivateKey(key)
+	if err != nil {
+		return parsedChain, fmt.Errorf("Parsed CA key Error: %s", err)
+	}
+	return parsedChain, parsedChain.matchesKey(parsedKey)
+}
+
+// Issue issues a client certificate, stored as issued/<name>.crt. The name defaults to client-<commonName>-<year>, like
+// the certificates issued by the portal.
+func (a *PKI) Issue(ctx context.Context, commonName, name string) (Certificate, error) {
+	if name == "" {
+		name = "client-" + commonName + "-" + time.Now().Format("2006")
+	}
+	if err := a.pki.storage.HeadObject(a.pki.bucket, a.pki.prefix+"issued/"+name+".crt"); err == nil {
+		return Certificate{}, fmt.Errorf("%s already exists, revoke it first", name)
+	}
+	login, _ := splitCommonName(commonName)
+	clientCert, _, err := a.pki.issueLocked(ctx, login, commonName, name, "")
+	if err != nil {
+		return Certificate{}, err
+	}
+	parsedCert, err := NewCert().readCert(clientCert.String())
+	if err != nil {
+		return Certificate{}, err
+	}
+	issued := issuedCert{Name: name, Cert: parsedCert}
+	a.auditCert(audit.CertIssued, issued)
+	return newCertificate(issued), nil
+}
+
+// IssueServer issues a certificate for an openvpn server, stored as issued/server-<name>.crt. An existing certificate
+// with the same name is replaced, the existing certificate stays valid until it's revoked.
+func (a *PKI) IssueServer(ctx context.Context, name string, sans []string) (Certificate, error) {
+	serverCert, _, err := a.pki.issueServerLocked(ctx, name, sans)
+	if err != nil {
+		return Certificate{}, err
+	}
+	parsedCert, err := NewCert().readCert(serverCert.String())
+	if err != nil {
+		return Certificate{}, err
+	}
+	issued := issuedCert{Name: serverCertName(name), Cert: parsedCert}
+	a.auditCert(audit.CertIssued, issued)
+	return newCertificate(issued), nil
+}
+
+// Revoke revokes all certificates with the common name, regenerates the CRL and disconnects the sessions of the common name
+func (a *PKI) Revoke(ctx context.Context, commonName, reason string) ([]Certificate, error) {
+	revoked, err := a.pki.revokeCommonName(commonName, reason)
+	certificates := make([]Certificate, len(revoked))
+	for k, issued := range revoked {
+		a.auditCert(audit.CertRevoked, issued)
+		certificates[k] = newCertificate(issued)
+		certificates[k].Revoked = true
+	}
+	if len(revoked) > 0 && len(a.management.Addresses) > 0 {
+		killed, killErr := killSessions(ctx, a.management, commonNamesOf(revoked))
+		for _, sessions := range killed {
+			a.auditLogger.Log(audit.Event{
+				Type:    audit.SessionKilled,
+				Actor:   a.actor,
+				Subject: sessions.CommonName,
+				Details: map[string]string{"server": sessions.Server, "sessions": strconv.Itoa(sessions.Sessions), "source": "cli"},
+			})
+		}
+		if killErr != nil {
+			slog.Warn("Could not disconnect revoked clients", "error", killErr)
+		}
+	}
+	return certificates, err
+}
+
+// List returns the issued and the revoked certificates, sorted by common name
+func (a *PKI) List() ([]Certificate, error) {
+	issued, err := a.pki.listIssued()
+	if err != nil {
+		return nil, err
+	}
+	revocations, err := a.pki.listRevocations()
+	if err != nil {
+		return nil, err
+	}
+	certificates := []Certificate{}
+	for _, issuedCert := range issued {
+		certificates = append(certificates, newCertificate(issuedCert))
+	}
+	for _, record := range revocations {
+		certificates = append(certificates, Certificate{
+			CommonName: record.CommonName,
+			Serial:     record.Serial,
+			Revoked:    true,
+			RevokedAt:  record.RevokedAt,
+		})
+	}
+	sort.SliceStable(certificates, func(i, j int) bool {
+		return certificates[i].CommonName < certificates[j].CommonName
+	})
+	return certificates, nil
+}
+
+// GenerateCRL regenerates crl.pem
+func (a *PKI) GenerateCRL() error {
+	return a.pki.generateCRL()
+}
+
+// IssueOCSPSigner issues a delegated OCSP signer (ocsp.crt and private/ocsp.key), so the responses of the OCSP responder
+// are not signed by the CA key. An existing signer is replaced.
+func (a *PKI) IssueOCSPSigner(ctx context.Context) (Certificate, error) {
+	signerCert, err := a.pki.issueOCSPSigner(ctx)
+	if err != nil {
+		return Certificate{}, err
+	}
+	issued := issuedCert{Name: "ocsp", Cert: signerCert}
+	a.auditCert(audit.CertIssued, issued)
+	return newCertificate(issued), nil
+}
+
+// RotateOptions are the options of RotateCA. When Chain is empty, a new root CA is created with CACommonName.
+type RotateOptions struct {
+	CACommonName string
+	Chain        string
+	Key          string
+	Overlap      time.Duration
+}
+
+// RotateCA replaces the CA. The previous CA stays trusted during the overlap window, certificates of the previous CA
+// are reissued by the new CA when the profile is downloaded.
+func (a *PKI) RotateCA(ctx context.Context, opts RotateOptions) error {
+	if opts.Overlap <= 0 {
+		opts.Overlap = defaultCAOverlap
+	}
+	if err := a.pki.rotateCA(ctx, opts.CACommonName, opts.Chain, opts.Key, opts.Overlap, time.Now()); err != nil {
+		return err
+	}
+	status, err := a.pki.caStatus(time.Now())
+	if err != nil {
+		return err
+	}
+	a.auditLogger.Log(audit.Event{Type: audit.AdminAction, Actor: a.actor, Subject: status.CA, Details: map[string]string{"action": "ca.rotate", "previous": status.PreviousCA, "overlapUntil": status.OverlapUntil.Format(time.RFC3339)}})
+	return nil
+}
+
+// CAStatus returns the CA, the state of the CA rotation and the certificates that are still signed by a previous CA
+func (a *PKI) CAStatus() (CAStatus, error) {
+	return a.pki.caStatus(time.Now())
+}
+
+// Usage returns the issued client certificates with the last connection of their common name, the certificates without a
+// connection in the last idle days are idle. With unused, only the certificates that are idle or never used are returned.
+func (a *PKI) Usage(idleDays int, unused bool) ([]CertificateUsage, error) {
+	certificates, err := a.pki.certificateUsage(time.Now(), time.Duration(idleDays)*24*time.Hour)
+	if err != nil || !unused {
+		return certificates, err
+	}
+	return unusedCertificates(certificates), nil
+}
+
+// FinishRotation stops trusting the previous CA and deletes its key. It fails when certificates of the previous CA are
+// still in use, unless force is set.
+func (a *PKI) FinishRotation(force bool) error {
+	status, err := a.pki.caStatus(time.Now())
+	if err != nil {
+		return err
+	}
+	if err := a.pki.finishRotation(force, time.Now()); err != nil {
+		return err
+	}
+	a.auditLogger.Log(audit.Event{Type: audit.AdminAction, Actor: a.actor, Subject: status.CA, Details: map[string]string{"action": "ca.finish-rotation", "previous": status.PreviousCA, "outdated": fmt.Sprint(len(status.Outdated))}})
+	return nil
+}
+
+// ResetMFA removes the second factor of the user, e.g. after losing the authenticator app and the recovery codes
+func (a *PKI) ResetMFA(login string) error {
+	p := a.pki
+	if p.storage.HeadObject(p.bucket, p.prefix+"mfa/"+login+".json") != nil {
+		return fmt.Errorf("%s didn't set up two-factor authentication", login)
+	}
+	if err := p.storage.DeleteObject(p.bucket, p.prefix+"mfa/"+login+".json"); err != nil {
+		return err
+	}
+	a.auditLogger.Log(audit.Event{Type: audit.MFARemoved, Actor: a.actor, Subject: login, Details: map[string]string{"source": "cli"}})
+	return nil
+}
+
+// Export returns the openvpn profile of the certificate issued/<name>.crt
+func (a *PKI) Export(name string) (string, error) {
+	clientCert, clientKey, err := a.pki.readClientCert(context.Background(), name)
+	if err != nil {
+		return "", fmt.Errorf("could not get certificate %s: %s", name, err)
+	}
+	ovpnConfig, err := a.pki.clientConfig(clientCert, clientKey)
+	if err != nil {
+		return "", err
+	}
+	parsedCert, err := NewCert().readCert(clientCert.String())
+	if err != nil {
+		return "", err
+	}
+	a.auditCert(audit.ProfileDownloaded, issuedCert{Name: name, Cert: parsedCert})
+	return ovpnConfig, nil
+}
+
+func (a *PKI) auditCert(eventType string, issued issuedCert) {
+	a.auditLogger.Log(audit.Event{
+		Type:    eventType,
+		Actor:   a.actor,
+		Subject: issued.Cert.Subject.CommonName,
+		Serial:  fmt.Sprintf("%X", issued.Cert.SerialNumber),
+		Details: map[string]string{"name": issued.Name, "source": "cli"},
+	})
+}
+
+func newCertificate(issued issuedCert) Certificate {
+	return Certificate{
+		Name:       issued.Name,
+		CommonName: issued.Cert.Subject.CommonName,
+		Serial:     fmt.Sprintf("%X", issued.Cert.SerialNumber),
+		NotAfter:   issued.Cert.NotAfter,
+	}
+}
+
+// dhParams returns the ffdhe2048 group as PKCS#3 DH parameters (dh.pem)
+func dhParams() (string, error) {
+	prime, ok := new(big.Int).SetString(ffdhe2048, 16)
+	if !ok {
+		return "", fmt.Errorf("invalid DH prime")
+	}
+	der, err := asn1.Marshal(struct {
+		P *big.Int
+		G int
+	}{prime, 2})
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "DH PARAMETERS", Bytes: der})), nil
+}
+
+// newTLSAuthKey returns a random 2048 bit OpenVPN static key, like openvpn --genkey
+func newTLSAuthKey() (string, error) {
+	key := make([]byte, 256)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	out.WriteString("#\n# 2048 bit OpenVPN static key\n#\n-----BEGIN OpenVPN Static key V1-----\n")
+	for i := 0; i < len(key); i += 16 {
+		out.WriteString(hex.EncodeToString(key[i:i+16]) + "\n")
+	}
+	out.WriteString("-----END OpenVPN Static key V1-----\n")
+	return out.String(), nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+func TestInitPKI(t *testing.T) {
+	blobStorage := storage.NewMemory()
+	a := newAdminPKI(newPKI(blobStorage, "bucket", "pki/"), "admin")
+	opts := InitOptions{CACommonName: "Test CA", ServerName: "openvpn", Remote: "vpn.example.com 1194 udp"}
+	if _, err := a.InitPKI(context.Background(), opts); err != nil {
+		t.Fatalf("InitPKI error: %s", err)
+	}
+	for _, key := range []string{"ca.crt", "private/ca.key", "issued/server-openvpn.crt", "private/server-openvpn.key", "dh.pem", "ta.key", "crl.pem", "openvpn-client.conf"} {
+		if err := blobStorage.HeadObject("bucket", "pki/"+key); err != nil {
+			t.Errorf("%s not found: %s", key, err)
+		}
+	}
+	if _, err := a.InitPKI(context.Background(), opts); err == nil {
+		t.Errorf("Expected error when the CA already exists")
+	}
+
+	caCert, _, err := a.pki.loadCA()
+	if err != nil {
+		t.Fatalf("loadCA error: %s", err)
+	}
+	if !caCert.IsCA || caCert.Subject.CommonName != "Test CA" {
+		t.Errorf("Unexpected CA: %+v", caCert.Subject)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	serverPem, _ := blobStorage.GetObject("bucket", "pki/issued/server-openvpn.crt")
+	serverCert, err := NewCert().readCert(serverPem.String())
+	if err != nil {
+		t.Fatalf("Parse server cert error: %s", err)
+	}
+	if _, err := serverCert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}); err != nil {
+		t.Errorf("Server certificate not valid: %s", err)
+	}
+
+	dhParams, _ := blobStorage.GetObject("bucket", "pki/dh.pem")
+	if !strings.HasPrefix(dhParams.String(), "-----BEGIN DH PARAMETERS-----\nMIIBCAKCAQEA//////////+t+FRYortKmq/cViAnPTzx2LnFg84tNpWp4TZBFGQz\n") {
+		t.Errorf("Unexpected DH parameters: %s", dhParams.String())
+	}
+	taKey, _ := blobStorage.GetObject("bucket", "pki/ta.key")
+	if lines := strings.Split(strings.TrimSpace(taKey.String()), "\n"); len(lines) != 21 || len(lines[5]) != 32 {
+		t.Errorf("Unexpected tls-auth key: %s", taKey.String())
+	}
+}
+
+func TestPKIIssueRevokeExport(t *testing.T) {
+	blobStorage := storage.NewMemory()
+	a := newAdminPKI(newPKI(blobStorage, "bucket", "pki/"), "admin")
+	if _, err := a.InitPKI(context.Background(), InitOptions{CACommonName: "Test CA", ServerName: "openvpn", Remote: "vpn.example.com 1194 udp"}); err != nil {
+		t.Fatalf("InitPKI error: %s", err)
+	}
+
+	issued, err := a.Issue(context.Background(), "alice@example.com", "")
+	if err != nil {
+		t.Fatalf("Issue error: %s", err)
+	}
+	if !strings.HasPrefix(issued.Name, "client-alice@example.com-") {
+		t.Errorf("Unexpected name: %s", issued.Name)
+	}
+	if _, err := a.Issue(context.Background(), "alice@example.com", ""); err == nil {
+		t.Errorf("Expected error when the certificate already exists")
+	}
+
+	ovpnConfig, err := a.Export(issued.Name)
+	if err != nil {
+		t.Fatalf("Export error: %s", err)
+	}
+	if !strings.Contains(ovpnConfig, "remote vpn.example.com 1194 udp") || !strings.Contains(ovpnConfig, "BEGIN OpenVPN Static key V1") {
+		t.Errorf("Unexpected profile: %s", ovpnConfig)
+	}
+
+	revoked, err := a.Revoke(context.Background(), "alice@example.com", "test")
+	if err != nil || len(revoked) != 1 || revoked[0].Serial != issued.Serial {
+		t.Fatalf("Unexpected revoke result: %+v (err: %v)", revoked, err)
+	}
+	certificates, err := a.List()
+	if err != nil {
+		t.Fatalf("List error: %s", err)
+	}
+	if len(certificates) != 2 || !certificates[0].Revoked || certificates[0].CommonName != "alice@example.com" || certificates[1].Name != "server-openvpn" {
+		t.Errorf("Unexpected certificates: %+v", certificates)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	auditObjects, _ := blobStorage.ListObjects("bucket", "pki/audit/")
+	if len(auditObjects) != 1 {
+		t.Errorf("Expected audit log to be flushed, got %d objects", len(auditObjects))
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/in4it/openvpn-access/pkg/logging"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+var pages = parsePages("index.html", "access.html", "error.html", "confirm.html", "issued.html", "connections.html", "mfa.html")
+
+// page is the data that is passed to every template
+type page struct {
+	Title     string
+	Prefix    string
+	Login     string
+	CSRFField template.HTML
+	Data      interface{}
+}
+
+type accessResponse struct {
+	Login        string            `json:"login"`
+	Certificates []certificateInfo `json:"certificates"`
+	MaxDevices   int               `json:"maxDevices"`
+	// MFA is "enrolled" or "not enrolled", empty when two-factor authentication is disabled
+	MFA string `json:"mfa,omitempty"`
+}
+
+type certificateInfo struct {
+	Name      string    `json:"name"`
+	Device    string    `json:"device,omitempty"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	Status    string    `json:"status"`
+}
+
+func newCertificateInfo(issued issuedCert) certificateInfo {
+	status := "valid"
+	if time.Now().After(issued.Cert.NotAfter) {
+		status = "expired"
+	}
+	_, device := splitCommonName(issued.Cert.Subject.CommonName)
+	return certificateInfo{
+		Name:      issued.Name,
+		Device:    device,
+		Serial:    fmt.Sprintf("%X", issued.Cert.SerialNumber),
+		NotBefore: issued.Cert.NotBefore,
+		NotAfter:  issued.Cert.NotAfter,
+		Status:    status,
+	}
+}
+
+func parsePages(names ...string) map[string]*template.Template {
+	parsed := make(map[string]*template.Template, len(names))
+	for _, name := range names {
+		parsed[name] = template.Must(template.ParseFS(templateFS, "templates/layout.html", "templates/"+name))
+	}
+	return parsed
+}
+
+// wantsJSON returns true when the client asked for a JSON response instead of a html page
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func (s *server) render(w http.ResponseWriter, r *http.Request, status int, name, title, login string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := pages[name].ExecuteTemplate(w, "layout", page{
+		Title:     title,
+		Prefix:    s.config.URLPrefix,
+		Login:     login,
+		CSRFField: csrf.TemplateField(r),
+		Data:      data,
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Could not render template", "template", name, "error", err)
+	}
+}
+
+// writeError returns a human-readable error page, or a json error when requested by the client
+func (s *server) writeError(w http.ResponseWriter, r *http.Request, status int, login, message string) {
+	if status >= http.StatusInternalServerError {
+		logging.FromContext(r.Context()).Error(message, "status", status, "login", login, "path", r.URL.Path)
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorResponse{Message: message})
+		return
+	}
+	s.render(w, r, status, "error.html", http.StatusText(status), login, message)
+}
+
+// getSessionLogin verifies the token in the session and returns the login of the user
+func (s *server) getSessionLogin(r *http.Request) (string, error) {
+	session, err := s.sessionStore.Get(r, "token-session")
+	if err != nil || session.Values["token"] == nil {
+		return "", fmt.Errorf("Unauthorized")
+	}
+	return s.auth.verifyToken(r.Context(), session.Values["token"].(string))
+}
+
+func (s *server) accessHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", "You need to log in to see your VPN access: "+err.Error())
+		return
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not create session: "+err.Error())
+		return
+	}
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	issued, err := p.listIssuedForLogin(login)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not retrieve certificates: "+err.Error())
+		return
+	}
+	response := accessResponse{
+		Login:        login,
+		Certificates: make([]certificateInfo, len(issued)),
+		MaxDevices:   s.config.MaxDevicesPerUser,
+	}
+	for k, issuedCert := range issued {
+		response.Certificates[k] = newCertificateInfo(issuedCert)
+	}
+	if s.mfaEnabled() {
+		response.MFA = "not enrolled"
+		if p.mfaEnrolled(login) {
+			response.MFA = "enrolled"
+		}
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	s.render(w, r, http.StatusOK, "access.html", "My VPN access", login, response)
+}
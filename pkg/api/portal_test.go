@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHomeHandlerContentNegotiation(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	s.homeHandler(rec, req)
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Expected html, got content type %s", rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `href="/login"`) {
+		t.Errorf("Landing page doesn't link to login: %s", rec.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	s.homeHandler(rec, req)
+	var response response
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Expected json, got error: %s", err)
+	}
+	if response.Message != "running" {
+		t.Errorf("Unexpected message: %s", response.Message)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/access", nil)
+	rec := httptest.NewRecorder()
+	s.writeError(rec, req, http.StatusForbidden, "alice", "Access <revoked>")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "Access &lt;revoked&gt;") {
+		t.Errorf("Error message not (escaped) in error page: %s", rec.Body.String())
+	}
+
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	s.writeError(rec, req, http.StatusForbidden, "alice", "Access revoked")
+	var response errorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Expected json, got error: %s", err)
+	}
+	if response.Message != "Access revoked" {
+		t.Errorf("Unexpected message: %s", response.Message)
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// defaultCAOverlap is how long the previous CA is trusted after a CA rotation
+const defaultCAOverlap = 30 * 24 * time.Hour
+
+// caRotation is the state of a CA rotation, stored as ca-rotation.json. The key of the previous CA is stored as
+// private/ca-previous.key, to sign the CRL for the certificates of the previous CA.
+type caRotation struct {
+	PreviousCA   string    `json:"previousCA"`
+	RotatedAt    time.Time `json:"rotatedAt"`
+	OverlapUntil time.Time `json:"overlapUntil"`
+}
+
+// CAStatus is the CA and the certificates that are not signed by it, after a CA rotation
+type CAStatus struct {
+	CA           string        `json:"ca"`
+	NotAfter     time.Time     `json:"notAfter"`
+	PreviousCA   string        `json:"previousCA,omitempty"`
+	RotatedAt    *time.Time    `json:"rotatedAt,omitempty"`
+	OverlapUntil *time.Time    `json:"overlapUntil,omitempty"`
+	Outdated     []Certificate `json:"outdated"`
+}
+
+// active returns true during the overlap window, when the previous CA is still trusted
+func (r *caRotation) active(now time.Time) bool {
+	return r != nil && now.Before(r.OverlapUntil)
+}
+
+// loadRotation returns the state of the CA rotation, or nil when the CA was never rotated (or the rotation is finished)
+func (p *pki) loadRotation() (*caRotation, error) {
+	if err := p.storage.HeadObject(p.bucket, p.prefix+"ca-rotation.json"); err != nil {
+		return nil, nil
+	}
+	data, err := p.storage.GetObject(p.bucket, p.prefix+"ca-rotation.json")
+	if err != nil {
+		return nil, fmt.Errorf("ca-rotation.json download error: %s", err)
+	}
+	var rotation caRotation
+	if err := json.Unmarshal(data.Bytes(), &rotation); err != nil {
+		return nil, fmt.Errorf("could not parse ca-rotation.json: %s", err)
+	}
+	return &rotation, nil
+}
+
+// loadPreviousCA returns the signing certificate and key of the CA before the rotation
+func (p *pki) loadPreviousCA(rotation *caRotation) (*x509.Certificate, interface{}, error) {
+	chain, err := parseCAChain(rotation.PreviousCA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Parsed previous CA cert Error: %s", err)
+	}
+	keyPem, err := p.storage.GetObject(p.bucket, p.prefix+"private/ca-previous.key")
+	if err != nil {
+		return nil, nil, fmt.Errorf("ca-previous.key download error: %s", err)
+	}
+	key, err := NewCert().readPrivateKey(keyPem.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Parsed previous CA key Error: %s", err)
+	}
+	return chain.signer(), key, nil
+}
+
+// trustBundle returns the root CA, followed by the root of the previous CA during the overlap window of a CA rotation
+func (p *pki) trustBundle(chain caChain, now time.Time) (string, error) {
+	rotation, err := p.loadRotation()
+	if err != nil {
+		return "", err
+	}
+	if !rotation.active(now) {
+		return chain.root(), nil
+	}
+	previous, err := parseCAChain(rotation.PreviousCA)
+	if err != nil {
+		return "", fmt.Errorf("Parsed previous CA cert Error: %s", err)
+	}
+	return chain.root() + previous.root(), nil
+}
+
+// writeTrustBundle writes the trust bundle to ca-bundle.crt, for openvpn servers that read their CA from the storage backend
+func (p *pki) writeTrustBundle(now time.Time) error {
+	chain, err := p.loadCAChain()
+	if err != nil {
+		return err
+	}
+	bundle, err := p.trustBundle(chain, now)
+	if err != nil {
+		return err
+	}
+	return p.storage.PutObject(p.bucket, p.prefix+"ca-bundle.crt", bundle, p.kmsArn)
+}
+
+// signedByCurrentCA returns false when the certificate is signed by a previous CA
+func (p *pki) signedByCurrentCA(cert *x509.Certificate) (bool, error) {
+	chain, err := p.loadCAChain()
+	if err != nil {
+		return false, err
+	}
+	return cert.CheckSignatureFrom(chain.signer()) == nil, nil
+}
+
+// supersedeOutdated revokes the certificate when it's signed by a previous CA, so a new certificate can be issued.
+// It returns the revoked certificate, or nil when the certificate is signed by the current CA.
+func (p *pki) supersedeOutdated(name string, certPem bytes.Buffer) (*issuedCert, error) {
+	parsedCert, err := NewCert().readCert(certPem.String())
+	if err != nil {
+		return nil, err
+	}
+	current, err := p.signedByCurrentCA(parsedCert)
+	if err != nil || current {
+		return nil, err
+	}
+	superseded := issuedCert{Name: name, Cert: parsedCert}
+	if _, err := p.revokeAll([]issuedCert{superseded}, "superseded"); err != nil {
+		return nil, err
+	}
+	return &superseded, nil
+}
+
+// rotateCA replaces the CA. The previous CA stays trusted until now + overlap: it's in the trust bundle of the profiles
+// and the server bundle, and the certificates of the previous CA can still be revoked. When chain is empty, a new root
+// CA is created with commonName.
+func (p *pki) rotateCA(ctx context.Context, commonName, chain, key string, overlap time.Duration, now time.Time) error {
+	rotation, err := p.loadRotation()
+	if err != nil {
+		return err
+	}
+	if rotation.active(now) {
+		return fmt.Errorf("the previous CA rotation is still in its overlap window until %s, finish it first", rotation.OverlapUntil.Format(time.RFC3339))
+	}
+	previousCA, err := p.storage.GetObject(p.bucket, p.prefix+"ca.crt")
+	if err != nil {
+		return fmt.Errorf("ca.crt download error: %s", err)
+	}
+	previousKey, err := p.storage.GetObject(p.bucket, p.prefix+"private/ca.key")
+	if err != nil {
+		return fmt.Errorf("ca.key download error: %s", err)
+	}
+	if chain == "" {
+		caCert, caKey, err := NewCert().createCA(ctx, commonName)
+		if err != nil {
+			return fmt.Errorf("Create CA error: %s", err)
+		}
+		chain, key = caCert.String(), caKey.String()
+	}
+	newChain, err := validateCA(chain, key)
+	if err != nil {
+		return err
+	}
+	if previousChain, err := parseCAChain(previousCA.String()); err == nil && previousChain.signer().Equal(newChain.signer()) {
+		return fmt.Errorf("%s is already the CA", newChain.signer().Subject.CommonName)
+	}
+
+	record, err := json.Marshal(caRotation{PreviousCA: previousCA.String(), RotatedAt: now.UTC(), OverlapUntil: now.Add(overlap).UTC()})
+	if err != nil {
+		return err
+	}
+	if err := p.storage.PutObject(p.bucket, p.prefix+"private/ca-previous.key", previousKey.String(), p.kmsArn); err != nil {
+		return fmt.Errorf("Blob Storage Put error: %s", err)
+	}
+	if err := p.storage.PutObject(p.bucket, p.prefix+"ca-rotation.json", string(record), p.kmsArn); err != nil {
+		return fmt.Errorf("Blob Storage Put error: %s", err)
+	}
+	if err := p.storeCA(chain, key); err != nil {
+		return err
+	}
+	if err := p.writeTrustBundle(now); err != nil {
+		return err
+	}
+	return p.generateCRL()
+}
+
+// finishRotation stops trusting the previous CA and deletes its key. The certificates of the previous CA should be
+// reissued first, unless force is set.
+func (p *pki) finishRotation(force bool, now time.Time) error {
+	status, err := p.caStatus(now)
+	if err != nil {
+		return err
+	}
+	if status.PreviousCA == "" {
+		return fmt.Errorf("there is no CA rotation to finish")
+	}
+	if len(status.Outdated) > 0 && !force {
+		return fmt.Errorf("%d certificates are still signed by the previous CA, use force to finish the rotation anyway", len(status.Outdated))
+	}
+	// the key is deleted first, a finish that fails halfway can be run again while ca-rotation.json exists
+	if err := p.storage.DeleteObject(p.bucket, p.prefix+"private/ca-previous.key"); err != nil {
+		return err
+	}
+	if err := p.storage.DeleteObject(p.bucket, p.prefix+"ca-rotation.json"); err != nil {
+		return err
+	}
+	if err := p.writeTrustBundle(now); err != nil {
+		return err
+	}
+	return p.generateCRL()
+}
+
+// caStatus returns the CA, the state of the rotation and the unexpired certificates that are not signed by the CA
+func (p *pki) caStatus(now time.Time) (CAStatus, error) {
+	chain, err := p.loadCAChain()
+	if err != nil {
+		return CAStatus{}, err
+	}
+	status := CAStatus{CA: chain.signer().Subject.CommonName, NotAfter: chain.signer().NotAfter, Outdated: []Certificate{}}
+	rotation, err := p.loadRotation()
+	if err != nil {
+		return status, err
+	}
+	if rotation != nil {
+		previous, err := parseCAChain(rotation.PreviousCA)
+		if err != nil {
+			return status, fmt.Errorf("Parsed previous CA cert Error: %s", err)
+		}
+		status.PreviousCA = previous.signer().Subject.CommonName
+		status.RotatedAt = &rotation.RotatedAt
+		status.OverlapUntil = &rotation.OverlapUntil
+	}
+	issued, err := p.listIssued()
+	if err != nil {
+		return status, err
+	}
+	for _, issuedCert := range issued {
+		if now.After(issuedCert.Cert.NotAfter) || issuedCert.Cert.CheckSignatureFrom(chain.signer()) == nil {
+			continue
+		}
+		status.Outdated = append(status.Outdated, newCertificate(issuedCert))
+	}
+	sort.SliceStable(status.Outdated, func(i, j int) bool {
+		return status.Outdated[i].CommonName < status.Outdated[j].CommonName
+	})
+	return status, nil
+}
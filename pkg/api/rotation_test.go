@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+// shortLivedCA returns a self-signed CA (pem) and its key, valid for validity
+func shortLivedCA(t *testing.T, commonName string, validity time.Duration) (string, string) {
+	caPem, caKeyPem, err := NewCert().createCert(context.Background(), &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("createCert error: %s", err)
+	}
+	return caPem.String(), caKeyPem.String()
+}
+
+// parseCRLs returns the CRLs in crl.pem
+func parseCRLs(t *testing.T, input string) []*x509.RevocationList {
+	var crls []*x509.RevocationList
+	rest := []byte(input)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return crls
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			t.Fatalf("ParseRevocationList error: %s", err)
+		}
+		crls = append(crls, crl)
+	}
+}
+
+func TestRotateCA(t *testing.T) {
+	blobStorage := storage.NewMemory()
+	p := newPKI(blobStorage, "bucket", "pki/")
+	a := newAdminPKI(p, "admin")
+	oldCA, oldKey := shortLivedCA(t, "Old CA", 2*time.Hour)
+	if err := a.ImportCA(oldCA, oldKey, false); err != nil {
+		t.Fatalf("ImportCA error: %s", err)
+	}
+	for _, key := range []string{"ta.key", "dh.pem", "openvpn-client.conf"} {
+		blobStorage.PutObject("bucket", "pki/"+key, "<ca>\n[CA]</ca>\n<cert>\n[CERT]</cert>\n", "")
+	}
+	alicePem, _, err := p.issueClientCert(context.Background(), "alice", "client-alice-2024", "")
+	if err != nil {
+		t.Fatalf("issueClientCert error: %s", err)
+	}
+	alice, _ := NewCert().readCert(alicePem.String())
+	if _, _, err := p.issueClientCert(context.Background(), "bob", "client-bob-2024", ""); err != nil {
+		t.Fatalf("issueClientCert error: %s", err)
+	}
+	if _, _, _, err := p.getServerCert(context.Background(), "vpn1", nil, time.Now()); err != nil {
+		t.Fatalf("getServerCert error: %s", err)
+	}
+
+	newCA, newKey := shortLivedCA(t, "New CA", 4*time.Hour)
+	now := time.Now()
+	if err := p.rotateCA(context.Background(), "", newCA, newKey, time.Hour, now); err != nil {
+		t.Fatalf("rotateCA error: %s", err)
+	}
+	if err := p.rotateCA(context.Background(), "Another CA", "", "", time.Hour, now); err == nil {
+		t.Errorf("Expected error when rotating during the overlap window")
+	}
+
+	status, err := p.caStatus(now)
+	if err != nil {
+		t.Fatalf("caStatus error: %s", err)
+	}
+	if status.CA != "New CA" || status.PreviousCA != "Old CA" || len(status.Outdated) != 3 || status.Outdated[0].CommonName != "alice" {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	// the certificates of the old CA are trusted during the overlap window
+	bundle, _ := blobStorage.GetObject("bucket", "pki/ca-bundle.crt")
+	if bundle.String() != strings.TrimSpace(newCA)+"\n"+strings.TrimSpace(oldCA)+"\n" {
+		t.Errorf("Unexpected trust bundle: %s", bundle.String())
+	}
+	aliceCert, aliceKey, _ := p.getClientCert("client-alice-2024")
+	ovpnConfig, err := p.clientConfig(aliceCert, aliceKey)
+	if err != nil {
+		t.Fatalf("clientConfig error: %s", err)
+	}
+	if err := verifyChain(aliceCert.String(), profileSection(t, ovpnConfig, "ca"), x509.ExtKeyUsageClientAuth); err != nil {
+		t.Errorf("Certificate of the old CA should be valid during the overlap window: %s", err)
+	}
+
+	// certificates of both CAs can be revoked
+	if _, err := p.revokeLogin("bob", "test"); err != nil {
+		t.Fatalf("revokeLogin error: %s", err)
+	}
+	crlPem, _ := blobStorage.GetObject("bucket", "pki/crl.pem")
+	crls := parseCRLs(t, crlPem.String())
+	oldChain, _ := parseCAChain(oldCA)
+	newChain, _ := parseCAChain(newCA)
+	if len(crls) != 2 || crls[0].CheckSignatureFrom(newChain.signer()) != nil || crls[1].CheckSignatureFrom(oldChain.signer()) != nil {
+		t.Fatalf("Expected a CRL signed by the new CA and one signed by the old CA, got %d", len(crls))
+	}
+	if len(crls[1].RevokedCertificateEntries) != 1 {
+		t.Errorf("Expected bob to be revoked in the CRL of the old CA")
+	}
+
+	// certificates of the old CA are reissued on download
+	superseded, err := p.supersedeOutdated("client-alice-2024", aliceCert)
+	if err != nil || superseded == nil || superseded.Cert.SerialNumber.Cmp(alice.SerialNumber) != 0 {
+		t.Fatalf("Expected the certificate of alice to be superseded, got %+v (err: %v)", superseded, err)
+	}
+	reissued, _, err := p.issueClientCert(context.Background(), "alice", "client-alice-2024", "")
+	if err != nil {
+		t.Fatalf("issueClientCert error: %s", err)
+	}
+	if superseded, err := p.supersedeOutdated("client-alice-2024", reissued); err != nil || superseded != nil {
+		t.Errorf("The certificate of the new CA should not be superseded (err: %v)", err)
+	}
+	serverCert, _, replaced, err := p.getServerCert(context.Background(), "vpn1", nil, now)
+	if err != nil || replaced == nil {
+		t.Fatalf("Expected a new server certificate (err: %v)", err)
+	}
+	if err := verifyChain(serverCert.String(), newCA, x509.ExtKeyUsageServerAuth); err != nil {
+		t.Errorf("Server certificate should be signed by the new CA: %s", err)
+	}
+	if status, _ := p.caStatus(now); len(status.Outdated) != 0 {
+		t.Errorf("Expected no outdated certificates, got %+v", status.Outdated)
+	}
+
+	// after the overlap window, only the new CA is trusted
+	bundleAfter, err := p.trustBundle(newChain, now.Add(2*time.Hour))
+	if err != nil || bundleAfter != newChain.root() {
+		t.Errorf("Expected only the new CA after the overlap window, got %s (err: %v)", bundleAfter, err)
+	}
+	if err := p.finishRotation(false, now); err != nil {
+		t.Fatalf("finishRotation error: %s", err)
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/private/ca-previous.key"); err == nil {
+		t.Errorf("The key of the previous CA should be deleted")
+	}
+	crlPem, _ = blobStorage.GetObject("bucket", "pki/crl.pem")
+	if crls := parseCRLs(t, crlPem.String()); len(crls) != 1 {
+		t.Errorf("Expected a single CRL after the rotation, got %d", len(crls))
+	}
+	if err := p.finishRotation(false, now); err == nil {
+		t.Errorf("Expected error when there is no rotation to finish")
+	}
+}
+
+func TestFinishRotationWithOutdatedCerts(t *testing.T) {
+	blobStorage := storage.NewMemory()
+	p := newPKI(blobStorage, "bucket", "pki/")
+	a := newAdminPKI(p, "admin")
+	oldCA, oldKey := shortLivedCA(t, "Old CA", time.Hour)
+	if err := a.ImportCA(oldCA, oldKey, false); err != nil {
+		t.Fatalf("ImportCA error: %s", err)
+	}
+	if _, _, err := p.issueClientCert(context.Background(), "alice", "client-alice-2024", ""); err != nil {
+		t.Fatalf("issueClientCert error: %s", err)
+	}
+	if err := a.RotateCA(context.Background(), RotateOptions{Chain: oldCA, Key: oldKey}); err == nil || !strings.Contains(err.Error(), "already the CA") {
+		t.Errorf("Expected error when rotating to the same CA, got: %v", err)
+	}
+	if err := a.RotateCA(context.Background(), RotateOptions{CACommonName: "New CA", Overlap: time.Minute}); err != nil {
+		t.Fatalf("RotateCA error: %s", err)
+	}
+	if err := a.FinishRotation(false); err == nil || !strings.Contains(err.Error(), "1 certificates") {
+		t.Errorf("Expected error for the certificate of the old CA, got: %v", err)
+	}
+	// a finish that fails halfway can be run again
+	failing := newPKI(&failingDeletes{StorageIf: blobStorage, prefix: "pki/ca-rotation.json"}, "bucket", "pki/")
+	if err := failing.finishRotation(true, time.Now()); err == nil {
+		t.Fatalf("Expected an error when ca-rotation.json can't be deleted")
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/private/ca-previous.key"); err == nil {
+		t.Errorf("Expected the key of the previous CA to be deleted first")
+	}
+	if err := a.FinishRotation(true); err != nil {
+		t.Fatalf("FinishRotation error: %s", err)
+	}
+	status, err := a.CAStatus()
+	if err != nil || status.PreviousCA != "" || len(status.Outdated) != 1 {
+		t.Errorf("Expected the certificate of the old CA to be reported after the rotation, got %+v (err: %v)", status, err)
+	}
+}
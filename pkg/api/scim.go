@@ -0,0 +1,596 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+var scimFilterRegexp = regexp.MustCompile(`(?i)^\s*(userName|externalId)\s+eq\s+"([^"]*)"\s*$`)
+
+var scimGroupPathRegexp = regexp.MustCompile(`(?i)^groups(\[\s*value\s+eq\s+"([^"]*)"\s*\])?$`)
+
+// errAccessRevoked is returned for users that are deactivated or deleted by the identity provider
+var errAccessRevoked = errors.New("Access has been revoked")
+
+// scimDirectory stores the users pushed by the identity provider in the storage backend
+type scimDirectory struct {
+	storage storage.StorageIf
+	bucket  string
+	prefix  string
+	kmsArn  string
+}
+
+func newScimDirectory(blobStorage storage.StorageIf, bucket, prefix string) *scimDirectory {
+	return &scimDirectory{
+		storage: blobStorage,
+		bucket:  bucket,
+		prefix:  prefix,
+	}
+}
+
+// newScimDirectory returns the scim directory in the storage backend, with the kms key of the configuration
+func (s *server) newScimDirectory(blobStorage storage.StorageIf, bucket, prefix string) *scimDirectory {
+	d := newScimDirectory(blobStorage, bucket, prefix)
+	d.kmsArn = s.config.Storage.S3.KMSArn
+	return d
+}
+
+func (d *scimDirectory) get(id string) (ScimUser, error) {
+	var user ScimUser
+	data, err := d.storage.GetObject(d.bucket, d.prefix+"scim/users/"+id+".json")
+	if err != nil {
+		return user, err
+	}
+	err = json.Unmarshal(data.Bytes(), &user)
+	return user, err
+}
+
+func (d *scimDirectory) getByLogin(login string) (ScimUser, error) {
+	id, err := d.storage.GetObject(d.bucket, d.prefix+"scim/logins/"+login)
+	if err != nil {
+		return ScimUser{}, err
+	}
+	return d.get(id.String())
+}
+
+// lookup returns the user with the login, a deleted user is returned from its tombstone as an inactive user
+func (d *scimDirectory) lookup(login string) (ScimUser, error) {
+	user, err := d.getByLogin(login)
+	if !errors.Is(err, storage.ErrNotExist) {
+		return user, err
+	}
+	data, err := d.storage.GetObject(d.bucket, d.prefix+"scim/deleted/"+login)
+	if err != nil {
+		return ScimUser{}, err
+	}
+	err = json.Unmarshal(data.Bytes(), &user)
+	user.Active = false
+	return user, err
+}
+
+/*
+ * checkAccess returns errAccessRevoked when the user is deactivated or deleted in the scim directory. Users that were
+ * never provisioned have access. Any other error is returned, so the caller denies access when the directory can't be
+ * read.
+ */
+func (d *scimDirectory) checkAccess(login string) error {
+	user, err := d.lookup(login)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Could not look up the user in the scim directory: %s", err)
+	}
+	if !user.Active {
+		return errAccessRevoked
+	}
+	return nil
+}
+
+func (d *scimDirectory) list() ([]ScimUser, error) {
+	users := []ScimUser{}
+	items, err := d.storage.ListObjects(d.bucket, d.prefix+"scim/users/")
+	if err != nil {
+		return users, err
+	}
+	for _, item := range items {
+		id := strings.TrimSuffix(strings.TrimPrefix(item, d.prefix+"scim/users/"), ".json")
+		user, err := d.get(id)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Meta.Created.Before(users[j].Meta.Created) })
+	return users, nil
+}
+
+// save stores the user. A renamed user keeps a tombstone of the previous userName in scim/deleted/, like a deleted user.
+func (d *scimDirectory) save(user ScimUser, previousUserName string) error {
+	out, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if err := d.storage.PutObject(d.bucket, d.prefix+"scim/users/"+user.ID+".json", string(out), d.kmsArn); err != nil {
+		return err
+	}
+	if previousUserName != "" && previousUserName != user.UserName {
+		previous := user
+		previous.UserName = previousUserName
+		if err := d.tombstone(previous); err != nil {
+			return err
+		}
+		if err := d.storage.DeleteObject(d.bucket, d.prefix+"scim/logins/"+previousUserName); err != nil {
+			return err
+		}
+	}
+	return d.storage.PutObject(d.bucket, d.prefix+"scim/logins/"+user.UserName, user.ID, d.kmsArn)
+}
+
+/*
+ * delete removes the user. An inactive copy of the user is kept as a tombstone in scim/deleted/, so the login stays
+ * denied after the delete, also when the deprovisioning didn't complete.
+ */
+func (d *scimDirectory) delete(user ScimUser) error {
+	if err := d.tombstone(user); err != nil {
+		return err
+	}
+	if err := d.storage.DeleteObject(d.bucket, d.prefix+"scim/logins/"+user.UserName); err != nil {
+		return err
+	}
+	return d.storage.DeleteObject(d.bucket, d.prefix+"scim/users/"+user.ID+".json")
+}
+
+// tombstone writes an inactive copy of the user to scim/deleted/<userName>
+func (d *scimDirectory) tombstone(user ScimUser) error {
+	user.Active = false
+	out, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return d.storage.PutObject(d.bucket, d.prefix+"scim/deleted/"+user.UserName, string(out), d.kmsArn)
+}
+
+func (s *server) scimRoutes(r *mux.Router, prefix string) {
+	scim := r.PathPrefix(prefix + "/scim/v2").Subrouter()
+	scim.Use(s.scimAuthMiddleware)
+	scim.HandleFunc("/Users", s.scimListUsersHandler).Methods("GET")
+	scim.HandleFunc("/Users", s.scimCreateUserHandler).Methods("POST")
+	scim.HandleFunc("/Users/{id}", s.scimGetUserHandler).Methods("GET")
+	scim.HandleFunc("/Users/{id}", s.scimReplaceUserHandler).Methods("PUT")
+	scim.HandleFunc("/Users/{id}", s.scimPatchUserHandler).Methods("PATCH")
+	scim.HandleFunc("/Users/{id}", s.scimDeleteUserHandler).Methods("DELETE")
+}
+
+func (s *server) scimAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validBearerToken(r, s.getSCIMToken()) {
+			scimError(w, http.StatusUnauthorized, "", "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) scimListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	directory, err := s.getScimDirectory(r.Context())
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	users, err := directory.list()
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		match := scimFilterRegexp.FindStringSubmatch(filter)
+		if match == nil {
+			scimError(w, http.StatusBadRequest, "invalidFilter", "Only userName eq and externalId eq filters are supported")
+			return
+		}
+		filtered := []ScimUser{}
+		for _, user := range users {
+			if (strings.EqualFold(match[1], "userName") && strings.EqualFold(user.UserName, match[2])) ||
+				(strings.EqualFold(match[1], "externalId") && user.ExternalID == match[2]) {
+				filtered = append(filtered, user)
+			}
+		}
+		users = filtered
+	}
+
+	startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 0 {
+		count = len(users)
+	}
+	page := []ScimUser{}
+	if startIndex <= len(users) {
+		page = users[startIndex-1:]
+		if count < len(page) {
+			page = page[:count]
+		}
+	}
+
+	scimWrite(w, http.StatusOK, ScimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(users),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+func (s *server) scimGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	directory, err := s.getScimDirectory(r.Context())
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	user, err := directory.get(mux.Vars(r)["id"])
+	if err != nil {
+		scimError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+	scimWrite(w, http.StatusOK, user)
+}
+
+func (s *server) scimCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := ScimUser{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		scimError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if err := validateScimUser(user); err != nil {
+		scimError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	directory, err := s.getScimDirectory(r.Context())
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if _, err := directory.getByLogin(user.UserName); err == nil {
+		scimError(w, http.StatusConflict, "uniqueness", "User with userName "+user.UserName+" already exists")
+		return
+	}
+
+	now := time.Now().UTC()
+	user.ID = uuid.New().String()
+	user.Schemas = []string{scimUserSchema}
+	user.Meta = ScimMeta{
+		ResourceType: "User",
+		Created:      now,
+		LastModified: now,
+		Location:     scimLocation(r, user.ID),
+	}
+	if err := directory.save(user, ""); err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	s.auditLog(r, audit.Event{Type: audit.UserProvisioned, Actor: "scim", Subject: user.UserName, Details: map[string]string{"id": user.ID}})
+	if !user.Active {
+		if err := s.deprovision(r, user.UserName); err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+	}
+	scimWrite(w, http.StatusCreated, user)
+}
+
+func (s *server) scimReplaceUserHandler(w http.ResponseWriter, r *http.Request) {
+	directory, err := s.getScimDirectory(r.Context())
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	existing, err := directory.get(mux.Vars(r)["id"])
+	if err != nil {
+		scimError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+	user := ScimUser{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		scimError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if err := validateScimUser(user); err != nil {
+		scimError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	user.ID = existing.ID
+	user.Schemas = []string{scimUserSchema}
+	user.Meta = existing.Meta
+	s.scimUpdateUser(w, r, directory, existing, user)
+}
+
+func (s *server) scimPatchUserHandler(w http.ResponseWriter, r *http.Request) {
+	var patch ScimPatchOp
+	directory, err := s.getScimDirectory(r.Context())
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	existing, err := directory.get(mux.Vars(r)["id"])
+	if err != nil {
+		scimError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		scimError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	user := existing
+	for _, operation := range patch.Operations {
+		if err := applyScimPatchOperation(&user, operation); err != nil {
+			scimError(w, http.StatusBadRequest, "invalidValue", err.Error())
+			return
+		}
+	}
+	if err := validateScimUser(user); err != nil {
+		scimError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	s.scimUpdateUser(w, r, directory, existing, user)
+}
+
+func (s *server) scimUpdateUser(w http.ResponseWriter, r *http.Request, directory *scimDirectory, existing, user ScimUser) {
+	if user.UserName != existing.UserName {
+		if _, err := directory.getByLogin(user.UserName); err == nil {
+			scimError(w, http.StatusConflict, "uniqueness", "User with userName "+user.UserName+" already exists")
+			return
+		}
+	}
+	user.Meta.LastModified = time.Now().UTC()
+	if err := directory.save(user, existing.UserName); err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	s.auditLog(r, audit.Event{Type: audit.UserUpdated, Actor: "scim", Subject: user.UserName, Details: map[string]string{
+		"id":       user.ID,
+		"active":   strconv.FormatBool(user.Active),
+		"userName": existing.UserName + " -> " + user.UserName,
+	}})
+	// a rename or a deactivation invalidates the certificates issued to the previous login
+	if user.UserName != existing.UserName {
+		if err := s.deprovision(r, existing.UserName); err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+	}
+	if !user.Active {
+		if err := s.deprovision(r, user.UserName); err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+	}
+	scimWrite(w, http.StatusOK, user)
+}
+
+func (s *server) scimDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	directory, err := s.getScimDirectory(r.Context())
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	user, err := directory.get(mux.Vars(r)["id"])
+	if err != nil {
+		scimError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+	if err := s.deprovision(r, user.UserName); err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if err := directory.delete(user); err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	s.auditLog(r, audit.Event{Type: audit.UserDeprovisioned, Actor: "scim", Subject: user.UserName, Details: map[string]string{"id": user.ID, "deleted": "true"}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deprovision revokes all certificates of the user and removes the client config dir (ccd) entries of the user and its devices
+func (s *server) deprovision(r *http.Request, login string) error {
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		return err
+	}
+	revoked, err := s.newPKI(blobStorage, storageBucket, storagePrefix).revokeLogin(login, "deprovisioned")
+	s.auditCerts(r, audit.CertRevoked, "scim", revoked...)
+	s.disconnect(r, "scim", revoked...)
+	if err != nil {
+		return err
+	}
+	if len(revoked) > 0 {
+		s.auditLog(r, audit.Event{Type: audit.UserDeprovisioned, Actor: "scim", Subject: login, Details: map[string]string{"revoked": strconv.Itoa(len(revoked))}})
+	}
+	// the entries of the devices are ccd/<login>:<device>
+	entries, err := blobStorage.ListObjects(storageBucket, storagePrefix+"ccd/"+login+":")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := blobStorage.DeleteObject(storageBucket, entry); err != nil {
+			return err
+		}
+	}
+	return blobStorage.DeleteObject(storageBucket, storagePrefix+"ccd/"+login)
+}
+
+func (s *server) getScimDirectory(ctx context.Context) (*scimDirectory, error) {
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.newScimDirectory(blobStorage, storageBucket, storagePrefix), nil
+}
+
+func applyScimPatchOperation(user *ScimUser, operation ScimPatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if match := scimGroupPathRegexp.FindStringSubmatch(operation.Path); match != nil {
+		return applyScimGroupsPatch(user, op, match[2], operation.Value)
+	}
+	if op != "replace" && op != "add" {
+		// removal of attributes is not relevant for the lifecycle of a user
+		return nil
+	}
+	if operation.Path == "" {
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(operation.Value, &values); err != nil {
+			return fmt.Errorf("patch value without path should be an object: %s", err)
+		}
+		for path, value := range values {
+			if err := applyScimPatchValue(user, path, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return applyScimPatchValue(user, operation.Path, operation.Value)
+}
+
+func applyScimPatchValue(user *ScimUser, path string, value json.RawMessage) error {
+	switch strings.ToLower(path) {
+	case "active":
+		active, err := parseScimBool(value)
+		if err != nil {
+			return err
+		}
+		user.Active = active
+	case "username":
+		return json.Unmarshal(value, &user.UserName)
+	case "externalid":
+		return json.Unmarshal(value, &user.ExternalID)
+	case "displayname":
+		return json.Unmarshal(value, &user.DisplayName)
+	case "groups":
+		groups, err := parseScimGroups(value)
+		user.Groups = groups
+		return err
+	}
+	return nil
+}
+
+// applyScimGroupsPatch adds, replaces or removes group memberships. A removal removes the group in the path filter
+// (groups[value eq "id"]), the groups in the value, or all groups.
+func applyScimGroupsPatch(user *ScimUser, op, filter string, value json.RawMessage) error {
+	groups, err := parseScimGroups(value)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case "replace":
+		user.Groups = groups
+	case "add":
+		for _, group := range groups {
+			if !slices.ContainsFunc(user.Groups, func(g ScimGroup) bool { return g.Value == group.Value }) {
+				user.Groups = append(user.Groups, group)
+			}
+		}
+	case "remove":
+		if filter != "" {
+			groups = []ScimGroup{{Value: filter}}
+		}
+		remaining := []ScimGroup{}
+		for _, group := range user.Groups {
+			if len(groups) > 0 && !slices.ContainsFunc(groups, func(removed ScimGroup) bool { return removed.Value == group.Value }) {
+				remaining = append(remaining, group)
+			}
+		}
+		user.Groups = remaining
+	}
+	return nil
+}
+
+// parseScimGroups parses a list of groups or a single group, an empty value is no groups
+func parseScimGroups(value json.RawMessage) ([]ScimGroup, error) {
+	groups := []ScimGroup{}
+	if len(value) == 0 || string(value) == "null" {
+		return groups, nil
+	}
+	if err := json.Unmarshal(value, &groups); err == nil {
+		return groups, nil
+	}
+	var group ScimGroup
+	if err := json.Unmarshal(value, &group); err != nil {
+		return nil, fmt.Errorf("invalid groups: %s", string(value))
+	}
+	return append(groups, group), nil
+}
+
+// parseScimBool accepts booleans and the string representations some identity providers send
+func parseScimBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var str string
+	if err := json.Unmarshal(value, &str); err != nil {
+		return false, fmt.Errorf("invalid boolean: %s", string(value))
+	}
+	return strconv.ParseBool(strings.ToLower(str))
+}
+
+func validateScimUser(user ScimUser) error {
+	if user.UserName == "" {
+		return fmt.Errorf("userName is required")
+	}
+	if strings.Contains(user.UserName, "/") {
+		return fmt.Errorf("userName can't contain a slash")
+	}
+	// the common names of devices are <login>:<device>, and server- is the prefix of the server certificates
+	if strings.Contains(user.UserName, ":") {
+		return fmt.Errorf("userName can't contain a colon")
+	}
+	if strings.HasPrefix(user.UserName, "server-") {
+		return fmt.Errorf("userName can't start with server-")
+	}
+	return nil
+}
+
+func scimLocation(r *http.Request, id string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + strings.TrimSuffix(r.URL.Path, "/") + "/" + id
+}
+
+func scimWrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func scimError(w http.ResponseWriter, status int, scimType, detail string) {
+	scimWrite(w, status, ScimError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
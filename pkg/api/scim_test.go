@@ -0,0 +1,279 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/config"
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+func newTestServer(t *testing.T) (*server, storage.StorageIf) {
+	blobStorage := storage.NewMemory()
+	if err := blobStorage.PutObject("bucket", "pki/ca.crt", caCert, ""); err != nil {
+		t.Fatalf("PutObject error: %s", err)
+	}
+	if err := blobStorage.PutObject("bucket", "pki/private/ca.key", caKey, ""); err != nil {
+		t.Fatalf("PutObject error: %s", err)
+	}
+	s := NewServer(config.Default())
+	s.storage = blobStorage
+	s.storageBucket = "bucket"
+	s.storagePrefix = "pki/"
+	s.auditLogger = audit.NewLogger(blobStorage, "bucket", "pki/", "", io.Discard)
+	return s, blobStorage
+}
+
+func issueTestCert(t *testing.T, blobStorage storage.StorageIf, login, name string) *x509.Certificate {
+	c := NewCert()
+	parsedCaCert, _ := c.readCert(caCert)
+	parsedCaKey, _ := c.readPrivateKey(caKey)
+	clientCert, clientKey, err := c.createClientCert(context.Background(), parsedCaCert, parsedCaKey, login, "")
+	if err != nil {
+		t.Fatalf("Create Cert error: %s", err)
+	}
+	blobStorage.PutObject("bucket", "pki/issued/"+name+".crt", clientCert.String(), "")
+	blobStorage.PutObject("bucket", "pki/private/"+name+".key", clientKey.String(), "")
+	parsed, err := c.readCert(clientCert.String())
+	if err != nil {
+		t.Fatalf("Parse cert error: %s", err)
+	}
+	if err := newPKI(blobStorage, "bucket", "pki/").indexSerial(name, parsed); err != nil {
+		t.Fatalf("indexSerial error: %s", err)
+	}
+	if err := newPKI(blobStorage, "bucket", "pki/").indexLogin(name, parsed); err != nil {
+		t.Fatalf("indexLogin error: %s", err)
+	}
+	return parsed
+}
+
+func scimRequest(t *testing.T, router *mux.Router, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var reqBody bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&reqBody).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &reqBody)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestScimAuth(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.config.SCIMToken = "secret-token"
+	r := mux.NewRouter()
+	s.scimRoutes(r, "")
+
+	rec := scimRequest(t, r, "GET", "/scim/v2/Users", "wrong-token", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d", rec.Code)
+	}
+	rec = scimRequest(t, r, "GET", "/scim/v2/Users", "secret-token", nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestScimDeactivateRevokesCertificates(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	s.config.SCIMToken = "secret-token"
+	r := mux.NewRouter()
+	s.scimRoutes(r, "")
+
+	aliceCert := issueTestCert(t, blobStorage, "alice@example.com", "client-alice@example.com-2024")
+	issueTestCert(t, blobStorage, "bob@example.com", "client-bob@example.com-2024")
+	blobStorage.PutObject("bucket", "pki/ccd/alice@example.com", "ifconfig-push 10.8.0.10 255.255.255.0", "")
+
+	rec := scimRequest(t, r, "POST", "/scim/v2/Users", "secret-token", ScimUser{UserName: "alice@example.com", Active: true})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var user ScimUser
+	if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+	if user.ID == "" || !user.Active {
+		t.Fatalf("Unexpected user: %+v", user)
+	}
+
+	rec = scimRequest(t, r, "POST", "/scim/v2/Users", "secret-token", ScimUser{UserName: "alice@example.com"})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for duplicate userName, got %d", rec.Code)
+	}
+
+	rec = scimRequest(t, r, "GET", `/scim/v2/Users?filter=userName+eq+"alice@example.com"`, "secret-token", nil)
+	var list ScimListResponse
+	json.NewDecoder(rec.Body).Decode(&list)
+	if list.TotalResults != 1 || list.Resources[0].ID != user.ID {
+		t.Errorf("Filter didn't return the user: %+v", list)
+	}
+
+	// Azure AD sends the active flag as a string
+	patch := ScimPatchOp{Operations: []ScimPatchOperation{{Op: "Replace", Path: "active", Value: json.RawMessage(`"False"`)}}}
+	rec = scimRequest(t, r, "PATCH", "/scim/v2/Users/"+user.ID, "secret-token", patch)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if err := blobStorage.HeadObject("bucket", "pki/issued/client-alice@example.com-2024.crt"); err == nil {
+		t.Errorf("Issued certificate still exists after deactivation")
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/private/client-alice@example.com-2024.key"); err == nil {
+		t.Errorf("Private key still exists after deactivation")
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/ccd/alice@example.com"); err == nil {
+		t.Errorf("CCD entry still exists after deactivation")
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/issued/client-bob@example.com-2024.crt"); err != nil {
+		t.Errorf("Certificate of other user was revoked: %s", err)
+	}
+	serial := fmt.Sprintf("%X", aliceCert.SerialNumber)
+	if err := blobStorage.HeadObject("bucket", "pki/revoked/certs_by_serial/"+serial+".crt"); err != nil {
+		t.Errorf("Revoked certificate not found: %s", err)
+	}
+
+	crlPem, err := blobStorage.GetObject("bucket", "pki/crl.pem")
+	if err != nil {
+		t.Fatalf("CRL not found: %s", err)
+	}
+	block, _ := pem.Decode(crlPem.Bytes())
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatalf("Could not parse CRL: %s", err)
+	}
+	if len(crl.RevokedCertificates) != 1 || crl.RevokedCertificates[0].SerialNumber.Cmp(aliceCert.SerialNumber) != 0 {
+		t.Errorf("CRL doesn't contain the revoked certificate")
+	}
+
+	s.auditLogger.Flush()
+	events, err := s.auditLogger.Query(audit.Query{Type: audit.CertRevoked, Actor: "scim"})
+	if err != nil || len(events) != 1 || events[0].Serial != serial {
+		t.Errorf("Expected revocation in audit log, got %+v (err: %v)", events, err)
+	}
+
+	rec = scimRequest(t, r, "DELETE", "/scim/v2/Users/"+user.ID, "secret-token", nil)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", rec.Code)
+	}
+	rec = scimRequest(t, r, "GET", "/scim/v2/Users/"+user.ID, "secret-token", nil)
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), scimErrorSchema) {
+		t.Errorf("Expected SCIM 404 error, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestScimRenameKeepsTombstone(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	s.config.SCIMToken = "secret-token"
+	r := mux.NewRouter()
+	s.scimRoutes(r, "")
+	directory := newScimDirectory(blobStorage, "bucket", "pki/")
+
+	rec := scimRequest(t, r, "POST", "/scim/v2/Users", "secret-token", ScimUser{UserName: "alice@example.com", Active: true})
+	var user ScimUser
+	if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+	patch := ScimPatchOp{Operations: []ScimPatchOperation{{Op: "replace", Path: "userName", Value: json.RawMessage(`"alice@example.org"`)}}}
+	if rec := scimRequest(t, r, "PATCH", "/scim/v2/Users/"+user.ID, "secret-token", patch); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := directory.checkAccess("alice@example.com"); !errors.Is(err, errAccessRevoked) {
+		t.Errorf("Expected errAccessRevoked for the previous userName, got %v", err)
+	}
+	if err := directory.checkAccess("alice@example.org"); err != nil {
+		t.Errorf("checkAccess error for the new userName: %s", err)
+	}
+
+	user.UserName = "alice@example.net"
+	if rec := scimRequest(t, r, "PUT", "/scim/v2/Users/"+user.ID, "secret-token", user); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := directory.checkAccess("alice@example.org"); !errors.Is(err, errAccessRevoked) {
+		t.Errorf("Expected errAccessRevoked for the previous userName, got %v", err)
+	}
+}
+
+func TestScimValidateUserName(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.config.SCIMToken = "secret-token"
+	r := mux.NewRouter()
+	s.scimRoutes(r, "")
+	for _, userName := range []string{"", "alice/bob", "alice:laptop", "server-openvpn"} {
+		if rec := scimRequest(t, r, "POST", "/scim/v2/Users", "secret-token", ScimUser{UserName: userName, Active: true}); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for userName %q, got %d", userName, rec.Code)
+		}
+	}
+}
+
+// failingStorage fails the reads of the objects with the prefix, like an unavailable storage backend
+type failingStorage struct {
+	storage.StorageIf
+	prefix string
+}
+
+func (s *failingStorage) HeadObject(bucket, item string) error {
+	if strings.HasPrefix(item, s.prefix) {
+		return fmt.Errorf("storage unavailable")
+	}
+	return s.StorageIf.HeadObject(bucket, item)
+}
+func (s *failingStorage) GetObject(bucket, item string) (bytes.Buffer, error) {
+	if strings.HasPrefix(item, s.prefix) {
+		return bytes.Buffer{}, fmt.Errorf("storage unavailable")
+	}
+	return s.StorageIf.GetObject(bucket, item)
+}
+
+func TestScimDeleteKeepsTombstone(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	s.config.SCIMToken = "secret-token"
+	r := mux.NewRouter()
+	s.scimRoutes(r, "")
+	directory := newScimDirectory(blobStorage, "bucket", "pki/")
+
+	rec := scimRequest(t, r, "POST", "/scim/v2/Users", "secret-token", ScimUser{UserName: "alice@example.com", Active: true})
+	var user ScimUser
+	if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+	if err := directory.checkAccess("alice@example.com"); err != nil {
+		t.Fatalf("checkAccess error for an active user: %s", err)
+	}
+	rec = scimRequest(t, r, "DELETE", "/scim/v2/Users/"+user.ID, "secret-token", nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rec.Code)
+	}
+	if err := directory.checkAccess("alice@example.com"); !errors.Is(err, errAccessRevoked) {
+		t.Errorf("Expected errAccessRevoked for a deleted user, got %v", err)
+	}
+	if err := directory.checkAccess("bob@example.com"); err != nil {
+		t.Errorf("checkAccess error for a user that isn't provisioned: %s", err)
+	}
+
+	// the identity provider can provision the login again
+	rec = scimRequest(t, r, "POST", "/scim/v2/Users", "secret-token", ScimUser{UserName: "alice@example.com", Active: true})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := directory.checkAccess("alice@example.com"); err != nil {
+		t.Errorf("checkAccess error for a provisioned user: %s", err)
+	}
+
+	failing := newScimDirectory(&failingStorage{StorageIf: blobStorage, prefix: "pki/scim/"}, "bucket", "pki/")
+	if err := failing.checkAccess("bob@example.com"); err == nil || errors.Is(err, errAccessRevoked) {
+		t.Errorf("Expected a lookup error when the scim directory can't be read, got %v", err)
+	}
+}
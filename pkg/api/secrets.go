@@ -0,0 +1,67 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/config"
+)
+
+// refreshSecrets resolves the secret references in the config at every interval, until ctx is done
+func (s *server) refreshSecrets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.updateSecrets(ctx); err != nil {
+				slog.Error("Could not refresh secrets", "error", err)
+			}
+		}
+	}
+}
+
+/*
+ * updateSecrets resolves the secret references again and uses the new oauth2 client secret, scim token, server token
+ * and management password. The session and csrf keys are only read at startup: changing them would invalidate the sessions of all users.
+ */
+func (s *server) updateSecrets(ctx context.Context) error {
+	s.secretsMu.RLock()
+	conf := s.config
+	s.secretsMu.RUnlock()
+
+	refreshed, err := conf.RefreshSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	s.auth.setClientSecret(refreshed.Auth.ClientSecret)
+
+	s.secretsMu.Lock()
+	defer s.secretsMu.Unlock()
+	s.config.Auth.ClientSecret = refreshed.Auth.ClientSecret
+	s.config.SCIMToken = refreshed.SCIMToken
+	s.config.ServerToken = refreshed.ServerToken
+	s.config.Management.Password = refreshed.Management.Password
+	return nil
+}
+
+func (s *server) getSCIMToken() string {
+	s.secretsMu.RLock()
+	defer s.secretsMu.RUnlock()
+	return s.config.SCIMToken
+}
+
+func (s *server) getServerToken() string {
+	s.secretsMu.RLock()
+	defer s.secretsMu.RUnlock()
+	return s.config.ServerToken
+}
+
+func (s *server) getManagementConfig() config.Management {
+	s.secretsMu.RLock()
+	defer s.secretsMu.RUnlock()
+	return s.config.Management
+}
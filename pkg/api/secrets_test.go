@@ -0,0 +1,30 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/in4it/openvpn-access/pkg/secrets"
+)
+
+func TestUpdateSecrets(t *testing.T) {
+	s, _ := newTestServer(t)
+	values := map[string]string{"client-secret": "client-secret", "scim-token": "scim-token"}
+	s.config.Auth.ClientSecret = "file:client-secret"
+	s.config.SCIMToken = "file:scim-token"
+	if err := s.config.ResolveSecrets(context.Background(), secrets.NewResolver(map[string]secrets.Provider{"file": secrets.NewMemory(values)})); err != nil {
+		t.Fatalf("ResolveSecrets error: %s", err)
+	}
+
+	values["client-secret"] = "rotated-client-secret"
+	values["scim-token"] = "rotated-scim-token"
+	if err := s.updateSecrets(context.Background()); err != nil {
+		t.Fatalf("updateSecrets error: %s", err)
+	}
+	if s.getSCIMToken() != "rotated-scim-token" {
+		t.Errorf("scim token not refreshed: %s", s.getSCIMToken())
+	}
+	if s.auth.getOauth2Config().ClientSecret != "rotated-client-secret" {
+		t.Errorf("client secret not refreshed: %s", s.auth.getOauth2Config().ClientSecret)
+	}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/audit"
+)
+
+type confirmation struct {
+	Message string
+	Action  string
+	Button  string
+	Fields  map[string]string
+}
+
+type issuedResponse struct {
+	Message     string          `json:"message"`
+	Note        string          `json:"-"`
+	Download    string          `json:"download"` // url of the configuration, including the url prefix
+	Certificate certificateInfo `json:"certificate"`
+}
+
+// rotateHandler asks for confirmation (GET), then revokes the certificates of the user and issues a new one (POST)
+func (s *server) rotateHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", err.Error())
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.render(w, r, http.StatusOK, "confirm.html", "Rotate certificate", login, confirmation{
+			Message: "Your current certificate will be revoked and a new certificate will be created. Configurations that you downloaded earlier will stop working. Device certificates are not affected.",
+			Action:  "/rotate",
+			Button:  "Rotate my certificate",
+		})
+		return
+	}
+	if r.FormValue("confirm") != "yes" {
+		s.writeError(w, r, http.StatusBadRequest, login, "Rotation was not confirmed")
+		return
+	}
+	issued, revoked, err := s.rotate(r.Context(), login)
+	s.auditCerts(r, audit.CertRevoked, login, revoked...)
+	s.disconnect(r, login, revoked...)
+	if errors.Is(err, errAccessRevoked) {
+		s.writeError(w, r, http.StatusForbidden, login, err.Error())
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not rotate certificate: "+err.Error())
+		return
+	}
+	s.auditCerts(r, audit.CertIssued, login, issued)
+	response := issuedResponse{
+		Message:     "Your certificate has been rotated",
+		Note:        "Replace the configuration on your device with the new one. The previous configuration won't work anymore.",
+		Download:    s.config.URLPrefix + "/ovpnconfig",
+		Certificate: newCertificateInfo(issued),
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	s.render(w, r, http.StatusOK, "issued.html", "Certificate rotated", login, response)
+}
+
+// revokeHandler asks for confirmation (GET), then revokes one certificate of the user (POST)
+func (s *server) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", err.Error())
+		return
+	}
+	serial := r.FormValue("serial")
+	if serial == "" {
+		s.writeError(w, r, http.StatusBadRequest, login, "No certificate serial given")
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.render(w, r, http.StatusOK, "confirm.html", "Revoke certificate", login, confirmation{
+			Message: "The certificate with serial " + serial + " will be revoked. Configurations using this certificate will stop working.",
+			Action:  "/revoke",
+			Button:  "Revoke certificate",
+			Fields:  map[string]string{"serial": serial},
+		})
+		return
+	}
+	if r.FormValue("confirm") != "yes" {
+		s.writeError(w, r, http.StatusBadRequest, login, "Revocation was not confirmed")
+		return
+	}
+	revoked, found, err := s.revokeUserCert(r.Context(), login, serial)
+	if found {
+		s.auditCerts(r, audit.CertRevoked, login, revoked)
+		s.disconnect(r, login, revoked)
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not revoke certificate: "+err.Error())
+		return
+	}
+	if !found {
+		s.writeError(w, r, http.StatusNotFound, login, "Certificate with serial "+serial+" not found")
+		return
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response{Message: "Certificate " + serial + " revoked"})
+		return
+	}
+	http.Redirect(w, r, s.config.URLPrefix+"/access", http.StatusSeeOther)
+}
+
+// rotate revokes the (non-device) certificates of the user and issues a new certificate, while holding the lock of the
+// login. The revoked certificates are returned as well.
+func (s *server) rotate(ctx context.Context, login string) (issuedCert, []issuedCert, error) {
+	var issued issuedCert
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		return issued, nil, err
+	}
+	if err := s.newScimDirectory(blobStorage, storageBucket, storagePrefix).checkAccess(login); err != nil {
+		return issued, nil, err
+	}
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	// a download of the user at the same time would issue the certificate that is rotated
+	lock, err := p.lockLogin(ctx, login)
+	if err != nil {
+		return issued, nil, err
+	}
+	defer lock.Release(context.WithoutCancel(ctx))
+	revoked, err := p.revokeCommonName(login, "rotated")
+	if err != nil {
+		return issued, revoked, err
+	}
+	issued.Name = "client-" + login + "-" + time.Now().Format("2006")
+	clientCert, _, err := p.issueClientCert(ctx, login, issued.Name, "")
+	if err != nil {
+		return issued, revoked, err
+	}
+	issued.Cert, err = NewCert().readCert(clientCert.String())
+	return issued, revoked, err
+}
+
+// revokeUserCert revokes the certificate with the given serial, if it belongs to the user
+func (s *server) revokeUserCert(ctx context.Context, login, serial string) (issuedCert, bool, error) {
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		return issuedCert{}, false, err
+	}
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	issued, err := p.listIssuedForLogin(login)
+	if err != nil {
+		return issuedCert{}, false, err
+	}
+	for _, userCert := range issued {
+		if fmt.Sprintf("%X", userCert.Cert.SerialNumber) == serial {
+			if err := p.revoke(userCert, "revoked by user"); err != nil {
+				return userCert, false, err
+			}
+			return userCert, true, p.generateCRL()
+		}
+	}
+	return issuedCert{}, false, nil
+}
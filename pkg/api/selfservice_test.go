@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotate(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	name := "client-alice@example.com-" + time.Now().Format("2006")
+	oldCert := issueTestCert(t, blobStorage, "alice@example.com", name)
+
+	issued, revoked, err := s.rotate(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatalf("Rotate error: %s", err)
+	}
+	if len(revoked) != 1 || revoked[0].Cert.SerialNumber.Cmp(oldCert.SerialNumber) != 0 {
+		t.Errorf("Expected the old certificate to be returned as revoked, got %+v", revoked)
+	}
+	if issued.Name != name {
+		t.Errorf("Unexpected certificate name: %s", issued.Name)
+	}
+	if issued.Cert.SerialNumber.Cmp(oldCert.SerialNumber) == 0 {
+		t.Errorf("Serial didn't change after rotation")
+	}
+	if err := blobStorage.HeadObject("bucket", fmt.Sprintf("pki/revoked/certs_by_serial/%X.crt", oldCert.SerialNumber)); err != nil {
+		t.Errorf("Old certificate is not revoked: %s", err)
+	}
+	if _, _, err := newPKI(blobStorage, "bucket", "pki/").getClientCert(name); err != nil {
+		t.Errorf("New certificate not found: %s", err)
+	}
+}
+
+func TestRotateConcurrently(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	issueTestCert(t, blobStorage, "alice@example.com", "client-alice@example.com-"+time.Now().Format("2006"))
+
+	// a rotation and a download at the same time both succeed, and leave one certificate
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, _, err := s.rotate(context.Background(), "alice@example.com"); err != nil {
+			t.Errorf("Rotate error: %s", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		name := "client-alice@example.com-" + time.Now().Format("2006")
+		if _, _, _, _, err := s.newPKI(blobStorage, "bucket", "pki/").ensureClientCert(context.Background(), "alice@example.com", name); err != nil {
+			t.Errorf("ensureClientCert error: %s", err)
+		}
+	}()
+	wg.Wait()
+	if issued, err := newPKI(blobStorage, "bucket", "pki/").listIssuedForLogin("alice@example.com"); err != nil || len(issued) != 1 {
+		t.Errorf("Expected one certificate, got %d (err: %v)", len(issued), err)
+	}
+}
+
+func TestRevokeUserCert(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	aliceCert := issueTestCert(t, blobStorage, "alice@example.com", "client-alice@example.com-2024")
+	bobCert := issueTestCert(t, blobStorage, "bob@example.com", "client-bob@example.com-2024")
+
+	_, found, err := s.revokeUserCert(context.Background(), "alice@example.com", fmt.Sprintf("%X", bobCert.SerialNumber))
+	if err != nil || found {
+		t.Errorf("User should not be able to revoke certificate of another user (found: %v, err: %v)", found, err)
+	}
+	_, found, err = s.revokeUserCert(context.Background(), "alice@example.com", fmt.Sprintf("%X", aliceCert.SerialNumber))
+	if err != nil || !found {
+		t.Fatalf("Could not revoke certificate (found: %v, err: %v)", found, err)
+	}
+	issued, err := newPKI(blobStorage, "bucket", "pki/").listIssuedForLogin("alice@example.com")
+	if err != nil || len(issued) != 0 {
+		t.Errorf("Expected no certificates for alice after revocation, got %d (err: %v)", len(issued), err)
+	}
+}
+
+func TestRotateHandlerDownloadPrefix(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	s.config.URLPrefix = "/vpn"
+	cookies := loginTestSession(t, s, "alice@example.com")
+	issueTestCert(t, blobStorage, "alice@example.com", "client-alice@example.com-"+time.Now().Format("2006"))
+
+	req := httptest.NewRequest("POST", "/vpn/rotate?confirm=yes", nil)
+	req.Header.Set("Accept", "application/json")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	s.rotateHandler(rec, req)
+	var response issuedResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected response %d (err: %v)", rec.Code, err)
+	}
+	if response.Download != "/vpn/ovpnconfig" {
+		t.Errorf("Expected the download link with the url prefix, got %s", response.Download)
+	}
+}
@@ -1,33 +1,46 @@
 package api
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/csrf"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/config"
+	"github.com/in4it/openvpn-access/pkg/logging"
+	"github.com/in4it/openvpn-access/pkg/metrics"
 	"github.com/in4it/openvpn-access/pkg/storage"
+	"github.com/in4it/openvpn-access/pkg/tracing"
 )
 
-/*
- * Config has a Port property
- */
-type Config struct {
-	Port string
-}
-
 type server struct {
-	config       Config
+	config       config.Config
 	auth         *Auth
 	sessionStore *sessions.CookieStore
+	auditLogger  *audit.Logger
+	// storage overrides the storage backend of the configuration
+	storage       storage.StorageIf
+	storageBucket string
+	storagePrefix string
+	// secretsMu protects the secrets in the config that are refreshed
+	secretsMu sync.RWMutex
+	ocspCache *ocspCache
+	caCache   *caCache
+	// blobStorage is the storage backend of the configuration with its clients, created once by initStorage
+	blobStorage   storage.StorageIf
+	backend       string
+	backendBucket string
+	backendPrefix string
 }
 
 type response struct {
@@ -40,16 +53,34 @@ type errorResponse struct {
 /*
  * NewServer initializes new server
  */
-func NewServer(conf Config) *server {
+func NewServer(conf config.Config) *server {
 	return &server{
-		config: conf,
-		auth:   NewAuth(),
+		config:    conf,
+		auth:      NewAuth(conf.Auth),
+		ocspCache: newOCSPCache(),
+		caCache:   newCACache(),
 	}
 }
-func (s *server) Start() {
+
+/*
+ * Start initializes the server and listens on the configured port, until ctx is done. In-flight requests are finished
+ * and the audit log is flushed before returning. An error is returned when the server can't be initialized or stops
+ * listening.
+ */
+func (s *server) Start(ctx context.Context) error {
+	// initialize storage, the clients are shared by every request
+	if err := s.initStorage(); err != nil {
+		return fmt.Errorf("Could not initialize storage: %s", err)
+	}
+
+	// the management interfaces are validated here, the config package doesn't depend on the management client
+	if err := checkManagementAddresses(s.config.Management); err != nil {
+		return err
+	}
+
 	r := mux.NewRouter()
 
-	prefix := os.Getenv("URL_PREFIX")
+	prefix := s.config.URLPrefix
 	prefixRoot := prefix
 	if prefix == "" {
 		prefixRoot = "/"
@@ -59,38 +90,140 @@ func (s *server) Start() {
 		r.HandleFunc("/", s.rootHandler)
 	}
 
+	// liveness and readiness, used by the load balancer
+	r.HandleFunc("/healthz", s.healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.readyzHandler).Methods("GET")
+
 	r.HandleFunc(prefixRoot, s.homeHandler)
 	r.HandleFunc(prefix+"/login", s.loginHandler)
 	r.HandleFunc(prefix+"/callback", s.callbackHandler)
+	r.HandleFunc(prefix+"/access", s.accessHandler)
+	r.HandleFunc(prefix+"/rotate", s.rotateHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix+"/revoke", s.revokeHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix+"/devices", s.devicesHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix+"/devices/{device}/ovpnconfig", s.deviceConfigHandler).Methods("GET")
+	r.HandleFunc(prefix+"/devices/{device}/revoke", s.deviceRevokeHandler).Methods("POST")
 	r.HandleFunc(prefix+"/ovpnconfig", s.ovpnConfigHandler)
+	r.HandleFunc(prefix+"/mfa", s.mfaHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix+"/mfa/remove", s.mfaRemoveHandler).Methods("POST")
+	r.HandleFunc(prefix+"/admin/audit", s.adminAuditHandler).Methods("GET")
+	r.HandleFunc(prefix+"/admin/ca", s.adminCAHandler).Methods("GET")
+	r.HandleFunc(prefix+"/admin/connections", s.adminConnectionsHandler).Methods("GET")
+	r.HandleFunc(prefix+"/admin/usage", s.adminUsageHandler).Methods("GET")
+	s.ocspRoutes(r, prefix)
+
+	// metrics are served on a separate listener when METRICS_LISTEN_ADDR is set
+	if s.config.Metrics.ListenAddr == "" {
+		r.Handle("/metrics", metrics.Handler())
+	}
 
-	if os.Getenv("DEBUG") == "true" {
+	if s.config.Debug {
 		r.HandleFunc(prefix+"/debug", s.debugHandler)
 	}
 
-	http.Handle("/", r)
+	if s.config.SCIMToken != "" {
+		s.scimRoutes(r, prefix)
+	}
+
+	if s.config.ServerToken != "" {
+		s.serverRoutes(r, prefix)
+	}
+
+	// trace every request, continuing the trace of the caller when a traceparent header is present
+	r.Use(tracing.Middleware)
+
+	// initialize tracing
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		return fmt.Errorf("Could not initialize tracing: %s", err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// initialize auth
-	err := s.auth.init()
+	err = s.auth.init()
+	if err != nil {
+		return fmt.Errorf("Could not initialize auth: %s", err)
+	}
+
+	// initialize audit log
+	auditStorage, auditBucket, auditPrefix, err := s.getStorage(context.Background())
 	if err != nil {
-		log.Fatalf("Could not initialize auth: %s", err)
+		return fmt.Errorf("Could not initialize audit log: %s", err)
 	}
+	s.auditLogger = audit.NewLogger(auditStorage, auditBucket, auditPrefix, s.config.Storage.S3.KMSArn, os.Stdout)
+	s.auditLogger.Start(audit.DefaultFlushInterval)
+	defer s.auditLogger.Close()
+
+	// refresh the secrets (optional)
+	if s.config.SecretsRefreshInterval > 0 {
+		go s.refreshSecrets(ctx, s.config.SecretsRefreshInterval)
+	}
+
+	// populate the certificate gauges
+	go s.refreshCertificateMetrics(ctx, certificateMetricsInterval)
+
+	// record the last connection of every common name from the status of the openvpn servers
+	go s.refreshUsage(ctx, usageCollectInterval)
 
 	// initialize session store
-	s.sessionStore = sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
+	s.sessionStore = sessions.NewCookieStore([]byte(s.config.SessionKey))
 
 	// enable csrf
-	CSRF := csrf.Protect([]byte(os.Getenv("CSRF_KEY")))
+	CSRF := csrf.Protect([]byte(s.config.CSRFKey))
+
+	// enable logging, with a request id per request
+	loggedRouter := logging.Middleware(skipCSRF(CSRF(r), prefix+"/scim/", prefix+"/api/", prefix+"/ocsp"))
 
-	// enable logging
-	loggedRouter := handlers.LoggingHandler(os.Stdout, CSRF(r))
+	// tls (optional)
+	tlsConfig, acmeManager, err := newTLSConfig(s.config)
+	if err != nil {
+		return fmt.Errorf("Could not initialize tls: %s", err)
+	}
+
+	// start servers
+	listeners := []listener{}
+	mainListener, err := listen(":"+s.config.Port, newHTTPServer(loggedRouter, tlsConfig))
+	if err != nil {
+		return err
+	}
+	listeners = append(listeners, mainListener)
+	slog.Info("Starting server", "port", s.config.Port, "prefix", prefix, "tls", tlsConfig != nil)
+	if s.config.Metrics.ListenAddr != "" {
+		metricsListener, err := listen(s.config.Metrics.ListenAddr, newHTTPServer(metrics.Handler(), nil))
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, metricsListener)
+		slog.Info("Starting metrics server", "addr", s.config.Metrics.ListenAddr)
+	}
+	if acmeManager != nil && s.config.ACME.HTTPListenAddr != "" {
+		acmeListener, err := listen(s.config.ACME.HTTPListenAddr, newHTTPServer(acmeManager.HTTPHandler(nil), nil))
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, acmeListener)
+		slog.Info("Starting acme http-01 challenge server", "addr", s.config.ACME.HTTPListenAddr)
+	}
+	return serve(ctx, listeners...)
+}
 
-	// start server
-	fmt.Printf("Starting server on port %s with prefix %s\n", s.config.Port, prefix)
-	log.Fatal(http.ListenAndServe(":"+s.config.Port, loggedRouter))
+// skipCSRF disables the CSRF check for endpoints that are not used by a browser, but authenticated with a bearer token
+func skipCSRF(next http.Handler, pathPrefixes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, pathPrefix := range pathPrefixes {
+			if strings.HasPrefix(r.URL.Path, pathPrefix) {
+				r = csrf.UnsafeSkipCheck(r)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
+	if !wantsJSON(r) {
+		s.render(w, r, http.StatusOK, "index.html", "Welcome", "", nil)
+		return
+	}
 	var response response
 	response.Message = "app up and running"
 	json.NewEncoder(w).Encode(response)
@@ -98,6 +231,10 @@ func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) homeHandler(w http.ResponseWriter, r *http.Request) {
+	if !wantsJSON(r) {
+		s.render(w, r, http.StatusOK, "index.html", "Welcome", "", nil)
+		return
+	}
 	var response response
 	response.Message = "running"
 	json.NewEncoder(w).Encode(response)
@@ -110,9 +247,11 @@ func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
 func (s *server) callbackHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := s.sessionStore.Get(r, "token-session")
 
-	token, err := s.auth.getToken(r.URL.Query().Get("code"))
+	token, err := s.auth.getToken(r.Context(), r.URL.Query().Get("code"))
 	if err != nil {
-		json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+		s.auditLog(r, audit.Event{Type: audit.LoginFailure, Details: map[string]string{"error": err.Error()}})
+		metrics.Logins.WithLabelValues(s.auth.authType, "failure").Inc()
+		s.writeError(w, r, http.StatusUnauthorized, "", "Login failed: "+err.Error())
 		return
 	}
 
@@ -121,137 +260,144 @@ func (s *server) callbackHandler(w http.ResponseWriter, r *http.Request) {
 	session.Save(r, w)
 
 	// Parse and verify ID Token payload.
-	err = s.auth.verifyToken(token)
+	login, err := s.auth.verifyToken(r.Context(), token)
 	if err != nil {
 		// handle error
-		json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+		s.auditLog(r, audit.Event{Type: audit.LoginFailure, Details: map[string]string{"error": err.Error()}})
+		metrics.Logins.WithLabelValues(s.auth.authType, "failure").Inc()
+		s.writeError(w, r, http.StatusUnauthorized, "", "Login failed: "+err.Error())
 		return
 	}
+	s.auditLog(r, audit.Event{Type: audit.LoginSuccess, Actor: login, Details: map[string]string{"provider": s.auth.authType}})
+	metrics.Logins.WithLabelValues(s.auth.authType, "success").Inc()
 
-	http.Redirect(w, r, os.Getenv("URL_PREFIX")+"/ovpnconfig", 301)
+	http.Redirect(w, r, s.config.URLPrefix+"/access", http.StatusFound)
 }
 
 func (s *server) ovpnConfigHandler(w http.ResponseWriter, r *http.Request) {
-	var (
-		clientCert bytes.Buffer
-		clientKey  bytes.Buffer
-	)
 	year := time.Now().Format("2006")
-	session, err := s.sessionStore.Get(r, "token-session")
-	if err != nil || session.Values["token"] == nil {
-		// handle error
-		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+	login, err := s.getSessionLogin(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, "", err.Error())
 		return
 	}
 
-	err = s.auth.verifyToken(session.Values["token"].(string))
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
 	if err != nil {
-		// handle error
-		json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not create session: "+err.Error())
 		return
 	}
-
-	login := s.auth.getLogin()
-	if login == "" {
-		json.NewEncoder(w).Encode(errorResponse{Message: "getLogin error"})
+	// users that are deactivated by the identity provider (SCIM) can't download a config anymore
+	if err := s.newScimDirectory(blobStorage, storageBucket, storagePrefix).checkAccess(login); errors.Is(err, errAccessRevoked) {
+		s.writeError(w, r, http.StatusForbidden, login, err.Error())
+		return
+	} else if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, err.Error())
 		return
 	}
 
-	// check in storage if .crt / .key is already created
-	blobStorage, storageBucket, storagePrefix, err := s.getStorage()
-	if err != nil {
-		json.NewEncoder(w).Encode(errorResponse{Message: "Could not create session: " + err.Error()})
+	// check in storage if .crt / .key is already created, create new cert if not
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	if s.mfaMissing(p, login) {
+		s.writeError(w, r, http.StatusForbidden, login, "Set up two-factor authentication before downloading a configuration")
 		return
 	}
-	err = blobStorage.HeadObject(storageBucket, storagePrefix+"issued/client-"+login+"-"+year+".crt")
-	if err == nil {
-		clientCert, _ = blobStorage.GetObject(storageBucket, storagePrefix+"issued/client-"+login+"-"+year+".crt")
-		clientKey, _ = blobStorage.GetObject(storageBucket, storagePrefix+"private/client-"+login+"-"+year+".key")
+	name := "client-" + login + "-" + year
+	clientCert, clientKey, superseded, issued, err := p.ensureClientCert(r.Context(), login, name)
+	// after a CA rotation, a certificate of the previous CA is revoked and reissued by the new CA
+	if superseded != nil {
+		s.auditCerts(r, audit.CertRevoked, login, *superseded)
 	}
-
-	// retrieve CA key / crt
-	caKey, err := blobStorage.GetObject(storageBucket, storagePrefix+"private/ca.key")
-	if err != nil {
-		json.NewEncoder(w).Encode(errorResponse{Message: "ca.crt download error: " + err.Error()})
+	if errors.Is(err, errConcurrentIssue) {
+		s.writeError(w, r, http.StatusConflict, login, err.Error())
 		return
 	}
-	caCert, err := blobStorage.GetObject(storageBucket, storagePrefix+"ca.crt")
-	if err != nil {
-		json.NewEncoder(w).Encode(errorResponse{Message: "ca.crt download error: " + err.Error()})
+	if errors.Is(err, errServerCert) {
+		s.writeError(w, r, http.StatusForbidden, login, err.Error())
 		return
 	}
-	taKey, err := blobStorage.GetObject(storageBucket, storagePrefix+"ta.key")
 	if err != nil {
-		json.NewEncoder(w).Encode(errorResponse{Message: "ta.key download error: " + err.Error()})
+		s.writeError(w, r, http.StatusInternalServerError, login, err.Error())
 		return
 	}
-	// create new cert (if not cached)
-	if clientCert.Len() == 0 || clientKey.Len() == 0 {
-		c := NewCert()
-		parsedCaCert, err := c.readCert(caCert.String())
-		if err != nil {
-			fmt.Printf("cert: %s", caCert.String())
-			json.NewEncoder(w).Encode(errorResponse{Message: "Parsed CA cert Error: " + err.Error()})
-			return
-		}
-		parsedCaKey, err := c.readPrivateKey(caKey.String())
-		if err != nil {
-			json.NewEncoder(w).Encode(errorResponse{Message: "Parsed CA key Error: " + err.Error()})
-			return
-		}
-		clientCert, clientKey, err = c.createClientCert(parsedCaCert, parsedCaKey, login)
-		if err != nil {
-			json.NewEncoder(w).Encode(errorResponse{Message: "Create Cert error: " + err.Error()})
-			return
-		}
-		// write key and cert to Blob Storage
-		err = blobStorage.PutObject(storageBucket, storagePrefix+"issued/client-"+login+"-"+year+".crt", clientCert.String(), os.Getenv("S3_KMS_ARN"))
-		if err != nil {
-			json.NewEncoder(w).Encode(errorResponse{Message: "Blob Storage Put error: " + err.Error()})
-			return
-		}
-		err = blobStorage.PutObject(storageBucket, storagePrefix+"private/client-"+login+"-"+year+".key", clientKey.String(), os.Getenv("S3_KMS_ARN"))
-		if err != nil {
-			json.NewEncoder(w).Encode(errorResponse{Message: "Blob Storage Put error: " + err.Error()})
-			return
-		}
+	parsedCert, err := NewCert().readCert(clientCert.String())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not parse client certificate: "+err.Error())
+		return
 	}
 
-	// output openvpn config
-	ovpnConfig, err := blobStorage.GetObject(storageBucket, storagePrefix+"openvpn-client.conf")
-	strOvpnConfig := ovpnConfig.String()
+	ovpnConfig, err := p.clientConfig(clientCert, clientKey)
 	if err != nil {
-		json.NewEncoder(w).Encode(errorResponse{Message: "openvpn-client.conf download error: " + err.Error()})
+		s.writeError(w, r, http.StatusInternalServerError, login, err.Error())
+		return
 	}
-	strOvpnConfig = strings.Replace(strOvpnConfig, "[CERT]", clientCert.String(), -1)
-	strOvpnConfig = strings.Replace(strOvpnConfig, "[KEY]", clientKey.String(), -1)
-	strOvpnConfig = strings.Replace(strOvpnConfig, "[CA]", caCert.String(), -1)
-	strOvpnConfig = strings.Replace(strOvpnConfig, "[TLS-AUTH]", taKey.String(), -1)
 
+	if issued {
+		s.auditCerts(r, audit.CertIssued, login, issuedCert{Name: name, Cert: parsedCert})
+	} else {
+		metrics.Certificates.WithLabelValues("reused").Inc()
+	}
+	s.auditCerts(r, audit.ProfileDownloaded, login, issuedCert{Name: name, Cert: parsedCert})
+	writeOvpnConfig(w, login, ovpnConfig)
+}
+
+// writeOvpnConfig offers the openvpn config as a download
+func writeOvpnConfig(w http.ResponseWriter, name, ovpnConfig string) {
 	// client filename
-	clientLogin := strings.Replace(strings.Replace(login, "@", "-", -1), ".", "-", -1)
+	clientLogin := strings.Replace(strings.Replace(name, "@", "-", -1), ".", "-", -1)
 	clientFilename := "client-" + clientLogin + ".ovpn"
 	// write to client
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("Content-Type", "application/force-download")
 	w.Header().Set("Content-Type", "application/download")
 	w.Header().Set("Content-Disposition", "attachment; filename="+clientFilename)
-	fmt.Fprintf(w, strOvpnConfig)
+	fmt.Fprint(w, ovpnConfig)
 }
-func (s *server) getStorage() (storage.StorageIf, string, string, error) {
-	// azure storage
-	if os.Getenv("STORAGE_TYPE") == "azblob" {
-		if os.Getenv("AZ_STORAGE_ACCOUNT_KEY") != "" {
-			blobStorage, err := storage.NewAzBlob(os.Getenv("AZ_STORAGE_ACCOUNT_NAME"), os.Getenv("AZ_STORAGE_ACCOUNT_KEY"))
-			return blobStorage, os.Getenv("AZ_STORAGE_ACCOUNT_CONTAINER"), "", err
-		}
-		// with MSI
-		blobStorage, err := storage.NewAzBlobWithMSI(os.Getenv("AZ_STORAGE_ACCOUNT_NAME"))
-		return blobStorage, os.Getenv("AZ_STORAGE_ACCOUNT_CONTAINER"), "", err
+
+// getStorage returns the storage backend, created by initStorage. Every call to the backend is traced as a child of the
+// span in ctx.
+func (s *server) getStorage(ctx context.Context) (storage.StorageIf, string, string, error) {
+	if s.storage != nil {
+		return tracing.NewStorage(ctx, "override", s.storage), s.storageBucket, s.storagePrefix, nil
+	}
+	if s.blobStorage == nil {
+		return nil, "", "", errors.New("storage is not initialized")
+	}
+	return tracing.NewStorage(ctx, s.backend, s.blobStorage), s.backendBucket, s.backendPrefix, nil
+}
+
+// initStorage creates the storage backend of the configuration, with the envelope encryption, metrics and cache. It's
+// called once at startup, the clients are reused by every request. A storage override (s.storage) is kept.
+func (s *server) initStorage() error {
+	if s.storage != nil {
+		return nil
 	}
+	var blobStorage storage.StorageIf
+	var err error
+	backend, bucket, prefix := s.config.Storage.Type, s.config.Storage.S3.Bucket, s.config.Storage.S3.Prefix+"/pki/"
+	switch {
+	// azure storage
+	case backend == "azblob" && s.config.Storage.Azure.AccountKey != "":
+		blobStorage, err = storage.NewAzBlob(s.config.Storage.Azure.AccountName, s.config.Storage.Azure.AccountKey)
+		bucket, prefix = s.config.Storage.Azure.Container, ""
+	// with MSI
+	case backend == "azblob":
+		blobStorage, err = storage.NewAzBlobWithMSI(s.config.Storage.Azure.AccountName)
+		bucket, prefix = s.config.Storage.Azure.Container, ""
 	// default storage
-	blobStorage, err := storage.NewS3()
-	return blobStorage, os.Getenv("S3_BUCKET"), os.Getenv("S3_PREFIX") + "/pki/", err
+	default:
+		backend = "s3"
+		blobStorage, err = storage.NewS3(s.config.Storage.S3.Region)
+	}
+	if err == nil {
+		blobStorage, err = s.encryptStorage(blobStorage)
+	}
+	if err != nil {
+		return err
+	}
+	s.blobStorage = s.cacheStorage(metrics.NewStorage(backend, blobStorage), prefix)
+	s.backend, s.backendBucket, s.backendPrefix = backend, bucket, prefix
+	return nil
 }
 
 func (s *server) debugHandler(w http.ResponseWriter, r *http.Request) {
@@ -262,7 +408,7 @@ func (s *server) debugHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.auth.verifyToken(session.Values["token"].(string))
+	_, err = s.auth.verifyToken(r.Context(), session.Values["token"].(string))
 	if err != nil {
 		// handle error
 		json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/logging"
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+var serverNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{0,62}$`)
+
+// serverCertRenewBefore is the remaining validity below which a server certificate is replaced instead of reused
+const serverCertRenewBefore = 30 * 24 * time.Hour
+
+type serverCertRequest struct {
+	SANs []string `json:"sans"`
+}
+
+// serverBundle contains everything an openvpn server needs to start: its certificate and key, and the shared files of the PKI
+type serverBundle struct {
+	Name        string `json:"name"`
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+	CA          string `json:"ca"`
+	TLSAuthKey  string `json:"tlsAuthKey"`
+	DHParams    string `json:"dhParams"`
+	CRL         string `json:"crl"`
+}
+
+// serverCertName returns the name of the certificate of an openvpn server in issued/
+func serverCertName(name string) string {
+	return "server-" + name
+}
+
+// isServerCert returns true for certificates of openvpn servers, these don't belong to a user
+func isServerCert(cert *x509.Certificate) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageServerAuth {
+			return true
+		}
+	}
+	return false
+}
+
+// issueServerCert creates a new server certificate signed by the CA and writes it to issued/server-<name>.crt and
+// private/server-<name>.key with writeCertAndKey. Callers hold the lock of the certificate, see issueServerLocked.
+func (p *pki) issueServerCert(ctx context.Context, name string, sans []string, ifMatch string) (bytes.Buffer, bytes.Buffer, error) {
+	var serverCert, serverKey bytes.Buffer
+	if !serverNameRegexp.MatchString(name) {
+		return serverCert, serverKey, fmt.Errorf("invalid server name: %s", name)
+	}
+	parsedCaCert, parsedCaKey, err := p.loadCA()
+	if err != nil {
+		return serverCert, serverKey, err
+	}
+	serverCert, serverKey, err = NewCert().createServerCert(ctx, parsedCaCert, parsedCaKey, name, p.clientOrganization, sans)
+	if err != nil {
+		return serverCert, serverKey, fmt.Errorf("Create Cert error: %s", err)
+	}
+	if err := p.writeCertAndKey(ctx, serverCertName(name), serverCert, serverKey, ifMatch); err != nil {
+		return serverCert, serverKey, err
+	}
+	return serverCert, serverKey, nil
+}
+
+// issueServerLocked replaces the certificate of the server with a new one while holding the lock of the certificate, the
+// replaced certificate stays valid until it's revoked
+func (p *pki) issueServerLocked(ctx context.Context, name string, sans []string) (bytes.Buffer, bytes.Buffer, error) {
+	lock, err := p.lockLogin(ctx, serverCertName(name))
+	if err != nil {
+		return bytes.Buffer{}, bytes.Buffer{}, err
+	}
+	defer lock.Release(context.WithoutCancel(ctx))
+	ifMatch, err := p.clientCertETag(ctx, serverCertName(name))
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return bytes.Buffer{}, bytes.Buffer{}, err
+	}
+	return p.issueServerCert(ctx, name, sans, ifMatch)
+}
+
+/*
+ * getServerCert returns the certificate of the server. The existing certificate is reused when it contains the sans, is
+ * signed by the current CA and doesn't expire soon. Servers with the same name share the certificate, so a certificate
+ * without the sans is replaced by one with the sans of both (the replaced certificate stays valid for the servers that
+ * still use it), a certificate of the previous CA or that expires soon is revoked and replaced. The certificate is
+ * issued while holding the lock of the certificate.
+ */
+func (p *pki) getServerCert(ctx context.Context, name string, sans []string, now time.Time) (bytes.Buffer, bytes.Buffer, *issuedCert, error) {
+	lock, err := p.lockLogin(ctx, serverCertName(name))
+	if err != nil {
+		return bytes.Buffer{}, bytes.Buffer{}, nil, err
+	}
+	defer lock.Release(context.WithoutCancel(ctx))
+
+	ifMatch := ""
+	serverCert, serverKey, err := p.getCertAndKey(serverCertName(name))
+	switch {
+	case err == nil:
+		parsedCert, err := NewCert().readCert(serverCert.String())
+		if err != nil {
+			return serverCert, serverKey, nil, err
+		}
+		current, err := p.signedByCurrentCA(parsedCert)
+		if err != nil {
+			return serverCert, serverKey, nil, err
+		}
+		sans = mergeSANs(parsedCert, sans)
+		if current && parsedCert.NotAfter.Sub(now) > serverCertRenewBefore {
+			if hasSANs(parsedCert, sans) {
+				return serverCert, serverKey, nil, nil
+			}
+			if ifMatch, err = p.clientCertETag(ctx, serverCertName(name)); err != nil {
+				return serverCert, serverKey, nil, err
+			}
+		} else if _, err := p.revokeAll([]issuedCert{{Name: serverCertName(name), Cert: parsedCert}}, "superseded"); err != nil {
+			return serverCert, serverKey, nil, err
+		}
+	case errors.Is(err, errIncompleteCert):
+		// left behind by an interrupted issue, the certificate is issued again
+		if parsedCert, err := NewCert().readCert(serverCert.String()); err == nil {
+			sans = mergeSANs(parsedCert, sans)
+		}
+		if ifMatch, err = p.clientCertETag(ctx, serverCertName(name)); err != nil {
+			return serverCert, serverKey, nil, err
+		}
+	case !errors.Is(err, storage.ErrNotExist):
+		return serverCert, serverKey, nil, err
+	}
+	serverCert, serverKey, err = p.issueServerCert(ctx, name, sans, ifMatch)
+	if err != nil {
+		return serverCert, serverKey, nil, err
+	}
+	parsedCert, err := NewCert().readCert(serverCert.String())
+	if err != nil {
+		return serverCert, serverKey, nil, err
+	}
+	return serverCert, serverKey, &issuedCert{Name: serverCertName(name), Cert: parsedCert}, nil
+}
+
+// mergeSANs returns the sans of the certificate with the sans that aren't in the certificate yet
+func mergeSANs(cert *x509.Certificate, sans []string) []string {
+	merged := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		merged = append(merged, ip.String())
+	}
+	for _, san := range sans {
+		if !hasSANs(cert, []string{san}) {
+			merged = append(merged, san)
+		}
+	}
+	return merged
+}
+
+// hasSANs returns true when all the sans are in the certificate
+func hasSANs(cert *x509.Certificate, sans []string) bool {
+	for _, san := range sans {
+		found := false
+		if ip := net.ParseIP(san); ip != nil {
+			for _, certIP := range cert.IPAddresses {
+				found = found || certIP.Equal(ip)
+			}
+		} else {
+			for _, dnsName := range cert.DNSNames {
+				found = found || strings.EqualFold(dnsName, san)
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// serverBundle returns the server certificate (with the intermediate CAs) and key with the root CA, tls-auth key, DH
+// parameters and CRL
+func (p *pki) serverBundle(name string, serverCert, serverKey bytes.Buffer) (serverBundle, error) {
+	chain, err := p.loadCAChain()
+	if err != nil {
+		return serverBundle{}, err
+	}
+	ca, err := p.trustBundle(chain, time.Now())
+	if err != nil {
+		return serverBundle{}, err
+	}
+	bundle := serverBundle{Name: name, Certificate: serverCert.String() + chain.intermediates(), Key: serverKey.String(), CA: ca}
+	files := []struct {
+		key   string
+		value *string
+	}{
+		{"ta.key", &bundle.TLSAuthKey},
+		{"dh.pem", &bundle.DHParams},
+		{"crl.pem", &bundle.CRL},
+	}
+	for _, file := range files {
+		data, err := p.storage.GetObject(p.bucket, p.prefix+file.key)
+		if err != nil {
+			return bundle, fmt.Errorf("%s download error: %s", file.key, err)
+		}
+		*file.value = data.String()
+	}
+	return bundle, nil
+}
+
+func (s *server) serverRoutes(r *mux.Router, prefix string) {
+	servers := r.PathPrefix(prefix + "/api/servers").Subrouter()
+	servers.Use(s.serverAuthMiddleware)
+	servers.HandleFunc("/{name}/certificate", s.serverCertHandler).Methods("POST")
+	servers.HandleFunc("/{name}/status", s.serverStatusHandler).Methods("PUT")
+	servers.HandleFunc("/{name}/verify", s.serverVerifyHandler).Methods("POST")
+}
+
+// serverAuthMiddleware only allows requests with the server token as bearer token
+func (s *server) serverAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validBearerToken(r, s.getServerToken()) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validBearerToken returns true when the authorization header contains the token. An empty token is never valid.
+func validBearerToken(r *http.Request, token string) bool {
+	authorization := r.Header.Get("Authorization")
+	return token != "" && strings.HasPrefix(authorization, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) == 1
+}
+
+// serverCertHandler returns the certificate of an openvpn server (issued when needed) with the files to bootstrap the server
+func (s *server) serverCertHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	// the errors of the server api are always json
+	r.Header.Set("Accept", "application/json")
+	if !serverNameRegexp.MatchString(name) {
+		s.writeError(w, r, http.StatusBadRequest, "", "Invalid server name: use lowercase letters, digits, dots and dashes")
+		return
+	}
+	var request serverCertRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			s.writeError(w, r, http.StatusBadRequest, "", "Invalid request: "+err.Error())
+			return
+		}
+	}
+
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "", "Could not create session: "+err.Error())
+		return
+	}
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	serverCert, serverKey, issued, err := p.getServerCert(r.Context(), name, request.SANs, time.Now())
+	if errors.Is(err, errConcurrentIssue) {
+		s.writeError(w, r, http.StatusConflict, "", err.Error())
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if issued != nil {
+		logging.FromContext(r.Context()).Info("Issued server certificate", "server", name, "serial", fmt.Sprintf("%X", issued.Cert.SerialNumber))
+		s.auditCerts(r, audit.CertIssued, "server:"+name, *issued)
+	}
+	bundle, err := p.serverBundle(name, serverCert, serverKey)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bundle)
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func serverCertRequestRecorder(t *testing.T, router *mux.Router, name, token string, sans ...string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(serverCertRequest{SANs: sans})
+	req := httptest.NewRequest("POST", "/api/servers/"+name+"/certificate", bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestServerCertHandler(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	s.config.ServerToken = "server-token"
+	for _, key := range []string{"ta.key", "dh.pem", "crl.pem"} {
+		blobStorage.PutObject("bucket", "pki/"+key, key, "")
+	}
+	router := mux.NewRouter()
+	s.serverRoutes(router, "")
+
+	if rr := serverCertRequestRecorder(t, router, "vpn1", "wrong-token"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized with a wrong token, got %d", rr.Code)
+	}
+	if rr := serverCertRequestRecorder(t, router, "Invalid_Name", "server-token"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request for an invalid name, got %d", rr.Code)
+	}
+
+	rr := serverCertRequestRecorder(t, router, "vpn1", "server-token", "vpn1.example.com", "10.0.0.1")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", rr.Code, rr.Body.String())
+	}
+	var bundle serverBundle
+	if err := json.NewDecoder(rr.Body).Decode(&bundle); err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+	if strings.TrimSpace(bundle.CA) != caCert || bundle.TLSAuthKey != "ta.key" || bundle.DHParams != "dh.pem" || bundle.CRL != "crl.pem" || bundle.Key == "" {
+		t.Errorf("Unexpected bundle: %+v", bundle)
+	}
+	serverCert, err := NewCert().readCert(bundle.Certificate)
+	if err != nil {
+		t.Fatalf("Parse server cert error: %s", err)
+	}
+	if len(serverCert.DNSNames) != 1 || serverCert.DNSNames[0] != "vpn1.example.com" || len(serverCert.IPAddresses) != 1 || serverCert.IPAddresses[0].String() != "10.0.0.1" {
+		t.Errorf("Unexpected sans: %v %v", serverCert.DNSNames, serverCert.IPAddresses)
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/issued/server-vpn1.crt"); err != nil {
+		t.Errorf("Server certificate not stored: %s", err)
+	}
+
+	// the certificate is reused, unless the sans change
+	rr = serverCertRequestRecorder(t, router, "vpn1", "server-token", "vpn1.example.com")
+	json.NewDecoder(rr.Body).Decode(&bundle)
+	if reused, _ := NewCert().readCert(bundle.Certificate); reused == nil || reused.SerialNumber.Cmp(serverCert.SerialNumber) != 0 {
+		t.Errorf("Expected the certificate to be reused")
+	}
+	rr = serverCertRequestRecorder(t, router, "vpn1", "server-token", "vpn2.example.com")
+	json.NewDecoder(rr.Body).Decode(&bundle)
+	replaced, _ := NewCert().readCert(bundle.Certificate)
+	if replaced == nil || replaced.SerialNumber.Cmp(serverCert.SerialNumber) == 0 {
+		t.Fatalf("Expected a new certificate for new sans")
+	}
+	if !hasSANs(replaced, []string{"vpn1.example.com", "10.0.0.1", "vpn2.example.com"}) {
+		t.Errorf("Expected the sans of both requests, got %v %v", replaced.DNSNames, replaced.IPAddresses)
+	}
+	// a server with the sans of the first request keeps using the new certificate
+	rr = serverCertRequestRecorder(t, router, "vpn1", "server-token", "vpn1.example.com", "10.0.0.1")
+	json.NewDecoder(rr.Body).Decode(&bundle)
+	if reused, _ := NewCert().readCert(bundle.Certificate); reused == nil || reused.SerialNumber.Cmp(replaced.SerialNumber) != 0 {
+		t.Errorf("Expected the certificate with both sans to be reused")
+	}
+	revocations, err := newPKI(blobStorage, "bucket", "pki/").listRevocations()
+	if err != nil || len(revocations) != 0 {
+		t.Errorf("Expected no revoked certificates, got %+v (err: %v)", revocations, err)
+	}
+}
+
+func TestGetServerCertConcurrent(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+	sans := [][]string{{"vpn1.example.com"}, {"vpn2.example.com"}, {"10.0.0.1"}, {"vpn1.example.com"}}
+	var wg sync.WaitGroup
+	errs := make([]error, len(sans))
+	for k := range sans {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			_, _, _, errs[k] = p.getServerCert(context.Background(), "vpn1", sans[k], time.Now())
+		}(k)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("getServerCert error: %s", err)
+		}
+	}
+	serverCert, _, err := p.getCertAndKey(serverCertName("vpn1"))
+	if err != nil {
+		t.Fatalf("Expected the certificate with its key, got %s", err)
+	}
+	parsedCert, _ := NewCert().readCert(serverCert.String())
+	if !hasSANs(parsedCert, []string{"vpn1.example.com", "vpn2.example.com", "10.0.0.1"}) {
+		t.Errorf("Expected the sans of all servers, got %v %v", parsedCert.DNSNames, parsedCert.IPAddresses)
+	}
+}
+
+func TestCreateServerCert(t *testing.T) {
+	c := NewCert()
+	parsedCaCert, _ := c.readCert(caCert)
+	parsedCaKey, _ := c.readPrivateKey(caKey)
+	serverPem, _, err := c.createServerCert(context.Background(), parsedCaCert, parsedCaKey, "vpn1", "example", []string{"vpn1.example.com"})
+	if err != nil {
+		t.Fatalf("createServerCert error: %s", err)
+	}
+	serverCert, err := c.readCert(serverPem.String())
+	if err != nil {
+		t.Fatalf("Parse server cert error: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(parsedCaCert)
+	if _, err := serverCert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "vpn1.example.com", KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}); err != nil {
+		t.Errorf("Server certificate not valid: %s", err)
+	}
+	found := false
+	for _, extension := range serverCert.Extensions {
+		if extension.Id.Equal(oidNsCertType) {
+			var nsCertType asn1.BitString
+			if _, err := asn1.Unmarshal(extension.Value, &nsCertType); err != nil || nsCertType.At(1) != 1 || nsCertType.At(0) != 0 {
+				t.Errorf("Unexpected nsCertType: %+v (err: %v)", nsCertType, err)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("nsCertType extension not found")
+	}
+	if !isServerCert(serverCert) {
+		t.Errorf("isServerCert should be true for a server certificate")
+	}
+}
+
+func TestListIssuedForLoginSkipsServerCerts(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+	if _, _, err := p.issueServerLocked(context.Background(), "alice", nil); err != nil {
+		t.Fatalf("issueServerCert error: %s", err)
+	}
+	issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+	issued, err := p.listIssuedForLogin("alice")
+	if err != nil || len(issued) != 1 || issued[0].Name != "client-alice-2024" {
+		t.Errorf("Expected only the client certificate, got %+v (err: %v)", issued, err)
+	}
+}
+
+func TestClientCertRefusesServerCerts(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	p := s.newPKI(blobStorage, "bucket", "pki/")
+	if _, _, err := p.issueServerLocked(context.Background(), "openvpn", nil); err != nil {
+		t.Fatalf("issueServerCert error: %s", err)
+	}
+	if _, _, err := p.getClientCert(serverCertName("openvpn")); !errors.Is(err, errServerCert) {
+		t.Errorf("Expected errServerCert for the certificate of a server, got %v", err)
+	}
+	if _, _, _, _, err := p.ensureClientCert(context.Background(), "alice", serverCertName("openvpn")); !errors.Is(err, errServerCert) {
+		t.Errorf("Expected errServerCert when ensuring the certificate of a server, got %v", err)
+	}
+	if _, _, _, _, err := p.ensureClientCert(context.Background(), "server-openvpn", "client-server-openvpn-2024"); !errors.Is(err, errServerCert) {
+		t.Errorf("Expected errServerCert for a login starting with server-, got %v", err)
+	}
+	if _, _, err := p.issueClientCert(context.Background(), "alice", serverCertName("vpn2"), ""); !errors.Is(err, errServerCert) {
+		t.Errorf("Expected errServerCert for a name starting with server-, got %v", err)
+	}
+	if err := blobStorage.HeadObject("bucket", "pki/issued/"+serverCertName("vpn2")+".crt"); err == nil {
+		t.Errorf("Client certificate was written with the name of a server")
+	}
+}
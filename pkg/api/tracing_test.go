@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/in4it/openvpn-access/pkg/tracing"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.SetExporter(exporter)
+	s, _ := newTestServer(t)
+
+	ctx, span := tracing.Start(context.Background(), "test")
+	if _, err := s.createDevice(ctx, "alice@example.com", "laptop"); err != nil {
+		t.Fatalf("createDevice error: %s", err)
+	}
+	span.End()
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatalf("ForceFlush error: %s", err)
+	}
+
+	names := map[string]bool{}
+	for _, recorded := range exporter.GetSpans() {
+		names[recorded.Name] = true
+		if recorded.SpanContext.TraceID() != span.SpanContext().TraceID() {
+			t.Errorf("span %s is not part of the trace", recorded.Name)
+		}
+	}
+	for _, name := range []string{"cert.generateKey", "cert.sign", "storage.GetObject", "storage.PutObject", "storage.ListObjects"} {
+		if !names[name] {
+			t.Errorf("span %s not found", name)
+		}
+	}
+}
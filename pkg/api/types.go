@@ -1,5 +1,10 @@
 package api
 
+import (
+	"encoding/json"
+	"time"
+)
+
 //Claims -  custom claims
 type Claims struct {
 	Email    string `json:"email"`
@@ -11,3 +16,68 @@ type GitHubUser struct {
 	Login   string `json:"login"`
 	Message string `json:"message"`
 }
+
+// ScimUser is the subset of the SCIM 2.0 core user schema that is needed for user lifecycle
+type ScimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Name        *ScimName   `json:"name,omitempty"`
+	Emails      []ScimEmail `json:"emails,omitempty"`
+	Groups      []ScimGroup `json:"groups,omitempty"`
+	Active      bool        `json:"active"`
+	Meta        ScimMeta    `json:"meta"`
+}
+
+type ScimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type ScimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// ScimGroup is a group membership of a user: the id of the group in the identity provider and its name
+type ScimGroup struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type ScimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location,omitempty"`
+}
+
+type ScimListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []ScimUser `json:"Resources"`
+}
+
+type ScimPatchOp struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []ScimPatchOperation `json:"Operations"`
+}
+
+type ScimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type ScimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
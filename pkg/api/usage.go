@@ -0,0 +1,368 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/management"
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+// usageCollectInterval is the interval at which the status files and the management interfaces are collected
+const usageCollectInterval = 5 * time.Minute
+
+// defaultIdleDays is the number of days without a connection after which a certificate is reported as idle
+const defaultIdleDays = 30
+
+// maxStatusSize is the maximum size of a status file that is pushed through the server api
+const maxStatusSize = 10 << 20
+
+// usageSaveRetries is the number of times the statuses are merged into usage.json when other replicas write it too
+const usageSaveRetries = 5
+
+// Usage states of a certificate
+const (
+	UsageActive    = "active"
+	UsageIdle      = "idle"
+	UsageNeverUsed = "never-used"
+)
+
+// usageRecord is the last connection of a common name, stored in usage.json
+type usageRecord struct {
+	LastSeen    time.Time `json:"lastSeen"`
+	RealAddress string    `json:"realAddress"`
+	Server      string    `json:"server"`
+	// BytesReceived and BytesSent are the totals of all the sessions that were seen
+	BytesReceived int64 `json:"bytesReceived"`
+	BytesSent     int64 `json:"bytesSent"`
+	// Sessions are the bytes of the open sessions, so the bytes of a session that is seen again are only counted once
+	Sessions map[string]sessionBytes `json:"sessions,omitempty"`
+}
+
+type sessionBytes struct {
+	Server        string `json:"server"`
+	BytesReceived int64  `json:"bytesReceived"`
+	BytesSent     int64  `json:"bytesSent"`
+}
+
+// CertificateUsage is an issued client certificate with the last connection of its common name
+type CertificateUsage struct {
+	Certificate
+	Usage         string     `json:"usage"`
+	LastSeen      *time.Time `json:"lastSeen,omitempty"`
+	RealAddress   string     `json:"realAddress,omitempty"`
+	Server        string     `json:"server,omitempty"`
+	BytesReceived int64      `json:"bytesReceived"`
+	BytesSent     int64      `json:"bytesSent"`
+}
+
+type usageResponse struct {
+	Certificates []CertificateUsage `json:"certificates"`
+}
+
+// loadUsage returns the usage records by common name from usage.json, or no records when it doesn't exist yet
+func (p *pki) loadUsage() (map[string]*usageRecord, error) {
+	usage, _, err := p.loadUsageETag()
+	return usage, err
+}
+
+// loadUsageETag returns the usage records and the ETag of usage.json, the ETag is empty when it doesn't exist yet
+func (p *pki) loadUsageETag() (map[string]*usageRecord, string, error) {
+	usage := map[string]*usageRecord{}
+	body, info, err := storage.Objects(p.storage).Get(context.Background(), p.bucket, p.prefix+"usage.json")
+	if errors.Is(err, storage.ErrNotExist) {
+		return usage, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&usage); err != nil {
+		return nil, "", fmt.Errorf("usage.json: %s", err)
+	}
+	return usage, info.ETag, nil
+}
+
+// loadStatusFiles returns the status files in status/, by server name. Files that can't be parsed are skipped, their
+// errors are returned with the other statuses.
+func (p *pki) loadStatusFiles() (map[string]*management.Status, error) {
+	statuses := map[string]*management.Status{}
+	items, err := p.storage.ListObjects(p.bucket, p.prefix+"status/")
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, item := range items {
+		name := strings.TrimPrefix(item, p.prefix+"status/")
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		data, err := p.storage.GetObject(p.bucket, item)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", name, err))
+			continue
+		}
+		status, err := management.ParseStatus(&data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", name, err))
+			continue
+		}
+		statuses[strings.TrimSuffix(name, ".log")] = status
+	}
+	return statuses, errors.Join(errs...)
+}
+
+/*
+ * recordUsage merges the connected clients of the statuses (by server) into usage.json. The clients are seen at the
+ * time of the status, or now when the status has no time. A session is identified by its server, real address and
+ * connection time: only the bytes since the previous collection are added to the totals, so collecting the same status
+ * again doesn't change them. usage.json is written with a conditional write: when another replica wrote it in the
+ * meantime, the statuses are merged again into its version.
+ */
+func (p *pki) recordUsage(statuses map[string]*management.Status, now time.Time) error {
+	for attempt := 1; ; attempt++ {
+		err := p.mergeUsage(statuses, now)
+		if !errors.Is(err, storage.ErrPreconditionFailed) || attempt == usageSaveRetries {
+			return err
+		}
+	}
+}
+
+// mergeUsage merges the statuses into usage.json once, storage.ErrPreconditionFailed is returned when usage.json changed
+func (p *pki) mergeUsage(statuses map[string]*management.Status, now time.Time) error {
+	usage, etag, err := p.loadUsageETag()
+	if err != nil {
+		return err
+	}
+	sessions := map[string]map[string]sessionBytes{}
+	for server, status := range statuses {
+		seen := status.Updated
+		if seen.IsZero() {
+			seen = now
+		}
+		for _, client := range status.Clients {
+			record, ok := usage[client.CommonName]
+			if !ok {
+				record = &usageRecord{}
+				usage[client.CommonName] = record
+			}
+			if seen.After(record.LastSeen) {
+				record.LastSeen = seen
+				record.RealAddress = client.RealAddress
+				record.Server = server
+			}
+			id := server + "/" + client.RealAddress + "/" + strconv.FormatInt(client.ConnectedSince.Unix(), 10)
+			session := record.Sessions[id]
+			session.Server = server
+			if client.BytesReceived > session.BytesReceived {
+				record.BytesReceived += client.BytesReceived - session.BytesReceived
+				session.BytesReceived = client.BytesReceived
+			}
+			if client.BytesSent > session.BytesSent {
+				record.BytesSent += client.BytesSent - session.BytesSent
+				session.BytesSent = client.BytesSent
+			}
+			if sessions[client.CommonName] == nil {
+				sessions[client.CommonName] = map[string]sessionBytes{}
+			}
+			sessions[client.CommonName][id] = session
+		}
+	}
+	// the sessions that are not in the status of their server anymore have ended. The sessions of servers that weren't
+	// collected are kept, so they are not counted twice when the server is collected again.
+	for commonName, record := range usage {
+		for id, session := range record.Sessions {
+			if _, collected := statuses[session.Server]; !collected {
+				if sessions[commonName] == nil {
+					sessions[commonName] = map[string]sessionBytes{}
+				}
+				sessions[commonName][id] = session
+			}
+		}
+		record.Sessions = sessions[commonName]
+	}
+	out, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = storage.Objects(p.storage).Put(context.Background(), p.bucket, p.prefix+"usage.json", bytes.NewReader(out), storage.PutOptions{
+		ContentType: "application/json",
+		KMSArn:      p.kmsArn,
+		IfNoneMatch: etag == "",
+		IfMatch:     etag,
+	})
+	return err
+}
+
+/*
+ * certificateUsage returns the issued client certificates with the last connection of their common name. A certificate
+ * is never used when its common name didn't connect since the certificate was issued, and idle when the last connection
+ * is older than idle.
+ */
+func (p *pki) certificateUsage(now time.Time, idle time.Duration) ([]CertificateUsage, error) {
+	issued, err := p.listIssued()
+	if err != nil {
+		return nil, err
+	}
+	usage, err := p.loadUsage()
+	if err != nil {
+		return nil, err
+	}
+	certificates := []CertificateUsage{}
+	for _, issuedCert := range issued {
+		if isServerCert(issuedCert.Cert) {
+			continue
+		}
+		certificate := CertificateUsage{Certificate: newCertificate(issuedCert), Usage: UsageNeverUsed}
+		record, ok := usage[issuedCert.Cert.Subject.CommonName]
+		if ok && !record.LastSeen.Before(issuedCert.Cert.NotBefore) {
+			lastSeen := record.LastSeen
+			certificate.LastSeen = &lastSeen
+			certificate.RealAddress = record.RealAddress
+			certificate.Server = record.Server
+			certificate.BytesReceived = record.BytesReceived
+			certificate.BytesSent = record.BytesSent
+			certificate.Usage = UsageActive
+			if now.Sub(lastSeen) > idle {
+				certificate.Usage = UsageIdle
+			}
+		}
+		certificates = append(certificates, certificate)
+	}
+	sort.SliceStable(certificates, func(i, j int) bool {
+		return certificates[i].CommonName < certificates[j].CommonName
+	})
+	return certificates, nil
+}
+
+// refreshUsage collects the status of the openvpn servers now and at every interval, until ctx is done
+func (s *server) refreshUsage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.collectUsage(ctx, time.Now()); err != nil {
+			slog.Error("Could not collect the status of the openvpn servers", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectUsage records the clients in the status files and the clients connected to the management interfaces. A server
+// is identified by its name: the status of a named management interface (<name>=<address>) replaces the status file of
+// the server with the same name, so its sessions are only counted once.
+func (s *server) collectUsage(ctx context.Context, now time.Time) error {
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		return err
+	}
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	statuses, statusErr := p.loadStatusFiles()
+	if statuses == nil {
+		return statusErr
+	}
+	conf := s.getManagementConfig()
+	var errs []error
+	for _, address := range conf.Addresses {
+		status, err := serverStatus(ctx, conf, address)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", address, err))
+			continue
+		}
+		name, _ := management.SplitAddress(address)
+		statuses[name] = status
+	}
+	if len(statuses) > 0 {
+		errs = append(errs, p.recordUsage(statuses, now))
+	}
+	return errors.Join(append(errs, statusErr)...)
+}
+
+// serverStatusHandler stores the status file pushed by an openvpn server as status/<name>.log
+func (s *server) serverStatusHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	r.Header.Set("Accept", "application/json")
+	if !serverNameRegexp.MatchString(name) {
+		s.writeError(w, r, http.StatusBadRequest, "", "Invalid server name: use lowercase letters, digits, dots and dashes")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStatusSize))
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, "", "Could not read status: "+err.Error())
+		return
+	}
+	if _, err := management.ParseStatus(bytes.NewReader(body)); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, "", "Invalid status: "+err.Error())
+		return
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "", "Could not create session: "+err.Error())
+		return
+	}
+	if err := blobStorage.PutObject(storageBucket, storagePrefix+"status/"+name+".log", string(body), s.config.Storage.S3.KMSArn); err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "", "Could not store status: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+ * adminUsageHandler returns the issued client certificates with their last connection. With the query parameter idle
+ * (days), only the certificates that were never used or not used in the last idle days are returned.
+ */
+func (s *server) adminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	login, ok := s.getAdminLogin(w, r)
+	if !ok {
+		return
+	}
+	idleDays, onlyUnused := defaultIdleDays, false
+	if idle := r.URL.Query().Get("idle"); idle != "" {
+		days, err := strconv.Atoi(idle)
+		if err != nil || days < 0 {
+			s.writeError(w, r, http.StatusBadRequest, login, "Invalid idle: use a number of days")
+			return
+		}
+		idleDays, onlyUnused = days, true
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not create session: "+err.Error())
+		return
+	}
+	certificates, err := s.newPKI(blobStorage, storageBucket, storagePrefix).certificateUsage(time.Now(), time.Duration(idleDays)*24*time.Hour)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, login, "Could not get certificate usage: "+err.Error())
+		return
+	}
+	if onlyUnused {
+		certificates = unusedCertificates(certificates)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usageResponse{Certificates: certificates})
+}
+
+// unusedCertificates returns the certificates that were never used or are idle
+func unusedCertificates(certificates []CertificateUsage) []CertificateUsage {
+	unused := []CertificateUsage{}
+	for _, certificate := range certificates {
+		if certificate.Usage != UsageActive {
+			unused = append(unused, certificate)
+		}
+	}
+	return unused
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/management"
+)
+
+const testStatus = "TITLE,OpenVPN 2.4.12\n" +
+	"TIME,Tue Jun 18 10:00:00 2024,1718704800\n" +
+	"HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Virtual IPv6 Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username,Client ID,Peer ID\n" +
+	"CLIENT_LIST,alice,203.0.113.10:51234,10.8.0.2,,1000,2000,Tue Jun 18 09:00:00 2024,1718701200,UNDEF,3,0\n" +
+	"END\n"
+
+func TestRecordUsage(t *testing.T) {
+	_, blobStorage := newTestServer(t)
+	p := newPKI(blobStorage, "bucket", "pki/")
+	status, err := management.ParseStatus(strings.NewReader(testStatus))
+	if err != nil {
+		t.Fatalf("ParseStatus error: %s", err)
+	}
+
+	// collecting the same status twice doesn't count the bytes twice
+	for i := 0; i < 2; i++ {
+		if err := p.recordUsage(map[string]*management.Status{"vpn1": status}, time.Now()); err != nil {
+			t.Fatalf("recordUsage error: %s", err)
+		}
+	}
+	usage, _ := p.loadUsage()
+	if alice := usage["alice"]; alice == nil || alice.BytesReceived != 1000 || alice.BytesSent != 2000 || alice.Server != "vpn1" ||
+		alice.RealAddress != "203.0.113.10:51234" || !alice.LastSeen.Equal(time.Unix(1718704800, 0)) {
+		t.Fatalf("Unexpected usage: %+v", usage["alice"])
+	}
+
+	// the session continues, and alice connects from a second address
+	status.Updated = status.Updated.Add(5 * time.Minute)
+	status.Clients[0].BytesReceived = 1500
+	status.Clients = append(status.Clients, management.ClientInfo{CommonName: "alice", RealAddress: "198.51.100.7:1194", BytesReceived: 10, BytesSent: 20, ConnectedSince: status.Updated})
+	// a server that wasn't collected before, with a status without time
+	other := &management.Status{Clients: []management.ClientInfo{{CommonName: "bob", RealAddress: "192.0.2.1:1194", BytesReceived: 5, BytesSent: 5}}}
+	now := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	if err := p.recordUsage(map[string]*management.Status{"vpn1": status, "vpn2": other}, now); err != nil {
+		t.Fatalf("recordUsage error: %s", err)
+	}
+	usage, _ = p.loadUsage()
+	if alice := usage["alice"]; alice.BytesReceived != 1510 || alice.BytesSent != 2020 || len(alice.Sessions) != 2 {
+		t.Errorf("Unexpected usage: %+v", alice)
+	}
+	if bob := usage["bob"]; bob == nil || !bob.LastSeen.Equal(now) || bob.Server != "vpn2" {
+		t.Errorf("Unexpected usage: %+v", bob)
+	}
+
+	// the sessions of alice ended, the sessions of servers that aren't collected are kept
+	if err := p.recordUsage(map[string]*management.Status{"vpn1": {}}, now); err != nil {
+		t.Fatalf("recordUsage error: %s", err)
+	}
+	usage, _ = p.loadUsage()
+	if len(usage["alice"].Sessions) != 0 || usage["alice"].BytesReceived != 1510 || len(usage["bob"].Sessions) != 1 {
+		t.Errorf("Unexpected sessions: %+v %+v", usage["alice"], usage["bob"])
+	}
+}
+
+func TestCertificateUsage(t *testing.T) {
+	_, blobStorage := newTestServer(t)
+	p := newPKI(blobStorage, "bucket", "pki/")
+	alice := issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+	issueTestCert(t, blobStorage, "bob", "client-bob-2024")
+	issueTestCert(t, blobStorage, "carol", "client-carol-2024")
+
+	now := alice.NotBefore.Add(60 * 24 * time.Hour)
+	statuses := map[string]*management.Status{
+		"vpn1": {Updated: now.Add(-time.Hour), Clients: []management.ClientInfo{{CommonName: "alice", RealAddress: "203.0.113.10:51234"}}},
+		"vpn2": {Updated: now.Add(-40 * 24 * time.Hour), Clients: []management.ClientInfo{{CommonName: "bob", RealAddress: "198.51.100.7:1194"}}},
+	}
+	if err := p.recordUsage(statuses, now); err != nil {
+		t.Fatalf("recordUsage error: %s", err)
+	}
+	certificates, err := p.certificateUsage(now, 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("certificateUsage error: %s", err)
+	}
+	usage := map[string]string{}
+	for _, certificate := range certificates {
+		usage[certificate.CommonName] = certificate.Usage
+	}
+	if usage["alice"] != UsageActive || usage["bob"] != UsageIdle || usage["carol"] != UsageNeverUsed {
+		t.Errorf("Unexpected usage: %v", usage)
+	}
+	if unused := unusedCertificates(certificates); len(unused) != 2 {
+		t.Errorf("Expected 2 unused certificates, got %d", len(unused))
+	}
+
+	// a certificate that was issued after the last connection of its common name was never used
+	previous := map[string]*management.Status{
+		"vpn3": {Updated: alice.NotBefore.Add(-time.Hour), Clients: []management.ClientInfo{{CommonName: "carol", RealAddress: "192.0.2.1:1194"}}},
+	}
+	if err := p.recordUsage(previous, now); err != nil {
+		t.Fatalf("recordUsage error: %s", err)
+	}
+	certificates, _ = p.certificateUsage(now, 30*24*time.Hour)
+	for _, certificate := range certificates {
+		if certificate.CommonName == "carol" && certificate.Usage != UsageNeverUsed {
+			t.Errorf("Unexpected usage of carol: %s", certificate.Usage)
+		}
+	}
+}
+
+func TestServerStatusPush(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	s.config.ServerToken = "server-token"
+	r := mux.NewRouter()
+	s.serverRoutes(r, "")
+
+	push := func(name, body string) int {
+		req := httptest.NewRequest("PUT", "/api/servers/"+name+"/status", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer server-token")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := push("vpn1", testStatus); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	if code := push("vpn2", "not a status"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid status, got %d", code)
+	}
+	blobStorage.PutObject("bucket", "pki/status/vpn3.log", "garbage", "")
+
+	if err := s.collectUsage(context.Background(), time.Now()); err == nil || !strings.Contains(err.Error(), "vpn3") {
+		t.Errorf("Expected an error for the invalid status file, got %v", err)
+	}
+	usage, _ := newPKI(blobStorage, "bucket", "pki/").loadUsage()
+	if usage["alice"] == nil || usage["alice"].Server != "vpn1" {
+		t.Errorf("Status of vpn1 was not collected: %+v", usage)
+	}
+}
+
+func TestRecordUsageConcurrently(t *testing.T) {
+	_, blobStorage := newTestServer(t)
+	p := newPKI(blobStorage, "bucket", "pki/")
+
+	// every replica collects another server, none of the sessions is lost
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			server := fmt.Sprintf("vpn%d", i)
+			status := &management.Status{Clients: []management.ClientInfo{{CommonName: "alice", RealAddress: server + ":1194", BytesReceived: 10}}}
+			if err := p.recordUsage(map[string]*management.Status{server: status}, time.Now()); err != nil {
+				t.Errorf("recordUsage error: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	usage, _ := p.loadUsage()
+	if alice := usage["alice"]; alice == nil || len(alice.Sessions) != 4 || alice.BytesReceived != 40 {
+		t.Errorf("Unexpected usage: %+v", alice)
+	}
+}
+
+func TestCollectUsageNamedManagement(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	blobStorage.PutObject("bucket", "pki/status/vpn1.log", testStatus, "")
+	fake := newFakeManagement(t, map[string]string{"alice": "3"})
+	s.config.Management.Addresses = []string{"vpn1=" + fake.listener.Addr().String()}
+
+	// the status file and the management interface of vpn1 have the same session, it's only counted once
+	if err := s.collectUsage(context.Background(), time.Now()); err != nil {
+		t.Fatalf("collectUsage error: %s", err)
+	}
+	usage, _ := newPKI(blobStorage, "bucket", "pki/").loadUsage()
+	if alice := usage["alice"]; alice == nil || alice.Server != "vpn1" || len(alice.Sessions) != 1 {
+		t.Errorf("Unexpected usage: %+v", alice)
+	}
+}
+
+func TestRefreshUsageStops(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.refreshUsage(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("refreshUsage didn't stop when the context was done")
+	}
+}
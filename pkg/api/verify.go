@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/metrics"
+	"github.com/in4it/openvpn-access/pkg/storage"
+	"github.com/in4it/openvpn-access/pkg/verify"
+)
+
+// parseSerial parses a serial in hex, with or without colons
+func parseSerial(serial string) (*big.Int, error) {
+	parsed, ok := new(big.Int).SetString(strings.ReplaceAll(serial, ":", ""), 16)
+	if !ok || serial == "" {
+		return nil, fmt.Errorf("invalid serial: %q", serial)
+	}
+	return parsed, nil
+}
+
+// deny returns a decision that refuses the connection
+func deny(reason string) verify.Decision {
+	return verify.Decision{Reason: reason}
+}
+
+/*
+ * verifyAccess decides whether a client may connect: the certificate has to be issued (found by serial in
+ * issued_by_serial/, with the common name of the request) and not revoked or expired, and
+ * the user has to be active in the scim directory and a member of one of the allowed groups (when configured). Users
+ * that are not in the scim directory may connect when no allowed groups are configured, users deleted from the
+ * directory can't connect. An error is returned when the revocation or the user can't be read, so the hook falls back
+ * to its cache or denies the connection.
+ */
+func (s *server) verifyAccess(ctx context.Context, request verify.Request, now time.Time) (verify.Decision, error) {
+	serial, err := parseSerial(request.Serial)
+	if err != nil {
+		return verify.Decision{}, err
+	}
+	blobStorage, storageBucket, storagePrefix, err := s.getStorage(ctx)
+	if err != nil {
+		return verify.Decision{}, err
+	}
+	p := s.newPKI(blobStorage, storageBucket, storagePrefix)
+	err = p.storage.HeadObject(p.bucket, fmt.Sprintf("%srevoked/index/%X.json", p.prefix, serial))
+	if err == nil {
+		return deny("certificate is revoked"), nil
+	}
+	if !errors.Is(err, storage.ErrNotExist) {
+		return verify.Decision{}, fmt.Errorf("Could not check the revocation of %X: %s", serial, err)
+	}
+	cert, err := p.lookupSerial(serial)
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return verify.Decision{}, fmt.Errorf("Could not look up the certificate %X: %s", serial, err)
+	}
+	switch {
+	case err != nil, cert.Subject.CommonName != request.CommonName:
+		return deny("certificate is not issued"), nil
+	case isServerCert(cert):
+		return deny("certificate of a server"), nil
+	case now.After(cert.NotAfter):
+		return deny("certificate is expired"), nil
+	}
+
+	login, _ := splitCommonName(request.CommonName)
+	if request.Username != "" && request.Username != login {
+		return deny("username doesn't match the certificate"), nil
+	}
+	user, err := s.newScimDirectory(blobStorage, storageBucket, storagePrefix).lookup(login)
+	if errors.Is(err, storage.ErrNotExist) {
+		if len(s.config.AllowedGroups) > 0 {
+			return deny("user is not provisioned"), nil
+		}
+		return verify.Decision{Allow: true}, nil
+	}
+	if err != nil {
+		return verify.Decision{}, fmt.Errorf("Could not look up the user in the scim directory: %s", err)
+	}
+	if !user.Active {
+		return deny("user is deactivated"), nil
+	}
+	if len(s.config.AllowedGroups) > 0 && !inAllowedGroup(user, s.config.AllowedGroups) {
+		return deny("user is not in an allowed group"), nil
+	}
+	return verify.Decision{Allow: true}, nil
+}
+
+// inAllowedGroup returns true when the user is a member of one of the groups, by id or display name
+func inAllowedGroup(user ScimUser, allowedGroups []string) bool {
+	for _, group := range user.Groups {
+		for _, allowed := range allowedGroups {
+			if allowed != "" && (group.Value == allowed || strings.EqualFold(group.Display, allowed)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serverVerifyHandler answers whether a client may connect to the openvpn server, with the second factor of the user
+// when it's enrolled. Denied connections are audited.
+func (s *server) serverVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	r.Header.Set("Accept", "application/json")
+	var request verify.Request
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.CommonName == "" {
+		s.writeError(w, r, http.StatusBadRequest, "", "Invalid request: commonName and serial are required")
+		return
+	}
+	serial, err := parseSerial(request.Serial)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, "", "Invalid request: "+err.Error())
+		return
+	}
+	decision, err := s.verifyAccess(r.Context(), request, time.Now())
+	if err == nil && decision.Allow {
+		decision, err = s.verifyMFA(r, request, time.Now())
+	}
+	if err != nil {
+		metrics.ConnectionVerifications.WithLabelValues("error").Inc()
+		s.writeError(w, r, http.StatusInternalServerError, "", "Could not verify access: "+err.Error())
+		return
+	}
+	if decision.Allow {
+		metrics.ConnectionVerifications.WithLabelValues("allow").Inc()
+	} else {
+		metrics.ConnectionVerifications.WithLabelValues("deny").Inc()
+		s.auditLog(r, audit.Event{
+			Type:    audit.ConnectionDenied,
+			Actor:   "server:" + name,
+			Subject: request.CommonName,
+			Serial:  fmt.Sprintf("%X", serial),
+			Details: map[string]string{"reason": decision.Reason},
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(decision)
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/audit"
+	"github.com/in4it/openvpn-access/pkg/storage"
+	"github.com/in4it/openvpn-access/pkg/verify"
+)
+
+func TestVerifyAccess(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	directory := newScimDirectory(blobStorage, "bucket", "pki/")
+	alice := issueTestCert(t, blobStorage, "alice", "client-alice-2024")
+	bob := issueTestCert(t, blobStorage, "bob", "client-bob-2024")
+	carol := issueTestCert(t, blobStorage, "carol", "client-carol-2024")
+	directory.save(ScimUser{ID: "1", UserName: "alice", Active: true, Groups: []ScimGroup{{Value: "g1", Display: "VPN Users"}}}, "")
+	directory.save(ScimUser{ID: "2", UserName: "bob", Active: false}, "")
+	if _, err := newPKI(blobStorage, "bucket", "pki/").revokeCommonName("carol", "test"); err != nil {
+		t.Fatalf("revokeCommonName error: %s", err)
+	}
+
+	serials := map[string]string{
+		"alice": fmt.Sprintf("%X", alice.SerialNumber),
+		"bob":   fmt.Sprintf("%X", bob.SerialNumber),
+		"carol": fmt.Sprintf("%X", carol.SerialNumber),
+	}
+	tests := []struct {
+		request       verify.Request
+		allowedGroups []string
+		reason        string
+	}{
+		{request: verify.Request{CommonName: "alice", Serial: serials["alice"]}},
+		{request: verify.Request{CommonName: "alice", Serial: serials["alice"], Username: "alice"}, allowedGroups: []string{"vpn users"}},
+		{request: verify.Request{CommonName: "alice", Serial: serials["alice"], Username: "bob"}, reason: "username doesn't match the certificate"},
+		{request: verify.Request{CommonName: "alice", Serial: serials["alice"]}, allowedGroups: []string{"admins"}, reason: "user is not in an allowed group"},
+		{request: verify.Request{CommonName: "alice", Serial: serials["bob"]}, reason: "certificate is not issued"},
+		{request: verify.Request{CommonName: "bob", Serial: serials["bob"]}, reason: "user is deactivated"},
+		{request: verify.Request{CommonName: "carol", Serial: serials["carol"]}, reason: "certificate is revoked"},
+	}
+	for _, test := range tests {
+		s.config.AllowedGroups = test.allowedGroups
+		decision, err := s.verifyAccess(context.Background(), test.request, time.Now())
+		if err != nil || decision.Allow != (test.reason == "") || decision.Reason != test.reason {
+			t.Errorf("Unexpected decision for %+v (groups %v): %+v (err: %v)", test.request, test.allowedGroups, decision, err)
+		}
+	}
+
+	// users that are not provisioned can only connect without allowed groups
+	dave := issueTestCert(t, blobStorage, "dave", "client-dave-2024")
+	for _, allowedGroups := range [][]string{nil, {"g1"}} {
+		s.config.AllowedGroups = allowedGroups
+		decision, _ := s.verifyAccess(context.Background(), verify.Request{CommonName: "dave", Serial: fmt.Sprintf("%X", dave.SerialNumber)}, time.Now())
+		if decision.Allow != (allowedGroups == nil) {
+			t.Errorf("Unexpected decision for dave (groups %v): %+v", allowedGroups, decision)
+		}
+	}
+	if decision, _ := s.verifyAccess(context.Background(), verify.Request{CommonName: "alice", Serial: serials["alice"]}, alice.NotAfter.Add(time.Hour)); decision.Reason != "certificate is expired" {
+		t.Errorf("Expected an expired certificate, got %+v", decision)
+	}
+
+	// when the revocation or the user can't be read, there's no decision
+	s.config.AllowedGroups = nil
+	for _, prefix := range []string{"pki/revoked/", "pki/issued_by_serial/", "pki/scim/"} {
+		s.storage = &failingStorage{StorageIf: blobStorage, prefix: prefix}
+		if decision, err := s.verifyAccess(context.Background(), verify.Request{CommonName: "dave", Serial: fmt.Sprintf("%X", dave.SerialNumber)}, time.Now()); err == nil {
+			t.Errorf("Expected an error when %s can't be read, got %+v", prefix, decision)
+		}
+	}
+
+	// the certificate is looked up by serial, issued/ isn't listed on every connection
+	s.storage = &failingLists{StorageIf: blobStorage, prefix: "pki/issued/"}
+	if decision, err := s.verifyAccess(context.Background(), verify.Request{CommonName: "dave", Serial: fmt.Sprintf("%X", dave.SerialNumber)}, time.Now()); err != nil || !decision.Allow {
+		t.Errorf("Expected dave to be allowed without listing issued/, got %+v (err: %v)", decision, err)
+	}
+}
+
+// failingLists fails the listing of the objects with the prefix
+type failingLists struct {
+	storage.StorageIf
+	prefix string
+}
+
+func (s *failingLists) ListObjects(bucket, prefix string) ([]string, error) {
+	if strings.HasPrefix(prefix, s.prefix) {
+		return nil, fmt.Errorf("storage unavailable")
+	}
+	return s.StorageIf.ListObjects(bucket, prefix)
+}
+
+func TestServerVerifyHandler(t *testing.T) {
+	s, blobStorage := newTestServer(t)
+	s.config.ServerToken = "server-token"
+	r := mux.NewRouter()
+	s.serverRoutes(r, "")
+	bob := issueTestCert(t, blobStorage, "bob", "client-bob-2024")
+	newPKI(blobStorage, "bucket", "pki/").revokeCommonName("bob", "test")
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/servers/vpn1/verify", bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer server-token")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	serial := fmt.Sprintf("%X", bob.SerialNumber)
+	rec := post(`{"commonName": "bob", "serial": "` + serial + `"}`)
+	var decision verify.Decision
+	if err := json.NewDecoder(rec.Body).Decode(&decision); err != nil || rec.Code != http.StatusOK || decision.Allow {
+		t.Fatalf("Expected a denied connection, got %d %+v (err: %v)", rec.Code, decision, err)
+	}
+	if rec := post(`{"commonName": "bob", "serial": "xyz"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid serial, got %d", rec.Code)
+	}
+
+	s.auditLogger.Flush()
+	events, err := s.auditLogger.Query(audit.Query{Type: audit.ConnectionDenied})
+	if err != nil || len(events) != 1 || events[0].Actor != "server:vpn1" || events[0].Serial != serial || events[0].Details["reason"] != "certificate is revoked" {
+		t.Errorf("Expected the denied connection in the audit log, got %+v (err: %v)", events, err)
+	}
+}
+
+func TestScimPatchGroups(t *testing.T) {
+	user := ScimUser{UserName: "alice", Groups: []ScimGroup{{Value: "g1"}}}
+	operations := []ScimPatchOperation{
+		{Op: "add", Path: "groups", Value: json.RawMessage(`[{"value": "g2", "display": "VPN Users"}, {"value": "g1"}]`)},
+		{Op: "remove", Path: `groups[value eq "g1"]`},
+		{Op: "Add", Path: "groups", Value: json.RawMessage(`{"value": "g3"}`)},
+	}
+	for _, operation := range operations {
+		if err := applyScimPatchOperation(&user, operation); err != nil {
+			t.Fatalf("applyScimPatchOperation error: %s", err)
+		}
+	}
+	if len(user.Groups) != 2 || user.Groups[0].Value != "g2" || user.Groups[1].Value != "g3" {
+		t.Errorf("Unexpected groups: %+v", user.Groups)
+	}
+	applyScimPatchOperation(&user, ScimPatchOperation{Op: "remove", Path: "groups", Value: json.RawMessage(`[{"value": "g3"}]`)})
+	if len(user.Groups) != 1 || user.Groups[0].Value != "g2" {
+		t.Errorf("Unexpected groups: %+v", user.Groups)
+	}
+	applyScimPatchOperation(&user, ScimPatchOperation{Op: "remove", Path: "groups"})
+	if len(user.Groups) != 0 {
+		t.Errorf("Expected no groups, got %+v", user.Groups)
+	}
+}
@@ -0,0 +1,244 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/metrics"
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+// Event types
+const (
+	LoginSuccess      = "login.success"
+	LoginFailure      = "login.failure"
+	CertIssued        = "cert.issued"
+	CertRevoked       = "cert.revoked"
+	ProfileDownloaded = "profile.downloaded"
+	UserProvisioned   = "user.provisioned"
+	UserUpdated       = "user.updated"
+	UserDeprovisioned = "user.deprovisioned"
+	AdminAction       = "admin.action"
+	SessionKilled     = "session.killed"
+	ConnectionDenied  = "connection.denied"
+	MFAEnrolled       = "mfa.enrolled"
+	MFARemoved        = "mfa.removed"
+	MFARecoveryUsed   = "mfa.recovery_used"
+)
+
+// DefaultFlushInterval is the interval at which buffered events are written to the storage backend
+const DefaultFlushInterval = 5 * time.Second
+
+// maxBufferedEvents is the maximum number of events kept for the storage backend, older events are dropped when it's reached
+var maxBufferedEvents = 10000
+
+// Event is a structured audit event
+type Event struct {
+	Time      time.Time         `json:"time"`
+	Type      string            `json:"type"`
+	Actor     string            `json:"actor"`
+	IP        string            `json:"ip,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty"`
+	Subject   string            `json:"subject,omitempty"`
+	Serial    string            `json:"serial,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// Query filters the events returned by Logger.Query. Empty fields match everything.
+type Query struct {
+	Type    string
+	Actor   string
+	Subject string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// Logger writes audit events as JSON lines to stdout and (append-only) to the storage backend.
+// Every flush writes a new object under audit/<yyyy>/<mm>/<dd>/, existing objects are never modified.
+type Logger struct {
+	storage storage.StorageIf
+	bucket  string
+	prefix  string
+	kmsArn  string
+	out     io.Writer
+
+	mu     sync.Mutex
+	buffer []Event
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+/*
+ * NewLogger returns an audit logger. Call Start to flush events periodically to the storage backend.
+ */
+func NewLogger(blobStorage storage.StorageIf, bucket, prefix, kmsArn string, out io.Writer) *Logger {
+	return &Logger{
+		storage: blobStorage,
+		bucket:  bucket,
+		prefix:  prefix,
+		kmsArn:  kmsArn,
+		out:     out,
+		done:    make(chan struct{}),
+	}
+}
+
+// Log records an event. The event is written to stdout immediately and buffered for the storage backend.
+func (l *Logger) Log(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Could not marshal audit event", "error", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out != nil {
+		fmt.Fprintf(l.out, "%s\n", line)
+	}
+	l.buffer = append(l.buffer, event)
+	l.trimBuffer()
+}
+
+// trimBuffer drops the oldest events when the buffer exceeds maxBufferedEvents. The caller holds l.mu.
+func (l *Logger) trimBuffer() {
+	dropped := len(l.buffer) - maxBufferedEvents
+	if dropped <= 0 {
+		return
+	}
+	l.buffer = append([]Event(nil), l.buffer[dropped:]...)
+	metrics.AuditEventsDropped.Add(float64(dropped))
+	slog.Error("Audit buffer is full, dropped the oldest events", "dropped", dropped)
+}
+
+// Start flushes the buffered events at every interval, until Close is called
+func (l *Logger) Start(interval time.Duration) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.Flush(); err != nil {
+					slog.Error("Could not flush audit log", "error", err)
+				}
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the periodic flush and writes the remaining events
+func (l *Logger) Close() error {
+	close(l.done)
+	l.wg.Wait()
+	return l.Flush()
+}
+
+// Flush writes the buffered events as a new JSON lines object to the storage backend
+func (l *Logger) Flush() error {
+	l.mu.Lock()
+	events := l.buffer
+	l.buffer = nil
+	l.mu.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+
+	var out bytes.Buffer
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	first := events[0].Time.UTC()
+	item := l.prefix + "audit/" + first.Format("2006/01/02") + "/" + first.Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix) + ".jsonl"
+	if err := l.storage.PutObject(l.bucket, item, out.String(), l.kmsArn); err != nil {
+		// put the events back, so they're retried on the next flush. The buffer is capped, so a storage backend that's
+		// down for a long time doesn't grow it forever.
+		l.mu.Lock()
+		l.buffer = append(events, l.buffer...)
+		l.trimBuffer()
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Query returns the events that match the query, oldest first. Since defaults to 7 days ago.
+func (l *Logger) Query(query Query) ([]Event, error) {
+	events := []Event{}
+	if query.Since.IsZero() {
+		query.Since = time.Now().AddDate(0, 0, -7)
+	}
+	if query.Until.IsZero() {
+		query.Until = time.Now()
+	}
+	since := query.Since.UTC()
+	until := query.Until.UTC()
+	for day := since.Truncate(24 * time.Hour); !day.After(until); day = day.AddDate(0, 0, 1) {
+		items, err := l.storage.ListObjects(l.bucket, l.prefix+"audit/"+day.Format("2006/01/02")+"/")
+		if err != nil {
+			return events, err
+		}
+		for _, item := range items {
+			data, err := l.storage.GetObject(l.bucket, item)
+			if err != nil {
+				return events, err
+			}
+			scanner := bufio.NewScanner(&data)
+			for scanner.Scan() {
+				var event Event
+				if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+					return events, fmt.Errorf("could not parse %s: %s", item, err)
+				}
+				if query.matches(event, since, until) {
+					events = append(events, event)
+				}
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	if query.Limit > 0 && len(events) > query.Limit {
+		events = events[len(events)-query.Limit:]
+	}
+	return events, nil
+}
+
+func (query Query) matches(event Event, since, until time.Time) bool {
+	if event.Time.Before(since) || event.Time.After(until) {
+		return false
+	}
+	if query.Type != "" && event.Type != query.Type && !strings.HasPrefix(event.Type, query.Type+".") {
+		return false
+	}
+	if query.Actor != "" && event.Actor != query.Actor {
+		return false
+	}
+	if query.Subject != "" && event.Subject != query.Subject {
+		return false
+	}
+	return true
+}
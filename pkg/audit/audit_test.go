@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/metrics"
+	"github.com/in4it/openvpn-access/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLogAndQuery(t *testing.T) {
+	var stdout bytes.Buffer
+	blobStorage := storage.NewMemory()
+	logger := NewLogger(blobStorage, "bucket", "pki/", "", &stdout)
+
+	logger.Log(Event{Type: LoginSuccess, Actor: "alice@example.com", IP: "10.0.0.1", UserAgent: "test"})
+	logger.Log(Event{Type: CertIssued, Actor: "alice@example.com", Subject: "alice@example.com", Serial: "AB01"})
+	logger.Log(Event{Type: LoginFailure, Details: map[string]string{"error": "invalid code"}})
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines on stdout, got %d", len(lines))
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatalf("stdout line is not json: %s", err)
+	}
+	if event.Serial != "AB01" || event.Time.IsZero() {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	if err := logger.Flush(); err != nil {
+		t.Fatalf("Flush error: %s", err)
+	}
+	logger.Log(Event{Type: ProfileDownloaded, Actor: "bob@example.com", Subject: "bob@example.com"})
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	items, _ := blobStorage.ListObjects("bucket", "pki/audit/"+time.Now().UTC().Format("2006/01/02")+"/")
+	if len(items) != 2 {
+		t.Errorf("Expected 2 audit objects (one per flush), got %d", len(items))
+	}
+
+	events, err := logger.Query(Query{})
+	if err != nil {
+		t.Fatalf("Query error: %s", err)
+	}
+	if len(events) != 4 {
+		t.Errorf("Expected 4 events, got %d", len(events))
+	}
+	events, _ = logger.Query(Query{Actor: "alice@example.com"})
+	if len(events) != 2 {
+		t.Errorf("Expected 2 events for alice, got %d", len(events))
+	}
+	events, _ = logger.Query(Query{Type: "login"})
+	if len(events) != 2 {
+		t.Errorf("Expected 2 login events, got %d", len(events))
+	}
+	events, _ = logger.Query(Query{Limit: 1})
+	if len(events) != 1 || events[0].Type != ProfileDownloaded {
+		t.Errorf("Expected the last event with limit 1, got %+v", events)
+	}
+	events, _ = logger.Query(Query{Since: time.Now().Add(time.Hour)})
+	if len(events) != 0 {
+		t.Errorf("Expected no events in the future, got %d", len(events))
+	}
+}
+
+// failingPuts fails every write, like a storage backend that's down
+type failingPuts struct {
+	storage.StorageIf
+}
+
+func (failingPuts) PutObject(bucket, item, body, kmsArn string) error {
+	return fmt.Errorf("storage is down")
+}
+
+func TestFlushCapsBuffer(t *testing.T) {
+	defer func(max int) { maxBufferedEvents = max }(maxBufferedEvents)
+	maxBufferedEvents = 3
+	dropped := testutil.ToFloat64(metrics.AuditEventsDropped)
+	logger := NewLogger(failingPuts{StorageIf: storage.NewMemory()}, "bucket", "pki/", "", nil)
+
+	for i := 0; i < 2; i++ {
+		logger.Log(Event{Type: LoginSuccess, Actor: fmt.Sprintf("user%d@example.com", i)})
+	}
+	if err := logger.Flush(); err == nil {
+		t.Fatalf("Expected a flush error")
+	}
+	for i := 2; i < 5; i++ {
+		logger.Log(Event{Type: LoginSuccess, Actor: fmt.Sprintf("user%d@example.com", i)})
+	}
+	if err := logger.Flush(); err == nil {
+		t.Fatalf("Expected a flush error")
+	}
+	if len(logger.buffer) != 3 || logger.buffer[0].Actor != "user2@example.com" {
+		t.Errorf("Expected the 3 newest events in the buffer, got %+v", logger.buffer)
+	}
+	if value := testutil.ToFloat64(metrics.AuditEventsDropped) - dropped; value != 2 {
+		t.Errorf("Expected 2 dropped events, got %v", value)
+	}
+}
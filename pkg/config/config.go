@@ -0,0 +1,448 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of openvpn-access. It's loaded from a yaml file, environment variables and flags (in that order).
+type Config struct {
+	Port              string     `yaml:"port" env:"PORT"`
+	URLPrefix         string     `yaml:"url_prefix" env:"URL_PREFIX"`
+	Debug             bool       `yaml:"debug" env:"DEBUG"`
+	SessionKey        string     `yaml:"session_key" env:"SESSION_KEY"`
+	CSRFKey           string     `yaml:"csrf_key" env:"CSRF_KEY"`
+	AdminUsers        []string   `yaml:"admin_users" env:"ADMIN_USERS"`
+	AllowedGroups     []string   `yaml:"allowed_groups" env:"ALLOWED_GROUPS"` // scim groups (id or name) that may connect
+	MaxDevicesPerUser int        `yaml:"max_devices_per_user" env:"MAX_DEVICES_PER_USER"`
+	SCIMToken         string     `yaml:"scim_token" env:"SCIM_TOKEN"`
+	ServerToken       string     `yaml:"server_token" env:"SERVER_TOKEN"`       // bearer token of the openvpn servers
+	TrustedProxies    int        `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"` // number of proxies (e.g. the ALB) that add X-Forwarded-For
+	Auth              Auth       `yaml:"auth"`
+	Cert              Cert       `yaml:"cert"`
+	Storage           Storage    `yaml:"storage"`
+	Metrics           Metrics    `yaml:"metrics"`
+	TLS               TLS        `yaml:"tls"`
+	ACME              ACME       `yaml:"acme"`
+	Log               Log        `yaml:"log"`
+	Management        Management `yaml:"management"`
+	MFA               MFA        `yaml:"mfa"`
+	// SecretsRefreshInterval is the interval to resolve the secret references again, 0 to only resolve at startup
+	SecretsRefreshInterval time.Duration `yaml:"secrets_refresh_interval" env:"SECRETS_REFRESH_INTERVAL"`
+
+	// secretRefs are the references of the resolved secrets, by field path (e.g. Auth.ClientSecret)
+	secretRefs map[string]string
+	resolver   *secrets.Resolver
+}
+
+// Auth is the configuration of the oauth2 / oidc identity provider
+type Auth struct {
+	Type         string   `yaml:"type" env:"AUTH_TYPE"`
+	ClientID     string   `yaml:"client_id" env:"OAUTH2_CLIENT_ID"`
+	ClientSecret string   `yaml:"client_secret" env:"OAUTH2_CLIENT_SECRET"`
+	RedirectURL  string   `yaml:"redirect_url" env:"OAUTH2_REDIRECT_URL"`
+	URL          string   `yaml:"url" env:"OAUTH2_URL"`
+	Scopes       []string `yaml:"scopes" env:"OAUTH2_SCOPES" sep:" "`
+}
+
+// Cert is the configuration of the issued client certificates
+type Cert struct {
+	ClientOrganization string `yaml:"client_organization" env:"CLIENT_CERT_ORG"`
+}
+
+// Storage is the configuration of the storage backend (s3 or azblob). The CA, the tls-auth key and the client config
+// template are cached for CacheTTL, the cache is disabled when it's 0.
+type Storage struct {
+	Type       string        `yaml:"type" env:"STORAGE_TYPE"`
+	S3         S3            `yaml:"s3"`
+	Azure      Azure         `yaml:"azure"`
+	Encryption Encryption    `yaml:"encryption"`
+	CacheTTL   time.Duration `yaml:"cache_ttl" env:"STORAGE_CACHE_TTL"`
+}
+
+// S3 is the configuration of the s3 storage backend
+type S3 struct {
+	Bucket string `yaml:"bucket" env:"S3_BUCKET"`
+	Prefix string `yaml:"prefix" env:"S3_PREFIX"`
+	KMSArn string `yaml:"kms_arn" env:"S3_KMS_ARN"`
+	Region string `yaml:"region" env:"AWS_REGION"`
+}
+
+// Azure is the configuration of the azure blob storage backend. Managed Service Identity is used when the account key is empty.
+type Azure struct {
+	AccountName string `yaml:"account_name" env:"AZ_STORAGE_ACCOUNT_NAME"`
+	AccountKey  string `yaml:"account_key" env:"AZ_STORAGE_ACCOUNT_KEY"`
+	Container   string `yaml:"container" env:"AZ_STORAGE_ACCOUNT_CONTAINER"`
+}
+
+// Encryption is the client-side envelope encryption of the private keys in the storage backend, with a key encryption
+// key (KEK) in AWS KMS, Azure Key Vault or a local file. The encryption is disabled when the KEK is empty.
+type Encryption struct {
+	KEK         string `yaml:"kek" env:"STORAGE_ENCRYPTION_KEK"`
+	KMSKeyID    string `yaml:"kms_key_id" env:"STORAGE_ENCRYPTION_KMS_KEY_ID"`
+	KeyVaultKey string `yaml:"key_vault_key" env:"STORAGE_ENCRYPTION_KEY_VAULT_KEY"`
+	KeyFile     string `yaml:"key_file" env:"STORAGE_ENCRYPTION_KEY_FILE"`
+}
+
+// Metrics is the configuration of the prometheus endpoint
+type Metrics struct {
+	ListenAddr string `yaml:"listen_addr" env:"METRICS_LISTEN_ADDR"`
+}
+
+// TLS is the configuration of native TLS with a certificate and key file
+type TLS struct {
+	CertFile string `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"TLS_KEY_FILE"`
+}
+
+// ACME is the configuration of native TLS with certificates requested with ACME
+type ACME struct {
+	Domains        []string `yaml:"domains" env:"ACME_DOMAINS"`
+	Email          string   `yaml:"email" env:"ACME_EMAIL"`
+	CacheDir       string   `yaml:"cache_dir" env:"ACME_CACHE_DIR"`
+	DirectoryURL   string   `yaml:"directory_url" env:"ACME_DIRECTORY_URL"`
+	HTTPListenAddr string   `yaml:"http_listen_addr" env:"ACME_HTTP_LISTEN_ADDR"`
+}
+
+// Management is the configuration of the management interfaces of the openvpn servers, to disconnect revoked clients
+// and to show the connected clients. An address is unix:///path/to/socket, tcp://host:port or host:port.
+type Management struct {
+	Addresses []string      `yaml:"addresses" env:"MANAGEMENT_ADDRESSES"`
+	Password  string        `yaml:"password" env:"MANAGEMENT_PASSWORD"`
+	Timeout   time.Duration `yaml:"timeout" env:"MANAGEMENT_TIMEOUT"`
+}
+
+// MFA is the configuration of the second factor (TOTP) of the openvpn clients. MFA is enabled when the key is set.
+type MFA struct {
+	// Key encrypts the enrolled secrets in the storage backend (32 bytes). It's only read at startup: with another key,
+	// the users have to enroll again.
+	Key    string `yaml:"key" env:"MFA_KEY"`
+	Issuer string `yaml:"issuer" env:"MFA_ISSUER"`
+	// Required refuses the openvpn profiles and connections of users that didn't enroll
+	Required bool `yaml:"required" env:"MFA_REQUIRED"`
+}
+
+// Log is the configuration of the logger
+type Log struct {
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+}
+
+// secretsTimeout is the maximum time to resolve the secrets at startup
+const secretsTimeout = 30 * time.Second
+
+// Default returns the configuration with the default values
+func Default() Config {
+	return Config{
+		Port:              "8080",
+		MaxDevicesPerUser: 5,
+		Auth:              Auth{Type: "oidc"},
+		Storage:           Storage{Type: "s3", CacheTTL: 30 * time.Second},
+		ACME:              ACME{CacheDir: "acme-cache"},
+		Log:               Log{Format: "text", Level: "info"},
+		Management:        Management{Timeout: 5 * time.Second},
+		MFA:               MFA{Issuer: "OpenVPN Access"},
+	}
+}
+
+/*
+ * Load loads the configuration: the defaults, overridden by the yaml file (-config flag or CONFIG_FILE), the environment
+ * variables and the flags in args. The configuration is validated.
+ */
+func Load(args []string) (Config, error) {
+	conf, err := load(args)
+	if err != nil {
+		return conf, err
+	}
+	return conf, conf.Validate()
+}
+
+/*
+ * LoadStorage loads the configuration like Load, but only validates the storage backend. It's used by the admin
+ * commands, which don't need the settings of the web server.
+ */
+func LoadStorage(args []string) (Config, error) {
+	conf, err := load(args)
+	if err != nil {
+		return conf, err
+	}
+	return conf, conf.ValidateStorage()
+}
+
+func load(args []string) (Config, error) {
+	conf := Default()
+
+	fs := flag.NewFlagSet("openvpn-access", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "yaml configuration file")
+	port := fs.String("port", "", "port to listen on")
+	urlPrefix := fs.String("url-prefix", "", "url prefix, e.g. /vpn")
+	logFormat := fs.String("log-format", "", "log format: text or json")
+	logLevel := fs.String("log-level", "", "log level: debug, info, warn or error")
+	debug := fs.Bool("debug", false, "enable the debug endpoint")
+	if err := fs.Parse(args); err != nil {
+		return conf, err
+	}
+
+	if *configFile != "" {
+		if err := conf.loadFile(*configFile); err != nil {
+			return conf, err
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&conf).Elem()); err != nil {
+		return conf, err
+	}
+	conf.resolver = secrets.NewDefaultResolver(conf.Storage.S3.Region)
+	ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+	defer cancel()
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			conf.Port = *port
+		case "url-prefix":
+			conf.URLPrefix = *urlPrefix
+		case "log-format":
+			conf.Log.Format = *logFormat
+		case "log-level":
+			conf.Log.Level = *logLevel
+		case "debug":
+			conf.Debug = *debug
+		}
+	})
+	if err := conf.ResolveSecrets(ctx, conf.resolver); err != nil {
+		return conf, err
+	}
+	return conf, nil
+}
+
+/*
+ * ResolveSecrets replaces the values that are a secret reference (e.g. ssm:/openvpn-access/csrf-key) with the secret.
+ * The references are kept to refresh the secrets.
+ */
+func (c *Config) ResolveSecrets(ctx context.Context, resolver *secrets.Resolver) error {
+	c.resolver = resolver
+	c.secretRefs = map[string]string{}
+	return c.resolveSecrets(ctx, reflect.ValueOf(c).Elem(), "")
+}
+
+func (c *Config) resolveSecrets(ctx context.Context, v reflect.Value, path string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := path + v.Type().Field(i).Name
+		if !field.CanSet() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Struct:
+			if err := c.resolveSecrets(ctx, field, name+"."); err != nil {
+				return err
+			}
+		case reflect.String:
+			if !c.resolver.IsReference(field.String()) {
+				continue
+			}
+			secret, err := c.resolver.Resolve(ctx, field.String())
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			c.secretRefs[name] = field.String()
+			field.SetString(secret)
+		}
+	}
+	return nil
+}
+
+// RefreshSecrets returns a copy of the configuration with the secret references resolved again
+func (c Config) RefreshSecrets(ctx context.Context) (Config, error) {
+	refreshed := c
+	for name, ref := range c.secretRefs {
+		secret, err := c.resolver.Resolve(ctx, ref)
+		if err != nil {
+			return c, fmt.Errorf("%s: %s", name, err)
+		}
+		field := reflect.ValueOf(&refreshed).Elem()
+		for _, part := range strings.Split(name, ".") {
+			field = field.FieldByName(part)
+		}
+		field.SetString(secret)
+	}
+	return refreshed, nil
+}
+
+// loadFile reads the yaml configuration file. Unknown keys are an error.
+func (c *Config) loadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Could not read config file: %s", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("Could not parse config file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// applyEnv sets the fields with an env tag to the value of the environment variable, when it's not empty
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		tag := v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+		name := tag.Tag.Get("env")
+		value := os.Getenv(name)
+		if name == "" || value == "" {
+			continue
+		}
+		switch {
+		case field.Type() == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s should be a duration (e.g. 5m): %s", name, err)
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s should be true or false: %s", name, err)
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s should be a number: %s", name, err)
+			}
+			field.SetInt(int64(n))
+		case field.Kind() == reflect.Slice:
+			sep := tag.Tag.Get("sep")
+			if sep == "" {
+				sep = ","
+			}
+			field.Set(reflect.ValueOf(splitList(value, sep)))
+		}
+	}
+	return nil
+}
+
+func splitList(value, sep string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, sep) {
+		if strings.TrimSpace(item) != "" {
+			list = append(list, strings.TrimSpace(item))
+		}
+	}
+	return list
+}
+
+// Validate returns all the errors in the configuration
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "port (PORT) should be a number between 1 and 65535, got %q", c.Port)
+	check(c.URLPrefix == "" || (strings.HasPrefix(c.URLPrefix, "/") && !strings.HasSuffix(c.URLPrefix, "/")), "url_prefix (URL_PREFIX) should start with a / and not end with a /, got %q", c.URLPrefix)
+	check(len(c.SessionKey) == 32 || len(c.SessionKey) == 64, "session_key (SESSION_KEY) should be 32 or 64 bytes long, got %d bytes", len(c.SessionKey))
+	check(len(c.CSRFKey) == 32, "csrf_key (CSRF_KEY) should be 32 bytes long, got %d bytes", len(c.CSRFKey))
+	check(c.SecretsRefreshInterval >= 0, "secrets_refresh_interval (SECRETS_REFRESH_INTERVAL) can't be negative")
+	check(c.MaxDevicesPerUser >= 0, "max_devices_per_user (MAX_DEVICES_PER_USER) can't be negative")
+	check(c.TrustedProxies >= 0, "trusted_proxies (TRUSTED_PROXIES) can't be negative")
+
+	switch c.Auth.Type {
+	case "oidc":
+		check(c.Auth.URL != "", "auth.url (OAUTH2_URL) is required for oidc")
+	case "github":
+	default:
+		check(false, "auth.type (AUTH_TYPE) should be oidc or github, got %q", c.Auth.Type)
+	}
+	check(c.Auth.ClientID != "", "auth.client_id (OAUTH2_CLIENT_ID) is required")
+	check(c.Auth.ClientSecret != "", "auth.client_secret (OAUTH2_CLIENT_SECRET) is required")
+	check(c.Auth.RedirectURL != "", "auth.redirect_url (OAUTH2_REDIRECT_URL) is required")
+
+	errs = append(errs, c.storageErrors()...)
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file (TLS_CERT_FILE) and tls.key_file (TLS_KEY_FILE) should be set together")
+	check(c.TLS.CertFile == "" || len(c.ACME.Domains) == 0, "tls.cert_file (TLS_CERT_FILE) and acme.domains (ACME_DOMAINS) can't be used together")
+
+	check(c.Management.Timeout > 0, "management.timeout (MANAGEMENT_TIMEOUT) should be positive")
+
+	check(c.MFA.Key == "" || len(c.MFA.Key) == 32, "mfa.key (MFA_KEY) should be 32 bytes long, got %d bytes", len(c.MFA.Key))
+	check(!c.MFA.Required || c.MFA.Key != "", "mfa.key (MFA_KEY) is required with mfa.required (MFA_REQUIRED)")
+
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format (LOG_FORMAT) should be text or json, got %q", c.Log.Format)
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "log.level (LOG_LEVEL) should be debug, info, warn or error, got %q", c.Log.Level)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// ValidateStorage returns the errors in the configuration of the storage backend
+func (c Config) ValidateStorage() error {
+	if errs := c.storageErrors(); len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (c Config) storageErrors() []error {
+	var errs []error
+	switch c.Storage.Type {
+	case "s3":
+		if c.Storage.S3.Bucket == "" {
+			errs = append(errs, fmt.Errorf("storage.s3.bucket (S3_BUCKET) is required for s3 storage"))
+		}
+	case "azblob":
+		if c.Storage.Azure.AccountName == "" {
+			errs = append(errs, fmt.Errorf("storage.azure.account_name (AZ_STORAGE_ACCOUNT_NAME) is required for azblob storage"))
+		}
+		if c.Storage.Azure.Container == "" {
+			errs = append(errs, fmt.Errorf("storage.azure.container (AZ_STORAGE_ACCOUNT_CONTAINER) is required for azblob storage"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.type (STORAGE_TYPE) should be s3 or azblob, got %q", c.Storage.Type))
+	}
+	if c.Storage.CacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("storage.cache_ttl (STORAGE_CACHE_TTL) should not be negative"))
+	}
+	encryption := c.Storage.Encryption
+	switch {
+	case encryption.KEK == "":
+	case encryption.KEK == "aws-kms" && encryption.KMSKeyID == "":
+		errs = append(errs, fmt.Errorf("storage.encryption.kms_key_id (STORAGE_ENCRYPTION_KMS_KEY_ID) is required for aws-kms"))
+	case encryption.KEK == "azure-keyvault" && !strings.HasPrefix(encryption.KeyVaultKey, "https://"):
+		errs = append(errs, fmt.Errorf("storage.encryption.key_vault_key (STORAGE_ENCRYPTION_KEY_VAULT_KEY) should be the url of the key for azure-keyvault, got %q", encryption.KeyVaultKey))
+	case encryption.KEK == "file" && encryption.KeyFile == "":
+		errs = append(errs, fmt.Errorf("storage.encryption.key_file (STORAGE_ENCRYPTION_KEY_FILE) is required for file"))
+	case encryption.KEK != "aws-kms" && encryption.KEK != "azure-keyvault" && encryption.KEK != "file":
+		errs = append(errs, fmt.Errorf("storage.encryption.kek (STORAGE_ENCRYPTION_KEK) should be aws-kms, azure-keyvault or file, got %q", encryption.KEK))
+	}
+	return errs
+}
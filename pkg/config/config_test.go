@@ -0,0 +1,177 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/secrets"
+)
+
+const testConfig = `
+port: "9000"
+url_prefix: /vpn
+session_key: 0123456789abcdef0123456789abcdef
+csrf_key: 0123456789abcdef0123456789abcdef
+admin_users:
+  - alice@example.com
+auth:
+  type: github
+  client_id: client-id
+  client_secret: client-secret
+  redirect_url: https://vpn.example.com/vpn/callback
+storage:
+  s3:
+    bucket: bucket
+    prefix: openvpn
+log:
+  level: debug
+`
+
+func writeConfig(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile error: %s", err)
+	}
+	return filename
+}
+
+func TestLoad(t *testing.T) {
+	filename := writeConfig(t, testConfig)
+	t.Setenv("URL_PREFIX", "/access")
+	t.Setenv("ADMIN_USERS", "bob@example.com, carol@example.com")
+	t.Setenv("OAUTH2_SCOPES", "openid email")
+	t.Setenv("MAX_DEVICES_PER_USER", "3")
+
+	conf, err := Load([]string{"-config", filename, "-port", "9090"})
+	if err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+	if conf.Port != "9090" {
+		t.Errorf("flag should override the file, got port %s", conf.Port)
+	}
+	if conf.URLPrefix != "/access" {
+		t.Errorf("env should override the file, got url prefix %s", conf.URLPrefix)
+	}
+	if !reflect.DeepEqual(conf.AdminUsers, []string{"bob@example.com", "carol@example.com"}) {
+		t.Errorf("unexpected admin users: %v", conf.AdminUsers)
+	}
+	if !reflect.DeepEqual(conf.Auth.Scopes, []string{"openid", "email"}) {
+		t.Errorf("unexpected scopes: %v", conf.Auth.Scopes)
+	}
+	if conf.MaxDevicesPerUser != 3 || conf.Log.Level != "debug" || conf.Storage.Type != "s3" || conf.Storage.S3.Bucket != "bucket" {
+		t.Errorf("unexpected config: %+v", conf)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := Load([]string{"-config", writeConfig(t, "unknown_key: true")}); err == nil || !strings.Contains(err.Error(), "unknown_key") {
+		t.Errorf("Expected error for unknown key, got: %v", err)
+	}
+	t.Setenv("MAX_DEVICES_PER_USER", "five")
+	if _, err := Load([]string{"-config", writeConfig(t, testConfig)}); err == nil || !strings.Contains(err.Error(), "MAX_DEVICES_PER_USER") {
+		t.Errorf("Expected error for invalid number, got: %v", err)
+	}
+}
+
+func TestLoadStorage(t *testing.T) {
+	filename := writeConfig(t, "storage:\n  s3:\n    bucket: bucket\n")
+	if _, err := Load([]string{"-config", filename}); err == nil {
+		t.Errorf("Expected validation error for the web server settings")
+	}
+	conf, err := LoadStorage([]string{"-config", filename})
+	if err != nil {
+		t.Fatalf("LoadStorage error: %s", err)
+	}
+	if conf.Storage.S3.Bucket != "bucket" {
+		t.Errorf("unexpected bucket: %s", conf.Storage.S3.Bucket)
+	}
+	t.Setenv("STORAGE_TYPE", "azblob")
+	if _, err := LoadStorage([]string{"-config", filename}); err == nil || !strings.Contains(err.Error(), "AZ_STORAGE_ACCOUNT_NAME") {
+		t.Errorf("Expected error for missing azure account, got: %v", err)
+	}
+	t.Setenv("STORAGE_TYPE", "s3")
+	t.Setenv("STORAGE_ENCRYPTION_KEK", "aws-kms")
+	if _, err := LoadStorage([]string{"-config", filename}); err == nil || !strings.Contains(err.Error(), "STORAGE_ENCRYPTION_KMS_KEY_ID") {
+		t.Errorf("Expected error for missing kms key, got: %v", err)
+	}
+	t.Setenv("STORAGE_ENCRYPTION_KMS_KEY_ID", "alias/openvpn-access")
+	conf, err = LoadStorage([]string{"-config", filename})
+	if err != nil {
+		t.Errorf("Expected valid encryption config, got: %v", err)
+	}
+	if conf.Storage.CacheTTL != 30*time.Second {
+		t.Errorf("Unexpected default cache ttl: %s", conf.Storage.CacheTTL)
+	}
+	t.Setenv("STORAGE_CACHE_TTL", "-1s")
+	if _, err := LoadStorage([]string{"-config", filename}); err == nil || !strings.Contains(err.Error(), "STORAGE_CACHE_TTL") {
+		t.Errorf("Expected error for a negative cache ttl, got: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	conf := Default()
+	conf.SessionKey = "short"
+	conf.CSRFKey = "0123456789abcdef0123456789abcdef"
+	conf.Auth.ClientID = "client-id"
+	conf.Auth.ClientSecret = "client-secret"
+	conf.Auth.RedirectURL = "https://vpn.example.com/callback"
+	conf.Storage.S3.Bucket = "bucket"
+	conf.TLS.CertFile = "tls.crt"
+	conf.MFA.Required = true
+
+	err := conf.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation error")
+	}
+	for _, expected := range []string{"(SESSION_KEY) should be 32 or 64 bytes long, got 5 bytes", "OAUTH2_URL", "TLS_KEY_FILE", "MFA_KEY"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in error: %s", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "CSRF_KEY") {
+		t.Errorf("CSRF_KEY is valid: %s", err)
+	}
+
+	conf.SessionKey = "0123456789abcdef0123456789abcdef"
+	conf.Auth.URL = "https://idp.example.com"
+	conf.TLS.CertFile = ""
+	conf.Management.Addresses = []string{"unix:///run/openvpn/management.sock", "localhost:7505"}
+	conf.MFA.Key = "0123456789abcdef0123456789abcdef"
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Expected valid config, got: %s", err)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	values := map[string]string{"/openvpn-access/client-secret": "client-secret"}
+	resolver := secrets.NewResolver(map[string]secrets.Provider{"ssm": secrets.NewMemory(values)})
+
+	conf := Default()
+	conf.Auth.ClientSecret = "ssm:/openvpn-access/client-secret"
+	conf.Auth.URL = "https://idp.example.com"
+	if err := conf.ResolveSecrets(context.Background(), resolver); err != nil {
+		t.Fatalf("ResolveSecrets error: %s", err)
+	}
+	if conf.Auth.ClientSecret != "client-secret" || conf.Auth.URL != "https://idp.example.com" {
+		t.Errorf("unexpected config after resolving secrets: %+v", conf.Auth)
+	}
+
+	values["/openvpn-access/client-secret"] = "rotated-client-secret"
+	refreshed, err := conf.RefreshSecrets(context.Background())
+	if err != nil {
+		t.Fatalf("RefreshSecrets error: %s", err)
+	}
+	if refreshed.Auth.ClientSecret != "rotated-client-secret" || conf.Auth.ClientSecret != "client-secret" {
+		t.Errorf("unexpected client secret after refresh: %s (original: %s)", refreshed.Auth.ClientSecret, conf.Auth.ClientSecret)
+	}
+
+	conf.CSRFKey = "ssm:/doesnotexist"
+	if err := conf.ResolveSecrets(context.Background(), resolver); err == nil || !strings.Contains(err.Error(), "CSRFKey") {
+		t.Errorf("Expected error for missing secret, got: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader is the header that contains the request id. An id set by the load balancer or caller is reused.
+const RequestIDHeader = "X-Request-Id"
+
+const redacted = "[REDACTED]"
+
+type contextKey struct{}
+
+// secretKeys matches attribute keys that contain secrets, like id_token, client_secret, authorization, ca_key or code
+var secretKeys = regexp.MustCompile(`(?i)(token|secret|password|passwd|authorization|cookie|(^|_)key|^code)$`)
+
+// privateKeyPEM matches (the start of) a PEM encoded private key in a value
+var privateKeyPEM = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+
+/*
+ * New returns a logger that writes to out. format is "json" or "text" (default), level is debug, info (default), warn or error.
+ * Attributes that contain secrets are redacted.
+ */
+func New(out io.Writer, format, level string) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level:       parseLevel(level),
+		ReplaceAttr: redact,
+	}
+	if strings.ToLower(format) == "json" {
+		return slog.New(slog.NewJSONHandler(out, opts))
+	}
+	return slog.New(slog.NewTextHandler(out, opts))
+}
+
+// Init sets the default logger, writing to stderr
+func Init(format, level string) {
+	slog.SetDefault(New(os.Stderr, format, level))
+}
+
+func parseLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// redact replaces the value of attributes that contain secrets
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+	if secretKeys.MatchString(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	if a.Value.Kind() == slog.KindString && privateKeyPEM.MatchString(a.Value.String()) {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// FromContext returns the default logger with the request id of the context
+func FromContext(ctx context.Context) *slog.Logger {
+	if requestID := RequestID(ctx); requestID != "" {
+		return slog.Default().With("request_id", requestID)
+	}
+	return slog.Default()
+}
+
+// RequestID returns the request id of the context, or an empty string
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(contextKey{}).(string)
+	return requestID
+}
+
+// WithRequestID returns a context with the request id
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, requestID)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+/*
+ * Middleware adds a request id to the context and response, and logs every request. The query string is not
+ * logged, as it can contain the oauth2 code.
+ */
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		ctx := WithRequestID(r.Context(), requestID)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		FromContext(ctx).LogAttrs(ctx, slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
@@ -0,0 +1,200 @@
+package management
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// passwordPrompt is sent by openvpn when the management interface is protected with a password. It's not followed by
+// a newline.
+const passwordPrompt = "ENTER PASSWORD:"
+
+// Client is a connection to the management interface of an openvpn server. The management interface accepts one
+// client at a time, so connect for every operation and close the connection afterwards.
+type Client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+/*
+ * SplitAddress returns the server name and the address of a management interface. <name>=<address> names the openvpn
+ * server, like the name of its status file or server API. Without a name, the address is the name of the server.
+ */
+func SplitAddress(address string) (string, string) {
+	if name, addr, ok := strings.Cut(address, "="); ok && name != "" && !strings.ContainsAny(name, ":/") {
+		return name, addr
+	}
+	return address, address
+}
+
+/*
+ * ParseAddress returns the network and address of a management interface: unix:///path/to/socket for a unix socket,
+ * tcp://host:port or host:port for tcp, optionally prefixed with the name of the server (<name>=<address>).
+ */
+func ParseAddress(address string) (string, string, error) {
+	_, address = SplitAddress(address)
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.Contains(address, "://"):
+		return "", "", fmt.Errorf("unsupported management address %q, use unix:// or tcp://", address)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid management address %q: %s", address, err)
+	}
+	return "tcp", address, nil
+}
+
+/*
+ * Dial connects to the management interface and logs in with the password, when the interface asks for one. Every
+ * command has to finish within timeout.
+ */
+func Dial(ctx context.Context, address, password string, timeout time.Duration) (*Client, error) {
+	network, addr, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := dialer.DialContext(dialCtx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+	if err := c.login(password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// login waits for the greeting (>INFO) of the management interface, and sends the password when it's asked for
+func (c *Client) login(password string) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return fmt.Errorf("management interface: %s", err)
+		}
+		switch {
+		case line == passwordPrompt:
+			if password == "" {
+				return fmt.Errorf("management interface asks for a password, but none is configured")
+			}
+			if _, err := fmt.Fprintf(c.conn, "%s\n", password); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "ERROR:"):
+			return fmt.Errorf("management interface: %s", line)
+		case strings.HasPrefix(line, ">INFO:"):
+			return nil
+		}
+	}
+}
+
+// readLine reads a line, or the password prompt that is not followed by a newline
+func (c *Client) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b)
+		if string(line) == passwordPrompt {
+			return passwordPrompt, nil
+		}
+	}
+}
+
+// command sends the command and returns the response: the lines up to END for a multi-line response, otherwise the
+// SUCCESS line. Real-time notifications (lines starting with >) are skipped.
+func (c *Client) command(cmd string, multiLine bool) ([]string, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := fmt.Fprintf(c.conn, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(line, ">"):
+			continue
+		case strings.HasPrefix(line, "ERROR:"):
+			return nil, fmt.Errorf("%s: %s", cmd, strings.TrimSpace(strings.TrimPrefix(line, "ERROR:")))
+		case !multiLine && strings.HasPrefix(line, "SUCCESS:"):
+			return []string{strings.TrimSpace(strings.TrimPrefix(line, "SUCCESS:"))}, nil
+		case multiLine && line == "END":
+			return append(lines, line), nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+// Status returns the connected clients
+func (c *Client) Status() (*Status, error) {
+	lines, err := c.command("status 3", true)
+	if err != nil {
+		return nil, err
+	}
+	return ParseStatus(strings.NewReader(strings.Join(lines, "\n")))
+}
+
+/*
+ * Kill disconnects all sessions with the common name and returns the number of killed sessions. The sessions are
+ * killed by client id, because the kill command treats a common name with a colon (like a device certificate) as an
+ * address. Servers that don't report client ids (before openvpn 2.1) are sent a kill by common name.
+ */
+func (c *Client) Kill(commonName string) (int, error) {
+	status, err := c.Status()
+	if err != nil {
+		return 0, err
+	}
+	var sessions []ClientInfo
+	for _, client := range status.Clients {
+		if client.CommonName == commonName {
+			sessions = append(sessions, client)
+		}
+	}
+	if len(sessions) > 0 && sessions[0].ClientID == "" {
+		if strings.Contains(commonName, ":") {
+			return 0, fmt.Errorf("can't kill %s: the server doesn't report client ids", commonName)
+		}
+		if _, err := c.command("kill "+quote(commonName), false); err != nil {
+			return 0, err
+		}
+		return len(sessions), nil
+	}
+	for k, session := range sessions {
+		if _, err := c.command("client-kill "+session.ClientID, false); err != nil {
+			return k, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// Close ends the management session and closes the connection
+func (c *Client) Close() error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	fmt.Fprint(c.conn, "quit\n")
+	return c.conn.Close()
+}
+
+// quote quotes an argument of a management command
+func quote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
@@ -0,0 +1,195 @@
+package management
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a management interface that serves the status and records the commands
+type fakeServer struct {
+	listener net.Listener
+	password string
+	status   string
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeServer(t *testing.T, network, password, status string) *fakeServer {
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "management.sock")
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	f := &fakeServer{listener: listener, password: password, status: status}
+	t.Cleanup(func() { listener.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeServer) address() string {
+	return f.listener.Addr().Network() + "://" + f.listener.Addr().String()
+}
+
+func (f *fakeServer) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.handle(conn)
+	}
+}
+
+func (f *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if f.password != "" {
+		fmt.Fprint(conn, "ENTER PASSWORD:")
+		password, _ := reader.ReadString('\n')
+		if strings.TrimSpace(password) != f.password {
+			fmt.Fprint(conn, "ERROR: bad password\n")
+			return
+		}
+		fmt.Fprint(conn, "SUCCESS: password is correct\n")
+	}
+	fmt.Fprint(conn, ">INFO:OpenVPN Management Interface Version 3 -- type 'help' for more info\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimSpace(line)
+		f.mu.Lock()
+		f.commands = append(f.commands, command)
+		f.mu.Unlock()
+		switch {
+		case command == "status 3":
+			// a real-time notification in the middle of the output
+			fmt.Fprint(conn, ">BYTECOUNT:1000,2000\n"+strings.ReplaceAll(f.status, ",", "\t"))
+		case strings.HasPrefix(command, "client-kill "):
+			fmt.Fprint(conn, "SUCCESS: client-kill command succeeded\n")
+		case strings.HasPrefix(command, "kill "):
+			fmt.Fprint(conn, "SUCCESS: common name 'x' found, 1 client(s) killed\n")
+		case command == "quit":
+			return
+		default:
+			fmt.Fprint(conn, "ERROR: unknown command, enter 'help' for more options\n")
+		}
+	}
+}
+
+func (f *fakeServer) getCommands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.commands...)
+}
+
+func TestClientStatusAndKill(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		f := newFakeServer(t, network, "secret", statusV2)
+		c, err := Dial(context.Background(), f.address(), "secret", time.Second)
+		if err != nil {
+			t.Fatalf("Dial error (%s): %s", network, err)
+		}
+		status, err := c.Status()
+		if err != nil || len(status.Clients) != 2 {
+			t.Fatalf("Unexpected status (%s): %+v (err: %v)", network, status, err)
+		}
+		killed, err := c.Kill("bob@example.com:laptop")
+		if err != nil || killed != 1 {
+			t.Errorf("Unexpected kill result (%s): %d (err: %v)", network, killed, err)
+		}
+		if killed, err := c.Kill("carol@example.com"); err != nil || killed != 0 {
+			t.Errorf("Expected no sessions for carol (%s): %d (err: %v)", network, killed, err)
+		}
+		if _, err := c.command("bogus", false); err == nil || !strings.Contains(err.Error(), "unknown command") {
+			t.Errorf("Expected error for an unknown command, got: %v", err)
+		}
+		c.Close()
+		commands := f.getCommands()
+		if len(commands) < 3 || commands[2] != "client-kill 4" {
+			t.Errorf("Unexpected commands (%s): %v", network, commands)
+		}
+	}
+}
+
+func TestClientWrongPassword(t *testing.T) {
+	f := newFakeServer(t, "tcp", "secret", statusV2)
+	if _, err := Dial(context.Background(), f.address(), "wrong", time.Second); err == nil || !strings.Contains(err.Error(), "bad password") {
+		t.Errorf("Expected bad password error, got: %v", err)
+	}
+	if _, err := Dial(context.Background(), f.address(), "", time.Second); err == nil {
+		t.Errorf("Expected error without password")
+	}
+}
+
+func TestKillWithoutClientID(t *testing.T) {
+	// openvpn before 2.1 doesn't report client ids
+	status := strings.Join([]string{
+		"TITLE,OpenVPN 2.0.9",
+		"HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t)",
+		"CLIENT_LIST,alice,203.0.113.10:51234,10.8.0.2,1,2,Tue Jun 18 09:00:00 2024,1718701200",
+		"CLIENT_LIST,alice:phone,203.0.113.11:51234,10.8.0.3,1,2,Tue Jun 18 09:00:00 2024,1718701200",
+		"END",
+		"",
+	}, "\n")
+	f := newFakeServer(t, "tcp", "", status)
+	c, err := Dial(context.Background(), f.address(), "", time.Second)
+	if err != nil {
+		t.Fatalf("Dial error: %s", err)
+	}
+	defer c.Close()
+	if killed, err := c.Kill("alice"); err != nil || killed != 1 {
+		t.Errorf("Unexpected kill result: %d (err: %v)", killed, err)
+	}
+	if _, err := c.Kill("alice:phone"); err == nil {
+		t.Errorf("Expected error for a common name with a colon without client ids")
+	}
+	if commands := f.getCommands(); commands[1] != `kill "alice"` {
+		t.Errorf("Unexpected commands: %v", commands)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := map[string]string{
+		"unix:///run/openvpn/management.sock": "unix /run/openvpn/management.sock",
+		"tcp://10.0.0.1:7505":                 "tcp 10.0.0.1:7505",
+		"localhost:7505":                      "tcp localhost:7505",
+		"vpn1=tcp://10.0.0.1:7505":            "tcp 10.0.0.1:7505",
+	}
+	for address, expected := range tests {
+		network, addr, err := ParseAddress(address)
+		if err != nil || network+" "+addr != expected {
+			t.Errorf("ParseAddress(%s) = %s %s (err: %v), expected %s", address, network, addr, err, expected)
+		}
+	}
+	for _, address := range []string{"http://localhost:7505", "localhost"} {
+		if _, _, err := ParseAddress(address); err == nil {
+			t.Errorf("Expected error for %s", address)
+		}
+	}
+}
+
+func TestSplitAddress(t *testing.T) {
+	tests := map[string]string{
+		"vpn1=tcp://10.0.0.1:7505":           "vpn1 tcp://10.0.0.1:7505",
+		"vpn2=unix:///run/openvpn/mgmt.sock": "vpn2 unix:///run/openvpn/mgmt.sock",
+		"localhost:7505":                     "localhost:7505 localhost:7505",
+		"unix:///run/openvpn/a=b.sock":       "unix:///run/openvpn/a=b.sock unix:///run/openvpn/a=b.sock",
+	}
+	for address, expected := range tests {
+		if name, addr := SplitAddress(address); name+" "+addr != expected {
+			t.Errorf("SplitAddress(%s) = %s %s, expected %s", address, name, addr, expected)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package management
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is the status of an openvpn server: the output of the status command of the management interface, or the
+// status file (status-version 2 or 3)
+type Status struct {
+	Title   string       `json:"title"`
+	Updated time.Time    `json:"updated"`
+	Clients []ClientInfo `json:"clients"`
+}
+
+// ClientInfo is a connected client, from the CLIENT_LIST and ROUTING_TABLE lines
+type ClientInfo struct {
+	CommonName         string    `json:"commonName"`
+	RealAddress        string    `json:"realAddress"`
+	VirtualAddress     string    `json:"virtualAddress,omitempty"`
+	VirtualIPv6Address string    `json:"virtualIPv6Address,omitempty"`
+	BytesReceived      int64     `json:"bytesReceived"`
+	BytesSent          int64     `json:"bytesSent"`
+	ConnectedSince     time.Time `json:"connectedSince"`
+	// LastRef is the last time a packet was routed to or from the client
+	LastRef  time.Time `json:"lastRef,omitempty"`
+	Username string    `json:"username,omitempty"`
+	// ClientID is the id of the client to kill the session with client-kill (openvpn 2.1 and newer)
+	ClientID string `json:"clientId,omitempty"`
+}
+
+// statusTimeFormats are the time formats of the status output: openvpn 2.6 and newer, and older versions
+var statusTimeFormats = []string{"2006-01-02 15:04:05", time.ANSIC}
+
+/*
+ * ParseStatus parses the status output of openvpn, version 2 (comma separated) or 3 (tab separated). The columns are
+ * mapped with the HEADER lines, so the extra columns of newer openvpn versions are optional.
+ */
+func ParseStatus(r io.Reader) (*Status, error) {
+	status := &Status{Clients: []ClientInfo{}}
+	headers := map[string]map[string]int{}
+	// lastRefs are the last references in the routing table, by common name and real address
+	lastRefs := map[string]time.Time{}
+	scanner := bufio.NewScanner(r)
+	found := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		sep := ","
+		if strings.Contains(line, "\t") {
+			sep = "\t"
+		}
+		fields := strings.Split(line, sep)
+		switch fields[0] {
+		case "TITLE":
+			found = true
+			status.Title = strings.Join(fields[1:], sep)
+		case "TIME":
+			found = true
+			status.Updated = parseStatusTime(fields[1:])
+		case "HEADER":
+			if len(fields) < 2 {
+				continue
+			}
+			columns := map[string]int{}
+			for k, name := range fields[2:] {
+				columns[name] = k + 1
+			}
+			headers[fields[1]] = columns
+		case "CLIENT_LIST":
+			found = true
+			columns, ok := headers["CLIENT_LIST"]
+			if !ok {
+				return nil, fmt.Errorf("CLIENT_LIST without HEADER")
+			}
+			get := func(name string) string {
+				return column(columns, fields, name)
+			}
+			client := ClientInfo{
+				CommonName:         get("Common Name"),
+				RealAddress:        get("Real Address"),
+				VirtualAddress:     get("Virtual Address"),
+				VirtualIPv6Address: get("Virtual IPv6 Address"),
+				Username:           get("Username"),
+				ClientID:           get("Client ID"),
+			}
+			if client.Username == "UNDEF" {
+				client.Username = ""
+			}
+			client.BytesReceived, _ = strconv.ParseInt(get("Bytes Received"), 10, 64)
+			client.BytesSent, _ = strconv.ParseInt(get("Bytes Sent"), 10, 64)
+			client.ConnectedSince = parseStatusTime([]string{get("Connected Since"), get("Connected Since (time_t)")})
+			status.Clients = append(status.Clients, client)
+		case "ROUTING_TABLE":
+			columns, ok := headers["ROUTING_TABLE"]
+			if !ok {
+				continue
+			}
+			get := func(name string) string {
+				return column(columns, fields, name)
+			}
+			key := get("Common Name") + "/" + get("Real Address")
+			lastRef := parseStatusTime([]string{get("Last Ref"), get("Last Ref (time_t)")})
+			if lastRef.After(lastRefs[key]) {
+				lastRefs[key] = lastRef
+			}
+		case "END":
+			found = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("not an openvpn status (version 2 or 3)")
+	}
+	for k, client := range status.Clients {
+		status.Clients[k].LastRef = lastRefs[client.CommonName+"/"+client.RealAddress]
+	}
+	return status, nil
+}
+
+// column returns the value of the column with the name in the HEADER, or an empty string when there's no such column
+func column(columns map[string]int, fields []string, name string) string {
+	if k, ok := columns[name]; ok && k < len(fields) {
+		return fields[k]
+	}
+	return ""
+}
+
+// parseStatusTime parses a time column followed by the time_t column, the time_t column is preferred when it's set
+func parseStatusTime(fields []string) time.Time {
+	if len(fields) > 1 {
+		if unix, err := strconv.ParseInt(fields[1], 10, 64); err == nil && unix > 0 {
+			return time.Unix(unix, 0).UTC()
+		}
+	}
+	if len(fields) > 0 {
+		for _, format := range statusTimeFormats {
+			if t, err := time.ParseInLocation(format, fields[0], time.Local); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
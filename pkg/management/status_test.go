@@ -0,0 +1,77 @@
+package management
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const statusV2 = `TITLE,OpenVPN 2.4.12 x86_64-pc-linux-gnu [SSL (OpenSSL)] [LZO] [LZ4] [EPOLL] [MH/PKTINFO] [AEAD]
+TIME,Tue Jun 18 10:00:00 2024,1718704800
+HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Virtual IPv6 Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username,Client ID,Peer ID
+CLIENT_LIST,alice@example.com,203.0.113.10:51234,10.8.0.2,,4521,9876,Tue Jun 18 09:00:00 2024,1718701200,UNDEF,3,0
+CLIENT_LIST,bob@example.com:laptop,198.51.100.7:1194,10.8.0.3,,100,200,Tue Jun 18 09:30:00 2024,1718703000,UNDEF,4,1
+HEADER,ROUTING_TABLE,Virtual Address,Common Name,Real Address,Last Ref,Last Ref (time_t)
+ROUTING_TABLE,10.8.0.2,alice@example.com,203.0.113.10:51234,Tue Jun 18 09:59:00 2024,1718704740
+ROUTING_TABLE,10.8.0.3,bob@example.com:laptop,198.51.100.7:1194,Tue Jun 18 09:45:00 2024,1718703900
+GLOBAL_STATS,Max bcast/mcast queue length,0
+END
+`
+
+func TestParseStatusV2(t *testing.T) {
+	status, err := ParseStatus(strings.NewReader(statusV2))
+	if err != nil {
+		t.Fatalf("ParseStatus error: %s", err)
+	}
+	if !strings.HasPrefix(status.Title, "OpenVPN 2.4.12") || !status.Updated.Equal(time.Unix(1718704800, 0)) {
+		t.Errorf("Unexpected title or time: %q %s", status.Title, status.Updated)
+	}
+	if len(status.Clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(status.Clients))
+	}
+	alice := status.Clients[0]
+	if alice.CommonName != "alice@example.com" || alice.RealAddress != "203.0.113.10:51234" || alice.VirtualAddress != "10.8.0.2" ||
+		alice.BytesReceived != 4521 || alice.BytesSent != 9876 || alice.ClientID != "3" || alice.Username != "" {
+		t.Errorf("Unexpected client: %+v", alice)
+	}
+	if !alice.ConnectedSince.Equal(time.Unix(1718701200, 0)) || !alice.LastRef.Equal(time.Unix(1718704740, 0)) {
+		t.Errorf("Unexpected times: %s %s", alice.ConnectedSince, alice.LastRef)
+	}
+	if status.Clients[1].CommonName != "bob@example.com:laptop" || !status.Clients[1].LastRef.Equal(time.Unix(1718703900, 0)) {
+		t.Errorf("Unexpected client: %+v", status.Clients[1])
+	}
+}
+
+func TestParseStatusV3(t *testing.T) {
+	// openvpn 2.6 adds columns and uses a different time format
+	statusV3 := strings.Join([]string{
+		"TITLE\tOpenVPN 2.6.8 x86_64-pc-linux-gnu",
+		"TIME\t2024-06-18 10:00:00\t1718704800",
+		"HEADER\tCLIENT_LIST\tCommon Name\tReal Address\tVirtual Address\tVirtual IPv6 Address\tBytes Received\tBytes Sent\tConnected Since\tConnected Since (time_t)\tUsername\tClient ID\tPeer ID\tData Channel Cipher",
+		"CLIENT_LIST\talice@example.com\t203.0.113.10:51234\t10.8.0.2\tfd00::2\t4521\t9876\t2024-06-18 09:00:00\t1718701200\talice\t3\t0\tAES-256-GCM",
+		"HEADER\tROUTING_TABLE\tVirtual Address\tCommon Name\tReal Address\tLast Ref\tLast Ref (time_t)",
+		"ROUTING_TABLE\t10.8.0.2\talice@example.com\t203.0.113.10:51234\t2024-06-18 09:59:00\t1718704740",
+		"END",
+	}, "\n")
+	status, err := ParseStatus(strings.NewReader(statusV3))
+	if err != nil {
+		t.Fatalf("ParseStatus error: %s", err)
+	}
+	if len(status.Clients) != 1 {
+		t.Fatalf("Expected 1 client, got %d", len(status.Clients))
+	}
+	alice := status.Clients[0]
+	if alice.CommonName != "alice@example.com" || alice.VirtualIPv6Address != "fd00::2" || alice.Username != "alice" || alice.BytesSent != 9876 ||
+		!alice.LastRef.Equal(time.Unix(1718704740, 0)) {
+		t.Errorf("Unexpected client: %+v", alice)
+	}
+}
+
+func TestParseStatusInvalid(t *testing.T) {
+	if _, err := ParseStatus(strings.NewReader("OpenVPN CLIENT LIST\nUpdated,Tue Jun 18 10:00:00 2024\n")); err == nil {
+		t.Errorf("Expected error for status version 1")
+	}
+	if _, err := ParseStatus(strings.NewReader("CLIENT_LIST,alice,1.2.3.4:5678\nEND\n")); err == nil {
+		t.Errorf("Expected error for a client list without header")
+	}
+}
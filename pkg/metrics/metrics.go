@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "openvpn_access"
+
+// Registry contains all the metrics of openvpn-access, plus the go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Logins counts the logins by auth provider (oidc / github) and outcome (success / failure)
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Number of logins by auth provider and outcome.",
+	}, []string{"provider", "outcome"})
+
+	// Certificates counts the certificates that are issued, reused (already issued, served again) or revoked
+	Certificates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "certificates_total",
+		Help:      "Number of certificates issued, reused or revoked.",
+	}, []string{"action"})
+
+	// ProfileDownloads counts the downloaded openvpn configurations
+	ProfileDownloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "profile_downloads_total",
+		Help:      "Number of downloaded openvpn profiles.",
+	})
+
+	// StorageLatency observes the latency of storage operations by backend, method and outcome
+	StorageLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of storage backend operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "method", "outcome"})
+
+	// CertificatesIssued is the number of valid certificates in issued/
+	CertificatesIssued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "certificates_issued",
+		Help:      "Number of unexpired certificates in issued/.",
+	})
+
+	// OCSPResponses counts the OCSP responses by certificate status (good / revoked / unknown) or error, and cache hit / miss
+	OCSPResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ocsp_responses_total",
+		Help:      "Number of OCSP responses by status and cache hit or miss.",
+	}, []string{"status", "cache"})
+
+	// SessionsKilled counts the openvpn sessions that were disconnected through the management interface
+	SessionsKilled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sessions_killed_total",
+		Help:      "Number of openvpn sessions disconnected after a revocation.",
+	})
+
+	// ConnectionVerifications counts the connect-time checks of the openvpn servers by decision (allow / deny / error)
+	ConnectionVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connection_verifications_total",
+		Help:      "Number of connect-time access checks by decision.",
+	}, []string{"decision"})
+
+	// CertificatesExpiring is the number of certificates in issued/ that expire within 30 days
+	CertificatesExpiring = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "certificates_expiring_30d",
+		Help:      "Number of certificates in issued/ that expire within 30 days.",
+	})
+
+	// CAExpiry is the expiry of the CA certificate in ca.crt that expires first, as a unix timestamp
+	CAExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ca_certificate_expiry_timestamp_seconds",
+		Help:      "Expiry of the first CA certificate in ca.crt to expire, in seconds since the epoch.",
+	})
+
+	// AuditEventsDropped counts the audit events that were dropped because the buffer was full, e.g. when the storage backend is down
+	AuditEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_events_dropped_total",
+		Help:      "Number of audit events dropped before they were written to the storage backend.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Logins,
+		Certificates,
+		ProfileDownloads,
+		StorageLatency,
+		CertificatesIssued,
+		CertificatesExpiring,
+		CAExpiry,
+		OCSPResponses,
+		SessionsKilled,
+		ConnectionVerifications,
+		AuditEventsDropped,
+	)
+}
+
+// Handler returns the http handler that exposes the metrics in the prometheus format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+type instrumentedStorage struct {
+	next    storage.ObjectStorage
+	backend string
+}
+
+/*
+ * NewStorage wraps a storage backend to observe the latency of every operation. The methods are labeled with the names
+ * of StorageIf.
+ */
+func NewStorage(backend string, next storage.StorageIf) storage.StorageIf {
+	return storage.NewStorageIf(&instrumentedStorage{
+		next:    storage.Objects(next),
+		backend: backend,
+	})
+}
+
+func (s *instrumentedStorage) observe(method string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	StorageLatency.WithLabelValues(s.backend, method, outcome).Observe(time.Since(start).Seconds())
+}
+
+func (s *instrumentedStorage) Head(ctx context.Context, bucket, item string) (storage.ObjectInfo, error) {
+	start := time.Now()
+	info, err := s.next.Head(ctx, bucket, item)
+	s.observe("HeadObject", start, err)
+	return info, err
+}
+func (s *instrumentedStorage) Get(ctx context.Context, bucket, item string) (io.ReadCloser, storage.ObjectInfo, error) {
+	start := time.Now()
+	body, info, err := s.next.Get(ctx, bucket, item)
+	s.observe("GetObject", start, err)
+	return body, info, err
+}
+func (s *instrumentedStorage) Put(ctx context.Context, bucket, item string, body io.Reader, opts storage.PutOptions) (storage.ObjectInfo, error) {
+	start := time.Now()
+	info, err := s.next.Put(ctx, bucket, item, body, opts)
+	s.observe("PutObject", start, err)
+	return info, err
+}
+func (s *instrumentedStorage) Delete(ctx context.Context, bucket, item string) error {
+	start := time.Now()
+	err := s.next.Delete(ctx, bucket, item)
+	s.observe("DeleteObject", start, err)
+	return err
+}
+func (s *instrumentedStorage) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	start := time.Now()
+	items, err := s.next.List(ctx, bucket, prefix)
+	s.observe("ListObjects", start, err)
+	return items, err
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/in4it/openvpn-access/pkg/storage"
+)
+
+func TestInstrumentedStorage(t *testing.T) {
+	blobStorage := NewStorage("memory", storage.NewMemory())
+
+	if err := blobStorage.PutObject("bucket", "test.txt", "test", ""); err != nil {
+		t.Fatalf("PutObject error: %s", err)
+	}
+	if _, err := blobStorage.GetObject("bucket", "test.txt"); err != nil {
+		t.Fatalf("GetObject error: %s", err)
+	}
+	if err := blobStorage.HeadObject("bucket", "missing.txt"); err == nil {
+		t.Fatalf("Expected HeadObject error")
+	}
+
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather error: %s", err)
+	}
+	observed := map[string]uint64{}
+	for _, family := range families {
+		if family.GetName() != "openvpn_access_storage_operation_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["backend"] == "memory" {
+				observed[labels["method"]+"/"+labels["outcome"]] = metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	for _, expected := range []string{"PutObject/success", "GetObject/success", "HeadObject/error"} {
+		if observed[expected] != 1 {
+			t.Errorf("Expected 1 observation for %s, got %d", expected, observed[expected])
+		}
+	}
+}
@@ -0,0 +1,457 @@
+// Package qrcode encodes text as a QR code (byte mode, error correction level M), to show otpauth uris to
+// authenticator apps. Only versions 1 to 13 are supported, up to 331 bytes.
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+const maxVersion = 13
+
+// eccPerBlock and blocks are the error correction codewords per block and the number of blocks of level M, by version
+var (
+	eccPerBlock = [maxVersion + 1]int{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22}
+	blocks      = [maxVersion + 1]int{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9}
+)
+
+// Code is a QR code: a square of dark and light modules
+type Code struct {
+	version int
+	size    int
+	// modules are the dark modules, by row
+	modules [][]bool
+	// function are the modules of the finder, timing and alignment patterns and the format and version information
+	function [][]bool
+}
+
+// Encode returns the smallest QR code for the data
+func Encode(data []byte) (*Code, error) {
+	version := 1
+	for ; version <= maxVersion; version++ {
+		if 4+charCountBits(version)+8*len(data) <= 8*dataCodewords(version) {
+			break
+		}
+	}
+	if version > maxVersion {
+		return nil, fmt.Errorf("data too long for a qr code: %d bytes", len(data))
+	}
+
+	// byte mode, character count, data, terminator and padding
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(data), charCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := 8 * dataCodewords(version)
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	c := &Code{version: version, size: 4*version + 17}
+	c.modules = make([][]bool, c.size)
+	c.function = make([][]bool, c.size)
+	for y := range c.modules {
+		c.modules[y] = make([]bool, c.size)
+		c.function[y] = make([]bool, c.size)
+	}
+	c.drawFunctionPatterns()
+	c.drawCodewords(addErrorCorrection(version, bits.bytes()))
+
+	// use the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if penalty := c.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+	return c, nil
+}
+
+// Size returns the number of modules on a side, without the quiet zone
+func (c *Code) Size() int {
+	return c.size
+}
+
+// Dark returns true when the module at x (column) and y (row) is dark
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// SVG returns the QR code as svg image with the given size in pixels per module, including a quiet zone of 4 modules
+func (c *Code) SVG(moduleSize int) string {
+	size := (c.size + 8) * moduleSize
+	var path strings.Builder
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path d="%s" fill="#000"/></svg>`, size, size, c.size+8, c.size+8, path.String())
+}
+
+func charCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// rawDataModules returns the number of modules for data and error correction, without the function patterns
+func rawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		alignments := version/7 + 2
+		result -= (25*alignments-10)*alignments - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+func dataCodewords(version int) int {
+	return rawDataModules(version)/8 - eccPerBlock[version]*blocks[version]
+}
+
+// alignmentPositions returns the centers of the alignment patterns, on both axes
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	count := version/7 + 2
+	step := (version*4 + count*2 + 1) / (count*2 - 2) * 2
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, pos := count-1, 4*version+10; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns() {
+	for i := 0; i < c.size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+	for _, center := range [][2]int{{3, 3}, {c.size - 4, 3}, {3, c.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x >= 0 && x < c.size && y >= 0 && y < c.size {
+					distance := max(abs(dx), abs(dy))
+					c.setFunction(x, y, distance != 2 && distance != 4)
+				}
+			}
+		}
+	}
+	positions := alignmentPositions(c.version)
+	last := len(positions) - 1
+	for i, y := range positions {
+		for j, x := range positions {
+			// the corners with a finder pattern
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// reserve the format information, the mask is chosen later
+	c.drawFormatBits(0)
+	c.drawVersion()
+}
+
+// formatBits returns the 15 bits of the format information: error correction level M and the mask, with the bch code
+func formatBits(mask int) int {
+	data := mask // the bits of level M are 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// versionBits returns the 18 bits of the version information of versions 7 and up
+func versionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func bit(x, i int) bool {
+	return (x>>i)&1 != 0
+}
+
+func (c *Code) drawFormatBits(mask int) {
+	bits := formatBits(mask)
+	// around the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(bits, i))
+	}
+	c.setFunction(8, 7, bit(bits, 6))
+	c.setFunction(8, 8, bit(bits, 7))
+	c.setFunction(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(bits, i))
+	}
+	// next to the top right and bottom left finder patterns
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.size-15+i, bit(bits, i))
+	}
+	c.setFunction(8, c.size-8, true)
+}
+
+func (c *Code) drawVersion() {
+	if c.version < 7 {
+		return
+	}
+	bits := versionBits(c.version)
+	for i := 0; i < 18; i++ {
+		a, b := c.size-11+i%3, i/3
+		c.setFunction(a, b, bit(bits, i))
+		c.setFunction(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords places the codewords in the zigzag pattern: two columns at a time, from the bottom right corner
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.size - 1 - vert
+				}
+				if !c.function[y][x] && i < len(codewords)*8 {
+					c.modules[y][x] = bit(int(codewords[i>>3]), 7-i&7)
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules of the mask pattern, applying it twice undoes the mask
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !c.function[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the readability of the code, lower is better: long runs of the same color, 2x2 blocks, patterns that
+// look like a finder pattern and an imbalance of dark and light modules
+func (c *Code) penalty() int {
+	penalty := 0
+	at := func(horizontal bool, i, j int) bool {
+		if horizontal {
+			return c.modules[i][j]
+		}
+		return c.modules[j][i]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, horizontal := range []bool{true, false} {
+		for i := 0; i < c.size; i++ {
+			run := 1
+			for j := 1; j <= c.size; j++ {
+				if j < c.size && at(horizontal, i, j) == at(horizontal, i, j-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			for j := 0; j+7 <= c.size; j++ {
+				matches := true
+				for k, dark := range finder {
+					matches = matches && at(horizontal, i, j+k) == dark
+				}
+				if matches && (c.light(horizontal, i, j-4, j) || c.light(horizontal, i, j+7, j+11)) {
+					penalty += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && c.modules[y][x] == c.modules[y-1][x] && c.modules[y][x] == c.modules[y][x-1] && c.modules[y][x] == c.modules[y-1][x-1] {
+				penalty += 3
+			}
+		}
+	}
+	total := c.size * c.size
+	return penalty + abs(dark*20-total*10)/total*10
+}
+
+// light returns true when the modules from start to end (exclusive) of a row or column are light, the quiet zone
+// outside of the code is light
+func (c *Code) light(horizontal bool, i, start, end int) bool {
+	for j := start; j < end; j++ {
+		if j < 0 || j >= c.size {
+			continue
+		}
+		if (horizontal && c.modules[i][j]) || (!horizontal && c.modules[j][i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// addErrorCorrection splits the data in blocks, adds the error correction codewords and interleaves the blocks
+func addErrorCorrection(version int, data []byte) []byte {
+	numBlocks, eccLen := blocks[version], eccPerBlock[version]
+	rawCodewords := rawDataModules(version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+
+	divisor := reedSolomonDivisor(eccLen)
+	dataBlocks := make([][]byte, numBlocks)
+	eccBlocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		length := shortBlockLen - eccLen
+		if i >= numShortBlocks {
+			length++
+		}
+		dataBlocks[i] = data[k : k+length]
+		eccBlocks[i] = reedSolomonRemainder(dataBlocks[i], divisor)
+		k += length
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := 0; i <= shortBlockLen-eccLen; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for _, block := range eccBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// reedSolomonDivisor returns the generator polynomial of the given degree, without the leading coefficient
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// bitBuffer is a sequence of bits
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, bit(value, i))
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	result := make([]byte, len(b)/8)
+	for i, set := range b {
+		if set {
+			result[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return result
+}
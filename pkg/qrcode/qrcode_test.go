@@ -0,0 +1,155 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// HELLO WORLD in version 1-M, from the thonky.com qr code tutorial
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if ecc := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(ecc, expected) {
+		t.Errorf("Unexpected error correction codewords: %v", ecc)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	formats := map[int]string{0: "101010000010010", 5: "100000011001110", 7: "100101010100000"}
+	for mask, expected := range formats {
+		if bits := fmt.Sprintf("%015b", formatBits(mask)); bits != expected {
+			t.Errorf("Unexpected format bits for mask %d: %s", mask, bits)
+		}
+	}
+	if bits := fmt.Sprintf("%018b", versionBits(7)); bits != "000111110010010100" {
+		t.Errorf("Unexpected version bits: %s", bits)
+	}
+}
+
+func TestDataCodewords(t *testing.T) {
+	expected := []int{16, 28, 44, 64, 86, 108, 124, 154, 182, 216, 254, 290, 334}
+	for version := 1; version <= maxVersion; version++ {
+		if n := dataCodewords(version); n != expected[version-1] {
+			t.Errorf("Unexpected data codewords for version %d: %d", version, n)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for _, length := range []int{0, 14, 100, 150, 213, 331} {
+		data := []byte(strings.Repeat("otpauth://totp/", 23)[:length])
+		c, err := Encode(data)
+		if err != nil {
+			t.Fatalf("Encode error for %d bytes: %s", length, err)
+		}
+		if decoded := decode(t, c); !bytes.Equal(decoded, data) {
+			t.Errorf("Decoded %q, expected %q", decoded, data)
+		}
+	}
+	if _, err := Encode(make([]byte, 332)); err == nil {
+		t.Errorf("Expected error for too much data")
+	}
+	if c, _ := Encode([]byte("a")); !strings.HasPrefix(c.SVG(4), `<svg xmlns="http://www.w3.org/2000/svg" width="116" height="116"`) {
+		t.Errorf("Unexpected svg: %s", c.SVG(4))
+	}
+}
+
+// decode reads the data of the qr code: the format information, the codewords in the zigzag pattern, and the blocks
+func decode(t *testing.T, c *Code) []byte {
+	t.Helper()
+	for i := 0; i < 7; i++ {
+		if !c.Dark(i, 0) || !c.Dark(c.Size()-1-i, 0) || !c.Dark(0, c.Size()-1-i) {
+			t.Fatalf("Missing finder pattern in version %d", c.version)
+		}
+	}
+	var format int
+	for i := 0; i < 15; i++ {
+		// the second copy of the format information, next to the top right and bottom left finder patterns
+		x, y := c.size-1-i, 8
+		if i >= 8 {
+			x, y = 8, c.size-15+i
+		}
+		if c.Dark(x, y) {
+			format |= 1 << i
+		}
+	}
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if formatBits(m) == format {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("Invalid format information: %015b", format)
+	}
+
+	c.applyMask(mask)
+	defer c.applyMask(mask)
+	var bits bitBuffer
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.size - 1 - vert
+				}
+				if !c.function[y][x] {
+					bits = append(bits, c.modules[y][x])
+				}
+			}
+		}
+	}
+	codewords := bits.bytes()
+	if len(codewords) != rawDataModules(c.version)/8 {
+		t.Fatalf("Expected %d codewords, got %d", rawDataModules(c.version)/8, len(codewords))
+	}
+
+	// deinterleave, the long blocks are at the end
+	numBlocks, eccLen := blocks[c.version], eccPerBlock[c.version]
+	numShortBlocks := numBlocks - len(codewords)%numBlocks
+	shortDataLen := len(codewords)/numBlocks - eccLen
+	dataBlocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i <= shortDataLen; i++ {
+		for j := range dataBlocks {
+			if i < shortDataLen || j >= numShortBlocks {
+				dataBlocks[j] = append(dataBlocks[j], codewords[k])
+				k++
+			}
+		}
+	}
+	var data []byte
+	for j, block := range dataBlocks {
+		ecc := make([]byte, eccLen)
+		for i := range ecc {
+			ecc[i] = codewords[k+i*numBlocks+j]
+		}
+		if !bytes.Equal(ecc, reedSolomonRemainder(block, reedSolomonDivisor(eccLen))) {
+			t.Fatalf("Invalid error correction codewords in block %d", j)
+		}
+		data = append(data, block...)
+	}
+
+	// byte mode and the character count
+	read := func(offset, length int) int {
+		value := 0
+		for i := offset; i < offset+length; i++ {
+			value = value<<1 | int(data[i/8]>>(7-i%8)&1)
+		}
+		return value
+	}
+	if mode := read(0, 4); mode != 0x4 {
+		t.Fatalf("Unexpected mode %b", mode)
+	}
+	count := read(4, charCountBits(c.version))
+	decoded := make([]byte, count)
+	for i := range decoded {
+		decoded[i] = byte(read(4+charCountBits(c.version)+8*i, 8))
+	}
+	return decoded
+}
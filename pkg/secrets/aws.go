@@ -0,0 +1,79 @@
+package secrets
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+type ssmProvider struct {
+	svc *ssm.SSM
+}
+
+type secretsManagerProvider struct {
+	svc *secretsmanager.SecretsManager
+}
+
+func newSession(region string, configs ...*aws.Config) (*session.Session, error) {
+	awsConfig := aws.NewConfig()
+	if region != "" {
+		awsConfig = awsConfig.WithRegion(region)
+	}
+	return session.NewSession(append([]*aws.Config{awsConfig}, configs...)...)
+}
+
+/*
+ * NewSSM returns a provider for SSM Parameter Store parameters (ssm:/path/to/parameter). SecureString parameters are decrypted.
+ */
+func NewSSM(region string, configs ...*aws.Config) (Provider, error) {
+	sess, err := newSession(region, configs...)
+	if err != nil {
+		return nil, err
+	}
+	return &ssmProvider{svc: ssm.New(sess)}, nil
+}
+
+func (s *ssmProvider) GetSecret(ctx context.Context, ref string) (string, error) {
+	out, err := s.svc.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(ref),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Parameter.Value), nil
+}
+
+/*
+ * NewSecretsManager returns a provider for Secrets Manager secrets (secretsmanager:<name or arn>). A key of a json secret
+ * can be selected with secretsmanager:<name or arn>#<key>.
+ */
+func NewSecretsManager(region string, configs ...*aws.Config) (Provider, error) {
+	sess, err := newSession(region, configs...)
+	if err != nil {
+		return nil, err
+	}
+	return &secretsManagerProvider{svc: secretsmanager.New(sess)}, nil
+}
+
+func (s *secretsManagerProvider) GetSecret(ctx context.Context, ref string) (string, error) {
+	secretID, key, hasKey := strings.Cut(ref, "#")
+	out, err := s.svc.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+	secret := aws.StringValue(out.SecretString)
+	if secret == "" && out.SecretBinary != nil {
+		secret = string(out.SecretBinary)
+	}
+	if hasKey {
+		return jsonKey(secret, key)
+	}
+	return secret, nil
+}
@@ -0,0 +1,79 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+)
+
+const keyVaultAPIVersion = "7.3"
+
+type azureKeyVault struct {
+	authorizer autorest.Authorizer
+	client     *http.Client
+	// vaultURL returns the url of a vault name
+	vaultURL func(vault string) string
+}
+
+/*
+ * NewAzureKeyVault returns a provider for Azure Key Vault secrets (azkv:<vault>/<secret>[/<version>]), authenticated
+ * with the azure environment settings or Managed Service Identity
+ */
+func NewAzureKeyVault() (Provider, error) {
+	authorizer, err := auth.NewAuthorizerFromEnvironmentWithResource("https://vault.azure.net")
+	if err != nil {
+		return nil, err
+	}
+	return NewAzureKeyVaultWithAuthorizer(authorizer, func(vault string) string {
+		return "https://" + vault + ".vault.azure.net"
+	}), nil
+}
+
+// NewAzureKeyVaultWithAuthorizer returns a provider for Azure Key Vault secrets, with a custom authorizer and vault url
+func NewAzureKeyVaultWithAuthorizer(authorizer autorest.Authorizer, vaultURL func(vault string) string) Provider {
+	return &azureKeyVault{
+		authorizer: authorizer,
+		client:     &http.Client{},
+		vaultURL:   vaultURL,
+	}
+}
+
+func (a *azureKeyVault) GetSecret(ctx context.Context, ref string) (string, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("reference should be <vault>/<secret>[/<version>]")
+	}
+	secretURL := a.vaultURL(parts[0]) + "/secrets/" + url.PathEscape(parts[1])
+	if len(parts) == 3 {
+		secretURL += "/" + url.PathEscape(parts[2])
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", secretURL+"?api-version="+keyVaultAPIVersion, nil)
+	if err != nil {
+		return "", err
+	}
+	req, err = autorest.Prepare(req, a.authorizer.WithAuthorization())
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("key vault returned %s", resp.Status)
+	}
+	var secret struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	return secret.Value, nil
+}
@@ -0,0 +1,24 @@
+package secrets
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+type file struct{}
+
+/*
+ * NewFile returns a provider that reads the secret from a file (e.g. a docker or kubernetes secret). The trailing newline is removed.
+ */
+func NewFile() Provider {
+	return &file{}
+}
+
+func (f *file) GetSecret(ctx context.Context, ref string) (string, error) {
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
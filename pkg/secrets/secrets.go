@@ -0,0 +1,113 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Provider returns the secret of a reference (without the scheme)
+type Provider interface {
+	GetSecret(ctx context.Context, ref string) (string, error)
+}
+
+// Resolver resolves references like ssm:/path, secretsmanager:arn, azkv:vault/secret and file:/run/secrets/x
+type Resolver struct {
+	providers map[string]Provider
+}
+
+/*
+ * NewResolver returns a resolver for the providers, by scheme (e.g. "ssm")
+ */
+func NewResolver(providers map[string]Provider) *Resolver {
+	return &Resolver{providers: providers}
+}
+
+/*
+ * NewDefaultResolver returns a resolver for ssm:, secretsmanager:, azkv: and file: references.
+ * The aws and azure clients are created when the first reference is resolved.
+ */
+func NewDefaultResolver(awsRegion string) *Resolver {
+	return NewResolver(map[string]Provider{
+		"ssm":            &lazyProvider{new: func() (Provider, error) { return NewSSM(awsRegion) }},
+		"secretsmanager": &lazyProvider{new: func() (Provider, error) { return NewSecretsManager(awsRegion) }},
+		"azkv":           &lazyProvider{new: func() (Provider, error) { return NewAzureKeyVault() }},
+		"file":           NewFile(),
+	})
+}
+
+// IsReference returns true when the value starts with the scheme of one of the providers
+func (r *Resolver) IsReference(value string) bool {
+	scheme, _, found := strings.Cut(value, ":")
+	_, ok := r.providers[scheme]
+	return found && ok
+}
+
+// Resolve returns the secret of the reference
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	scheme, ref, _ := strings.Cut(value, ":")
+	provider, ok := r.providers[scheme]
+	if !ok {
+		return "", fmt.Errorf("no secret provider for %q", scheme)
+	}
+	secret, err := provider.GetSecret(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s secret %q: %s", scheme, ref, err)
+	}
+	return secret, nil
+}
+
+// lazyProvider creates the provider on first use, to not require aws or azure credentials when they're not used
+type lazyProvider struct {
+	new      func() (Provider, error)
+	once     sync.Once
+	provider Provider
+	err      error
+}
+
+func (l *lazyProvider) GetSecret(ctx context.Context, ref string) (string, error) {
+	l.once.Do(func() {
+		l.provider, l.err = l.new()
+	})
+	if l.err != nil {
+		return "", l.err
+	}
+	return l.provider.GetSecret(ctx, ref)
+}
+
+// jsonKey returns the value of key in a json object, used for secrets that contain multiple values (secret#key)
+func jsonKey(secret, key string) (string, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &values); err != nil {
+		return "", fmt.Errorf("secret is not a json object: %s", err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("key %q not found in secret", key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+type memory struct {
+	secrets map[string]string
+}
+
+/*
+ * NewMemory returns a provider with fixed secrets, by reference. It's a local stand-in for the aws and azure providers.
+ */
+func NewMemory(secrets map[string]string) Provider {
+	return &memory{secrets: secrets}
+}
+
+func (m *memory) GetSecret(ctx context.Context, ref string) (string, error) {
+	secret, ok := m.secrets[ref]
+	if !ok {
+		return "", fmt.Errorf("secret not found")
+	}
+	return secret, nil
+}
@@ -0,0 +1,112 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// newAWSStandIn returns a local stand-in for the SSM and Secrets Manager api
+func newAWSStandIn(t *testing.T, values map[string]string) *aws.Config {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Name     string
+			SecretId string
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonSSM.GetParameter":
+			if value, ok := values[input.Name]; ok {
+				json.NewEncoder(w).Encode(map[string]interface{}{"Parameter": map[string]string{"Name": input.Name, "Value": value}})
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ParameterNotFound", "message": "not found"})
+		case "secretsmanager.GetSecretValue":
+			if value, ok := values[input.SecretId]; ok {
+				json.NewEncoder(w).Encode(map[string]string{"SecretString": value})
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ResourceNotFoundException", "message": "not found"})
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithMaxRetries(0)
+}
+
+func TestResolver(t *testing.T) {
+	awsConfig := newAWSStandIn(t, map[string]string{
+		"/openvpn-access/csrf-key": "csrf-key-from-ssm",
+		"arn:aws:secretsmanager:eu-west-1:123456789012:secret:openvpn-access": `{"client_secret":"client-secret-from-secretsmanager"}`,
+	})
+	ssmProvider, err := NewSSM("eu-west-1", awsConfig)
+	if err != nil {
+		t.Fatalf("NewSSM error: %s", err)
+	}
+	secretsManagerProvider, err := NewSecretsManager("eu-west-1", awsConfig)
+	if err != nil {
+		t.Fatalf("NewSecretsManager error: %s", err)
+	}
+	keyVault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/secrets/session-key" || r.URL.Query().Get("api-version") == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": "session-key-from-keyvault"})
+	}))
+	defer keyVault.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "scim-token")
+	os.WriteFile(secretFile, []byte("scim-token-from-file\n"), 0600)
+
+	resolver := NewResolver(map[string]Provider{
+		"ssm":            ssmProvider,
+		"secretsmanager": secretsManagerProvider,
+		"azkv":           NewAzureKeyVaultWithAuthorizer(autorest.NullAuthorizer{}, func(vault string) string { return keyVault.URL }),
+		"file":           NewFile(),
+	})
+
+	for ref, expected := range map[string]string{
+		"ssm:/openvpn-access/csrf-key": "csrf-key-from-ssm",
+		"secretsmanager:arn:aws:secretsmanager:eu-west-1:123456789012:secret:openvpn-access#client_secret": "client-secret-from-secretsmanager",
+		"azkv:myvault/session-key": "session-key-from-keyvault",
+		"file:" + secretFile:       "scim-token-from-file",
+	} {
+		if !resolver.IsReference(ref) {
+			t.Errorf("%s should be a reference", ref)
+		}
+		secret, err := resolver.Resolve(context.Background(), ref)
+		if err != nil {
+			t.Errorf("Resolve %s error: %s", ref, err)
+		}
+		if secret != expected {
+			t.Errorf("Resolve %s: expected %q, got %q", ref, expected, secret)
+		}
+	}
+
+	for _, ref := range []string{"ssm:/doesnotexist", "secretsmanager:doesnotexist", "azkv:myvault/doesnotexist", "azkv:invalid", "file:/doesnotexist"} {
+		if _, err := resolver.Resolve(context.Background(), ref); err == nil {
+			t.Errorf("Expected error for %s", ref)
+		}
+	}
+	for _, value := range []string{"https://idp.example.com", "plain-value", ""} {
+		if resolver.IsReference(value) {
+			t.Errorf("%s should not be a reference", value)
+		}
+	}
+}
@@ -1,18 +1,18 @@
 package storage
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
-	"strings"
+	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 )
 
 type azBlob struct {
-	StorageIf
 	serviceURL azblob.ServiceURL
 }
 
@@ -44,7 +44,14 @@ func NewAzBlobWithMSI(accountName string) (StorageIf, error) {
 		return nil, err
 	}
 
-	credential := azblob.NewTokenCredential(token.OAuthToken(), nil)
+	// the token is refreshed 5 minutes before it expires, the client is used as long as the process runs
+	credential := azblob.NewTokenCredential(token.OAuthToken(), func(credential azblob.TokenCredential) time.Duration {
+		if err := token.EnsureFreshWithContext(context.Background()); err != nil {
+			return time.Minute
+		}
+		credential.SetToken(token.OAuthToken())
+		return max(time.Until(token.Token().Expires())-5*time.Minute, time.Minute)
+	})
 
 	return NewAzBlobWithCredential(accountName, credential)
 }
@@ -54,57 +61,100 @@ func NewAzBlobWithCredential(accountName string, credential azblob.Credential) (
 	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", accountName))
 	serviceURL := azblob.NewServiceURL(*u, p)
 
-	return &azBlob{
+	return NewStorageIf(&azBlob{
 		serviceURL: serviceURL,
-	}, nil
+	}), nil
 }
 
-func (a *azBlob) HeadObject(container, item string) error {
-	ctx := context.Background()
-	containerURL := a.serviceURL.NewContainerURL(container)
-	blobURL := containerURL.NewBlockBlobURL(item)
-	_, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
-	if err != nil {
+// azBlobError wraps the not found and precondition errors of azure with ErrNotExist and ErrPreconditionFailed
+func azBlobError(err error, container, item string) error {
+	serr, ok := err.(azblob.StorageError)
+	if !ok {
 		return err
 	}
+	if serr.ServiceCode() == azblob.ServiceCodeBlobNotFound || (serr.Response() != nil && serr.Response().StatusCode == http.StatusNotFound) {
+		return fmt.Errorf("%q in container %q: %w", item, container, ErrNotExist)
+	}
+	if serr.ServiceCode() == azblob.ServiceCodeBlobAlreadyExists || serr.ServiceCode() == azblob.ServiceCodeConditionNotMet {
+		return fmt.Errorf("%q in container %q: %w", item, container, ErrPreconditionFailed)
+	}
+	return err
+}
 
-	return nil
-
+func (a *azBlob) Head(ctx context.Context, container, item string) (ObjectInfo, error) {
+	blobURL := a.serviceURL.NewContainerURL(container).NewBlockBlobURL(item)
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return ObjectInfo{}, azBlobError(err, container, item)
+	}
+	return ObjectInfo{
+		ContentType:  props.ContentType(),
+		Tags:         lowerKeys(props.NewMetadata()),
+		ETag:         string(props.ETag()),
+		Size:         props.ContentLength(),
+		LastModified: props.LastModified(),
+	}, nil
 }
-func (a *azBlob) GetObject(container, item string) (bytes.Buffer, error) {
-	buffer := bytes.Buffer{}
-	ctx := context.Background()
-	containerURL := a.serviceURL.NewContainerURL(container)
-	blobURL := containerURL.NewBlockBlobURL(item)
+func (a *azBlob) Get(ctx context.Context, container, item string) (io.ReadCloser, ObjectInfo, error) {
+	blobURL := a.serviceURL.NewContainerURL(container).NewBlockBlobURL(item)
 	get, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false)
 	if err != nil {
-		return buffer, err
+		return nil, ObjectInfo{}, azBlobError(err, container, item)
 	}
-
-	reader := get.Body(azblob.RetryReaderOptions{})
-	buffer.ReadFrom(reader)
-	reader.Close()
-
-	return buffer, nil
+	return get.Body(azblob.RetryReaderOptions{}), ObjectInfo{
+		ContentType:  get.ContentType(),
+		Tags:         lowerKeys(get.NewMetadata()),
+		ETag:         string(get.ETag()),
+		Size:         get.ContentLength(),
+		LastModified: get.LastModified(),
+	}, nil
 }
-func (a *azBlob) PutObject(container, item, data, kmsArn string) error {
-	ctx := context.Background()
-	containerURL := a.serviceURL.NewContainerURL(container)
-	blobURL := containerURL.NewBlockBlobURL(item)
-	_, err := blobURL.Upload(ctx, strings.NewReader(data), azblob.BlobHTTPHeaders{ContentType: "text/plain"}, azblob.Metadata{}, azblob.BlobAccessConditions{})
+
+// Put streams the object as block blob. The content type defaults to text/plain. The KMS key of the options isn't used.
+func (a *azBlob) Put(ctx context.Context, container, item string, body io.Reader, opts PutOptions) (ObjectInfo, error) {
+	blobURL := a.serviceURL.NewContainerURL(container).NewBlockBlobURL(item)
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	conditions := azblob.ModifiedAccessConditions{IfMatch: azblob.ETag(opts.IfMatch)}
+	if opts.IfNoneMatch {
+		conditions.IfNoneMatch = azblob.ETagAny
+	}
+	out, err := azblob.UploadStreamToBlockBlob(ctx, body, blobURL, azblob.UploadStreamToBlockBlobOptions{
+		BlobHTTPHeaders:  azblob.BlobHTTPHeaders{ContentType: contentType},
+		Metadata:         lowerKeys(opts.Tags),
+		AccessConditions: azblob.BlobAccessConditions{ModifiedAccessConditions: conditions},
+	})
 	if err != nil {
-		return err
+		return ObjectInfo{}, azBlobError(err, container, item)
 	}
-
-	return nil
+	return ObjectInfo{ContentType: contentType, Tags: lowerKeys(opts.Tags), ETag: string(out.ETag()), LastModified: out.LastModified()}, nil
 }
-func (a *azBlob) DeleteObject(container, item string) error {
-	ctx := context.Background()
-	containerURL := a.serviceURL.NewContainerURL(container)
-	blobURL := containerURL.NewBlockBlobURL(item)
+func (a *azBlob) Delete(ctx context.Context, container, item string) error {
+	blobURL := a.serviceURL.NewContainerURL(container).NewBlockBlobURL(item)
 	_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	// like in S3, deleting a blob that doesn't exist succeeds (a missing container is still an error)
+	if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return nil
+	}
 	if err != nil {
-		return err
+		return azBlobError(err, container, item)
 	}
 	return nil
 }
+func (a *azBlob) List(ctx context.Context, container, prefix string) ([]string, error) {
+	items := []string{}
+	containerURL := a.serviceURL.NewContainerURL(container)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return items, err
+		}
+		marker = list.NextMarker
+		for _, blob := range list.Segment.BlobItems {
+			items = append(items, blob.Name)
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	data []byte
+	info ObjectInfo
+	// missing is true when the object doesn't exist
+	missing bool
+	// validated is the last time the entry was downloaded or found unchanged
+	validated time.Time
+}
+
+type cache struct {
+	next      ObjectStorage
+	ttl       time.Duration
+	cacheable func(item string) bool
+	now       func() time.Time
+	mu        sync.Mutex
+	entries   map[string]*cacheEntry
+}
+
+/*
+ * NewCache wraps a storage backend to keep the objects for which cacheable returns true in memory, or the fact that they
+ * don't exist. A cached object is returned for ttl, after that its ETag is checked with a HeadObject: an unchanged
+ * object is returned from the cache for another ttl, a changed object is downloaded again. Writes and deletes through
+ * the cache remove the object from the cache, writes by other replicas show up after at most ttl.
+ */
+func NewCache(next StorageIf, ttl time.Duration, cacheable func(item string) bool) StorageIf {
+	return NewStorageIf(&cache{
+		next:      Objects(next),
+		ttl:       ttl,
+		cacheable: cacheable,
+		now:       time.Now,
+		entries:   make(map[string]*cacheEntry),
+	})
+}
+
+// entry returns the cached entry when it's validated less than ttl ago, and the stale entry otherwise
+func (c *cache) entry(bucket, item string) (fresh, stale *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[bucket+"/"+item]
+	if !ok {
+		return nil, nil
+	}
+	if c.now().Sub(entry.validated) < c.ttl {
+		return entry, nil
+	}
+	return nil, entry
+}
+
+func (c *cache) store(bucket, item string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[bucket+"/"+item] = entry
+}
+
+func (c *cache) invalidate(bucket, item string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, bucket+"/"+item)
+}
+
+func (c *cache) Head(ctx context.Context, bucket, item string) (ObjectInfo, error) {
+	if fresh, _ := c.entry(bucket, item); fresh != nil && fresh.missing {
+		return ObjectInfo{}, fmt.Errorf("%q in bucket %q: %w", item, bucket, ErrNotExist)
+	} else if fresh != nil {
+		return fresh.info, nil
+	}
+	validated := c.now()
+	info, err := c.next.Head(ctx, bucket, item)
+	if errors.Is(err, ErrNotExist) && c.cacheable(item) {
+		c.store(bucket, item, &cacheEntry{missing: true, validated: validated})
+	}
+	return info, err
+}
+
+func (c *cache) Get(ctx context.Context, bucket, item string) (io.ReadCloser, ObjectInfo, error) {
+	if !c.cacheable(item) {
+		return c.next.Get(ctx, bucket, item)
+	}
+	fresh, stale := c.entry(bucket, item)
+	if fresh != nil && fresh.missing {
+		return nil, ObjectInfo{}, fmt.Errorf("%q in bucket %q: %w", item, bucket, ErrNotExist)
+	}
+	if fresh != nil {
+		return io.NopCloser(bytes.NewReader(fresh.data)), fresh.info, nil
+	}
+	if stale != nil && stale.info.ETag != "" {
+		info, err := c.next.Head(ctx, bucket, item)
+		if errors.Is(err, ErrNotExist) {
+			c.store(bucket, item, &cacheEntry{missing: true, validated: c.now()})
+			return nil, info, err
+		}
+		if err == nil && info.ETag == stale.info.ETag {
+			c.store(bucket, item, &cacheEntry{data: stale.data, info: stale.info, validated: c.now()})
+			return io.NopCloser(bytes.NewReader(stale.data)), stale.info, nil
+		}
+	}
+	validated := c.now()
+	body, info, err := c.next.Get(ctx, bucket, item)
+	if errors.Is(err, ErrNotExist) {
+		c.store(bucket, item, &cacheEntry{missing: true, validated: validated})
+	}
+	if err != nil {
+		return body, info, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, info, err
+	}
+	c.store(bucket, item, &cacheEntry{data: data, info: info, validated: validated})
+	return io.NopCloser(bytes.NewReader(data)), info, nil
+}
+
+func (c *cache) Put(ctx context.Context, bucket, item string, body io.Reader, opts PutOptions) (ObjectInfo, error) {
+	info, err := c.next.Put(ctx, bucket, item, body, opts)
+	c.invalidate(bucket, item)
+	return info, err
+}
+
+func (c *cache) Delete(ctx context.Context, bucket, item string) error {
+	err := c.next.Delete(ctx, bucket, item)
+	c.invalidate(bucket, item)
+	return err
+}
+
+func (c *cache) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	return c.next.List(ctx, bucket, prefix)
+}
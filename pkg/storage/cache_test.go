@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingStorage counts the downloads of the backend
+type countingStorage struct {
+	StorageIf
+	gets int
+}
+
+func (c *countingStorage) GetObject(bucket, item string) (bytes.Buffer, error) {
+	c.gets++
+	return c.StorageIf.GetObject(bucket, item)
+}
+
+func cacheOf(s StorageIf) *cache {
+	return s.(*storageIfAdapter).ObjectStorage.(*cache)
+}
+
+func TestCache(t *testing.T) {
+	backend := &countingStorage{StorageIf: NewMemory()}
+	backend.PutObject("bucket", "pki/ca.crt", "ca", "")
+	backend.PutObject("bucket", "pki/issued/a.crt", "a", "")
+	now := time.Now()
+	cached := NewCache(backend, time.Minute, func(item string) bool { return item == "pki/ca.crt" })
+	cacheOf(cached).now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if out, err := cached.GetObject("bucket", "pki/ca.crt"); err != nil || out.String() != "ca" {
+			t.Fatalf("Unexpected object: %q (err: %v)", out.String(), err)
+		}
+		cached.GetObject("bucket", "pki/issued/a.crt")
+	}
+	if backend.gets != 4 {
+		t.Errorf("Expected 1 download of the cached object and 3 of the other object, got %d downloads", backend.gets)
+	}
+
+	// other replicas write to the backend: the object is revalidated after the ttl
+	backend.PutObject("bucket", "pki/ca.crt", "rotated", "")
+	if out, _ := cached.GetObject("bucket", "pki/ca.crt"); out.String() != "ca" {
+		t.Errorf("Expected the cached object within the ttl, got %q", out.String())
+	}
+	now = now.Add(2 * time.Minute)
+	if out, _ := cached.GetObject("bucket", "pki/ca.crt"); out.String() != "rotated" {
+		t.Errorf("Expected the changed object after the ttl, got %q", out.String())
+	}
+
+	// writes through the cache invalidate the object
+	cached.PutObject("bucket", "pki/ca.crt", "ca2", "")
+	if out, _ := cached.GetObject("bucket", "pki/ca.crt"); out.String() != "ca2" {
+		t.Errorf("Expected the written object, got %q", out.String())
+	}
+	backend.DeleteObject("bucket", "pki/ca.crt")
+	now = now.Add(2 * time.Minute)
+	if _, err := cached.GetObject("bucket", "pki/ca.crt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Expected ErrNotExist after the ttl, got %v", err)
+	}
+
+	// a missing object is cached as well
+	gets := backend.gets
+	if err := cached.HeadObject("bucket", "pki/ca.crt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Expected ErrNotExist, got %v", err)
+	}
+	if _, err := cached.GetObject("bucket", "pki/ca.crt"); !errors.Is(err, ErrNotExist) || backend.gets != gets {
+		t.Errorf("Expected ErrNotExist from the cache, got %v (%d downloads)", err, backend.gets-gets)
+	}
+	cached.PutObject("bucket", "pki/ca.crt", "ca3", "")
+	if out, _ := cached.GetObject("bucket", "pki/ca.crt"); out.String() != "ca3" {
+		t.Errorf("Expected the written object, got %q", out.String())
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	backend := NewMemory()
+	backend.PutObject("bucket", "ca.crt", strings.Repeat("ca", 100), "")
+	now := time.Now()
+	cached := NewCache(backend, time.Minute, func(string) bool { return true })
+	cacheOf(cached).now = func() time.Time { return now }
+	cached.GetObject("bucket", "ca.crt")
+
+	// an unchanged object is only checked with its ETag after the ttl
+	now = now.Add(2 * time.Minute)
+	if out, err := cached.GetObject("bucket", "ca.crt"); err != nil || out.Len() != 200 {
+		t.Fatalf("Unexpected object after revalidation: %d bytes (err: %v)", out.Len(), err)
+	}
+	entry, _ := cacheOf(cached).entry("bucket", "ca.crt")
+	if entry == nil || !entry.validated.Equal(now) {
+		t.Errorf("Expected the entry to be revalidated, got %+v", entry)
+	}
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// envelopeHeader is the first line of an encrypted object, objects without it are read as they are
+const envelopeHeader = "openvpn-access-envelope:v1\n"
+
+// EncryptedDirs are the directories with private keys, the objects in these directories are encrypted by NewEnvelope
+var EncryptedDirs = []string{"private/", "revoked/private_by_serial/"}
+
+// envelopeObject is an encrypted object: the data encrypted with a data key, and the data key wrapped by the key encryption key
+type envelopeObject struct {
+	// KEK identifies the key encryption key that wrapped the data key
+	KEK   string `json:"kek"`
+	Key   string `json:"key"`
+	Nonce string `json:"nonce"`
+	Data  string `json:"data"`
+}
+
+type envelope struct {
+	ObjectStorage
+	kek KeyEncryptionKey
+}
+
+/*
+ * NewEnvelope wraps a storage backend to encrypt the objects in EncryptedDirs on the client side, independent of the
+ * encryption at rest of the backend. Every object is encrypted with a new data key (AES-GCM), which is stored wrapped by
+ * the key encryption key. Objects that were written before the encryption was enabled are read unencrypted.
+ */
+func NewEnvelope(next StorageIf, kek KeyEncryptionKey) StorageIf {
+	return NewStorageIf(&envelope{
+		ObjectStorage: Objects(next),
+		kek:           kek,
+	})
+}
+
+// encryptedPath returns the path of the item from the encrypted directory, empty when the item isn't encrypted. The
+// path is authenticated with the data: an encrypted key can't be moved to another name.
+func encryptedPath(item string) string {
+	for _, dir := range EncryptedDirs {
+		if strings.HasPrefix(item, dir) {
+			return item
+		}
+		if i := strings.Index(item, "/"+dir); i >= 0 {
+			return item[i+1:]
+		}
+	}
+	return ""
+}
+
+// Get decrypts the encrypted objects in memory, the size of the object info is the size of the encrypted object
+func (e *envelope) Get(ctx context.Context, bucket, item string) (io.ReadCloser, ObjectInfo, error) {
+	body, info, err := e.ObjectStorage.Get(ctx, bucket, item)
+	if err != nil || encryptedPath(item) == "" {
+		return body, info, err
+	}
+	defer body.Close()
+	out, err := io.ReadAll(body)
+	if err != nil {
+		return nil, info, err
+	}
+	if !bytes.HasPrefix(out, []byte(envelopeHeader)) {
+		return io.NopCloser(bytes.NewReader(out)), info, nil
+	}
+	data, err := e.open(encryptedPath(item), out[len(envelopeHeader):])
+	if err != nil {
+		return nil, info, fmt.Errorf("could not decrypt %q: %s", item, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), info, nil
+}
+
+func (e *envelope) Put(ctx context.Context, bucket, item string, body io.Reader, opts PutOptions) (ObjectInfo, error) {
+	if encryptedPath(item) == "" {
+		return e.ObjectStorage.Put(ctx, bucket, item, body, opts)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	sealed, err := e.seal(encryptedPath(item), data)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("could not encrypt %q: %s", item, err)
+	}
+	return e.ObjectStorage.Put(ctx, bucket, item, io.MultiReader(strings.NewReader(envelopeHeader), bytes.NewReader(sealed)), opts)
+}
+
+func (e *envelope) seal(path string, data []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrapped, kekID, err := e.kek.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not wrap data key: %s", err)
+	}
+	return json.Marshal(envelopeObject{
+		KEK:   kekID,
+		Key:   base64.StdEncoding.EncodeToString(wrapped),
+		Nonce: base64.StdEncoding.EncodeToString(nonce),
+		Data:  base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, data, []byte(path))),
+	})
+}
+
+func (e *envelope) open(path string, sealed []byte) ([]byte, error) {
+	var object envelopeObject
+	if err := json.Unmarshal(sealed, &object); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %s", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(object.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope: %s", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(object.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope: %s", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(object.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope: %s", err)
+	}
+	dataKey, err := e.kek.UnwrapKey(object.KEK, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key: %s", err)
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid envelope: nonce of %d bytes", len(nonce))
+	}
+	return gcm.Open(nil, nonce, ciphertext, []byte(path))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// KeyEncryptionKey wraps the data keys of the envelope encryption
+type KeyEncryptionKey interface {
+	// WrapKey encrypts a data key and returns the id of the key encryption key, which is passed to UnwrapKey
+	WrapKey(key []byte) (wrapped []byte, id string, err error)
+	UnwrapKey(id string, wrapped []byte) ([]byte, error)
+}
+
+// localKEK is a key encryption key from a file
+type localKEK struct {
+	key []byte
+	id  string
+}
+
+/*
+ * NewKeyFileKEK returns the key encryption key in the file: 32 bytes, raw or hex or base64 encoded. The id of the key is
+ * a fingerprint of the key, to recognize objects that were encrypted with another key.
+ */
+func NewKeyFileKEK(filename string) (KeyEncryptionKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key := data
+	if encoded := strings.TrimSpace(string(data)); len(encoded) == 64 {
+		key, err = hex.DecodeString(encoded)
+	} else if len(encoded) == 44 {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s should contain a key of 32 bytes, raw or hex or base64 encoded", filename)
+	}
+	return NewLocalKEK(key)
+}
+
+// NewLocalKEK returns a key encryption key of 32 bytes that wraps the data keys with AES-GCM
+func NewLocalKEK(key []byte) (KeyEncryptionKey, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key encryption key should be 32 bytes long, got %d bytes", len(key))
+	}
+	fingerprint := sha256.Sum256(key)
+	return &localKEK{key: key, id: "file:" + hex.EncodeToString(fingerprint[:8])}, nil
+}
+
+func (k *localKEK) WrapKey(key []byte) ([]byte, string, error) {
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return gcm.Seal(nonce, nonce, key, nil), k.id, nil
+}
+
+func (k *localKEK) UnwrapKey(id string, wrapped []byte) ([]byte, error) {
+	if id != k.id {
+		return nil, fmt.Errorf("wrapped with key %s, the configured key is %s", id, k.id)
+	}
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key")
+	}
+	return gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], nil)
+}
+
+// kmsKEK is a key encryption key in AWS KMS
+type kmsKEK struct {
+	client kmsiface.KMSAPI
+	keyID  string
+}
+
+// kmsEncryptionContext is authenticated with the data keys, it shows up in the CloudTrail logs of the key
+var kmsEncryptionContext = map[string]*string{"application": aws.String("openvpn-access")}
+
+/*
+ * NewKMSKEK returns the key encryption key in AWS KMS (key id, alias or arn). The region is read from the environment
+ * (AWS_REGION) when empty. Data keys can be unwrapped as long as the key that wrapped them can be used, also after
+ * changing the key id.
+ */
+func NewKMSKEK(region, keyID string) (KeyEncryptionKey, error) {
+	awsConfig := aws.NewConfig()
+	if region != "" {
+		awsConfig = awsConfig.WithRegion(region)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &kmsKEK{client: kms.New(sess), keyID: keyID}, nil
+}
+
+func (k *kmsKEK) WrapKey(key []byte) ([]byte, string, error) {
+	out, err := k.client.Encrypt(&kms.EncryptInput{
+		KeyId:             aws.String(k.keyID),
+		Plaintext:         key,
+		EncryptionContext: kmsEncryptionContext,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("KMS Encrypt error: %s", err)
+	}
+	return out.CiphertextBlob, "aws-kms:" + aws.StringValue(out.KeyId), nil
+}
+
+func (k *kmsKEK) UnwrapKey(id string, wrapped []byte) ([]byte, error) {
+	if !strings.HasPrefix(id, "aws-kms:") {
+		return nil, fmt.Errorf("wrapped with key %s, not with AWS KMS", id)
+	}
+	out, err := k.client.Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    wrapped,
+		EncryptionContext: kmsEncryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("KMS Decrypt error: %s", err)
+	}
+	return out.Plaintext, nil
+}
+
+// keyVaultKEK is a key encryption key in Azure Key Vault, used with the wrapkey and unwrapkey operations of the REST API
+type keyVaultKEK struct {
+	keyURL     string
+	authorizer autorest.Authorizer
+	httpClient *http.Client
+}
+
+// keyVaultOperation is the request and response of the wrapkey and unwrapkey operations
+type keyVaultOperation struct {
+	KID   string `json:"kid,omitempty"`
+	Alg   string `json:"alg,omitempty"`
+	Value string `json:"value"`
+}
+
+/*
+ * NewKeyVaultKEK returns the RSA key encryption key in Azure Key Vault, e.g. https://<vault>.vault.azure.net/keys/<name>,
+ * optionally with the version. The credentials are read from the environment, or Managed Service Identity is used.
+ */
+func NewKeyVaultKEK(keyURL string) (KeyEncryptionKey, error) {
+	authorizer, err := auth.NewAuthorizerFromEnvironmentWithResource("https://vault.azure.net")
+	if err != nil {
+		return nil, err
+	}
+	return &keyVaultKEK{
+		keyURL:     strings.TrimRight(keyURL, "/"),
+		authorizer: authorizer,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (k *keyVaultKEK) WrapKey(key []byte) ([]byte, string, error) {
+	out, err := k.do(k.keyURL+"/wrapkey", key)
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(out.Value)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid wrapkey response: %s", err)
+	}
+	// the kid includes the version of the key, which is needed to unwrap
+	return wrapped, "azure-keyvault:" + out.KID, nil
+}
+
+func (k *keyVaultKEK) UnwrapKey(id string, wrapped []byte) ([]byte, error) {
+	kid := strings.TrimPrefix(id, "azure-keyvault:")
+	if kid == id {
+		return nil, fmt.Errorf("wrapped with key %s, not with Azure Key Vault", id)
+	}
+	// the kid is read from the stored object, the token is only sent to the configured key
+	if !k.isKey(kid) {
+		return nil, fmt.Errorf("wrapped with key %s, not with %s", kid, k.keyURL)
+	}
+	out, err := k.do(kid+"/unwrapkey", wrapped)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.RawURLEncoding.DecodeString(out.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unwrapkey response: %s", err)
+	}
+	return key, nil
+}
+
+// isKey returns true when the kid is the configured key, with any version: same scheme, host and key name
+func (k *keyVaultKEK) isKey(kid string) bool {
+	keyURL, err := url.Parse(k.keyURL)
+	if err != nil {
+		return false
+	}
+	parsedKID, err := url.Parse(kid)
+	if err != nil || parsedKID.Scheme != keyURL.Scheme || !strings.EqualFold(parsedKID.Host, keyURL.Host) ||
+		parsedKID.User != nil || parsedKID.RawQuery != "" || parsedKID.Fragment != "" {
+		return false
+	}
+	// keys/<name>, the version of the configured key is optional
+	keyPath := strings.Split(strings.Trim(keyURL.Path, "/"), "/")
+	if len(keyPath) < 2 || keyPath[0] != "keys" {
+		return false
+	}
+	kidPath := strings.Split(strings.Trim(parsedKID.Path, "/"), "/")
+	return (len(kidPath) == 2 || len(kidPath) == 3) && kidPath[0] == "keys" && kidPath[1] == keyPath[1] &&
+		(len(kidPath) == 2 || kidPath[2] != "")
+}
+
+func (k *keyVaultKEK) do(operationURL string, value []byte) (keyVaultOperation, error) {
+	var out keyVaultOperation
+	body, err := json.Marshal(keyVaultOperation{Alg: "RSA-OAEP-256", Value: base64.RawURLEncoding.EncodeToString(value)})
+	if err != nil {
+		return out, err
+	}
+	req, err := http.NewRequest(http.MethodPost, operationURL+"?api-version=7.3", bytes.NewReader(body))
+	if err != nil {
+		return out, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req, err = autorest.Prepare(req, k.authorizer.WithAuthorization())
+	if err != nil {
+		return out, fmt.Errorf("Key Vault authorization error: %s", err)
+	}
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return out, fmt.Errorf("Key Vault error: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return out, fmt.Errorf("Key Vault returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return out, fmt.Errorf("invalid Key Vault response: %s", err)
+	}
+	return out, nil
+}
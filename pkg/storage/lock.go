@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrLocked is returned when the lock is still held by another owner when the context is done
+var ErrLocked = errors.New("locked by another owner")
+
+// lockRetryInterval is the maximum interval between two attempts to acquire a lock
+var lockRetryInterval = time.Second
+
+// lockRecord is the content of a lock object
+type lockRecord struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// Lock is a lease on a lock object in the storage backend
+type Lock struct {
+	objects ObjectStorage
+	bucket  string
+	item    string
+	owner   string
+	etag    string
+}
+
+/*
+ * AcquireLock creates the lock object item, which is held until it's released or for ttl. The lock object is created
+ * with a conditional write, so only one replica holds the lock. A lock that's expired, e.g. because its owner crashed,
+ * is taken over. AcquireLock retries until the context is done and returns ErrLocked when the lock is still held. The
+ * expiry uses the clocks of the replicas, keep ttl well above their clock skew.
+ */
+func AcquireLock(ctx context.Context, s StorageIf, bucket, item string, ttl time.Duration) (*Lock, error) {
+	lock := &Lock{objects: Objects(s), bucket: bucket, item: item, owner: lockOwner()}
+	retry := 50 * time.Millisecond
+	for {
+		acquired, err := lock.tryAcquire(ctx, ttl)
+		if err != nil && ctx.Err() == nil {
+			return nil, err
+		}
+		if acquired {
+			return lock, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%q in bucket %q: %w", item, bucket, ErrLocked)
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, lockRetryInterval)
+	}
+}
+
+// tryAcquire creates the lock object, or replaces it when it's expired
+func (l *Lock) tryAcquire(ctx context.Context, ttl time.Duration) (bool, error) {
+	record, err := json.Marshal(lockRecord{Owner: l.owner, Expires: time.Now().Add(ttl).UTC()})
+	if err != nil {
+		return false, err
+	}
+	opts := PutOptions{ContentType: "application/json", IfNoneMatch: true}
+	body, info, err := l.objects.Get(ctx, l.bucket, l.item)
+	if err == nil {
+		var current lockRecord
+		decodeErr := json.NewDecoder(io.LimitReader(body, 4096)).Decode(&current)
+		body.Close()
+		if decodeErr == nil && time.Now().Before(current.Expires) {
+			return false, nil
+		}
+		// the lock is expired (or unreadable): take it over, unless another owner does it first
+		opts = PutOptions{ContentType: "application/json", IfMatch: info.ETag}
+	} else if !errors.Is(err, ErrNotExist) {
+		return false, err
+	}
+	info, err = l.objects.Put(ctx, l.bucket, l.item, bytes.NewReader(record), opts)
+	if errors.Is(err, ErrPreconditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	l.etag = info.ETag
+	return true, nil
+}
+
+// Release deletes the lock object, unless it was taken over by another owner after it expired
+func (l *Lock) Release(ctx context.Context) error {
+	body, info, err := l.objects.Get(ctx, l.bucket, l.item)
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var current lockRecord
+	err = json.NewDecoder(io.LimitReader(body, 4096)).Decode(&current)
+	body.Close()
+	if err != nil || current.Owner != l.owner || (l.etag != "" && info.ETag != l.etag) {
+		return nil
+	}
+	return l.objects.Delete(ctx, l.bucket, l.item)
+}
+
+// lockOwner returns a unique owner of a lock: the hostname (the task or container) with a random suffix
+func lockOwner() string {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
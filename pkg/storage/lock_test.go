@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	blobStorage := NewMemory()
+	lock, err := AcquireLock(context.Background(), blobStorage, "bucket", "locks/alice.json", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLock error: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := AcquireLock(ctx, blobStorage, "bucket", "locks/alice.json", time.Minute); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+	if err := lock.Release(context.Background()); err != nil {
+		t.Fatalf("Release error: %s", err)
+	}
+	if err := blobStorage.HeadObject("bucket", "locks/alice.json"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Expected the lock object to be deleted, got %v", err)
+	}
+
+	// an expired lock is taken over, and isn't deleted by its previous owner
+	expired, err := AcquireLock(context.Background(), blobStorage, "bucket", "locks/alice.json", -time.Second)
+	if err != nil {
+		t.Fatalf("AcquireLock error: %s", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	lock, err = AcquireLock(ctx, blobStorage, "bucket", "locks/alice.json", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected the expired lock to be taken over, got %v", err)
+	}
+	if err := expired.Release(context.Background()); err != nil {
+		t.Fatalf("Release error: %s", err)
+	}
+	if err := blobStorage.HeadObject("bucket", "locks/alice.json"); err != nil {
+		t.Errorf("Expected the lock of the new owner to be kept, got %v", err)
+	}
+	lock.Release(context.Background())
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memory struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+/*
+ * NewMemory returns an in-memory storage backend. Objects are lost when the process exits.
+ */
+func NewMemory() StorageIf {
+	return NewStorageIf(&memory{
+		objects: make(map[string]memoryObject),
+	})
+}
+
+func (m *memory) Head(ctx context.Context, bucket, item string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[bucket+"/"+item]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("%q in bucket %q: %w", item, bucket, ErrNotExist)
+	}
+	return object.info, nil
+}
+func (m *memory) Get(ctx context.Context, bucket, item string) (io.ReadCloser, ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[bucket+"/"+item]
+	if !ok {
+		return nil, ObjectInfo{}, fmt.Errorf("%q in bucket %q: %w", item, bucket, ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), object.info, nil
+}
+func (m *memory) Put(ctx context.Context, bucket, item string, body io.Reader, opts PutOptions) (ObjectInfo, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, exists := m.objects[bucket+"/"+item]
+	if (opts.IfNoneMatch && exists) || (opts.IfMatch != "" && (!exists || current.info.ETag != opts.IfMatch)) {
+		return ObjectInfo{}, fmt.Errorf("%q in bucket %q: %w", item, bucket, ErrPreconditionFailed)
+	}
+	info := contentInfo(data)
+	info.ContentType = opts.ContentType
+	info.Tags = lowerKeys(opts.Tags)
+	info.LastModified = time.Now()
+	m.objects[bucket+"/"+item] = memoryObject{data: data, info: info}
+	return info, nil
+}
+func (m *memory) Delete(ctx context.Context, bucket, item string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, bucket+"/"+item)
+	return nil
+}
+func (m *memory) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	items := []string{}
+	for key := range m.objects {
+		if strings.HasPrefix(key, bucket+"/"+prefix) {
+			items = append(items, strings.TrimPrefix(key, bucket+"/"))
+		}
+	}
+	sort.Strings(items)
+	return items, nil
+}
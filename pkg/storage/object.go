@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrPreconditionFailed is returned by a conditional write when the object already exists (IfNoneMatch) or was changed
+// (IfMatch)
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ObjectInfo is the metadata of an object
+type ObjectInfo struct {
+	ContentType string
+	// Tags are stored as user metadata of the object, the keys are lower case
+	Tags map[string]string
+	// ETag changes with every write of the object, it's empty when the backend didn't return it
+	ETag         string
+	Size         int64
+	LastModified time.Time
+}
+
+// PutOptions are the metadata and conditions of a write
+type PutOptions struct {
+	ContentType string
+	Tags        map[string]string
+	// KMSArn is the KMS key to encrypt the object with (s3)
+	KMSArn string
+	// IfNoneMatch only writes the object when it doesn't exist yet
+	IfNoneMatch bool
+	// IfMatch only writes the object when its ETag is still IfMatch
+	IfMatch string
+}
+
+// conditional returns true when the write has a condition
+func (o PutOptions) conditional() bool {
+	return o.IfNoneMatch || o.IfMatch != ""
+}
+
+/*
+ * ObjectStorage is the interface of the storage backends. Every operation takes a context for cancellation and timeouts,
+ * objects are streamed and carry their metadata. Conditional writes fail with ErrPreconditionFailed, which allows
+ * replicas to create an object only once. StorageIf is the previous interface, NewStorageIf and Objects convert between
+ * both.
+ */
+type ObjectStorage interface {
+	Head(ctx context.Context, bucket, item string) (ObjectInfo, error)
+	// Get returns the content of the object, which needs to be closed
+	Get(ctx context.Context, bucket, item string) (io.ReadCloser, ObjectInfo, error)
+	Put(ctx context.Context, bucket, item string, body io.Reader, opts PutOptions) (ObjectInfo, error)
+	// Delete removes the object. Deleting an object that doesn't exist succeeds (like in S3), so a delete can be retried
+	Delete(ctx context.Context, bucket, item string) error
+	List(ctx context.Context, bucket, prefix string) ([]string, error)
+}
+
+// storageIfAdapter implements StorageIf with an ObjectStorage, and still exposes the ObjectStorage
+type storageIfAdapter struct {
+	ObjectStorage
+}
+
+/*
+ * NewStorageIf returns the StorageIf interface of an ObjectStorage, for the code that doesn't use contexts or
+ * metadata. The result still implements ObjectStorage.
+ */
+func NewStorageIf(s ObjectStorage) StorageIf {
+	return &storageIfAdapter{ObjectStorage: s}
+}
+
+func (a *storageIfAdapter) HeadObject(bucket, item string) error {
+	_, err := a.Head(context.Background(), bucket, item)
+	return err
+}
+func (a *storageIfAdapter) GetObject(bucket, item string) (bytes.Buffer, error) {
+	var out bytes.Buffer
+	body, _, err := a.Get(context.Background(), bucket, item)
+	if err != nil {
+		return out, err
+	}
+	defer body.Close()
+	if _, err := out.ReadFrom(body); err != nil {
+		return out, fmt.Errorf("Unable to read %q in %q: %s", item, bucket, err)
+	}
+	return out, nil
+}
+func (a *storageIfAdapter) PutObject(bucket, item, data, kmsArn string) error {
+	_, err := a.Put(context.Background(), bucket, item, strings.NewReader(data), PutOptions{KMSArn: kmsArn})
+	return err
+}
+func (a *storageIfAdapter) DeleteObject(bucket, item string) error {
+	return a.Delete(context.Background(), bucket, item)
+}
+func (a *storageIfAdapter) ListObjects(bucket, prefix string) ([]string, error) {
+	return a.List(context.Background(), bucket, prefix)
+}
+
+// objectStorageAdapter implements ObjectStorage with a StorageIf that doesn't implement it, e.g. the fakes of tests
+type objectStorageAdapter struct {
+	StorageIf
+}
+
+/*
+ * Objects returns the ObjectStorage interface of a storage backend. Backends that only implement StorageIf are
+ * adapted: the context is only checked before every operation, metadata isn't stored, the ETag is the md5 of the
+ * content and conditional writes are checked before writing, which isn't atomic.
+ */
+func Objects(s StorageIf) ObjectStorage {
+	if objects, ok := s.(ObjectStorage); ok {
+		return objects
+	}
+	return &objectStorageAdapter{StorageIf: s}
+}
+
+func (a *objectStorageAdapter) Head(ctx context.Context, bucket, item string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	out, err := a.GetObject(bucket, item)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return contentInfo(out.Bytes()), nil
+}
+func (a *objectStorageAdapter) Get(ctx context.Context, bucket, item string) (io.ReadCloser, ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	out, err := a.GetObject(bucket, item)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return io.NopCloser(bytes.NewReader(out.Bytes())), contentInfo(out.Bytes()), nil
+}
+func (a *objectStorageAdapter) Put(ctx context.Context, bucket, item string, body io.Reader, opts PutOptions) (ObjectInfo, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	if opts.conditional() {
+		current, err := a.Head(ctx, bucket, item)
+		if err != nil && !errors.Is(err, ErrNotExist) {
+			return ObjectInfo{}, err
+		}
+		if exists := err == nil; (opts.IfNoneMatch && exists) || (opts.IfMatch != "" && (!exists || current.ETag != opts.IfMatch)) {
+			return ObjectInfo{}, fmt.Errorf("%q in bucket %q: %w", item, bucket, ErrPreconditionFailed)
+		}
+	}
+	if err := a.PutObject(bucket, item, string(data), opts.KMSArn); err != nil {
+		return ObjectInfo{}, err
+	}
+	return contentInfo(data), nil
+}
+func (a *objectStorageAdapter) Delete(ctx context.Context, bucket, item string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.DeleteObject(bucket, item)
+}
+func (a *objectStorageAdapter) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.ListObjects(bucket, prefix)
+}
+
+// contentInfo returns the size and the md5 ETag of the content
+func contentInfo(data []byte) ObjectInfo {
+	sum := md5.Sum(data)
+	return ObjectInfo{ETag: `"` + hex.EncodeToString(sum[:]) + `"`, Size: int64(len(data))}
+}
+
+// lowerKeys returns the tags with lower case keys, like they're returned by the backends
+func lowerKeys(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(tags))
+	for key, value := range tags {
+		out[strings.ToLower(key)] = value
+	}
+	return out
+}
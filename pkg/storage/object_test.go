@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// legacyStorage only implements StorageIf
+type legacyStorage struct {
+	StorageIf
+}
+
+func TestObjectStorage(t *testing.T) {
+	for name, objects := range map[string]ObjectStorage{
+		"memory":  Objects(NewMemory()),
+		"adapter": Objects(&legacyStorage{StorageIf: NewMemory()}),
+	} {
+		ctx := context.Background()
+		info, err := objects.Put(ctx, "bucket", "pki/issued/a.crt", strings.NewReader("cert"), PutOptions{ContentType: "application/x-pem-file", Tags: map[string]string{"Login": "alice"}, IfNoneMatch: true})
+		if err != nil || info.ETag == "" {
+			t.Fatalf("%s: Put error: %v (info: %+v)", name, err, info)
+		}
+		if _, err := objects.Put(ctx, "bucket", "pki/issued/a.crt", strings.NewReader("other"), PutOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("%s: Expected ErrPreconditionFailed for an existing object, got %v", name, err)
+		}
+		if _, err := objects.Put(ctx, "bucket", "pki/issued/a.crt", strings.NewReader("other"), PutOptions{IfMatch: `"outdated"`}); !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("%s: Expected ErrPreconditionFailed for another ETag, got %v", name, err)
+		}
+		if _, err := objects.Put(ctx, "bucket", "pki/issued/missing.crt", strings.NewReader("other"), PutOptions{IfMatch: info.ETag}); !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("%s: Expected ErrPreconditionFailed for a missing object, got %v", name, err)
+		}
+		renewed, err := objects.Put(ctx, "bucket", "pki/issued/a.crt", strings.NewReader("renewed"), PutOptions{IfMatch: info.ETag})
+		if err != nil || renewed.ETag == info.ETag {
+			t.Errorf("%s: Unexpected renewal: %+v (err: %v)", name, renewed, err)
+		}
+
+		body, got, err := objects.Get(ctx, "bucket", "pki/issued/a.crt")
+		if err != nil {
+			t.Fatalf("%s: Get error: %s", name, err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if string(data) != "renewed" || got.ETag != renewed.ETag || got.Size != 7 {
+			t.Errorf("%s: Unexpected object %q: %+v", name, data, got)
+		}
+		if _, err := objects.Head(ctx, "bucket", "pki/issued/missing.crt"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("%s: Expected ErrNotExist, got %v", name, err)
+		}
+		if err := objects.Delete(ctx, "bucket", "pki/issued/missing.crt"); err != nil {
+			t.Errorf("%s: Expected a delete of a missing object to succeed, got %v", name, err)
+		}
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := objects.List(canceled, "bucket", "pki/"); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: Expected context.Canceled, got %v", name, err)
+		}
+	}
+
+	// metadata is only stored by the backends
+	objects := Objects(NewMemory())
+	objects.Put(context.Background(), "bucket", "a.crt", strings.NewReader("cert"), PutOptions{ContentType: "application/x-pem-file", Tags: map[string]string{"Login": "alice"}})
+	if info, err := objects.Head(context.Background(), "bucket", "a.crt"); err != nil || info.ContentType != "application/x-pem-file" || info.Tags["login"] != "alice" {
+		t.Errorf("Unexpected metadata: %+v (err: %v)", info, err)
+	}
+}
+
+func TestStorageIfAdapter(t *testing.T) {
+	blobStorage := NewMemory()
+	if err := blobStorage.PutObject("bucket", "a.txt", "data", ""); err != nil {
+		t.Fatalf("PutObject error: %s", err)
+	}
+	if out, err := blobStorage.GetObject("bucket", "a.txt"); err != nil || out.String() != "data" {
+		t.Errorf("Unexpected object: %q (err: %v)", out.String(), err)
+	}
+	if err := blobStorage.HeadObject("bucket", "b.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Expected ErrNotExist, got %v", err)
+	}
+	// the adapter still exposes the ObjectStorage of the backend
+	if _, ok := Objects(blobStorage).(*objectStorageAdapter); ok {
+		t.Errorf("Expected the ObjectStorage of the backend")
+	}
+}
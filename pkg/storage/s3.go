@@ -2,91 +2,173 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"strings"
+	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type s3Struct struct {
-	StorageIf
-	sess *session.Session
+	svc      *s3.S3
+	uploader *s3manager.Uploader
 }
 
 /*
- * cert
+ * NewS3 returns the s3 storage backend. The region is read from the environment (AWS_REGION) when empty. The client is
+ * safe for concurrent use, create it once.
  */
-func NewS3() (StorageIf, error) {
-	sess, err := session.NewSession()
+func NewS3(region string) (StorageIf, error) {
+	awsConfig := aws.NewConfig()
+	if region != "" {
+		awsConfig = awsConfig.WithRegion(region)
+	}
+	sess, err := session.NewSession(awsConfig)
 	if err != nil {
 		return nil, err
 	}
-	return &s3Struct{sess: sess}, nil
+	return NewStorageIf(&s3Struct{svc: s3.New(sess), uploader: s3manager.NewUploader(sess)}), nil
 }
-func (s *s3Struct) HeadObject(bucket, item string) error {
 
-	svc := s3.New(session.New())
-	_, err := svc.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(item),
-	})
-	if err == nil {
-		return nil
-	} else {
-		return err
+// s3Error wraps the not found and precondition errors of s3 with ErrNotExist and ErrPreconditionFailed
+func s3Error(err error, bucket, item string) error {
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+		return fmt.Errorf("%q in bucket %q: %w", item, bucket, ErrNotExist)
+	}
+	// 409 is returned when a conditional write conflicts with a concurrent write of the same object
+	if rerr, ok := err.(awserr.RequestFailure); ok && (rerr.StatusCode() == http.StatusPreconditionFailed || rerr.StatusCode() == http.StatusConflict) {
+		return fmt.Errorf("%q in bucket %q: %w", item, bucket, ErrPreconditionFailed)
 	}
+	return err
 }
 
-func (s *s3Struct) GetObject(bucket, item string) (bytes.Buffer, error) {
-	var out bytes.Buffer
-	var err error
+// s3Info returns the metadata of an object, the tags are stored as user metadata
+func s3Info(contentType, etag *string, size *int64, lastModified *time.Time, metadata map[string]*string) ObjectInfo {
+	tags := map[string]string{}
+	for key, value := range metadata {
+		tags[key] = aws.StringValue(value)
+	}
+	return ObjectInfo{
+		ContentType:  aws.StringValue(contentType),
+		Tags:         lowerKeys(tags),
+		ETag:         aws.StringValue(etag),
+		Size:         aws.Int64Value(size),
+		LastModified: aws.TimeValue(lastModified),
+	}
+}
 
-	requestInput := s3.GetObjectInput{
+func (s *s3Struct) Head(ctx context.Context, bucket, item string) (ObjectInfo, error) {
+	out, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(item),
+	})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err, bucket, item)
 	}
+	return s3Info(out.ContentType, out.ETag, out.ContentLength, out.LastModified, out.Metadata), nil
+}
 
-	buf := aws.NewWriteAtBuffer([]byte{})
-	downloader := s3manager.NewDownloader(s.sess)
-	_, err = downloader.Download(buf, &requestInput)
+func (s *s3Struct) Get(ctx context.Context, bucket, item string) (io.ReadCloser, ObjectInfo, error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(item),
+	})
 	if err != nil {
-		return out, fmt.Errorf("S3 Download error %s", err)
+		return nil, ObjectInfo{}, fmt.Errorf("S3 Download error %w", s3Error(err, bucket, item))
 	}
+	return out.Body, s3Info(out.ContentType, out.ETag, out.ContentLength, out.LastModified, out.Metadata), nil
+}
 
-	if len(buf.Bytes()) == 0 {
-		return out, fmt.Errorf("Unable to download item %q, bucket %q (0 bytes downloaded)", item, bucket)
+/*
+ * Put streams the object with the s3 upload manager. Conditional writes are sent with the If-None-Match or If-Match
+ * header in a single PutObject request, so the body is read in memory first. S3 compatible stores that don't support
+ * conditional writes ignore the headers.
+ */
+func (s *s3Struct) Put(ctx context.Context, bucket, item string, body io.Reader, opts PutOptions) (ObjectInfo, error) {
+	metadata := map[string]*string{}
+	for key, value := range lowerKeys(opts.Tags) {
+		metadata[key] = aws.String(value)
 	}
-
-	_, err = io.Copy(&out, bytes.NewReader(buf.Bytes()))
+	var contentType, sseKMSKeyID, serverSideEncryption *string
+	if opts.ContentType != "" {
+		contentType = aws.String(opts.ContentType)
+	}
+	if opts.KMSArn != "" {
+		sseKMSKeyID = aws.String(opts.KMSArn)
+		serverSideEncryption = aws.String("aws:kms")
+	}
+	if !opts.conditional() {
+		_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(item),
+			Body:                 body,
+			ContentType:          contentType,
+			Metadata:             metadata,
+			SSEKMSKeyId:          sseKMSKeyID,
+			ServerSideEncryption: serverSideEncryption,
+		})
+		if err != nil {
+			return ObjectInfo{}, fmt.Errorf("Unable to upload %q to %q, %v", item, bucket, err)
+		}
+		return ObjectInfo{ContentType: opts.ContentType, Tags: lowerKeys(opts.Tags)}, nil
+	}
+	data, err := io.ReadAll(body)
 	if err != nil {
-		return out, fmt.Errorf("Unable to output buffer")
+		return ObjectInfo{}, err
 	}
-	return out, nil
+	out, err := s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(item),
+		Body:                 bytes.NewReader(data),
+		ContentType:          contentType,
+		Metadata:             metadata,
+		SSEKMSKeyId:          sseKMSKeyID,
+		ServerSideEncryption: serverSideEncryption,
+	}, func(r *request.Request) {
+		if opts.IfNoneMatch {
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		}
+		if opts.IfMatch != "" {
+			r.HTTPRequest.Header.Set("If-Match", opts.IfMatch)
+		}
+	})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("Unable to upload %q to %q, %w", item, bucket, s3Error(err, bucket, item))
+	}
+	return ObjectInfo{ContentType: opts.ContentType, Tags: lowerKeys(opts.Tags), ETag: aws.StringValue(out.ETag), Size: int64(len(data))}, nil
 }
-func (s *s3Struct) PutObject(bucket, item, data, kmsArn string) error {
-	reader := strings.NewReader(data)
 
-	uploader := s3manager.NewUploader(s.sess)
-	uploadInput := s3manager.UploadInput{
+func (s *s3Struct) Delete(ctx context.Context, bucket, item string) error {
+	_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(item),
-		Body:   reader,
-	}
-	if kmsArn != "" {
-		uploadInput.SSEKMSKeyId = aws.String(kmsArn)
-		uploadInput.ServerSideEncryption = aws.String("aws:kms")
-	}
-	_, err := uploader.Upload(&uploadInput)
+	})
 	if err != nil {
-		return fmt.Errorf("Unable to upload %q to %q, %v", item, bucket, err)
+		return fmt.Errorf("Unable to delete %q from %q, %v", item, bucket, err)
 	}
-
 	return nil
 }
-func (s *s3Struct) DeleteObject(bucket, item string) error {
-	return fmt.Errorf("Not implemented")
+
+func (s *s3Struct) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	items := []string{}
+	err := s.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			items = append(items, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return items, fmt.Errorf("Unable to list %q in %q, %v", prefix, bucket, err)
+	}
+	return items, nil
 }
@@ -1,11 +1,19 @@
 package storage
 
-import "bytes"
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrNotExist is returned when an object doesn't exist in the storage backend
+var ErrNotExist = errors.New("object does not exist")
 
 //StorageIf implements an interface for the different types of supported storage
 type StorageIf interface {
 	HeadObject(bucket, item string) error
 	GetObject(bucket, item string) (bytes.Buffer, error)
 	PutObject(bucket, item, data, kmsArn string) error
+	// DeleteObject removes the object, see ObjectStorage.Delete: deleting an object that doesn't exist succeeds
 	DeleteObject(bucket, item string) error
+	ListObjects(bucket, prefix string) ([]string, error)
 }
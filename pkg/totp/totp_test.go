@@ -0,0 +1,50 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{59: "94287082", 1111111109: "07081804", 1111111111: "14050471", 1234567890: "89005924", 2000000000: "69279037"}
+	for unix, expected := range vectors {
+		if code := hotp(key, Step(time.Unix(unix, 0)), 8); code != expected {
+			t.Errorf("Unexpected code at %d: %s, expected %s", unix, code, expected)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil || len(secret) != 32 {
+		t.Fatalf("Unexpected secret %q (err: %v)", secret, err)
+	}
+	now := time.Unix(1718704800, 0)
+	code, err := Code(secret, now.Add(-Period))
+	if err != nil {
+		t.Fatalf("Code error: %s", err)
+	}
+	if step, ok := Validate(secret, code, now, 1); !ok || step != Step(now)-1 {
+		t.Errorf("Expected the code of the previous step to be valid, got %d %v", step, ok)
+	}
+	if _, ok := Validate(secret, code, now.Add(Period), 1); ok {
+		t.Errorf("Expected the code to be expired")
+	}
+	// secrets are accepted in lower case and with spaces, like authenticator apps show them
+	if _, ok := Validate(strings.ToLower(secret[:4]+" "+secret[4:]), code, now, 1); !ok {
+		t.Errorf("Expected a valid code with a formatted secret")
+	}
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Errorf("Expected a short code to be invalid")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("OpenVPN Access", "alice@example.com", "JBSWY3DPEHPK3PXP")
+	if uri != "otpauth://totp/OpenVPN%20Access:alice@example.com?issuer=OpenVPN%20Access&secret=JBSWY3DPEHPK3PXP" {
+		t.Errorf("Unexpected uri: %s", uri)
+	}
+}
@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"github.com/in4it/openvpn-access/pkg/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tracedStorage struct {
+	next    storage.ObjectStorage
+	ctx     context.Context
+	backend string
+}
+
+/*
+ * NewStorage wraps a storage backend to create a span for every operation, as child of the span in the context of the
+ * operation, or in ctx when the operation has no span (e.g. the operations of StorageIf)
+ */
+func NewStorage(ctx context.Context, backend string, next storage.StorageIf) storage.StorageIf {
+	return storage.NewStorageIf(&tracedStorage{
+		next:    storage.Objects(next),
+		ctx:     ctx,
+		backend: backend,
+	})
+}
+
+func (s *tracedStorage) start(ctx context.Context, method, bucket, item string) (context.Context, func(error)) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = s.ctx
+	}
+	ctx, span := Start(ctx, "storage."+method,
+		attribute.String("storage.backend", s.backend),
+		attribute.String("storage.bucket", bucket),
+		attribute.String("storage.item", item),
+	)
+	return ctx, func(err error) {
+		End(span, err)
+	}
+}
+
+func (s *tracedStorage) Head(ctx context.Context, bucket, item string) (storage.ObjectInfo, error) {
+	ctx, end := s.start(ctx, "HeadObject", bucket, item)
+	info, err := s.next.Head(ctx, bucket, item)
+	end(err)
+	return info, err
+}
+func (s *tracedStorage) Get(ctx context.Context, bucket, item string) (io.ReadCloser, storage.ObjectInfo, error) {
+	ctx, end := s.start(ctx, "GetObject", bucket, item)
+	body, info, err := s.next.Get(ctx, bucket, item)
+	end(err)
+	return body, info, err
+}
+func (s *tracedStorage) Put(ctx context.Context, bucket, item string, body io.Reader, opts storage.PutOptions) (storage.ObjectInfo, error) {
+	ctx, end := s.start(ctx, "PutObject", bucket, item)
+	info, err := s.next.Put(ctx, bucket, item, body, opts)
+	end(err)
+	return info, err
+}
+func (s *tracedStorage) Delete(ctx context.Context, bucket, item string) error {
+	ctx, end := s.start(ctx, "DeleteObject", bucket, item)
+	err := s.next.Delete(ctx, bucket, item)
+	end(err)
+	return err
+}
+func (s *tracedStorage) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	ctx, end := s.start(ctx, "ListObjects", bucket, prefix)
+	items, err := s.next.List(ctx, bucket, prefix)
+	end(err)
+	return items, err
+}
@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/in4it/openvpn-access/pkg/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMiddleware(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := SetExporter(exporter)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/devices/{device}/ovpnconfig", func(w http.ResponseWriter, r *http.Request) {
+		blobStorage := NewStorage(r.Context(), "memory", storage.NewMemory())
+		blobStorage.PutObject("bucket", "pki/issued/test.crt", "data", "")
+		blobStorage.GetObject("bucket", "pki/issued/test.crt")
+		if _, err := blobStorage.GetObject("bucket", "pki/issued/doesnotexist.crt"); err == nil {
+			t.Errorf("expected error for object that doesn't exist")
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	req := httptest.NewRequest("GET", "/devices/laptop/ovpnconfig", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatalf("ForceFlush error: %s", err)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(spans))
+	}
+	server := spans[len(spans)-1]
+	if server.Name != "GET /devices/{device}/ovpnconfig" {
+		t.Errorf("unexpected server span name: %s", server.Name)
+	}
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace id is not propagated from the request: %s", server.SpanContext.TraceID())
+	}
+	if server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("parent span id is not propagated from the request: %s", server.Parent.SpanID())
+	}
+	for _, span := range spans[:3] {
+		if span.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("span %s is not a child of the server span", span.Name)
+		}
+	}
+	if spans[2].Name != "storage.GetObject" || spans[2].Status.Code.String() != "Error" {
+		t.Errorf("expected failed GetObject span, got %s (%s)", spans[2].Name, spans[2].Status.Code)
+	}
+}
@@ -0,0 +1,208 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HookTLSVerify is the Hook of the requests of the tls-verify hook, these have no username and password
+const HookTLSVerify = "tls-verify"
+
+// Request is sent by an openvpn server when a client connects
+type Request struct {
+	// Hook is the openvpn hook (script_type) that sent the request: tls-verify or user-pass-verify
+	Hook       string `json:"hook,omitempty"`
+	CommonName string `json:"commonName"`
+	// Serial is the serial of the client certificate in hex, optionally with colons (tls_serial_hex_0 of openvpn)
+	Serial string `json:"serial"`
+	// Username is the username of auth-user-pass-verify, it has to match the login of the common name when it's set
+	Username string `json:"username,omitempty"`
+	// Password is the password of auth-user-pass-verify: the code of the authenticator app, or a recovery code
+	Password string `json:"password,omitempty"`
+}
+
+// Decision is the answer to a Request: allow the client to connect or not, and why not
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+	// Cached is set when the server couldn't be reached and the decision is the last answer of the server
+	Cached bool `json:"-"`
+}
+
+// cachedDecision is a decision in the cache dir
+type cachedDecision struct {
+	Decision Decision  `json:"decision"`
+	Time     time.Time `json:"time"`
+}
+
+// Client asks openvpn-access whether a client may connect
+type Client struct {
+	// URL is the url of openvpn-access, including the url prefix
+	URL string
+	// Server is the name of the openvpn server
+	Server string
+	// Token is the server token (SERVER_TOKEN)
+	Token      string
+	HTTPClient *http.Client
+	// CacheDir stores the decisions of the server. When the server can't be reached, the last decision for the request
+	// is used when it's not older than CacheTTL. Decisions are not cached when CacheDir is empty.
+	CacheDir string
+	CacheTTL time.Duration
+}
+
+/*
+ * Verify asks openvpn-access whether the client may connect. When openvpn-access can't be reached or fails, the last
+ * decision for the same request is returned when it's recent enough, so a short outage doesn't lock out the users.
+ * Requests with a password are never cached: a one-time code can only be checked by openvpn-access.
+ */
+func (c *Client) Verify(ctx context.Context, request Request) (Decision, error) {
+	decision, err := c.verify(ctx, request)
+	if err == nil {
+		if cacheErr := c.store(request, decision, time.Now()); cacheErr != nil {
+			fmt.Fprintf(os.Stderr, "could not cache decision: %s\n", cacheErr)
+		}
+		return decision, nil
+	}
+	cached, ok := c.load(request, time.Now())
+	if !ok {
+		return Decision{}, err
+	}
+	cached.Cached = true
+	return cached, nil
+}
+
+func (c *Client) verify(ctx context.Context, request Request) (Decision, error) {
+	var decision Decision
+	body, err := json.Marshal(request)
+	if err != nil {
+		return decision, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(c.URL, "/")+"/api/servers/"+c.Server+"/verify", bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decision, fmt.Errorf("openvpn-access returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return decision, fmt.Errorf("invalid response: %s", err)
+	}
+	return decision, nil
+}
+
+// cacheFile returns the file of the cached decision for the request
+func (c *Client) cacheFile(request Request) string {
+	key := sha256.Sum256([]byte(c.Server + "\n" + request.CommonName + "\n" + request.Serial + "\n" + request.Username))
+	return filepath.Join(c.CacheDir, hex.EncodeToString(key[:])+".json")
+}
+
+func (c *Client) store(request Request, decision Decision, now time.Time) error {
+	if c.CacheDir == "" || request.Password != "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.CacheDir, 0700); err != nil {
+		return err
+	}
+	out, err := json.Marshal(cachedDecision{Decision: decision, Time: now})
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, connections are verified concurrently
+	tmp, err := os.CreateTemp(c.CacheDir, ".decision-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.cacheFile(request))
+}
+
+func (c *Client) load(request Request, now time.Time) (Decision, bool) {
+	if c.CacheDir == "" || request.Password != "" {
+		return Decision{}, false
+	}
+	data, err := os.ReadFile(c.cacheFile(request))
+	if err != nil {
+		return Decision{}, false
+	}
+	var cached cachedDecision
+	if err := json.Unmarshal(data, &cached); err != nil || now.Sub(cached.Time) > c.CacheTTL {
+		return Decision{}, false
+	}
+	return cached.Decision, true
+}
+
+/*
+ * RequestFromEnv returns the request for the openvpn hook that runs the program (script_type): tls-verify, with the
+ * depth and subject as arguments, or auth-user-pass-verify via-env or via-file (the file with the username and password
+ * as argument). skip is true for the certificates of the CA chain in tls-verify, those are verified by openvpn.
+ */
+func RequestFromEnv(getenv func(string) string, args []string) (request Request, skip bool, err error) {
+	request.Serial = getenv("tls_serial_hex_0")
+	if request.Serial == "" && getenv("tls_serial_0") != "" {
+		serial, ok := new(big.Int).SetString(getenv("tls_serial_0"), 10)
+		if !ok {
+			return request, false, fmt.Errorf("invalid tls_serial_0: %s", getenv("tls_serial_0"))
+		}
+		request.Serial = fmt.Sprintf("%X", serial)
+	}
+	request.Hook = getenv("script_type")
+	switch request.Hook {
+	case HookTLSVerify:
+		if len(args) < 1 {
+			return request, false, fmt.Errorf("tls-verify expects the certificate depth as argument")
+		}
+		if args[0] != "0" {
+			return request, true, nil
+		}
+		request.CommonName = getenv("X509_0_CN")
+	case "user-pass-verify":
+		request.CommonName = getenv("common_name")
+		request.Username = getenv("username")
+		request.Password = getenv("password")
+		if request.Username == "" && len(args) > 0 {
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return request, false, err
+			}
+			lines := strings.SplitN(string(data), "\n", 3)
+			request.Username = strings.TrimRight(lines[0], "\r")
+			if len(lines) > 1 {
+				request.Password = strings.TrimRight(lines[1], "\r")
+			}
+		}
+	default:
+		return request, false, fmt.Errorf("unsupported script_type %q, use tls-verify or auth-user-pass-verify", getenv("script_type"))
+	}
+	if request.CommonName == "" || request.Serial == "" {
+		return request, false, fmt.Errorf("no client certificate: the common name or serial is missing")
+	}
+	return request, false, nil
+}
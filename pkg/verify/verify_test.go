@@ -0,0 +1,83 @@
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(key string) string { return values[key] }
+}
+
+func TestRequestFromEnv(t *testing.T) {
+	request, skip, err := RequestFromEnv(env(map[string]string{"script_type": "tls-verify", "X509_0_CN": "alice:laptop", "tls_serial_hex_0": "01:ab"}), []string{"0", "CN=alice:laptop"})
+	if err != nil || skip || request.CommonName != "alice:laptop" || request.Serial != "01:ab" {
+		t.Errorf("Unexpected tls-verify request: %+v (skip: %v, err: %v)", request, skip, err)
+	}
+	if _, skip, err := RequestFromEnv(env(map[string]string{"script_type": "tls-verify"}), []string{"1", "CN=CA"}); err != nil || !skip {
+		t.Errorf("Expected the CA to be skipped (err: %v)", err)
+	}
+
+	// auth-user-pass-verify via-file, with the decimal serial of older openvpn versions
+	file := filepath.Join(t.TempDir(), "credentials")
+	os.WriteFile(file, []byte("alice\nsecret\n"), 0600)
+	request, _, err = RequestFromEnv(env(map[string]string{"script_type": "user-pass-verify", "common_name": "alice", "tls_serial_0": "427"}), []string{file})
+	if err != nil || request.Hook != "user-pass-verify" || request.Username != "alice" || request.Password != "secret" || request.Serial != "1AB" {
+		t.Errorf("Unexpected user-pass-verify request: %+v (err: %v)", request, err)
+	}
+
+	if _, _, err := RequestFromEnv(env(map[string]string{"script_type": "client-connect", "common_name": "alice"}), nil); err == nil {
+		t.Errorf("Expected error for an unsupported script type")
+	}
+	if _, _, err := RequestFromEnv(env(map[string]string{"script_type": "user-pass-verify", "username": "alice"}), nil); err == nil {
+		t.Errorf("Expected error without client certificate")
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/vpn/api/servers/vpn1/verify" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var request Request
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(Decision{Allow: request.CommonName == "alice", Reason: "denied"})
+	}))
+	client := &Client{URL: server.URL + "/vpn/", Server: "vpn1", Token: "token", CacheDir: t.TempDir(), CacheTTL: time.Minute}
+
+	alice := Request{CommonName: "alice", Serial: "01"}
+	if decision, err := client.Verify(context.Background(), alice); err != nil || !decision.Allow || decision.Cached {
+		t.Fatalf("Unexpected decision: %+v (err: %v)", decision, err)
+	}
+	if decision, err := client.Verify(context.Background(), Request{CommonName: "bob", Serial: "02"}); err != nil || decision.Allow {
+		t.Errorf("Unexpected decision for bob: %+v (err: %v)", decision, err)
+	}
+
+	// openvpn-access is down: the cached decision is used until it expires
+	server.Close()
+	if decision, err := client.Verify(context.Background(), alice); err != nil || !decision.Allow || !decision.Cached {
+		t.Errorf("Expected the cached decision, got %+v (err: %v)", decision, err)
+	}
+	if decision, err := client.Verify(context.Background(), Request{CommonName: "carol", Serial: "03"}); err == nil {
+		t.Errorf("Expected error without cached decision, got %+v", decision)
+	}
+	if _, ok := client.load(alice, time.Now().Add(2*time.Minute)); ok {
+		t.Errorf("Expected the cached decision to expire")
+	}
+	// a one-time code is never answered from the cache
+	if decision, err := client.Verify(context.Background(), Request{CommonName: "alice", Serial: "01", Password: "123456"}); err == nil {
+		t.Errorf("Expected error for a request with a password, got %+v", decision)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+}